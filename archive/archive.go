@@ -0,0 +1,437 @@
+// Package archive encrypts directories into archives of encrypted batch files
+// and restores, validates and lists them. It's the library the
+// directory-encryptor command is built on.
+package archive
+
+import (
+	"context"
+	"io"
+	"io/fs"
+
+	"github.com/alex-ant/directory-encryptor/internal/encryptor"
+)
+
+// DefaultMaxBatchSize is the max batch file size used unless configured.
+const DefaultMaxBatchSize int64 = 200 * 1024 * 1024
+
+// Options configures the archive operations. SourceDir and OutputDir are the
+// directories read and written by the operations, e.g. the raw file directory
+// and the archive for Encrypt and the other way around for Decrypt. Remote
+// archives are given as s3://bucket/prefix or sftp://user@host/path.
+type Options struct {
+	SourceDir string
+	OutputDir string
+
+	// SourceFS is the file tree Encrypt reads instead of SourceDir, e.g. an
+	// fstest.MapFS, a *zip.Reader or an os.DirFS of a filesystem snapshot.
+	SourceFS fs.FS
+
+	// Password and Keyfile, the path to a file which contents contribute to
+	// the encryption key, unlock archives encrypted with them.
+	Password string
+	Keyfile  string
+
+	// Recipients are X25519 public key files new archives are encrypted to
+	// instead of the password, Identity is the private key decrypting them.
+	Recipients []string
+	Identity   string
+
+	// NewPassword and NewKeyfile unlock the key slot written by Passwd and
+	// AddKey.
+	NewPassword string
+	NewKeyfile  string
+
+	// MaxBatchSize is the max size of the batch files written in bytes,
+	// files which don't fit along with their metadata are split across
+	// batches. DefaultMaxBatchSize is used if not positive.
+	MaxBatchSize int64
+
+	// VolumeSize groups batch files into volume directories of at most
+	// VolumeSize bytes each when positive, Volumes lists the volume
+	// directories to read batch files from.
+	VolumeSize int64
+	Volumes    []string
+
+	// ParityShards enables generating the given number of Reed-Solomon parity
+	// files per group of ParityGroupSize batch files when positive.
+	ParityShards    int
+	ParityGroupSize int
+
+	// Include and Exclude are gitignore-style patterns selecting the files to
+	// process, MinSize and MaxSize exclude files outside of the size range
+	// when positive and ExcludeCaches skips directories tagged with
+	// CACHEDIR.TAG.
+	Include       []string
+	Exclude       []string
+	MinSize       int64
+	MaxSize       int64
+	ExcludeCaches bool
+
+	// IgnoredFiles are file base names Validate ignores.
+	IgnoredFiles []string
+
+	// ExportPath is the archive file written by Export, the archive is
+	// written to Stdout if empty. Export encrypts to AgeRecipients and
+	// AgePassphrase, Import decrypts with AgeIdentity or AgePassphrase.
+	ExportPath    string
+	AgeRecipients []string
+	AgeIdentity   string
+	AgePassphrase string
+
+	// ZipPassword is the password of the ZIP file written by ExportZip.
+	ZipPassword string
+
+	// OpenSSLIterations is the PBKDF2 iteration count of OpenSSLEncrypt and
+	// OpenSSLDecrypt, the openssl enc default is used if not positive.
+	OpenSSLIterations int
+
+	// S3 credentials of s3:// archives, AWS S3 is used if the endpoint is
+	// empty.
+	S3Endpoint  string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// SFTPKey and SFTPKnownHosts authenticate sftp:// archives, both default
+	// to the files in ~/.ssh.
+	SFTPKey        string
+	SFTPKnownHosts string
+
+	// ServeAddr and ServeToken configure Serve, DefaultServeAddr and a
+	// random token are used if empty.
+	ServeAddr  string
+	ServeToken string
+
+	// MountCacheSize is the max number of decrypted bytes Mount keeps in
+	// memory, DefaultMountCacheSize is used if not positive.
+	MountCacheSize int64
+
+	// Stdin and Stdout are used by the "-" source and output directories
+	// standing for tar streams and by Export, os.Stdin and os.Stdout are used
+	// if nil.
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	// Progress receives the state of the operations as the work is done,
+	// the percentage done is logged instead if nil.
+	Progress ProgressReporter
+}
+
+// ProgressReporter receives the progress of the operations, at most every
+// 200ms and once the operation completes.
+type ProgressReporter interface {
+	Report(p Progress)
+}
+
+// ProgressFunc is a function receiving the progress.
+type ProgressFunc func(p Progress)
+
+// Report calls f(p).
+func (f ProgressFunc) Report(p Progress) {
+	f(p)
+}
+
+func (o Options) config() encryptor.Config {
+	cfg := encryptor.Config{
+		MaxBatchSize: o.MaxBatchSize,
+
+		SourceDir: o.SourceDir,
+		OutputDir: o.OutputDir,
+		SourceFS:  o.SourceFS,
+
+		Password:   o.Password,
+		Keyfile:    o.Keyfile,
+		Recipients: o.Recipients,
+		Identity:   o.Identity,
+
+		NewPassword: o.NewPassword,
+		NewKeyfile:  o.NewKeyfile,
+
+		IgnoredFiles: o.IgnoredFiles,
+
+		VolumeSize: o.VolumeSize,
+		Volumes:    o.Volumes,
+
+		Include:       o.Include,
+		Exclude:       o.Exclude,
+		MinSize:       o.MinSize,
+		MaxSize:       o.MaxSize,
+		ExcludeCaches: o.ExcludeCaches,
+
+		ParityShards:    o.ParityShards,
+		ParityGroupSize: o.ParityGroupSize,
+
+		ExportPath:    o.ExportPath,
+		AgeRecipients: o.AgeRecipients,
+		AgeIdentity:   o.AgeIdentity,
+		AgePassphrase: o.AgePassphrase,
+
+		ZipPassword: o.ZipPassword,
+
+		OpenSSLIterations: o.OpenSSLIterations,
+
+		S3Endpoint:  o.S3Endpoint,
+		S3Region:    o.S3Region,
+		S3AccessKey: o.S3AccessKey,
+		S3SecretKey: o.S3SecretKey,
+
+		SFTPKey:        o.SFTPKey,
+		SFTPKnownHosts: o.SFTPKnownHosts,
+
+		ServeAddr:  o.ServeAddr,
+		ServeToken: o.ServeToken,
+
+		MountCacheSize: o.MountCacheSize,
+
+		Stdin:  o.Stdin,
+		Stdout: o.Stdout,
+	}
+
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = DefaultMaxBatchSize
+	}
+
+	if o.Progress != nil {
+		cfg.OnProgress = func(p encryptor.Progress) {
+			o.Progress.Report(newProgress(p))
+		}
+	}
+
+	return cfg
+}
+
+// Archive runs the operations on the configured directories. It isn't safe
+// for concurrent use.
+type Archive struct {
+	p *encryptor.Processor
+}
+
+// New validates the options and connects to the remote storage, Close closes
+// the connections.
+func New(opts Options) (*Archive, error) {
+	p, pErr := encryptor.New(opts.config())
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	return &Archive{
+		p: p,
+	}, nil
+}
+
+// Close closes the connections to the remote storage, the archive can't be
+// used afterwards.
+func (a *Archive) Close() error {
+	return a.p.Close()
+}
+
+// Keygen writes a new X25519 private key to the identity file and the public
+// key to the .pub file next to it.
+func Keygen(identity string) error {
+	return encryptor.Keygen(identity)
+}
+
+// Encrypt encrypts the source directory into the archive in the output
+// directory, new batch files are appended to an existing archive.
+func (a *Archive) Encrypt() error {
+	return a.EncryptContext(context.Background())
+}
+
+// EncryptContext is Encrypt stopping with ErrCanceled once the context is
+// done. The batch files written by the canceled run are removed.
+func (a *Archive) EncryptContext(ctx context.Context) error {
+	return a.p.Encrypt(ctx)
+}
+
+// Decrypt restores the archive in the source directory into the output
+// directory. Checksum mismatches and files missing parts are returned as a
+// *ChecksumError once all files are restored.
+func (a *Archive) Decrypt() error {
+	return a.DecryptContext(context.Background())
+}
+
+// DecryptContext is Decrypt stopping with ErrCanceled once the context is
+// done. The file being restored is removed, the restored ones are kept.
+func (a *Archive) DecryptContext(ctx context.Context) error {
+	return convertError(a.p.Decrypt(ctx))
+}
+
+// Validate compares the archive in the source directory against the raw
+// file directory given as the output directory. If differences are found,
+// the report is returned along with a *DifferenceError.
+func (a *Archive) Validate() (*ValidationReport, error) {
+	return a.ValidateContext(context.Background())
+}
+
+// ValidateContext is Validate stopping with ErrCanceled once the context is
+// done.
+func (a *Archive) ValidateContext(ctx context.Context) (*ValidationReport, error) {
+	report, reportErr := a.p.ValidateReport(ctx)
+	if reportErr != nil {
+		return nil, reportErr
+	}
+
+	res := newValidationReport(report)
+
+	return res, res.Err()
+}
+
+// Verify checks the integrity of the archive in the source directory. If
+// damaged records are found, the report is returned along with a
+// *DamageError.
+func (a *Archive) Verify() (*VerificationReport, error) {
+	return a.VerifyContext(context.Background())
+}
+
+// VerifyContext is Verify stopping with ErrCanceled once the context is done.
+func (a *Archive) VerifyContext(ctx context.Context) (*VerificationReport, error) {
+	report, reportErr := a.p.VerifyReport(ctx)
+	if reportErr != nil {
+		return nil, reportErr
+	}
+
+	res := newVerificationReport(report)
+
+	return res, res.Err()
+}
+
+// Salvage restores the readable files of a damaged archive. If damaged
+// records are skipped, the report is returned along with a *DamageError.
+func (a *Archive) Salvage() (*SalvageReport, error) {
+	return a.SalvageContext(context.Background())
+}
+
+// SalvageContext is Salvage stopping with ErrCanceled once the context is
+// done.
+func (a *Archive) SalvageContext(ctx context.Context) (*SalvageReport, error) {
+	report, reportErr := a.p.SalvageReport(ctx)
+	if reportErr != nil {
+		return nil, reportErr
+	}
+
+	res := newSalvageReport(report)
+
+	return res, res.Err()
+}
+
+// List returns the entries of the archive in the source directory.
+func (a *Archive) List() (*Listing, error) {
+	return a.ListContext(context.Background())
+}
+
+// ListContext is List stopping with ErrCanceled once the context is done.
+func (a *Archive) ListContext(ctx context.Context) (*Listing, error) {
+	l, lErr := a.p.List(ctx)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	return newListing(l), nil
+}
+
+// FS returns the archive in the source directory as an fs.FS, which also
+// implements fs.ReadDirFS and fs.StatFS. Files are decrypted on demand and
+// implement io.Seeker, seeking skips the records preceding the offset without
+// decrypting them. The checksums of file parts are only verified if they're
+// read from their start. The FS can be used concurrently.
+func (a *Archive) FS() (fs.FS, error) {
+	return a.FSContext(context.Background())
+}
+
+// FSContext is FS stopping with ErrCanceled once the context is done, the
+// files can't be read afterwards.
+func (a *Archive) FSContext(ctx context.Context) (fs.FS, error) {
+	return a.p.FS(ctx)
+}
+
+// Repair checks batch files against parity manifests and reconstructs damaged
+// or missing ones from parity files.
+func (a *Archive) Repair() error {
+	return a.p.Repair()
+}
+
+// Passwd replaces the credentials of the key slot unlocked by the current
+// ones with NewPassword and NewKeyfile.
+func (a *Archive) Passwd() error {
+	return a.p.Passwd(context.Background())
+}
+
+// AddKey adds a key slot unlocked by NewPassword and NewKeyfile.
+func (a *Archive) AddKey() error {
+	return a.p.AddKey(context.Background())
+}
+
+// RemoveKey removes the key slot unlocked by the current credentials.
+func (a *Archive) RemoveKey() error {
+	return a.p.RemoveKey(context.Background())
+}
+
+// Export writes the archive file at ExportPath, or a tar stream of the whole
+// archive if it's empty, to Stdout in the age format.
+func (a *Archive) Export() error {
+	return a.ExportContext(context.Background())
+}
+
+// ExportContext is Export stopping with ErrCanceled once the context is done.
+// The age file written so far fails to decrypt as truncated.
+func (a *Archive) ExportContext(ctx context.Context) error {
+	return a.p.Export(ctx)
+}
+
+// Import decrypts the age file at the source path and encrypts its contents
+// to the archive in the output directory.
+func (a *Archive) Import() error {
+	return a.ImportContext(context.Background())
+}
+
+// ImportContext is Import stopping with ErrCanceled once the context is done.
+func (a *Archive) ImportContext(ctx context.Context) error {
+	return a.p.Import(ctx)
+}
+
+// ExportZip writes the archive entries selected by the filter rules to Stdout
+// as a ZIP file encrypted with WinZip AES-256 under ZipPassword.
+func (a *Archive) ExportZip() error {
+	return a.ExportZipContext(context.Background())
+}
+
+// ExportZipContext is ExportZip stopping with ErrCanceled once the context is
+// done.
+func (a *Archive) ExportZipContext(ctx context.Context) error {
+	return a.p.ExportZip(ctx)
+}
+
+// OpenSSLEncrypt encrypts the source file into the output directory in the
+// `openssl enc -aes-256-cbc -pbkdf2` format.
+func (a *Archive) OpenSSLEncrypt() error {
+	return a.p.OpenSSLEncrypt()
+}
+
+// OpenSSLDecrypt decrypts the source file encrypted by OpenSSLEncrypt or
+// `openssl enc -aes-256-cbc -pbkdf2` into the output directory.
+func (a *Archive) OpenSSLDecrypt() error {
+	return a.p.OpenSSLDecrypt()
+}
+
+// Serve serves the archive over HTTP until it fails.
+func (a *Archive) Serve() error {
+	return a.ServeContext(context.Background())
+}
+
+// ServeContext is Serve shutting the server down and returning ErrCanceled
+// once the context is done.
+func (a *Archive) ServeContext(ctx context.Context) error {
+	return a.p.Serve(ctx)
+}
+
+// Mount mounts the archive read-only at the output directory until it's
+// unmounted, it's only supported on Linux.
+func (a *Archive) Mount() error {
+	return a.MountContext(context.Background())
+}
+
+// MountContext is Mount unmounting the archive and returning ErrCanceled once
+// the context is done.
+func (a *Archive) MountContext(ctx context.Context) error {
+	return a.p.Mount(ctx)
+}
@@ -0,0 +1,311 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestTree(t *testing.T, dir string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "docs", "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("first file"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docs", "b.txt"), make([]byte, 3000), 0644))
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	raw := filepath.Join(dir, "raw")
+	enc := filepath.Join(dir, "enc")
+	restored := filepath.Join(dir, "restored")
+
+	writeTestTree(t, raw)
+
+	var progress []Progress
+
+	a, aErr := New(Options{
+		SourceDir:    raw,
+		OutputDir:    enc,
+		Password:     "password",
+		MaxBatchSize: 1024,
+		Progress: ProgressFunc(func(p Progress) {
+			progress = append(progress, p)
+		}),
+	})
+	require.NoError(t, aErr)
+	require.NoError(t, a.Encrypt())
+
+	require.NotEmpty(t, progress)
+
+	last := progress[len(progress)-1]
+	require.Equal(t, int64(2), last.Files)
+	require.Equal(t, int64(2), last.TotalFiles)
+	require.Equal(t, int64(3010), last.Bytes)
+	require.Equal(t, int64(3010), last.TotalBytes)
+
+	// List.
+	progress = nil
+
+	a, aErr = New(Options{
+		SourceDir: enc,
+		Password:  "password",
+		Progress: ProgressFunc(func(p Progress) {
+			progress = append(progress, p)
+		}),
+	})
+	require.NoError(t, aErr)
+
+	l, lErr := a.List()
+	require.NoError(t, lErr)
+
+	var paths []string
+	for _, e := range l.Entries {
+		paths = append(paths, e.Path)
+	}
+
+	require.Equal(t, []string{"a.txt", "docs", "docs/b.txt", "docs/empty"}, paths)
+	require.Equal(t, 2, l.Files)
+	require.Equal(t, int64(3010), l.Bytes)
+
+	// Batch file bytes are reported by the other operations.
+	last = progress[len(progress)-1]
+	require.Equal(t, int64(2), last.Files)
+	require.Greater(t, last.TotalBytes, int64(0))
+	require.Equal(t, last.TotalBytes, last.Bytes)
+
+	// Decrypt and validate.
+	a, aErr = New(Options{
+		SourceDir: enc,
+		OutputDir: restored,
+		Password:  "password",
+	})
+	require.NoError(t, aErr)
+	require.NoError(t, a.Decrypt())
+
+	data, dErr := ioutil.ReadFile(filepath.Join(restored, "a.txt"))
+	require.NoError(t, dErr)
+	require.Equal(t, "first file", string(data))
+
+	report, vErr := a.Validate()
+	require.NoError(t, vErr)
+	require.Empty(t, report.Differences)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(restored, "a.txt"), []byte("first File"), 0644))
+
+	report, vErr = a.Validate()
+
+	var diffErr *DifferenceError
+	require.True(t, errors.As(vErr, &diffErr), vErr)
+	require.Equal(t, 1, diffErr.Differences)
+	require.Equal(t, DifferenceContent, report.Differences[0].Kind)
+
+	// Reports are written as the internal ones.
+	var buf bytes.Buffer
+	require.NoError(t, report.Write(&buf, ReportFormatJSON))
+
+	var decoded ValidationReport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, *report, decoded)
+
+	buf.Reset()
+	require.NoError(t, report.Write(&buf, ReportFormatTable))
+	require.Contains(t, buf.String(), "1 content-differs")
+
+	// Wrong password.
+	a, aErr = New(Options{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "other"),
+		Password:  "wrong",
+	})
+	require.NoError(t, aErr)
+	require.True(t, errors.Is(a.Decrypt(), ErrWrongKey))
+
+	_, lErr = a.List()
+	require.True(t, errors.Is(lErr, ErrWrongKey))
+}
+
+func TestCancel(t *testing.T) {
+	dir := t.TempDir()
+
+	raw := filepath.Join(dir, "raw")
+	enc := filepath.Join(dir, "enc")
+
+	writeTestTree(t, raw)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel once the first file is written, its batch is stored before the
+	// following file is written.
+	a, aErr := New(Options{
+		SourceDir:    raw,
+		OutputDir:    enc,
+		Password:     "password",
+		MaxBatchSize: 1024,
+		Progress: ProgressFunc(func(p Progress) {
+			if p.Bytes > 0 {
+				cancel()
+			}
+		}),
+	})
+	require.NoError(t, aErr)
+
+	eErr := a.EncryptContext(ctx)
+	require.True(t, errors.Is(eErr, ErrCanceled), eErr)
+	require.True(t, errors.Is(eErr, context.Canceled), eErr)
+
+	// Batch files written before the cancellation are removed.
+	files, fErr := ioutil.ReadDir(enc)
+	require.NoError(t, fErr)
+
+	for _, f := range files {
+		require.Equal(t, ".header", f.Name())
+	}
+
+	require.NoError(t, a.Encrypt())
+
+	// Already canceled operations don't start.
+	a, aErr = New(Options{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+		Password:  "password",
+	})
+	require.NoError(t, aErr)
+
+	require.True(t, errors.Is(a.DecryptContext(ctx), ErrCanceled))
+
+	_, lErr := a.ListContext(ctx)
+	require.True(t, errors.Is(lErr, ErrCanceled))
+
+	l, lErr := a.List()
+	require.NoError(t, lErr)
+	require.Equal(t, 2, l.Files)
+}
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+
+	raw := filepath.Join(dir, "raw")
+	enc := filepath.Join(dir, "enc")
+
+	writeTestTree(t, raw)
+
+	// Spread the large file across batches and records.
+	large := make([]byte, 5000)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(raw, "docs", "large.bin"), large, 0644))
+
+	a, aErr := New(Options{
+		SourceDir:    raw,
+		OutputDir:    enc,
+		Password:     "password",
+		MaxBatchSize: 1024,
+	})
+	require.NoError(t, aErr)
+	require.NoError(t, a.Encrypt())
+
+	a, aErr = New(Options{
+		SourceDir: enc,
+		Password:  "password",
+	})
+	require.NoError(t, aErr)
+
+	fsys, fsErr := a.FS()
+	require.NoError(t, fsErr)
+
+	require.NoError(t, fstest.TestFS(fsys, "a.txt", "docs/b.txt", "docs/large.bin", "docs/empty"))
+
+	data, rErr := fs.ReadFile(fsys, "a.txt")
+	require.NoError(t, rErr)
+	require.Equal(t, "first file", string(data))
+
+	// Seek across the parts.
+	f, oErr := fsys.Open("docs/large.bin")
+	require.NoError(t, oErr)
+
+	defer f.Close()
+
+	for _, offset := range []int64{4000, 1023, 1024, 17, 0, 4999} {
+		_, sErr := f.(io.Seeker).Seek(offset, io.SeekStart)
+		require.NoError(t, sErr)
+
+		buf := make([]byte, 100)
+
+		n, rErr := io.ReadFull(f, buf)
+		if offset+100 > int64(len(large)) {
+			require.Equal(t, io.ErrUnexpectedEOF, rErr)
+		} else {
+			require.NoError(t, rErr)
+		}
+
+		require.Equal(t, large[offset:offset+int64(n)], buf[:n], "offset %d", offset)
+	}
+
+	_, sErr := fs.Stat(fsys, "missing")
+	require.True(t, errors.Is(sErr, fs.ErrNotExist), sErr)
+}
+
+func TestSourceFS(t *testing.T) {
+	enc := filepath.Join(t.TempDir(), "enc")
+
+	src := fstest.MapFS{
+		"a.txt":                 {Data: []byte("first file")},
+		"docs/b.txt":            {Data: make([]byte, 3000)},
+		"docs/skipped.log":      {Data: []byte("log")},
+		"docs/.encryptorignore": {Data: []byte("*.log\n")},
+		"docs/empty":            {Mode: fs.ModeDir},
+		"cache/CACHEDIR.TAG":    {Data: []byte("Signature: 8a477f597d28d172789f06886806bc55")},
+		"cache/cached.bin":      {Data: []byte("cached")},
+	}
+
+	a, aErr := New(Options{
+		SourceFS:      src,
+		OutputDir:     enc,
+		Password:      "password",
+		MaxBatchSize:  1024,
+		ExcludeCaches: true,
+	})
+	require.NoError(t, aErr)
+	require.NoError(t, a.Encrypt())
+
+	a, aErr = New(Options{
+		SourceDir: enc,
+		Password:  "password",
+	})
+	require.NoError(t, aErr)
+
+	fsys, fsErr := a.FS()
+	require.NoError(t, fsErr)
+
+	var names []string
+
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		names = append(names, name)
+
+		return nil
+	}))
+	require.Equal(t, []string{".", "a.txt", "docs", "docs/.encryptorignore", "docs/b.txt", "docs/empty"}, names)
+
+	for _, name := range []string{"a.txt", "docs/b.txt"} {
+		data, rErr := fs.ReadFile(fsys, name)
+		require.NoError(t, rErr)
+		require.Equal(t, src[name].Data, data, name)
+	}
+}
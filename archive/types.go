@@ -0,0 +1,409 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/alex-ant/directory-encryptor/internal/encryptor"
+)
+
+// Defaults of the corresponding options.
+const (
+	DefaultServeAddr      = encryptor.DefaultServeAddr
+	DefaultMountCacheSize = encryptor.DefaultMountCacheSize
+)
+
+// Errors returned by the operations, use errors.Is and errors.As to detect
+// them.
+var (
+	// ErrWrongKey is returned if the credentials don't unlock the archive.
+	// Wrong passwords of archives without key slots or recipients aren't
+	// detected until their contents fail to decrypt.
+	ErrWrongKey = encryptor.ErrWrongKey
+
+	// ErrCanceled is returned by the Context variants of the operations once
+	// the context is done, the errors match context.Canceled or
+	// context.DeadlineExceeded too.
+	ErrCanceled = encryptor.ErrCanceled
+)
+
+// Progress is the state of the running operation. Bytes are raw file bytes
+// written by Encrypt and batch file bytes read by the other operations, the
+// totals are 0 if unknown.
+type Progress struct {
+	Files      int64
+	TotalFiles int64
+	Bytes      int64
+	TotalBytes int64
+
+	// Path of the file being processed.
+	Path string
+
+	// Elapsed time and the average number of bytes processed per second.
+	Elapsed    time.Duration
+	Throughput float64
+}
+
+func newProgress(p encryptor.Progress) Progress {
+	return Progress{
+		Files:      p.Files,
+		TotalFiles: p.TotalFiles,
+		Bytes:      p.Bytes,
+		TotalBytes: p.TotalBytes,
+		Path:       p.Path,
+		Elapsed:    p.Elapsed,
+		Throughput: p.Throughput,
+	}
+}
+
+// ChecksumError is returned by Decrypt if restored file parts don't match
+// their checksums or parts of the restored files are missing.
+type ChecksumError struct {
+	Paths []string
+
+	// Files restored shorter than their size.
+	Incomplete []string
+}
+
+func (e *ChecksumError) Error() string {
+	return (&encryptor.ChecksumError{Paths: e.Paths, Incomplete: e.Incomplete}).Error()
+}
+
+// DifferenceError is returned by Validate along with the report if
+// differences are found.
+type DifferenceError struct {
+	Differences int
+}
+
+func (e *DifferenceError) Error() string {
+	return fmt.Sprintf("found %d differences", e.Differences)
+}
+
+// DamageError is returned by Verify and Salvage along with the report if
+// damaged records are found.
+type DamageError struct {
+	Problems int
+}
+
+func (e *DamageError) Error() string {
+	return fmt.Sprintf("found %d problems", e.Problems)
+}
+
+// convertError returns the errors of the operations as the types of the
+// package.
+func convertError(err error) error {
+	var checksumErr *encryptor.ChecksumError
+	if errors.As(err, &checksumErr) {
+		return &ChecksumError{Paths: checksumErr.Paths, Incomplete: checksumErr.Incomplete}
+	}
+
+	return err
+}
+
+// Report formats of the Write methods.
+const (
+	ReportFormatTable = encryptor.ReportFormatTable
+	ReportFormatJSON  = encryptor.ReportFormatJSON
+)
+
+// DifferenceKind describes the kind of difference between an archive and a raw
+// file directory.
+type DifferenceKind string
+
+// Validation difference kinds.
+const (
+	DifferenceMissing DifferenceKind = "missing"
+	DifferenceExtra   DifferenceKind = "extra"
+
+	// DifferenceContent is reported if the bytes the archived and the disk
+	// files have in common differ.
+	DifferenceContent DifferenceKind = "content-differs"
+
+	// DifferenceSize is reported if the file sizes differ, its details tell
+	// whether the disk file is truncated or appended to when the common bytes
+	// are the same.
+	DifferenceSize DifferenceKind = "size-differs"
+
+	// DifferenceMetadata is only reported for entries archived as a directory
+	// and stored as a file on disk or vice versa. File modes and modification
+	// times aren't compared since they're only recorded for tar sources and
+	// aren't restored.
+	DifferenceMetadata DifferenceKind = "metadata-differs"
+)
+
+// Difference describes a single difference found by Validate.
+type Difference struct {
+	Kind DifferenceKind `json:"kind"`
+	Path string         `json:"path"`
+
+	// Offset of the first differing byte for content differences.
+	Offset *int64 `json:"offset,omitempty"`
+
+	ArchiveSize *int64 `json:"archive_size,omitempty"`
+	DiskSize    *int64 `json:"disk_size,omitempty"`
+
+	Details string `json:"details,omitempty"`
+}
+
+// ValidationReport contains the result of a validation.
+type ValidationReport struct {
+	Checked     int                    `json:"checked"`
+	Differences []Difference           `json:"differences"`
+	Summary     map[DifferenceKind]int `json:"summary"`
+}
+
+func newValidationReport(r *encryptor.ValidationReport) *ValidationReport {
+	res := &ValidationReport{
+		Checked:     r.Checked,
+		Differences: make([]Difference, len(r.Differences)),
+		Summary:     make(map[DifferenceKind]int, len(r.Summary)),
+	}
+
+	for i, d := range r.Differences {
+		res.Differences[i] = Difference{
+			Kind:        DifferenceKind(d.Kind),
+			Path:        d.Path,
+			Offset:      d.Offset,
+			ArchiveSize: d.ArchiveSize,
+			DiskSize:    d.DiskSize,
+			Details:     d.Details,
+		}
+	}
+
+	for k, n := range r.Summary {
+		res.Summary[DifferenceKind(k)] = n
+	}
+
+	return res
+}
+
+// Write writes the report in the given format.
+func (r *ValidationReport) Write(w io.Writer, format string) error {
+	report := &encryptor.ValidationReport{
+		Checked:     r.Checked,
+		Differences: make([]encryptor.Difference, len(r.Differences)),
+		Summary:     make(map[encryptor.DifferenceKind]int, len(r.Summary)),
+	}
+
+	for i, d := range r.Differences {
+		report.Differences[i] = encryptor.Difference{
+			Kind:        encryptor.DifferenceKind(d.Kind),
+			Path:        d.Path,
+			Offset:      d.Offset,
+			ArchiveSize: d.ArchiveSize,
+			DiskSize:    d.DiskSize,
+			Details:     d.Details,
+		}
+	}
+
+	for k, n := range r.Summary {
+		report.Summary[encryptor.DifferenceKind(k)] = n
+	}
+
+	return report.Write(w, format)
+}
+
+// Err returns the DifferenceError if differences were found.
+func (r *ValidationReport) Err() error {
+	if len(r.Differences) > 0 {
+		return &DifferenceError{Differences: len(r.Differences)}
+	}
+
+	return nil
+}
+
+// VerificationProblem describes a single problem found by Verify.
+type VerificationProblem struct {
+	Batch string `json:"batch,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// VerificationReport contains the result of an archive verification.
+type VerificationReport struct {
+	Batches int   `json:"batches"`
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+
+	// Number of file part checksums compared.
+	VerifiedChecksums int `json:"verified_checksums"`
+
+	DamagedBatches []string              `json:"damaged_batches"`
+	AffectedFiles  []string              `json:"affected_files"`
+	Problems       []VerificationProblem `json:"problems"`
+}
+
+func newVerificationReport(r *encryptor.VerificationReport) *VerificationReport {
+	res := &VerificationReport{
+		Batches:           r.Batches,
+		Files:             r.Files,
+		Bytes:             r.Bytes,
+		VerifiedChecksums: r.VerifiedChecksums,
+		DamagedBatches:    r.DamagedBatches,
+		AffectedFiles:     r.AffectedFiles,
+		Problems:          make([]VerificationProblem, len(r.Problems)),
+	}
+
+	for i, p := range r.Problems {
+		res.Problems[i] = VerificationProblem(p)
+	}
+
+	return res
+}
+
+// Write writes the report in the given format.
+func (r *VerificationReport) Write(w io.Writer, format string) error {
+	report := &encryptor.VerificationReport{
+		Batches:           r.Batches,
+		Files:             r.Files,
+		Bytes:             r.Bytes,
+		VerifiedChecksums: r.VerifiedChecksums,
+		DamagedBatches:    r.DamagedBatches,
+		AffectedFiles:     r.AffectedFiles,
+		Problems:          make([]encryptor.VerificationProblem, len(r.Problems)),
+	}
+
+	for i, p := range r.Problems {
+		report.Problems[i] = encryptor.VerificationProblem(p)
+	}
+
+	return report.Write(w, format)
+}
+
+// Err returns the DamageError if problems were found.
+func (r *VerificationReport) Err() error {
+	if len(r.Problems) > 0 {
+		return &DamageError{Problems: len(r.Problems)}
+	}
+
+	return nil
+}
+
+// Salvaged file statuses.
+const (
+	SalvageStatusPartial = "partial"
+	SalvageStatusLost    = "lost"
+)
+
+// SalvageProblem describes a damaged record skipped by Salvage.
+type SalvageProblem struct {
+	Batch string `json:"batch,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// SalvagedFile describes a file which couldn't be fully restored.
+type SalvagedFile struct {
+	Path           string `json:"path"`
+	Status         string `json:"status"`
+	Size           int64  `json:"size"`
+	RecoveredBytes int64  `json:"recovered_bytes"`
+}
+
+// SalvageReport contains the result of a salvage run.
+type SalvageReport struct {
+	Batches       int `json:"batches"`
+	RestoredFiles int `json:"restored_files"`
+
+	DamagedBatches []string         `json:"damaged_batches"`
+	Files          []SalvagedFile   `json:"files"`
+	Problems       []SalvageProblem `json:"problems"`
+}
+
+func newSalvageReport(r *encryptor.SalvageReport) *SalvageReport {
+	res := &SalvageReport{
+		Batches:        r.Batches,
+		RestoredFiles:  r.RestoredFiles,
+		DamagedBatches: r.DamagedBatches,
+		Files:          make([]SalvagedFile, len(r.Files)),
+		Problems:       make([]SalvageProblem, len(r.Problems)),
+	}
+
+	for i, f := range r.Files {
+		res.Files[i] = SalvagedFile(f)
+	}
+
+	for i, p := range r.Problems {
+		res.Problems[i] = SalvageProblem(p)
+	}
+
+	return res
+}
+
+// Write writes the report in the given format.
+func (r *SalvageReport) Write(w io.Writer, format string) error {
+	report := &encryptor.SalvageReport{
+		Batches:        r.Batches,
+		RestoredFiles:  r.RestoredFiles,
+		DamagedBatches: r.DamagedBatches,
+		Files:          make([]encryptor.SalvagedFile, len(r.Files)),
+		Problems:       make([]encryptor.SalvageProblem, len(r.Problems)),
+	}
+
+	for i, f := range r.Files {
+		report.Files[i] = encryptor.SalvagedFile(f)
+	}
+
+	for i, p := range r.Problems {
+		report.Problems[i] = encryptor.SalvageProblem(p)
+	}
+
+	return report.Write(w, format)
+}
+
+// Err returns the DamageError if problems were found.
+func (r *SalvageReport) Err() error {
+	if len(r.Problems) > 0 {
+		return &DamageError{Problems: len(r.Problems)}
+	}
+
+	return nil
+}
+
+// Entry describes a file or a directory stored in the archive.
+type Entry struct {
+	Path    string      `json:"path"`
+	IsDir   bool        `json:"is_dir"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// Listing contains the archive entries selected by the filter rules.
+type Listing struct {
+	Entries []Entry `json:"entries"`
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+}
+
+func newListing(l *encryptor.Listing) *Listing {
+	res := &Listing{
+		Entries: make([]Entry, len(l.Entries)),
+		Files:   l.Files,
+		Bytes:   l.Bytes,
+	}
+
+	for i, e := range l.Entries {
+		res.Entries[i] = Entry(e)
+	}
+
+	return res
+}
+
+// Write writes the listing in the given format.
+func (l *Listing) Write(w io.Writer, format string) error {
+	listing := &encryptor.Listing{
+		Entries: make([]encryptor.Entry, len(l.Entries)),
+		Files:   l.Files,
+		Bytes:   l.Bytes,
+	}
+
+	for i, e := range l.Entries {
+		listing.Entries[i] = encryptor.Entry(e)
+	}
+
+	return listing.Write(w, format)
+}
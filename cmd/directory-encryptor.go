@@ -1,38 +1,203 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/alex-ant/directory-encryptor/archive"
 	"github.com/alex-ant/directory-encryptor/internal/config"
-	"github.com/alex-ant/directory-encryptor/internal/encryptor"
+	"github.com/alex-ant/directory-encryptor/internal/progress"
 )
 
+// report is written by the modes producing reports.
+type report interface {
+	Write(w io.Writer, format string) error
+}
+
+// writeReport writes the report unless the operation failed before producing
+// it, the operation error is returned.
+func writeReport(r report, opErr error) error {
+	var diffErr *archive.DifferenceError
+	var damageErr *archive.DamageError
+
+	if opErr != nil && !errors.As(opErr, &diffErr) && !errors.As(opErr, &damageErr) {
+		return opErr
+	}
+
+	wErr := r.Write(os.Stdout, *config.ReportFormat)
+	if wErr != nil {
+		log.Printf("failed to write report: %v", wErr)
+	}
+
+	return opErr
+}
+
 func main() {
-	enc, encErr := encryptor.New(*config.MaxBatchSize, *config.SourceDir, *config.OutputDir, *config.EncryptionPassword, *config.IgnoredFiles)
-	if encErr != nil {
-		log.Fatalf("failed to initialize new encrypter processor: %v", encErr)
+	// Key pairs are generated without an archive.
+	if *config.Mode == "keygen" {
+		kErr := archive.Keygen(*config.Identity)
+		if kErr != nil {
+			log.Fatalf("failed to generate key pair: %v", kErr)
+		}
+
+		log.Printf("private key written to %s, public key written to %s.pub", *config.Identity, *config.Identity)
+
+		return
 	}
 
+	switch *config.ReportFormat {
+	case archive.ReportFormatTable, archive.ReportFormatJSON:
+	default:
+		log.Fatalf("unsupported report format %s", *config.ReportFormat)
+	}
+
+	pr, prErr := progress.New(*config.ProgressFormat, *config.ProgressFile)
+	if prErr != nil {
+		log.Fatalf("failed to initialize progress: %v", prErr)
+	}
+
+	a, aErr := archive.New(archive.Options{
+		MaxBatchSize: *config.MaxBatchSize,
+		SourceDir:    *config.SourceDir,
+		OutputDir:    *config.OutputDir,
+		Password:     *config.EncryptionPassword,
+		Keyfile:      *config.Keyfile,
+		Recipients:   config.List(*config.Recipients),
+		Identity:     *config.Identity,
+		NewPassword:  *config.NewPassword,
+		NewKeyfile:   *config.NewKeyfile,
+		IgnoredFiles: config.List(*config.IgnoredFiles),
+		VolumeSize:   *config.VolumeSize,
+		Volumes:      config.List(*config.Volumes),
+
+		Include:       config.List(*config.Include),
+		Exclude:       config.List(*config.Exclude),
+		MinSize:       *config.MinSize,
+		MaxSize:       *config.MaxSize,
+		ExcludeCaches: *config.ExcludeCaches,
+
+		ParityShards:    *config.ParityShards,
+		ParityGroupSize: *config.ParityGroupSize,
+
+		ExportPath:    *config.ExportPath,
+		AgeRecipients: config.List(*config.AgeRecipients),
+		AgeIdentity:   *config.AgeIdentity,
+		AgePassphrase: *config.AgePassphrase,
+
+		ZipPassword: *config.ZipPassword,
+
+		OpenSSLIterations: *config.OpenSSLIterations,
+
+		S3Endpoint:  *config.S3Endpoint,
+		S3Region:    *config.S3Region,
+		S3AccessKey: *config.S3AccessKey,
+		S3SecretKey: *config.S3SecretKey,
+
+		SFTPKey:        *config.SFTPKey,
+		SFTPKnownHosts: *config.SFTPKnownHosts,
+
+		ServeAddr:  *config.ServeAddr,
+		ServeToken: *config.ServeToken,
+
+		MountCacheSize: *config.MountCacheSize,
+
+		Progress: pr,
+	})
+	if aErr != nil {
+		log.Fatalf("failed to initialize archive: %v", aErr)
+	}
+
+	defer func() {
+		cErr := a.Close()
+		if cErr != nil {
+			log.Printf("failed to close archive: %v", cErr)
+		}
+	}()
+
+	// Stop gracefully on interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	startTime := time.Now()
 
+	var r report
 	var pErr error
 
 	switch *config.Mode {
 	case "encrypt":
-		pErr = enc.Encrypt()
+		pErr = a.EncryptContext(ctx)
 
 	case "decrypt":
-		pErr = enc.Decrypt()
+		pErr = a.DecryptContext(ctx)
 
 	case "validate":
-		pErr = enc.Validate()
+		r, pErr = a.ValidateContext(ctx)
+
+	case "verify":
+		r, pErr = a.VerifyContext(ctx)
+
+	case "repair":
+		pErr = a.Repair()
+
+	case "salvage":
+		r, pErr = a.SalvageContext(ctx)
+
+	case "list":
+		r, pErr = a.ListContext(ctx)
+
+	case "passwd":
+		pErr = a.Passwd()
+
+	case "addkey":
+		pErr = a.AddKey()
+
+	case "removekey":
+		pErr = a.RemoveKey()
+
+	case "export":
+		pErr = a.ExportContext(ctx)
+
+	case "import":
+		pErr = a.ImportContext(ctx)
+
+	case "export-zip":
+		pErr = a.ExportZipContext(ctx)
+
+	case "openssl-encrypt":
+		pErr = a.OpenSSLEncrypt()
+
+	case "openssl-decrypt":
+		pErr = a.OpenSSLDecrypt()
+
+	case "serve":
+		pErr = a.ServeContext(ctx)
+
+	case "mount":
+		pErr = a.MountContext(ctx)
 
 	default:
-		log.Fatalf("invalid mode %s, supported modes - encrypt/decryp/validatet", *config.Mode)
+		log.Fatalf("invalid mode %s, supported modes - encrypt/decrypt/validate/verify/repair/salvage/list/keygen/passwd/addkey/removekey/export/import/export-zip/openssl-encrypt/openssl-decrypt/serve/mount", *config.Mode)
+	}
+
+	if pr != nil {
+		pr.Finish(pErr)
 	}
 
-	if pErr != nil {
+	if r != nil {
+		pErr = writeReport(r, pErr)
+	}
+
+	switch {
+	case errors.Is(pErr, archive.ErrCanceled):
+		log.Printf("%s interrupted", *config.Mode)
+
+	case pErr != nil:
 		log.Printf("failed to %s data: %v", *config.Mode, pErr)
 	}
 
@@ -4,13 +4,20 @@ go 1.17
 
 require (
 	github.com/alex-ant/envs v0.0.0-20180605211528-ff120f8dc147
-	github.com/stretchr/testify v1.7.0
+	github.com/hanwen/go-fuse/v2 v2.5.0
+	github.com/klauspost/reedsolomon v1.11.8
+	github.com/olekukonko/tablewriter v0.0.5
+	github.com/pkg/sftp v1.13.6
+	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.13.0
 )
 
 require (
-	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.1.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
-	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+	golang.org/x/sys v0.12.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
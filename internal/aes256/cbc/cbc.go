@@ -15,18 +15,11 @@ func Encrypt(data []byte, key, iv string) ([]byte, error) {
 		return nil, errors.New("empty data payload provided")
 	}
 
-	c, cErr := aes.NewCipher([]byte(key))
-	if cErr != nil {
-		return nil, fmt.Errorf("failed to create new AES cipher: %v", cErr)
+	encrypted, encErr := EncryptBytes(data, []byte(key), []byte(iv))
+	if encErr != nil {
+		return nil, encErr
 	}
 
-	enc := cipher.NewCBCEncrypter(c, []byte(iv))
-
-	dataB := pkcs5Padding(data, c.BlockSize())
-
-	encrypted := make([]byte, len(dataB))
-	enc.CryptBlocks(encrypted, dataB)
-
 	return []byte(base64.StdEncoding.EncodeToString(encrypted)), nil
 }
 
@@ -37,17 +30,44 @@ func Decrypt(data []byte, key, iv string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to decode encrypted base64 string: %v", encryptedErr)
 	}
 
-	c, cErr := aes.NewCipher([]byte(key))
+	return DecryptBytes(encrypted, []byte(key), []byte(iv))
+}
+
+// EncryptBytes encrypts passed data with PKCS#5 padding returning the raw
+// ciphertext.
+func EncryptBytes(data, key, iv []byte) ([]byte, error) {
+	c, cErr := newCipher(key, iv)
 	if cErr != nil {
-		return nil, fmt.Errorf("failed to create new AES cipher: %v", cErr)
+		return nil, cErr
+	}
+
+	enc := cipher.NewCBCEncrypter(c, iv)
+
+	dataB := pkcs5Padding(data, c.BlockSize())
+
+	encrypted := make([]byte, len(dataB))
+	enc.CryptBlocks(encrypted, dataB)
+
+	return encrypted, nil
+}
+
+// DecryptBytes decrypts the raw ciphertext and removes the PKCS#5 padding.
+func DecryptBytes(encrypted, key, iv []byte) ([]byte, error) {
+	c, cErr := newCipher(key, iv)
+	if cErr != nil {
+		return nil, cErr
 	}
 
-	dec := cipher.NewCBCDecrypter(c, []byte(iv))
+	if len(encrypted) == 0 || len(encrypted)%c.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted data length %d", len(encrypted))
+	}
+
+	dec := cipher.NewCBCDecrypter(c, iv)
 
 	decrypted := make([]byte, len(encrypted))
 	dec.CryptBlocks(decrypted, encrypted)
 
-	tr, trErr := pkcs5Trimming(decrypted)
+	tr, trErr := pkcs5Trimming(decrypted, c.BlockSize())
 	if trErr != nil {
 		return nil, trErr
 	}
@@ -55,13 +75,27 @@ func Decrypt(data []byte, key, iv string) ([]byte, error) {
 	return tr, nil
 }
 
+// newCipher returns the AES cipher checking the IV length.
+func newCipher(key, iv []byte) (cipher.Block, error) {
+	c, cErr := aes.NewCipher(key)
+	if cErr != nil {
+		return nil, fmt.Errorf("failed to create new AES cipher: %v", cErr)
+	}
+
+	if len(iv) != c.BlockSize() {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+
+	return c, nil
+}
+
 func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
 	padding := blockSize - len(ciphertext)%blockSize
 	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
 	return append(ciphertext, padtext...)
 }
 
-func pkcs5Trimming(encrypt []byte) ([]byte, error) {
+func pkcs5Trimming(encrypt []byte, blockSize int) ([]byte, error) {
 	if len(encrypt) == 0 {
 		return nil, errors.New("empty trimming array")
 	}
@@ -74,9 +108,16 @@ func pkcs5Trimming(encrypt []byte) ([]byte, error) {
 
 	padding := encrypt[encIdx]
 
-	if int(padding) == 0 || int(padding) > len(encrypt)-1 {
+	if int(padding) == 0 || int(padding) > len(encrypt) || int(padding) > blockSize {
 		return nil, errors.New("invalid encryption key")
 	}
 
+	// Check all padding bytes.
+	for _, b := range encrypt[len(encrypt)-int(padding):] {
+		if b != padding {
+			return nil, errors.New("invalid padding")
+		}
+	}
+
 	return encrypt[:len(encrypt)-int(padding)], nil
 }
@@ -1,8 +1,13 @@
 package cbc
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/require"
@@ -36,6 +41,118 @@ func TestCBC(t *testing.T) {
 	}
 }
 
+func TestDecryptInvalidData(t *testing.T) {
+	const (
+		testKey = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.f` // 32 bytes
+		iv      = `hII>]?oE=96mk&U&`                 // 16 bytes
+	)
+
+	encrypted, encryptedErr := Encrypt([]byte("test data"), testKey, iv)
+	require.NoError(t, encryptedErr)
+
+	// Truncated data.
+	_, decErr := Decrypt(encrypted[:len(encrypted)-4], testKey, iv)
+	require.Error(t, decErr)
+
+	// Wrong key.
+	_, decErr = Decrypt(encrypted, `0J*R07(l@K!<P8j0\qI^0'(rb;f&\;.f`, iv)
+	require.Error(t, decErr)
+}
+
+func TestReaderSkip(t *testing.T) {
+	const (
+		testKey = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.f` // 32 bytes
+		iv      = `hII>]?oE=96mk&U&`                 // 16 bytes
+	)
+
+	for _, n := range []int{1, 15, 16, 17, 100, streamBufferSize, 3*streamBufferSize + 17} {
+		testData := []byte(randomString(n))
+
+		encrypted, encryptedErr := Encrypt(testData, testKey, iv)
+		require.NoError(t, encryptedErr)
+
+		offsets := []int{0, 1, 15, 16, 17, n - 1, n, n + 20}
+		for _, base := range []int{streamBufferSize, 2 * streamBufferSize} {
+			offsets = append(offsets, base-17, base-16, base-1, base, base+1, base+16)
+		}
+
+		for _, offset := range offsets {
+			if offset < 0 {
+				continue
+			}
+
+			r, rErr := NewReader(bytes.NewReader(encrypted), []byte(testKey), []byte(iv))
+			require.NoError(t, rErr)
+
+			skipped, sErr := r.Skip(int64(offset))
+
+			if offset > n {
+				require.Equal(t, io.EOF, sErr)
+				require.Equal(t, int64(n), skipped)
+				continue
+			}
+
+			require.NoError(t, sErr)
+			require.Equal(t, int64(offset), skipped)
+
+			rest, restErr := ioutil.ReadAll(r)
+			require.NoError(t, restErr)
+			require.Equal(t, testData[offset:], rest, "%d bytes from %d", n, offset)
+		}
+
+		// Skip after reading.
+		r, rErr := NewReader(bytes.NewReader(encrypted), []byte(testKey), []byte(iv))
+		require.NoError(t, rErr)
+
+		head := make([]byte, n/3)
+		_, hErr := io.ReadFull(r, head)
+		require.NoError(t, hErr)
+
+		skipped, sErr := r.Skip(int64(n / 3))
+		require.NoError(t, sErr)
+		require.Equal(t, int64(n/3), skipped)
+
+		rest, restErr := ioutil.ReadAll(r)
+		require.NoError(t, restErr)
+		require.Equal(t, testData[2*(n/3):], rest)
+	}
+}
+
+// failingWriter fails once the limit is exceeded.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		return 0, errors.New("limit exceeded")
+	}
+
+	w.limit -= len(b)
+
+	return len(b), nil
+}
+
+func TestWriterError(t *testing.T) {
+	const (
+		testKey = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.f` // 32 bytes
+		iv      = `hII>]?oE=96mk&U&`                 // 16 bytes
+	)
+
+	w, wErr := NewWriter(&failingWriter{limit: 10}, []byte(testKey), []byte(iv))
+	require.NoError(t, wErr)
+
+	// The first buffer is consumed before it fails to be written.
+	n, wErr := w.Write(make([]byte, streamBufferSize+10))
+	require.Error(t, wErr)
+	require.Equal(t, streamBufferSize, n)
+
+	n, wErr = w.Write([]byte("data"))
+	require.Error(t, wErr)
+	require.Equal(t, 0, n)
+	require.Error(t, w.Close())
+}
+
 func randomString(n int) string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
@@ -49,3 +166,94 @@ func randomString(n int) string {
 func randomInt(min, max int) int {
 	return rand.Intn(max-min) + min
 }
+
+func TestStream(t *testing.T) {
+	const (
+		testKey = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.f` // 32 bytes
+		iv      = `hII>]?oE=96mk&U&`                 // 16 bytes
+	)
+
+	for _, size := range []int{0, 1, 15, 16, 17, streamBufferSize - 1, streamBufferSize, streamBufferSize + 16, 3*streamBufferSize + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		// Write in uneven pieces.
+		var buf bytes.Buffer
+
+		w, wErr := NewWriter(&buf, []byte(testKey), []byte(iv))
+		require.NoError(t, wErr)
+
+		for left := data; len(left) > 0; {
+			n := randomInt(1, 5000)
+			if n > len(left) {
+				n = len(left)
+			}
+
+			_, wErr = w.Write(left[:n])
+			require.NoError(t, wErr)
+
+			left = left[n:]
+		}
+
+		require.NoError(t, w.Close())
+		require.Equal(t, EncodedLen(int64(size)), int64(buf.Len()), "size %d", size)
+
+		if size > 0 {
+			encrypted, encryptedErr := Encrypt(data, testKey, iv)
+			require.NoError(t, encryptedErr)
+			require.Equal(t, string(encrypted), buf.String(), "size %d", size)
+		}
+
+		r, rErr := NewReader(bytes.NewReader(buf.Bytes()), []byte(testKey), []byte(iv))
+		require.NoError(t, rErr)
+
+		decrypted, dErr := ioutil.ReadAll(iotest.OneByteReader(r))
+		require.NoError(t, dErr)
+		require.Equal(t, data, decrypted, "size %d", size)
+
+		// Raw ciphertext.
+		buf.Reset()
+
+		bw, bwErr := NewBytesWriter(&buf, []byte(testKey), []byte(iv))
+		require.NoError(t, bwErr)
+
+		_, bwErr = bw.Write(data)
+		require.NoError(t, bwErr)
+		require.NoError(t, bw.Close())
+
+		encryptedBytes, ebErr := EncryptBytes(data, []byte(testKey), []byte(iv))
+		require.NoError(t, ebErr)
+		require.Equal(t, encryptedBytes, buf.Bytes(), "size %d", size)
+
+		br, brErr := NewBytesReader(bytes.NewReader(buf.Bytes()), []byte(testKey), []byte(iv))
+		require.NoError(t, brErr)
+
+		decrypted, dErr = ioutil.ReadAll(br)
+		require.NoError(t, dErr)
+		require.Equal(t, data, decrypted, "size %d", size)
+	}
+
+	encrypted, encryptedErr := Encrypt(make([]byte, 100), testKey, iv)
+	require.NoError(t, encryptedErr)
+
+	// Truncated data.
+	r, rErr := NewReader(bytes.NewReader(encrypted[:len(encrypted)-4]), []byte(testKey), []byte(iv))
+	require.NoError(t, rErr)
+
+	_, dErr := ioutil.ReadAll(r)
+	require.Error(t, dErr)
+
+	// Wrong key.
+	r, rErr = NewReader(bytes.NewReader(encrypted), []byte(`0J*R07(l@K!<P8j0\qI^0'(rb;f&\;.f`), []byte(iv))
+	require.NoError(t, rErr)
+
+	_, dErr = ioutil.ReadAll(r)
+	require.Error(t, dErr)
+
+	// Empty string.
+	r, rErr = NewReader(bytes.NewReader(nil), []byte(testKey), []byte(iv))
+	require.NoError(t, rErr)
+
+	_, dErr = ioutil.ReadAll(r)
+	require.Error(t, dErr)
+}
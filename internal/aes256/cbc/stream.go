@@ -0,0 +1,333 @@
+package cbc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamBufferSize is the size of the buffers used by Writer and Reader, a
+// multiple of the block size.
+const streamBufferSize = 32 * 1024
+
+// EncodedLen returns the length of the base64-encoded ciphertext of n bytes
+// of data produced by Encrypt and Writer.
+func EncodedLen(n int64) int64 {
+	padded := (n/aes.BlockSize + 1) * aes.BlockSize
+
+	return (padded + 2) / 3 * 4
+}
+
+// Writer encrypts the data written to it into an AES-256-CBC base64-encoded
+// string written to the underlying writer, the output is the same as the
+// output of Encrypt for the whole data. Data is processed in fixed size
+// buffers, Close must be called to write the padded last block.
+type Writer struct {
+	enc  io.WriteCloser
+	mode cipher.BlockMode
+
+	// Data not encrypted yet.
+	buf []byte
+
+	err error
+}
+
+// NewWriter returns a writer encrypting the data written to w.
+func NewWriter(w io.Writer, key, iv []byte) (*Writer, error) {
+	c, cErr := newCipher(key, iv)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	return &Writer{
+		enc:  base64.NewEncoder(base64.StdEncoding, w),
+		mode: cipher.NewCBCEncrypter(c, iv),
+		buf:  make([]byte, 0, streamBufferSize),
+	}, nil
+}
+
+// NewBytesWriter returns a writer encrypting the data written to w into the
+// raw ciphertext, the output is the same as the output of EncryptBytes.
+func NewBytesWriter(w io.Writer, key, iv []byte) (*Writer, error) {
+	c, cErr := newCipher(key, iv)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	return &Writer{
+		enc:  nopWriteCloser{w},
+		mode: cipher.NewCBCEncrypter(c, iv),
+		buf:  make([]byte, 0, streamBufferSize),
+	}, nil
+}
+
+// nopWriteCloser passes the writes to the underlying writer which isn't
+// closed.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Write encrypts the data once a buffer of it is collected.
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var written int
+
+	for len(data) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], data)
+		w.buf = w.buf[:len(w.buf)+n]
+		data = data[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			fErr := w.flush()
+			if fErr != nil {
+				return written, fErr
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// flush encrypts and writes the buffered data, which length is a multiple of
+// the block size.
+func (w *Writer) flush() error {
+	w.mode.CryptBlocks(w.buf, w.buf)
+
+	_, wErr := w.enc.Write(w.buf)
+	if wErr != nil {
+		w.err = wErr
+		return wErr
+	}
+
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// Close pads and writes the last block and flushes the encoded string, the
+// underlying writer isn't closed.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	// The buffer is never full at this point, so the padding fits.
+	w.buf = pkcs5Padding(w.buf, aes.BlockSize)
+
+	fErr := w.flush()
+	if fErr != nil {
+		return fErr
+	}
+
+	w.err = errors.New("write to closed writer")
+
+	return w.enc.Close()
+}
+
+// Reader decrypts an AES-256-CBC encrypted base64-encoded string read from
+// the underlying reader, the output is the same as the output of Decrypt for
+// the whole string. Data is processed in fixed size buffers, the last block
+// is held back until the end of the string to remove the padding.
+type Reader struct {
+	src   io.Reader
+	block cipher.Block
+	mode  cipher.BlockMode
+
+	// Ciphertext read buffer and the decrypted data not returned yet.
+	buf   []byte
+	plain []byte
+	out   []byte
+
+	// The last decrypted block.
+	last [aes.BlockSize]byte
+	held bool
+
+	// Number of ciphertext bytes read.
+	total int64
+
+	// Set when the ciphertext is base64-encoded.
+	encoded bool
+
+	err error
+}
+
+// NewReader returns a reader decrypting the string read from r.
+func NewReader(r io.Reader, key, iv []byte) (*Reader, error) {
+	c, cErr := newCipher(key, iv)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	return &Reader{
+		src:     base64.NewDecoder(base64.StdEncoding, r),
+		block:   c,
+		mode:    cipher.NewCBCDecrypter(c, iv),
+		buf:     make([]byte, streamBufferSize),
+		plain:   make([]byte, 0, streamBufferSize+aes.BlockSize),
+		encoded: true,
+	}, nil
+}
+
+// NewBytesReader returns a reader decrypting the raw ciphertext read from r,
+// the output is the same as the output of DecryptBytes.
+func NewBytesReader(r io.Reader, key, iv []byte) (*Reader, error) {
+	c, cErr := newCipher(key, iv)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	return &Reader{
+		src:   r,
+		block: c,
+		mode:  cipher.NewCBCDecrypter(c, iv),
+		buf:   make([]byte, streamBufferSize),
+		plain: make([]byte, 0, streamBufferSize+aes.BlockSize),
+	}, nil
+}
+
+// Read returns the decrypted data, io.EOF is returned once the whole string
+// is read and the padding is valid.
+func (r *Reader) Read(data []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		n, end := r.read()
+		if r.err == nil {
+			r.decrypt(n, end)
+		}
+	}
+
+	if len(r.out) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(data, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+// Skip discards n bytes of the decrypted data returning the number of bytes
+// discarded, io.EOF is returned if the string ends before. Buffers of the
+// ciphertext preceding the remaining data are skipped without decrypting
+// them.
+func (r *Reader) Skip(n int64) (int64, error) {
+	var skipped int64
+
+	for skipped < n {
+		if len(r.out) > 0 {
+			k := int64(len(r.out))
+			if k > n-skipped {
+				k = n - skipped
+			}
+
+			r.out = r.out[k:]
+			skipped += k
+
+			continue
+		}
+
+		if r.err != nil {
+			return skipped, r.err
+		}
+
+		cn, end := r.read()
+		if r.err != nil {
+			continue
+		}
+
+		// Data preceding the last block of the buffer, which is held back.
+		var preceding int64
+		if r.held {
+			preceding = aes.BlockSize
+		}
+
+		preceding += int64(cn) - aes.BlockSize
+
+		if end || n-skipped < preceding {
+			r.decrypt(cn, end)
+			continue
+		}
+
+		// Only the last block is decrypted, its preceding block serves as
+		// the IV. The following blocks are chained to the last one.
+		cipher.NewCBCDecrypter(r.block, r.buf[cn-2*aes.BlockSize:cn-aes.BlockSize]).CryptBlocks(r.last[:], r.buf[cn-aes.BlockSize:cn])
+		r.mode = cipher.NewCBCDecrypter(r.block, r.buf[cn-aes.BlockSize:cn])
+		r.held = true
+
+		skipped += preceding
+	}
+
+	return skipped, nil
+}
+
+// read reads the next buffer of the ciphertext returning its length and
+// whether the string ended.
+func (r *Reader) read() (int, bool) {
+	n, rErr := io.ReadFull(r.src, r.buf)
+
+	end := rErr == io.EOF || rErr == io.ErrUnexpectedEOF
+	if rErr != nil && !end {
+		if r.encoded {
+			r.err = fmt.Errorf("failed to decode encrypted base64 string: %v", rErr)
+		} else {
+			r.err = fmt.Errorf("failed to read encrypted data: %v", rErr)
+		}
+
+		return 0, false
+	}
+
+	r.total += int64(n)
+
+	if n%aes.BlockSize != 0 {
+		r.err = fmt.Errorf("invalid encrypted data length %d", r.total)
+		return 0, false
+	}
+
+	return n, end
+}
+
+// decrypt decrypts n bytes of the ciphertext buffer.
+func (r *Reader) decrypt(n int, end bool) {
+	r.mode.CryptBlocks(r.buf[:n], r.buf[:n])
+
+	plain := r.plain[:0]
+
+	if n > 0 {
+		if r.held {
+			plain = append(plain, r.last[:]...)
+		}
+
+		plain = append(plain, r.buf[:n-aes.BlockSize]...)
+		copy(r.last[:], r.buf[n-aes.BlockSize:n])
+		r.held = true
+	}
+
+	if end {
+		if !r.held {
+			r.err = fmt.Errorf("invalid encrypted data length %d", r.total)
+			return
+		}
+
+		tr, trErr := pkcs5Trimming(r.last[:], aes.BlockSize)
+		if trErr != nil {
+			r.err = trErr
+			return
+		}
+
+		plain = append(plain, tr...)
+		r.held = false
+		r.err = io.EOF
+	}
+
+	r.out = plain
+}
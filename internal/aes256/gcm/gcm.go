@@ -0,0 +1,60 @@
+package gcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	c, cErr := aes.NewCipher(key)
+	if cErr != nil {
+		return nil, fmt.Errorf("failed to create new AES cipher: %v", cErr)
+	}
+
+	aead, aeadErr := cipher.NewGCM(c)
+	if aeadErr != nil {
+		return nil, fmt.Errorf("failed to create GCM cipher: %v", aeadErr)
+	}
+
+	return aead, nil
+}
+
+// Seal encrypts and authenticates data with AES-256-GCM prepending a random nonce.
+func Seal(data, key []byte) ([]byte, error) {
+	aead, aeadErr := newAEAD(key)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	_, rErr := io.ReadFull(rand.Reader, nonce)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", rErr)
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Open decrypts data sealed by Seal.
+func Open(sealed, key []byte) ([]byte, error) {
+	aead, aeadErr := newAEAD(key)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("invalid sealed data length %d", len(sealed))
+	}
+
+	data, dErr := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if dErr != nil {
+		return nil, errors.New("failed to authenticate sealed data")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,42 @@
+package gcm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCM(t *testing.T) {
+	const (
+		testKey  = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.f` // 32 bytes
+		otherKey = `NJ*R07(l@K!<P8j0\qI^0'(rb;f&\;.g` // 32 bytes
+	)
+
+	data := []byte("master key data")
+
+	sealed, sealedErr := Seal(data, []byte(testKey))
+	require.NoError(t, sealedErr)
+
+	// Nonces are random.
+	sealedAgain, sealedErr := Seal(data, []byte(testKey))
+	require.NoError(t, sealedErr)
+	require.NotEqual(t, sealed, sealedAgain)
+
+	opened, openedErr := Open(sealed, []byte(testKey))
+	require.NoError(t, openedErr)
+	require.Equal(t, data, opened)
+
+	// Wrong key.
+	_, openedErr = Open(sealed, []byte(otherKey))
+	require.Error(t, openedErr)
+
+	// Damaged data.
+	sealed[len(sealed)-1] ^= 1
+
+	_, openedErr = Open(sealed, []byte(testKey))
+	require.Error(t, openedErr)
+
+	// Truncated data.
+	_, openedErr = Open(sealed[:10], []byte(testKey))
+	require.Error(t, openedErr)
+}
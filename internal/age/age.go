@@ -0,0 +1,431 @@
+// Package age implements the age v1 file encryption format
+// (https://age-encryption.org/v1) with X25519 and scrypt recipients.
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	versionLine = "age-encryption.org/v1"
+
+	stanzaPrefix = "->"
+	footerPrefix = "---"
+
+	// Max length of a header line, long enough for any stanza argument.
+	maxLineLength = 4096
+
+	columnsPerLine = 64
+
+	fileKeySize = 16
+)
+
+var (
+	// ErrNoMatch is returned by Decrypt if none of the identities unwraps
+	// any of the recipient stanzas.
+	ErrNoMatch = errors.New("no identity matched any of the recipients")
+
+	// ErrHeaderMAC is returned by Decrypt if the header was tampered with.
+	ErrHeaderMAC = errors.New("bad header MAC")
+)
+
+var b64 = base64.RawStdEncoding.Strict()
+
+// Stanza is a recipient stanza of the header.
+type Stanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// Recipient wraps file keys.
+type Recipient interface {
+	Wrap(fileKey []byte) ([]*Stanza, error)
+}
+
+// Identity unwraps file keys. Unwrap returns ErrNoMatch if none of the
+// stanzas is addressed to the identity.
+type Identity interface {
+	Unwrap(stanzas []*Stanza) ([]byte, error)
+}
+
+// header is the parsed age header.
+type header struct {
+	stanzas []*Stanza
+	mac     []byte
+}
+
+// marshalWithoutMAC writes the header up to and including the footer prefix
+// covered by the MAC.
+func (h *header) marshalWithoutMAC(w io.Writer) error {
+	var sb strings.Builder
+
+	sb.WriteString(versionLine + "\n")
+
+	for _, s := range h.stanzas {
+		sb.WriteString(stanzaPrefix + " " + strings.Join(append([]string{s.Type}, s.Args...), " ") + "\n")
+
+		body := b64.EncodeToString(s.Body)
+		for len(body) >= columnsPerLine {
+			sb.WriteString(body[:columnsPerLine] + "\n")
+			body = body[columnsPerLine:]
+		}
+
+		// The body always ends with a short line, even if empty.
+		sb.WriteString(body + "\n")
+	}
+
+	sb.WriteString(footerPrefix)
+
+	_, wErr := io.WriteString(w, sb.String())
+
+	return wErr
+}
+
+func (h *header) marshal(w io.Writer) error {
+	mErr := h.marshalWithoutMAC(w)
+	if mErr != nil {
+		return mErr
+	}
+
+	_, wErr := io.WriteString(w, " "+b64.EncodeToString(h.mac)+"\n")
+
+	return wErr
+}
+
+// headerMAC returns the MAC of the header calculated with the file key.
+func headerMAC(fileKey []byte, h *header) ([]byte, error) {
+	hmacKey := make([]byte, 32)
+
+	_, rErr := io.ReadFull(hkdf.New(sha256.New, fileKey, nil, []byte("header")), hmacKey)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to derive header MAC key: %v", rErr)
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+
+	mErr := h.marshalWithoutMAC(mac)
+	if mErr != nil {
+		return nil, mErr
+	}
+
+	return mac.Sum(nil), nil
+}
+
+// validArg reports whether the stanza argument is non-empty and consists of
+// visible ASCII characters only.
+func validArg(arg string) bool {
+	if arg == "" {
+		return false
+	}
+
+	for _, c := range []byte(arg) {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readLine reads a header line without the trailing LF.
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+
+	for {
+		b, bErr := br.ReadByte()
+		if bErr != nil {
+			if bErr == io.EOF {
+				return "", errors.New("unexpected end of header")
+			}
+
+			return "", fmt.Errorf("failed to read header: %v", bErr)
+		}
+
+		if b == '\n' {
+			return string(line), nil
+		}
+
+		line = append(line, b)
+
+		if len(line) > maxLineLength {
+			return "", errors.New("header line is too long")
+		}
+	}
+}
+
+// parseHeader parses the header leaving br at the start of the payload.
+func parseHeader(br *bufio.Reader) (*header, error) {
+	line, lErr := readLine(br)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	if line != versionLine {
+		return nil, fmt.Errorf("unsupported version line %q", line)
+	}
+
+	h := &header{}
+
+	line, lErr = readLine(br)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	for {
+		if strings.HasPrefix(line, footerPrefix) {
+			if !strings.HasPrefix(line, footerPrefix+" ") {
+				return nil, errors.New("malformed header MAC line")
+			}
+
+			mac, macErr := b64.DecodeString(strings.TrimPrefix(line, footerPrefix+" "))
+			if macErr != nil || len(mac) != sha256.Size {
+				return nil, errors.New("malformed header MAC")
+			}
+
+			h.mac = mac
+
+			return h, nil
+		}
+
+		if !strings.HasPrefix(line, stanzaPrefix+" ") {
+			return nil, fmt.Errorf("malformed stanza line %q", line)
+		}
+
+		args := strings.Split(strings.TrimPrefix(line, stanzaPrefix+" "), " ")
+		for _, arg := range args {
+			if !validArg(arg) {
+				return nil, fmt.Errorf("malformed stanza argument %q", arg)
+			}
+		}
+
+		s := &Stanza{
+			Type: args[0],
+			Args: args[1:],
+		}
+
+		// Read body lines up to the first short one.
+		for {
+			line, lErr = readLine(br)
+			if lErr != nil {
+				return nil, lErr
+			}
+
+			if len(line) > columnsPerLine {
+				return nil, errors.New("stanza body line is too long")
+			}
+
+			b, bErr := b64.DecodeString(line)
+			if bErr != nil {
+				return nil, fmt.Errorf("malformed stanza body: %v", bErr)
+			}
+
+			s.Body = append(s.Body, b...)
+
+			if len(line) < columnsPerLine {
+				break
+			}
+		}
+
+		h.stanzas = append(h.stanzas, s)
+
+		line, lErr = readLine(br)
+		if lErr != nil {
+			return nil, lErr
+		}
+	}
+}
+
+// Encrypt returns a writer encrypting the data written to it to the
+// recipients, it must be closed to flush the final chunk.
+func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+
+	fileKey := make([]byte, fileKeySize)
+
+	_, rErr := io.ReadFull(rand.Reader, fileKey)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate file key: %v", rErr)
+	}
+
+	h := &header{}
+
+	for _, r := range recipients {
+		stanzas, wErr := r.Wrap(fileKey)
+		if wErr != nil {
+			return nil, fmt.Errorf("failed to wrap file key: %v", wErr)
+		}
+
+		h.stanzas = append(h.stanzas, stanzas...)
+	}
+
+	// Scrypt stanzas must be alone.
+	for _, s := range h.stanzas {
+		if s.Type == scryptStanzaType && len(h.stanzas) != 1 {
+			return nil, errors.New("scrypt recipients can't be combined with other recipients")
+		}
+	}
+
+	mac, macErr := headerMAC(fileKey, h)
+	if macErr != nil {
+		return nil, macErr
+	}
+
+	h.mac = mac
+
+	hErr := h.marshal(dst)
+	if hErr != nil {
+		return nil, fmt.Errorf("failed to write header: %v", hErr)
+	}
+
+	nonce := make([]byte, streamNonceSize)
+
+	_, rErr = io.ReadFull(rand.Reader, nonce)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", rErr)
+	}
+
+	_, wErr := dst.Write(nonce)
+	if wErr != nil {
+		return nil, fmt.Errorf("failed to write nonce: %v", wErr)
+	}
+
+	return newStreamWriter(streamKey(fileKey, nonce), dst)
+}
+
+// Decrypt parses the header of the age file read from src, unwraps the file
+// key with the identities and returns a reader of the decrypted payload.
+func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
+	r, _, dErr := decrypt(src, identities)
+	return r, dErr
+}
+
+// DecryptFile is Decrypt reading the age file of the given size, it also
+// returns the size of the decrypted payload computed from the size of the
+// encrypted one. The payload isn't authenticated until it's read.
+func DecryptFile(src io.Reader, size int64, identities ...Identity) (io.Reader, int64, error) {
+	r, headerSize, dErr := decrypt(src, identities)
+	if dErr != nil {
+		return nil, 0, dErr
+	}
+
+	plainSize, sErr := payloadSize(size - headerSize)
+	if sErr != nil {
+		return nil, 0, sErr
+	}
+
+	return r, plainSize, nil
+}
+
+// payloadSize returns the size of the decrypted payload of the encrypted
+// payload of the given size, the nonce excluded.
+func payloadSize(size int64) (int64, error) {
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	if size-(chunks-1)*encChunkSize < chacha20poly1305.Overhead {
+		return 0, errors.New("truncated payload chunk")
+	}
+
+	return size - chunks*chacha20poly1305.Overhead, nil
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(data []byte) (int, error) {
+	n, rErr := c.r.Read(data)
+	c.n += int64(n)
+
+	return n, rErr
+}
+
+// decrypt returns the reader of the decrypted payload and the size of the
+// header including the nonce.
+func decrypt(src io.Reader, identities []Identity) (io.Reader, int64, error) {
+	if len(identities) == 0 {
+		return nil, 0, errors.New("no identities specified")
+	}
+
+	cr := &countingReader{r: src}
+	br := bufio.NewReader(cr)
+
+	h, hErr := parseHeader(br)
+	if hErr != nil {
+		return nil, 0, fmt.Errorf("failed to parse header: %v", hErr)
+	}
+
+	// Scrypt stanzas must be alone.
+	for _, s := range h.stanzas {
+		if s.Type == scryptStanzaType && len(h.stanzas) != 1 {
+			return nil, 0, errors.New("scrypt stanza must be alone in the header")
+		}
+	}
+
+	var fileKey []byte
+
+	for _, id := range identities {
+		var uErr error
+		fileKey, uErr = id.Unwrap(h.stanzas)
+		if uErr == ErrNoMatch {
+			continue
+		}
+
+		if uErr != nil {
+			return nil, 0, uErr
+		}
+
+		break
+	}
+
+	if fileKey == nil {
+		return nil, 0, ErrNoMatch
+	}
+
+	mac, macErr := headerMAC(fileKey, h)
+	if macErr != nil {
+		return nil, 0, macErr
+	}
+
+	if !hmac.Equal(mac, h.mac) {
+		return nil, 0, ErrHeaderMAC
+	}
+
+	nonce := make([]byte, streamNonceSize)
+
+	_, rErr := io.ReadFull(br, nonce)
+	if rErr != nil {
+		return nil, 0, fmt.Errorf("failed to read nonce: %v", rErr)
+	}
+
+	sr, srErr := newStreamReader(streamKey(fileKey, nonce), br)
+	if srErr != nil {
+		return nil, 0, srErr
+	}
+
+	return sr, cr.n - int64(br.Buffered()), nil
+}
+
+// IsEncrypted reports whether the data starts with the age header.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(versionLine+"\n"))
+}
@@ -0,0 +1,231 @@
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testVector is a test vector of the C2SP CCTV age suite.
+type testVector struct {
+	expect     string
+	payload    string
+	identities []Identity
+	armored    bool
+	file       []byte
+}
+
+func parseTestVector(t *testing.T, path string) *testVector {
+	data, rErr := os.ReadFile(path)
+	require.NoError(t, rErr)
+
+	v := &testVector{}
+
+	br := bufio.NewReader(bytes.NewReader(data))
+
+	for {
+		line, lErr := br.ReadString('\n')
+		require.NoError(t, lErr)
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+
+		kv := strings.SplitN(line, ": ", 2)
+		require.Len(t, kv, 2, line)
+
+		switch kv[0] {
+		case "expect":
+			v.expect = kv[1]
+		case "payload":
+			v.payload = kv[1]
+		case "identity":
+			id, idErr := ParseX25519Identity(kv[1])
+			require.NoError(t, idErr)
+			v.identities = append(v.identities, id)
+		case "passphrase":
+			id, idErr := NewScryptIdentity(kv[1])
+			require.NoError(t, idErr)
+			v.identities = append(v.identities, id)
+		case "armored":
+			v.armored = kv[1] == "yes"
+		}
+	}
+
+	v.file, rErr = io.ReadAll(br)
+	require.NoError(t, rErr)
+
+	return v
+}
+
+func TestVectors(t *testing.T) {
+	paths, gErr := filepath.Glob("testdata/*")
+	require.NoError(t, gErr)
+
+	for _, path := range paths {
+		if filepath.Base(path) == "README.md" {
+			continue
+		}
+
+		path := path
+
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			v := parseTestVector(t, path)
+			if v.armored {
+				t.Skip("armored files are not supported")
+			}
+
+			r, dErr := Decrypt(bytes.NewReader(v.file), v.identities...)
+
+			switch v.expect {
+			case "success":
+				require.NoError(t, dErr)
+
+				data, rErr := io.ReadAll(r)
+				require.NoError(t, rErr)
+
+				sum := sha256.Sum256(data)
+				require.Equal(t, v.payload, hex.EncodeToString(sum[:]))
+			case "no match":
+				require.Equal(t, ErrNoMatch, dErr)
+			case "HMAC failure":
+				require.Equal(t, ErrHeaderMAC, dErr)
+			case "header failure":
+				require.Error(t, dErr)
+				require.NotEqual(t, ErrNoMatch, dErr)
+				require.NotEqual(t, ErrHeaderMAC, dErr)
+			case "payload failure":
+				require.NoError(t, dErr)
+
+				data, rErr := io.ReadAll(r)
+				require.Error(t, rErr)
+
+				sum := sha256.Sum256(data)
+				require.Equal(t, v.payload, hex.EncodeToString(sum[:]))
+			default:
+				t.Fatalf("unknown expectation %q", v.expect)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	id, gErr := GenerateX25519Identity()
+	require.NoError(t, gErr)
+
+	parsedID, pErr := ParseX25519Identity(id.String())
+	require.NoError(t, pErr)
+
+	recipient, pErr := ParseX25519Recipient(id.Recipient().String())
+	require.NoError(t, pErr)
+
+	scryptRecipient, sErr := NewScryptRecipient("password")
+	require.NoError(t, sErr)
+	scryptRecipient.SetWorkFactor(10)
+
+	scryptID, sErr := NewScryptIdentity("password")
+	require.NoError(t, sErr)
+
+	cases := []struct {
+		recipient Recipient
+		identity  Identity
+	}{
+		{recipient, parsedID},
+		{scryptRecipient, scryptID},
+	}
+
+	// Sizes around the chunk boundaries.
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize, 2*chunkSize + 100}
+
+	for _, c := range cases {
+		for _, size := range sizes {
+			plain := bytes.Repeat([]byte{'a'}, size)
+
+			var buf bytes.Buffer
+
+			w, eErr := Encrypt(&buf, c.recipient)
+			require.NoError(t, eErr)
+
+			_, wErr := w.Write(plain)
+			require.NoError(t, wErr)
+			require.NoError(t, w.Close())
+			require.True(t, IsEncrypted(buf.Bytes()))
+
+			// The payload size is known before it's read.
+			fr, frSize, frErr := DecryptFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()), c.identity)
+			require.NoError(t, frErr)
+			require.Equal(t, int64(size), frSize)
+
+			data, rErr := io.ReadAll(fr)
+			require.NoError(t, rErr)
+			require.Equal(t, plain, data)
+
+			r, dErr := Decrypt(&buf, c.identity)
+			require.NoError(t, dErr)
+
+			data, rErr = io.ReadAll(r)
+			require.NoError(t, rErr)
+			require.Equal(t, plain, data)
+		}
+	}
+
+	// Wrong identity.
+	otherID, gErr := GenerateX25519Identity()
+	require.NoError(t, gErr)
+
+	var buf bytes.Buffer
+
+	w, eErr := Encrypt(&buf, recipient)
+	require.NoError(t, eErr)
+	require.NoError(t, w.Close())
+
+	_, dErr := Decrypt(&buf, otherID)
+	require.Equal(t, ErrNoMatch, dErr)
+}
+
+func TestBech32(t *testing.T) {
+	valid := []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	}
+
+	for _, s := range valid {
+		hrp, data, dErr := bech32Decode(s)
+		require.NoError(t, dErr, s)
+
+		if strings.ToUpper(s) == s {
+			hrp = strings.ToUpper(hrp)
+		}
+
+		encoded, eErr := bech32Encode(hrp, data)
+		require.NoError(t, eErr)
+		require.Equal(t, s, encoded)
+	}
+
+	invalid := []string{
+		"pzry9x0s0muk",
+		"1pzry9x0s0muk",
+		"x1b4n0q5v",
+		"li1dgmt3",
+		"A1G7SGD8",
+		"10a06t8",
+		"1qzzfhee",
+		"a12UEL5L",
+	}
+
+	for _, s := range invalid {
+		_, _, dErr := bech32Decode(s)
+		require.Error(t, dErr, s)
+	}
+}
@@ -0,0 +1,156 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Bech32 encoding as defined by BIP 173 without the length limit.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	res := make([]byte, 0, len(hrp)*2+1)
+
+	for _, c := range []byte(hrp) {
+		res = append(res, c>>5)
+	}
+
+	res = append(res, 0)
+
+	for _, c := range []byte(hrp) {
+		res = append(res, c&31)
+	}
+
+	return res
+}
+
+// convertBits regroups data of fromBits bits per byte into toBits bits per byte.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var res []byte
+
+	maxV := uint32(1)<<toBits - 1
+
+	for _, b := range data {
+		if uint32(b)>>fromBits != 0 {
+			return nil, fmt.Errorf("invalid data byte %d", b)
+		}
+
+		acc = acc<<fromBits | uint32(b)
+		bits += fromBits
+
+		for bits >= toBits {
+			bits -= toBits
+			res = append(res, byte(acc>>bits&maxV))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			res = append(res, byte(acc<<(toBits-bits)&maxV))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxV != 0 {
+		return nil, errors.New("invalid padding")
+	}
+
+	return res, nil
+}
+
+// bech32Encode encodes the data with the human-readable part hrp, the result
+// is uppercase if hrp is.
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values, vErr := convertBits(data, 8, 5, true)
+	if vErr != nil {
+		return "", vErr
+	}
+
+	upper := strings.ToUpper(hrp) == hrp && strings.ToLower(hrp) != hrp
+	hrp = strings.ToLower(hrp)
+
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+
+	if upper {
+		return strings.ToUpper(sb.String()), nil
+	}
+
+	return sb.String(), nil
+}
+
+// bech32Decode returns the human-readable part and the data of the string.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("separator '1' at invalid position")
+	}
+
+	hrp := s[:pos]
+	for _, c := range []byte(hrp) {
+		if c < 33 || c > 126 {
+			return "", nil, fmt.Errorf("invalid character in human-readable part: %q", c)
+		}
+	}
+
+	s = strings.ToLower(s)
+	hrp = strings.ToLower(hrp)
+
+	var values []byte
+
+	for _, c := range []byte(s[pos+1:]) {
+		v := strings.IndexByte(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid character in data part: %q", c)
+		}
+
+		values = append(values, byte(v))
+	}
+
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	data, dErr := convertBits(values[:len(values)-6], 5, 8, false)
+	if dErr != nil {
+		return "", nil, dErr
+	}
+
+	return hrp, data, nil
+}
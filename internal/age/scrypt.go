@@ -0,0 +1,163 @@
+package age
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptStanzaType = "scrypt"
+	scryptLabel      = "age-encryption.org/v1/scrypt"
+	scryptSaltSize   = 16
+
+	// DefaultScryptWorkFactor is the base-2 logarithm of the scrypt cost
+	// used by ScryptRecipient, it takes about a second.
+	DefaultScryptWorkFactor = 18
+
+	// MaxScryptWorkFactor is the highest work factor accepted by ScryptIdentity.
+	MaxScryptWorkFactor = 22
+)
+
+func scryptKey(passphrase string, salt []byte, workFactor int) ([]byte, error) {
+	label := append([]byte(scryptLabel), salt...)
+
+	key, kErr := scrypt.Key([]byte(passphrase), label, 1<<uint(workFactor), 8, 1, chacha20poly1305.KeySize)
+	if kErr != nil {
+		return nil, fmt.Errorf("failed to derive scrypt key: %v", kErr)
+	}
+
+	return key, nil
+}
+
+// ScryptRecipient encrypts the file key with a passphrase.
+type ScryptRecipient struct {
+	passphrase string
+	workFactor int
+}
+
+// NewScryptRecipient returns a recipient of the passphrase.
+func NewScryptRecipient(passphrase string) (*ScryptRecipient, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase provided")
+	}
+
+	return &ScryptRecipient{
+		passphrase: passphrase,
+		workFactor: DefaultScryptWorkFactor,
+	}, nil
+}
+
+// SetWorkFactor sets the base-2 logarithm of the scrypt cost.
+func (r *ScryptRecipient) SetWorkFactor(workFactor int) {
+	r.workFactor = workFactor
+}
+
+// Wrap implements Recipient.
+func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	if r.workFactor < 1 || r.workFactor > MaxScryptWorkFactor {
+		return nil, fmt.Errorf("invalid scrypt work factor %d", r.workFactor)
+	}
+
+	salt := make([]byte, scryptSaltSize)
+
+	_, rErr := io.ReadFull(rand.Reader, salt)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", rErr)
+	}
+
+	key, kErr := scryptKey(r.passphrase, salt, r.workFactor)
+	if kErr != nil {
+		return nil, kErr
+	}
+
+	body, wErr := wrapKey(key, fileKey)
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	return []*Stanza{{
+		Type: scryptStanzaType,
+		Args: []string{b64.EncodeToString(salt), strconv.Itoa(r.workFactor)},
+		Body: body,
+	}}, nil
+}
+
+// ScryptIdentity decrypts the file key with a passphrase.
+type ScryptIdentity struct {
+	passphrase string
+}
+
+// NewScryptIdentity returns an identity of the passphrase.
+func NewScryptIdentity(passphrase string) (*ScryptIdentity, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase provided")
+	}
+
+	return &ScryptIdentity{passphrase: passphrase}, nil
+}
+
+// parseWorkFactor parses the decimal work factor without leading zeros or signs.
+func parseWorkFactor(s string) (int, error) {
+	if s == "" || s[0] == '0' || len(s) > 2 {
+		return 0, fmt.Errorf("invalid scrypt work factor %q", s)
+	}
+
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid scrypt work factor %q", s)
+		}
+	}
+
+	return strconv.Atoi(s)
+}
+
+// Unwrap implements Identity.
+func (i *ScryptIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != scryptStanzaType {
+			continue
+		}
+
+		if len(s.Args) != 2 {
+			return nil, errors.New("invalid scrypt stanza")
+		}
+
+		salt, saltErr := b64.DecodeString(s.Args[0])
+		if saltErr != nil || len(salt) != scryptSaltSize {
+			return nil, errors.New("invalid scrypt stanza salt")
+		}
+
+		workFactor, wfErr := parseWorkFactor(s.Args[1])
+		if wfErr != nil {
+			return nil, wfErr
+		}
+
+		if workFactor > MaxScryptWorkFactor {
+			return nil, fmt.Errorf("scrypt work factor %d is too high", workFactor)
+		}
+
+		if len(s.Body) != fileKeySize+chacha20poly1305.Overhead {
+			return nil, fmt.Errorf("invalid stanza body length %d", len(s.Body))
+		}
+
+		key, kErr := scryptKey(i.passphrase, salt, workFactor)
+		if kErr != nil {
+			return nil, kErr
+		}
+
+		fileKey, uErr := unwrapKey(key, s.Body)
+		if uErr == ErrNoMatch {
+			continue
+		}
+
+		return fileKey, uErr
+	}
+
+	return nil, ErrNoMatch
+}
@@ -0,0 +1,220 @@
+package age
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// STREAM construction encrypting the payload in chunks.
+
+const (
+	streamNonceSize = 16
+
+	chunkSize    = 64 * 1024
+	encChunkSize = chunkSize + chacha20poly1305.Overhead
+)
+
+// streamKey derives the payload key from the file key and the nonce.
+func streamKey(fileKey, nonce []byte) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	// HKDF can't fail reading less than 255 hashes.
+	io.ReadFull(hkdf.New(sha256.New, fileKey, nonce, []byte("payload")), key)
+
+	return key
+}
+
+// chunkNonce returns the nonce of the chunk with the given counter.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+
+	for i := 10; i >= 0 && counter > 0; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+type streamReader struct {
+	aead cipher.AEAD
+	src  io.Reader
+
+	counter uint64
+	buf     []byte
+	// Number of bytes of the next chunk already read into buf.
+	have  int
+	plain []byte
+	done  bool
+	err   error
+}
+
+func newStreamReader(key []byte, src io.Reader) (*streamReader, error) {
+	aead, aeadErr := chacha20poly1305.New(key)
+	if aeadErr != nil {
+		return nil, fmt.Errorf("failed to create payload cipher: %v", aeadErr)
+	}
+
+	return &streamReader{
+		aead: aead,
+		src:  src,
+		buf:  make([]byte, encChunkSize+1),
+	}, nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.done {
+			return 0, io.EOF
+		}
+
+		r.plain, r.err = r.readChunk()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk.
+func (r *streamReader) readChunk() ([]byte, error) {
+	// Read one more byte to tell whether the chunk is the last one.
+	n, rErr := io.ReadFull(r.src, r.buf[r.have:])
+	if rErr != nil && rErr != io.ErrUnexpectedEOF && rErr != io.EOF {
+		return nil, fmt.Errorf("failed to read payload: %v", rErr)
+	}
+
+	n += r.have
+	r.have = 0
+
+	chunk := r.buf[:n]
+	last := n <= encChunkSize
+
+	if !last {
+		chunk = r.buf[:encChunkSize]
+	}
+
+	if len(chunk) < chacha20poly1305.Overhead {
+		return nil, errors.New("truncated payload chunk")
+	}
+
+	plain, oErr := r.aead.Open(nil, chunkNonce(r.counter, last), chunk, nil)
+	if oErr != nil {
+		// Return whatever authenticates with the opposite flag along with
+		// the error, a full last chunk might be followed by trailing data
+		// or a full chunk might be truncated before the last one.
+		if p, pErr := r.aead.Open(nil, chunkNonce(r.counter, !last), chunk, nil); pErr == nil && len(chunk) == encChunkSize {
+			if last {
+				return p, errors.New("payload is truncated")
+			}
+
+			return p, errors.New("trailing data after the last payload chunk")
+		}
+
+		return nil, errors.New("failed to decrypt payload chunk")
+	}
+
+	if last {
+		if len(plain) == 0 && r.counter > 0 {
+			return nil, errors.New("last payload chunk is empty")
+		}
+
+		r.done = true
+	} else {
+		// Keep the extra byte read for the next chunk.
+		r.buf[0] = r.buf[encChunkSize]
+		r.have = 1
+	}
+
+	r.counter++
+
+	return plain, nil
+}
+
+type streamWriter struct {
+	aead cipher.AEAD
+	dst  io.Writer
+
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+func newStreamWriter(key []byte, dst io.Writer) (*streamWriter, error) {
+	aead, aeadErr := chacha20poly1305.New(key)
+	if aeadErr != nil {
+		return nil, fmt.Errorf("failed to create payload cipher: %v", aeadErr)
+	}
+
+	return &streamWriter{
+		aead: aead,
+		dst:  dst,
+		buf:  make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed writer")
+	}
+
+	var written int
+
+	for len(p) > 0 {
+		// Flush a full chunk only once more data follows, the last chunk
+		// might be full.
+		if len(w.buf) == chunkSize {
+			fErr := w.flush(false)
+			if fErr != nil {
+				return written, fErr
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *streamWriter) flush(last bool) error {
+	enc := w.aead.Seal(nil, chunkNonce(w.counter, last), w.buf, nil)
+
+	_, wErr := w.dst.Write(enc)
+	if wErr != nil {
+		return fmt.Errorf("failed to write payload chunk: %v", wErr)
+	}
+
+	w.counter++
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// Close writes the last chunk.
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.flush(true)
+}
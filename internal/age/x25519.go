@@ -0,0 +1,242 @@
+package age
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	x25519StanzaType = "X25519"
+	x25519Label      = "age-encryption.org/v1/X25519"
+
+	recipientHRP = "age"
+	identityHRP  = "AGE-SECRET-KEY-"
+)
+
+// wrapKey encrypts the file key with the key, which is used only once.
+func wrapKey(key, fileKey []byte) ([]byte, error) {
+	aead, aeadErr := chacha20poly1305.New(key)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// unwrapKey decrypts the file key returning ErrNoMatch if it can't be
+// authenticated.
+func unwrapKey(key, body []byte) ([]byte, error) {
+	if len(body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("invalid stanza body length %d", len(body))
+	}
+
+	aead, aeadErr := chacha20poly1305.New(key)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+
+	fileKey, oErr := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+	if oErr != nil {
+		return nil, ErrNoMatch
+	}
+
+	return fileKey, nil
+}
+
+// x25519WrapKey derives the key wrapping the file key exchanged between the
+// ephemeral share and the recipient.
+func x25519WrapKey(secret, share, recipient []byte) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	salt := append(append([]byte{}, share...), recipient...)
+
+	// HKDF can't fail reading less than 255 hashes.
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(x25519Label)), key)
+
+	return key
+}
+
+// X25519Recipient is the public key of an X25519 identity.
+type X25519Recipient struct {
+	publicKey []byte
+}
+
+// ParseX25519Recipient parses the Bech32-encoded age1... recipient.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	hrp, k, kErr := bech32Decode(s)
+	if kErr != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, kErr)
+	}
+
+	if hrp != recipientHRP || len(k) != curve25519.PointSize {
+		return nil, fmt.Errorf("malformed recipient %q", s)
+	}
+
+	return &X25519Recipient{publicKey: k}, nil
+}
+
+// String returns the Bech32-encoded recipient.
+func (r *X25519Recipient) String() string {
+	s, _ := bech32Encode(recipientHRP, r.publicKey)
+	return s
+}
+
+// Wrap implements Recipient.
+func (r *X25519Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+
+	_, rErr := io.ReadFull(rand.Reader, ephemeral)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %v", rErr)
+	}
+
+	share, sErr := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	secret, sErr := curve25519.X25519(ephemeral, r.publicKey)
+	if sErr != nil {
+		return nil, fmt.Errorf("failed to calculate shared secret: %v", sErr)
+	}
+
+	body, wErr := wrapKey(x25519WrapKey(secret, share, r.publicKey), fileKey)
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	return []*Stanza{{
+		Type: x25519StanzaType,
+		Args: []string{b64.EncodeToString(share)},
+		Body: body,
+	}}, nil
+}
+
+// X25519Identity is an X25519 private key.
+type X25519Identity struct {
+	secretKey []byte
+	publicKey []byte
+}
+
+// GenerateX25519Identity returns a new random identity.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+
+	_, rErr := io.ReadFull(rand.Reader, secretKey)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate secret key: %v", rErr)
+	}
+
+	return newX25519Identity(secretKey)
+}
+
+func newX25519Identity(secretKey []byte) (*X25519Identity, error) {
+	publicKey, pErr := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	return &X25519Identity{
+		secretKey: secretKey,
+		publicKey: publicKey,
+	}, nil
+}
+
+// ParseX25519Identity parses the Bech32-encoded AGE-SECRET-KEY-1... identity.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	hrp, k, kErr := bech32Decode(s)
+	if kErr != nil {
+		return nil, fmt.Errorf("malformed identity: %v", kErr)
+	}
+
+	if hrp != strings.ToLower(identityHRP) || len(k) != curve25519.ScalarSize {
+		return nil, errors.New("malformed identity")
+	}
+
+	return newX25519Identity(k)
+}
+
+// ParseIdentities parses an identity file listing one identity per line,
+// empty lines and lines starting with # are ignored.
+func ParseIdentities(r io.Reader) ([]Identity, error) {
+	var res []Identity
+
+	sc := bufio.NewScanner(r)
+
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, idErr := ParseX25519Identity(line)
+		if idErr != nil {
+			return nil, fmt.Errorf("failed to parse identity on line %d: %v", n, idErr)
+		}
+
+		res = append(res, id)
+	}
+
+	if sc.Err() != nil {
+		return nil, fmt.Errorf("failed to read identities: %v", sc.Err())
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("no identities found")
+	}
+
+	return res, nil
+}
+
+// Recipient returns the recipient of the identity.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{publicKey: i.publicKey}
+}
+
+// String returns the Bech32-encoded identity.
+func (i *X25519Identity) String() string {
+	s, _ := bech32Encode(identityHRP, i.secretKey)
+	return s
+}
+
+// Unwrap implements Identity.
+func (i *X25519Identity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != x25519StanzaType {
+			continue
+		}
+
+		if len(s.Args) != 1 {
+			return nil, errors.New("invalid X25519 stanza")
+		}
+
+		share, shareErr := b64.DecodeString(s.Args[0])
+		if shareErr != nil || len(share) != curve25519.PointSize {
+			return nil, errors.New("invalid X25519 stanza share")
+		}
+
+		// Low-order shares resulting in the all-zero secret are rejected.
+		secret, sErr := curve25519.X25519(i.secretKey, share)
+		if sErr != nil {
+			return nil, fmt.Errorf("invalid X25519 stanza share: %v", sErr)
+		}
+
+		fileKey, uErr := unwrapKey(x25519WrapKey(secret, share, i.publicKey), s.Body)
+		if uErr == ErrNoMatch {
+			continue
+		}
+
+		return fileKey, uErr
+	}
+
+	return nil, ErrNoMatch
+}
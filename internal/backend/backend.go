@@ -0,0 +1,128 @@
+// Package backend stores archive files in the local filesystem or in an
+// S3-compatible object storage.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Backend lists, reads, writes and deletes archive files. Names are
+// slash-separated paths, directories are implied by the files they contain.
+// The context cancels the requests of the call and the reads and writes of
+// the returned files, local files aren't affected by it.
+type Backend interface {
+	// List returns the files stored directly in dir.
+	List(ctx context.Context, dir string) ([]File, error)
+
+	// Open opens the file for reading, the error satisfies os.IsNotExist if
+	// the file doesn't exist.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Create creates or replaces the file, it appears once the returned
+	// writer is closed successfully.
+	Create(ctx context.Context, name string) (Writer, error)
+
+	// Remove deletes the file.
+	Remove(ctx context.Context, name string) error
+}
+
+// File describes a stored file.
+type File struct {
+	Name string
+	Size int64
+}
+
+// Writer writes a file created by Backend.Create.
+type Writer interface {
+	io.WriteCloser
+
+	// Abort discards the file written so far instead of storing it.
+	Abort() error
+}
+
+// Local stores files in the local filesystem, names are local paths.
+type Local struct{}
+
+// List returns the regular files stored in dir.
+func (Local) List(ctx context.Context, dir string) ([]File, error) {
+	files, filesErr := ioutil.ReadDir(dir)
+	if filesErr != nil {
+		return nil, filesErr
+	}
+
+	var res []File
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		res = append(res, File{
+			Name: f.Name(),
+			Size: f.Size(),
+		})
+	}
+
+	return res, nil
+}
+
+// Open opens the file for reading.
+func (Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// Create writes the file to a hidden temporary file in the same directory
+// which replaces the file on Close.
+func (Local) Create(ctx context.Context, name string) (Writer, error) {
+	f, fErr := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp-")
+	if fErr != nil {
+		return nil, fErr
+	}
+
+	return &localFile{
+		File: f,
+		name: name,
+	}, nil
+}
+
+// Remove deletes the file.
+func (Local) Remove(ctx context.Context, name string) error {
+	return os.Remove(name)
+}
+
+type localFile struct {
+	*os.File
+	name string
+}
+
+func (f *localFile) Close() error {
+	closeErr := f.File.Close()
+	if closeErr != nil {
+		os.Remove(f.File.Name())
+		return closeErr
+	}
+
+	chmodErr := os.Chmod(f.File.Name(), 0644)
+	if chmodErr != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("failed to set permissions of %s: %v", f.name, chmodErr)
+	}
+
+	mvErr := os.Rename(f.File.Name(), f.name)
+	if mvErr != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("failed to replace %s: %v", f.name, mvErr)
+	}
+
+	return nil
+}
+
+func (f *localFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, b Backend, name string, data []byte) {
+	w, wErr := b.Create(context.Background(), name)
+	require.NoError(t, wErr)
+
+	// Write in chunks not aligned with the part size.
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+
+		_, wErr = w.Write(data[:n])
+		require.NoError(t, wErr)
+
+		data = data[n:]
+	}
+
+	require.NoError(t, w.Close())
+}
+
+func readTestFile(t *testing.T, b Backend, name string) []byte {
+	r, rErr := b.Open(context.Background(), name)
+	require.NoError(t, rErr)
+
+	defer r.Close()
+
+	data, dataErr := ioutil.ReadAll(r)
+	require.NoError(t, dataErr)
+
+	return data
+}
+
+// listTestFiles returns the sorted names of the files stored in dir.
+func listTestFiles(t *testing.T, b Backend, dir string) []string {
+	files, lErr := b.List(context.Background(), dir)
+	require.NoError(t, lErr)
+
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func testBackend(t *testing.T, b Backend, dir string) {
+	files := map[string][]byte{
+		"a.data":     []byte("small"),
+		"b c+d.data": bytes.Repeat([]byte("0123456789"), 5),
+		"e.data":     bytes.Repeat([]byte("x"), 33),
+		".header":    []byte("{}"),
+	}
+
+	for name, data := range files {
+		writeTestFile(t, b, dir+"/"+name, data)
+	}
+
+	// Files of subdirectories aren't listed.
+	writeTestFile(t, b, dir+"/sub/f.data", []byte("nested"))
+
+	for name, data := range files {
+		require.Equal(t, data, readTestFile(t, b, dir+"/"+name))
+	}
+
+	require.Equal(t, []string{".header", "a.data", "b c+d.data", "e.data"}, listTestFiles(t, b, dir))
+
+	stored, lErr := b.List(context.Background(), dir)
+	require.NoError(t, lErr)
+
+	for _, f := range stored {
+		require.Equal(t, int64(len(readTestFile(t, b, dir+"/"+f.Name))), f.Size, f.Name)
+	}
+
+	// Aborted files don't replace the stored ones.
+	w, wErr := b.Create(context.Background(), dir+"/e.data")
+	require.NoError(t, wErr)
+
+	_, wErr = w.Write(bytes.Repeat([]byte("y"), 25))
+	require.NoError(t, wErr)
+
+	require.NoError(t, w.Abort())
+	require.Equal(t, files["e.data"], readTestFile(t, b, dir+"/e.data"))
+
+	// Replace a file.
+	writeTestFile(t, b, dir+"/a.data", []byte("replaced"))
+	require.Equal(t, []byte("replaced"), readTestFile(t, b, dir+"/a.data"))
+
+	require.NoError(t, b.Remove(context.Background(), dir+"/a.data"))
+
+	_, oErr := b.Open(context.Background(), dir+"/a.data")
+	require.True(t, os.IsNotExist(oErr), oErr)
+
+	require.Equal(t, []string{".header", "b c+d.data", "e.data"}, listTestFiles(t, b, dir))
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.Mkdir(dir+"/archive", 0755))
+	require.NoError(t, os.Mkdir(dir+"/archive/sub", 0755))
+
+	testBackend(t, Local{}, dir+"/archive")
+
+	// Files appear once closed.
+	w, wErr := Local{}.Create(context.Background(), dir+"/archive/f.data")
+	require.NoError(t, wErr)
+
+	_, wErr = w.Write([]byte("data"))
+	require.NoError(t, wErr)
+
+	_, sErr := os.Stat(dir + "/archive/f.data")
+	require.True(t, os.IsNotExist(sErr))
+
+	require.NoError(t, w.Close())
+	require.Equal(t, []byte("data"), readTestFile(t, Local{}, dir+"/archive/f.data"))
+}
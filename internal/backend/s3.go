@@ -0,0 +1,444 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegion is used if the S3 region isn't configured.
+	DefaultRegion = "us-east-1"
+
+	// Objects larger than the part size are uploaded in parts, S3 requires
+	// parts of at least 5MB.
+	defaultPartSize = 16 * 1024 * 1024
+)
+
+// S3Config contains S3 backend configuration.
+type S3Config struct {
+	// Endpoint is the URL of an S3-compatible service such as MinIO, AWS S3
+	// is used if empty.
+	Endpoint string
+
+	Region string
+	Bucket string
+
+	AccessKey string
+	SecretKey string
+}
+
+// S3 stores files as objects of a bucket, names are object keys. Requests
+// are path-style so that any S3-compatible service can be used.
+type S3 struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+
+	accessKey string
+	secretKey string
+
+	client   *http.Client
+	partSize int
+	now      func() time.Time
+}
+
+// NewS3 returns new S3 backend.
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("empty S3 bucket provided")
+	}
+
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("S3 access key and secret key are required")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	u, uErr := url.Parse(endpoint)
+	if uErr != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %s", endpoint)
+	}
+
+	return &S3{
+		endpoint: u,
+		region:   region,
+		bucket:   cfg.Bucket,
+
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+
+		client:   &http.Client{},
+		partSize: defaultPartSize,
+		now:      time.Now,
+	}, nil
+}
+
+// s3Error is the error response of the service.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.Status)
+	}
+
+	return fmt.Sprintf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	e := &s3Error{Status: resp.StatusCode}
+	xml.Unmarshal(body, e)
+
+	return e
+}
+
+// key returns the object key of the name.
+func key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// do sends the signed request, the response body must be closed by the
+// caller unless an error is returned.
+func (s *S3) do(ctx context.Context, method, objectKey string, query url.Values, body []byte) (*http.Response, error) {
+	p := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket
+	if objectKey != "" {
+		p += "/" + objectKey
+	}
+
+	u := *s.endpoint
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, reqErr := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	req.ContentLength = int64(len(body))
+
+	signRequest(req, s.accessKey, s.secretKey, s.region, sha256Hex(body), s.now())
+
+	resp, respErr := s.client.Do(req)
+	if respErr != nil {
+		return nil, respErr
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	return resp, nil
+}
+
+// doXML sends the request and decodes the XML response into res.
+func (s *S3) doXML(ctx context.Context, method, objectKey string, query url.Values, body []byte, res interface{}) error {
+	resp, respErr := s.do(ctx, method, objectKey, query, body)
+	if respErr != nil {
+		return respErr
+	}
+
+	defer resp.Body.Close()
+
+	data, dataErr := ioutil.ReadAll(resp.Body)
+	if dataErr != nil {
+		return fmt.Errorf("failed to read response: %v", dataErr)
+	}
+
+	// Some requests may fail after the response status is sent.
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	uErr := xml.Unmarshal(data, res)
+	if uErr != nil {
+		return fmt.Errorf("failed to decode response: %v", uErr)
+	}
+
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the objects which keys start with dir followed by a slash and
+// have no more slashes.
+func (s *S3) List(ctx context.Context, dir string) ([]File, error) {
+	prefix := key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var res []File
+	var token string
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var lr listBucketResult
+
+		lErr := s.doXML(ctx, http.MethodGet, "", query, nil, &lr)
+		if lErr != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", dir, lErr)
+		}
+
+		for _, c := range lr.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name != "" {
+				res = append(res, File{
+					Name: name,
+					Size: c.Size,
+				})
+			}
+		}
+
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return res, nil
+		}
+
+		token = lr.NextContinuationToken
+	}
+}
+
+// Open returns the object contents as they're downloaded.
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, respErr := s.do(ctx, http.MethodGet, key(name), nil, nil)
+	if respErr != nil {
+		var e *s3Error
+		if errors.As(respErr, &e) && e.Status == http.StatusNotFound {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+
+		return nil, fmt.Errorf("failed to get %s: %v", name, respErr)
+	}
+
+	return resp.Body, nil
+}
+
+// Create uploads the object as it's written, objects larger than the part
+// size are uploaded in parts so only one part is kept in memory.
+func (s *S3) Create(ctx context.Context, name string) (Writer, error) {
+	return &s3Writer{
+		ctx: ctx,
+		s:   s,
+		key: key(name),
+	}, nil
+}
+
+// Remove deletes the object.
+func (s *S3) Remove(ctx context.Context, name string) error {
+	resp, respErr := s.do(ctx, http.MethodDelete, key(name), nil, nil)
+	if respErr != nil {
+		return fmt.Errorf("failed to delete %s: %v", name, respErr)
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type s3Writer struct {
+	ctx context.Context
+	s   *S3
+	key string
+	buf bytes.Buffer
+
+	uploadID string
+	parts    []completedPart
+
+	err    error
+	closed bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.closed {
+		return 0, errors.New("write to closed writer")
+	}
+
+	w.buf.Write(p)
+
+	for w.buf.Len() >= w.s.partSize {
+		w.err = w.uploadPart(w.buf.Next(w.s.partSize))
+		if w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+	}
+
+	return len(p), nil
+}
+
+// uploadPart uploads the next part starting the multipart upload if needed.
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		var res struct {
+			UploadID string `xml:"UploadId"`
+		}
+
+		iErr := w.s.doXML(w.ctx, http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, &res)
+		if iErr != nil {
+			return fmt.Errorf("failed to start upload of %s: %v", w.key, iErr)
+		}
+
+		w.uploadID = res.UploadID
+	}
+
+	n := len(w.parts) + 1
+
+	resp, respErr := w.s.do(w.ctx, http.MethodPut, w.key, url.Values{
+		"partNumber": {strconv.Itoa(n)},
+		"uploadId":   {w.uploadID},
+	}, data)
+	if respErr != nil {
+		return fmt.Errorf("failed to upload part %d of %s: %v", n, w.key, respErr)
+	}
+
+	resp.Body.Close()
+
+	w.parts = append(w.parts, completedPart{
+		PartNumber: n,
+		ETag:       resp.Header.Get("ETag"),
+	})
+
+	return nil
+}
+
+// abort cancels the multipart upload so that its parts aren't stored, it's
+// requested even if the context is done.
+func (w *s3Writer) abort() {
+	if w.uploadID == "" {
+		return
+	}
+
+	resp, respErr := w.s.do(context.Background(), http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if respErr == nil {
+		resp.Body.Close()
+	}
+
+	w.uploadID = ""
+}
+
+// Close uploads the rest of the object, the object isn't stored if any
+// upload failed.
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+
+	w.closed = true
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.uploadID == "" {
+		resp, respErr := w.s.do(w.ctx, http.MethodPut, w.key, nil, w.buf.Bytes())
+		if respErr != nil {
+			w.err = fmt.Errorf("failed to upload %s: %v", w.key, respErr)
+			return w.err
+		}
+
+		resp.Body.Close()
+
+		return nil
+	}
+
+	if w.buf.Len() > 0 {
+		w.err = w.uploadPart(w.buf.Bytes())
+		if w.err != nil {
+			w.abort()
+			return w.err
+		}
+	}
+
+	body, bodyErr := xml.Marshal(completeMultipartUpload{Parts: w.parts})
+	if bodyErr != nil {
+		w.abort()
+		w.err = fmt.Errorf("failed to encode upload parts: %v", bodyErr)
+		return w.err
+	}
+
+	cErr := w.s.doXML(w.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body, nil)
+	if cErr != nil {
+		w.abort()
+		w.err = fmt.Errorf("failed to complete upload of %s: %v", w.key, cErr)
+		return w.err
+	}
+
+	return nil
+}
+
+// Abort cancels the upload.
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return w.err
+	}
+
+	w.closed = true
+	w.err = fmt.Errorf("upload of %s aborted", w.key)
+
+	w.abort()
+	w.buf.Reset()
+
+	return nil
+}
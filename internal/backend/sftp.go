@@ -0,0 +1,311 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Reads and writes are buffered to reduce the number of round trips.
+const sftpBufferSize = 1024 * 1024
+
+// SFTPConfig contains SFTP backend configuration.
+type SFTPConfig struct {
+	// Addr is the host:port of the SSH server, port 22 is used if omitted.
+	Addr string
+
+	// User defaults to the current user.
+	User string
+
+	// KeyFile is the unencrypted private key authenticating the user,
+	// ~/.ssh/id_ed25519 or ~/.ssh/id_rsa is used if empty.
+	KeyFile string
+
+	// KnownHostsFile lists the host keys the server is verified against,
+	// ~/.ssh/known_hosts is used if empty.
+	KnownHostsFile string
+}
+
+// defaults fills in the user and the files of the current user.
+func (cfg *SFTPConfig) defaults() error {
+	if cfg.User != "" && cfg.KeyFile != "" && cfg.KnownHostsFile != "" {
+		return nil
+	}
+
+	u, uErr := user.Current()
+	if uErr != nil {
+		return fmt.Errorf("failed to determine current user: %v", uErr)
+	}
+
+	if cfg.User == "" {
+		cfg.User = u.Username
+	}
+
+	sshDir := filepath.Join(u.HomeDir, ".ssh")
+
+	if cfg.KeyFile == "" {
+		cfg.KeyFile = filepath.Join(sshDir, "id_ed25519")
+
+		if _, err := os.Stat(cfg.KeyFile); os.IsNotExist(err) {
+			cfg.KeyFile = filepath.Join(sshDir, "id_rsa")
+		}
+	}
+
+	if cfg.KnownHostsFile == "" {
+		cfg.KnownHostsFile = filepath.Join(sshDir, "known_hosts")
+	}
+
+	return nil
+}
+
+// SFTP stores files in a remote filesystem over SFTP, names are remote paths.
+type SFTP struct {
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTP connects to the SSH server and starts the SFTP session.
+func NewSFTP(cfg SFTPConfig) (*SFTP, error) {
+	dErr := cfg.defaults()
+	if dErr != nil {
+		return nil, dErr
+	}
+
+	keyData, keyErr := ioutil.ReadFile(cfg.KeyFile)
+	if keyErr != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", keyErr)
+	}
+
+	signer, signerErr := ssh.ParsePrivateKey(keyData)
+	if signerErr != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", signerErr)
+	}
+
+	hostKeyCallback, hkErr := knownhosts.New(cfg.KnownHostsFile)
+	if hkErr != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %v", hkErr)
+	}
+
+	addr := cfg.Addr
+	if _, _, splitErr := net.SplitHostPort(addr); splitErr != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	conn, connErr := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if connErr != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, connErr)
+	}
+
+	client, clientErr := sftp.NewClient(conn)
+	if clientErr != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %v", clientErr)
+	}
+
+	return &SFTP{
+		conn:   conn,
+		client: client,
+	}, nil
+}
+
+// List returns the regular files stored in dir.
+func (s *SFTP) List(ctx context.Context, dir string) ([]File, error) {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	files, filesErr := s.client.ReadDir(dir)
+	if filesErr != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: filesErr}
+	}
+
+	var res []File
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		res = append(res, File{
+			Name: f.Name(),
+			Size: f.Size(),
+		})
+	}
+
+	return res, nil
+}
+
+type sftpReader struct {
+	ctx context.Context
+	r   *bufio.Reader
+	f   *sftp.File
+}
+
+// Read stops once the context is done.
+func (r *sftpReader) Read(b []byte) (int, error) {
+	ctxErr := r.ctx.Err()
+	if ctxErr != nil {
+		return 0, ctxErr
+	}
+
+	return r.r.Read(b)
+}
+
+func (r *sftpReader) Close() error {
+	return r.f.Close()
+}
+
+// Open opens the remote file for reading.
+func (s *SFTP) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	f, fErr := s.client.Open(name)
+	if fErr != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fErr}
+	}
+
+	return &sftpReader{
+		ctx: ctx,
+		r:   bufio.NewReaderSize(f, sftpBufferSize),
+		f:   f,
+	}, nil
+}
+
+// Create writes the file to a hidden temporary file in the same directory,
+// which is created if needed, and replaces the file with it on Close. An
+// interrupted upload never leaves a partial file under the final name.
+func (s *SFTP) Create(ctx context.Context, name string) (Writer, error) {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	dir := path.Dir(name)
+
+	mkdirErr := s.client.MkdirAll(dir)
+	if mkdirErr != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dir, mkdirErr)
+	}
+
+	suffix := make([]byte, 8)
+
+	_, rErr := io.ReadFull(rand.Reader, suffix)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate temporary file name: %v", rErr)
+	}
+
+	tmpName := path.Join(dir, "."+path.Base(name)+".tmp-"+hex.EncodeToString(suffix))
+
+	f, fErr := s.client.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if fErr != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", tmpName, fErr)
+	}
+
+	return &sftpWriter{
+		ctx:     ctx,
+		w:       bufio.NewWriterSize(f, sftpBufferSize),
+		s:       s,
+		f:       f,
+		name:    name,
+		tmpName: tmpName,
+	}, nil
+}
+
+// Remove deletes the remote file.
+func (s *SFTP) Remove(ctx context.Context, name string) error {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	rmErr := s.client.Remove(name)
+	if rmErr != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: rmErr}
+	}
+
+	return nil
+}
+
+// Close ends the SFTP session.
+func (s *SFTP) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+type sftpWriter struct {
+	ctx     context.Context
+	w       *bufio.Writer
+	s       *SFTP
+	f       *sftp.File
+	name    string
+	tmpName string
+}
+
+// Write stops once the context is done.
+func (w *sftpWriter) Write(b []byte) (int, error) {
+	ctxErr := w.ctx.Err()
+	if ctxErr != nil {
+		return 0, ctxErr
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *sftpWriter) Close() error {
+	// The file isn't stored once the context is done.
+	flushErr := w.ctx.Err()
+	if flushErr == nil {
+		flushErr = w.w.Flush()
+	}
+
+	closeErr := w.f.Close()
+
+	if flushErr == nil {
+		flushErr = closeErr
+	}
+
+	if flushErr != nil {
+		w.s.client.Remove(w.tmpName)
+		return fmt.Errorf("failed to write %s: %v", w.name, flushErr)
+	}
+
+	mvErr := w.s.client.PosixRename(w.tmpName, w.name)
+	if mvErr != nil {
+		w.s.client.Remove(w.tmpName)
+		return fmt.Errorf("failed to replace %s: %v", w.name, mvErr)
+	}
+
+	return nil
+}
+
+func (w *sftpWriter) Abort() error {
+	w.f.Close()
+
+	rmErr := w.s.client.Remove(w.tmpName)
+	if rmErr != nil {
+		return fmt.Errorf("failed to remove %s: %v", w.tmpName, rmErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeTestKey writes a new private key file returning its signer.
+func writeTestKey(t *testing.T, path string) ssh.Signer {
+	_, key, gErr := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, gErr)
+
+	der, mErr := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, mErr)
+
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	signer, sErr := ssh.NewSignerFromKey(key)
+	require.NoError(t, sErr)
+
+	return signer
+}
+
+// serveSFTP runs an in-process SSH server accepting the authorized key and
+// serving SFTP sessions, it returns the server address.
+func serveSFTP(t *testing.T, hostKey ssh.Signer, authorized ssh.PublicKey) string {
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, ssh.ErrNoAuth
+		},
+	}
+
+	cfg.AddHostKey(hostKey)
+
+	l, lErr := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, lErr)
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			nc, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go serveSSHConn(nc, cfg)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveSSHConn(nc net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, connErr := ssh.NewServerConn(nc, cfg)
+	if connErr != nil {
+		nc.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		ch, chReqs, chErr := nch.Accept()
+		if chErr != nil {
+			continue
+		}
+
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+
+				if !ok {
+					continue
+				}
+
+				srv, srvErr := sftp.NewServer(ch)
+				if srvErr != nil {
+					ch.Close()
+					return
+				}
+
+				srv.Serve()
+				srv.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	dir := t.TempDir()
+
+	hostKey := writeTestKey(t, filepath.Join(dir, "host_key"))
+	clientKey := writeTestKey(t, filepath.Join(dir, "id_ed25519"))
+	otherKey := writeTestKey(t, filepath.Join(dir, "other_key"))
+
+	addr := serveSFTP(t, hostKey, clientKey.PublicKey())
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	require.NoError(t, ioutil.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey.PublicKey())+"\n"), 0644))
+
+	cfg := SFTPConfig{
+		Addr:           addr,
+		User:           "backup",
+		KeyFile:        filepath.Join(dir, "id_ed25519"),
+		KnownHostsFile: knownHosts,
+	}
+
+	s, sErr := NewSFTP(cfg)
+	require.NoError(t, sErr)
+
+	defer s.Close()
+
+	// The archive directory is created along with the first file.
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "remote"), 0755))
+
+	testBackend(t, s, filepath.Join(dir, "remote", "archive"))
+
+	_, lErr := s.List(context.Background(), filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(lErr), lErr)
+
+	// Temporary files are replaced on Close and removed on failure.
+	w, wErr := s.Create(context.Background(), filepath.Join(dir, "remote", "archive", "f.data"))
+	require.NoError(t, wErr)
+
+	_, wErr = w.Write(bytes.Repeat([]byte("x"), 3*sftpBufferSize))
+	require.NoError(t, wErr)
+
+	_, oErr := s.Open(context.Background(), filepath.Join(dir, "remote", "archive", "f.data"))
+	require.True(t, os.IsNotExist(oErr), oErr)
+
+	require.NoError(t, w.Close())
+	require.Equal(t, bytes.Repeat([]byte("x"), 3*sftpBufferSize), readTestFile(t, s, filepath.Join(dir, "remote", "archive", "f.data")))
+
+	require.Equal(t, []string{".header", "b c+d.data", "e.data", "f.data"}, listTestFiles(t, Local{}, filepath.Join(dir, "remote", "archive")))
+
+	// Unauthorized key.
+	_, sErr = NewSFTP(SFTPConfig{
+		Addr:           addr,
+		User:           "backup",
+		KeyFile:        filepath.Join(dir, "other_key"),
+		KnownHostsFile: knownHosts,
+	})
+	require.Error(t, sErr)
+
+	// Unknown host key.
+	require.NoError(t, ioutil.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, otherKey.PublicKey())+"\n"), 0644))
+
+	_, sErr = NewSFTP(cfg)
+	require.Error(t, sErr)
+	require.Contains(t, sErr.Error(), "key mismatch")
+}
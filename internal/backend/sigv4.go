@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4
+// (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html).
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+	scopeService  = "s3"
+	scopeRequest  = "aws4_request"
+)
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, the
+// slash is kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// canonicalQuery returns the query string sorted by keys and values.
+func canonicalQuery(query url.Values) string {
+	var params []string
+
+	for k, vv := range query {
+		for _, v := range vv {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// signedHeaders returns the sorted names of the headers covered by the
+// signature.
+func signedHeaders(header http.Header) []string {
+	res := []string{"host"}
+
+	for k := range header {
+		k = strings.ToLower(k)
+		if k == "range" || k == "content-type" || k == "content-md5" || strings.HasPrefix(k, "x-amz-") {
+			res = append(res, k)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+func canonicalRequest(method, path string, query url.Values, header http.Header, host string, signed []string, payloadHash string) string {
+	var headers strings.Builder
+
+	for _, k := range signed {
+		v := host
+		if k != "host" {
+			v = strings.Join(strings.Fields(strings.Join(header.Values(k), ",")), " ")
+		}
+
+		headers.WriteString(k + ":" + v + "\n")
+	}
+
+	return strings.Join([]string{
+		method,
+		uriEncode(path, false),
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func credentialScope(t time.Time, region string) string {
+	return strings.Join([]string{t.UTC().Format("20060102"), region, scopeService, scopeRequest}, "/")
+}
+
+// signature signs the canonical request with the key derived from the
+// secret key.
+func signature(secretKey, region string, t time.Time, canonical string) string {
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		t.UTC().Format(amzDateFormat),
+		credentialScope(t, region),
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.UTC().Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, scopeService)
+	key = hmacSHA256(key, scopeRequest)
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// signRequest adds the date, the payload hash and the authorization headers
+// to the request.
+func signRequest(req *http.Request, accessKey, secretKey, region, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.UTC().Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	signed := signedHeaders(req.Header)
+	canonical := canonicalRequest(req.Method, req.URL.Path, req.URL.Query(), req.Header, host, signed, payloadHash)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		signAlgorithm, accessKey, credentialScope(t, region), strings.Join(signed, ";"), signature(secretKey, region, t, canonical)))
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"flag"
 	"log"
+	"strings"
 
 	"github.com/alex-ant/envs"
 )
@@ -13,15 +14,59 @@ const (
 
 var (
 	EncryptionPassword = flag.String("p", "", "Encryption password")
+	Keyfile            = flag.String("k", "", "path to a keyfile used instead of or in addition to the password")
+	Recipients         = flag.String("recipients", "", "comma-separated list of X25519 public key files to encrypt to instead of the password")
+	NewPassword        = flag.String("new-password", "", "new password set by the passwd and addkey modes")
+	NewKeyfile         = flag.String("new-keyfile", "", "new keyfile set by the passwd and addkey modes")
+	Identity           = flag.String("identity", "", "X25519 private key file to decrypt with, generated along with the .pub public key file by the keygen mode")
 
-	SourceDir = flag.String("s", "", "Directory to encrypt")
-	OutputDir = flag.String("o", "", "Output directory")
+	SourceDir = flag.String("s", "", "Directory to encrypt, - reads a tar stream from stdin, s3://bucket/prefix or sftp://user@host/path reads the archive from remote storage")
+	OutputDir = flag.String("o", "", "Output directory (mount point of the mount mode), - writes the decrypted files to stdout as a tar stream, s3://bucket/prefix or sftp://user@host/path writes the archive to remote storage")
 
-	Mode = flag.String("m", "", "operation mode (encrypt/decrypt)")
+	Mode = flag.String("m", "", "operation mode (encrypt/decrypt/validate/verify/repair/salvage/list/keygen/passwd/addkey/removekey/export/import/export-zip/openssl-encrypt/openssl-decrypt/serve/mount)")
 
 	IgnoredFiles = flag.String("i", ".DS_Store", "comma-separated list of file base names to ignore during the validation")
 
+	Include       = flag.String("include", "", "comma-separated list of gitignore-style patterns of files to process, all files are processed if empty")
+	Exclude       = flag.String("exclude", "", "comma-separated list of gitignore-style patterns of files and directories to skip")
+	MinSize       = flag.Int64("min-size", 0, "skip files smaller than the given size in bytes if set")
+	MaxSize       = flag.Int64("max-size", 0, "skip files larger than the given size in bytes if set")
+	ExcludeCaches = flag.Bool("exclude-caches", false, "skip directories tagged with CACHEDIR.TAG")
+
+	ReportFormat = flag.String("report", "table", "validation, verification, salvage and list report format (table/json)")
+
+	ProgressFormat = flag.String("progress", "log", "progress format (log/bar/json), json writes newline-delimited progress events")
+	ProgressFile   = flag.String("progress-file", "", "file progress events are written to, stderr is used if empty")
+
+	ParityShards    = flag.Int("parity", 0, "number of Reed-Solomon parity files generated per parity group, parity is disabled if 0")
+	ParityGroupSize = flag.Int("parity-group", 10, "number of batch files per parity group")
+
+	ExportPath    = flag.String("export-path", "", "archive file written by the export mode, the whole archive is exported as a tar stream if empty")
+	AgeRecipients = flag.String("age-recipients", "", "comma-separated list of age1... recipients or files listing them to export to")
+	AgeIdentity   = flag.String("age-identity", "", "age identity file to import with")
+	AgePassphrase = flag.String("age-passphrase", "", "age passphrase to export or import with")
+
+	ZipPassword = flag.String("zip-password", "", "password of the ZIP file written by the export-zip mode")
+
+	OpenSSLIterations = flag.Int("openssl-iter", 10000, "PBKDF2 iteration count of the openssl-encrypt and openssl-decrypt modes, same as openssl enc -iter")
+
+	S3Endpoint  = flag.String("s3-endpoint", "", "URL of an S3-compatible service such as MinIO storing s3:// archives, AWS S3 is used if empty")
+	S3Region    = flag.String("s3-region", "us-east-1", "S3 region")
+	S3AccessKey = flag.String("s3-access-key", "", "S3 access key ID")
+	S3SecretKey = flag.String("s3-secret-key", "", "S3 secret access key")
+
+	SFTPKey        = flag.String("sftp-key", "", "private key file authenticating to the SSH server of sftp:// archives, ~/.ssh/id_ed25519 or ~/.ssh/id_rsa by default")
+	SFTPKnownHosts = flag.String("sftp-known-hosts", "", "known hosts file verifying the SSH server of sftp:// archives, ~/.ssh/known_hosts by default")
+
+	ServeAddr  = flag.String("serve-addr", "127.0.0.1:8080", "loopback address the serve mode listens on")
+	ServeToken = flag.String("serve-token", "", "access token of the serve mode, a random one is generated if empty")
+
+	MountCacheSize = flag.Int64("mount-cache", 64*1024*1024, "max number of decrypted bytes the mount mode keeps in memory (64Mb by default)")
+
 	MaxBatchSize = flag.Int64("b", batchSize200Mb, "Max encrypted batch file size in bytes (200Mb by default)")
+
+	VolumeSize = flag.Int64("v", 0, "Max volume directory size in bytes, batch files are grouped into volumes if set")
+	Volumes    = flag.String("volumes", "", "comma-separated list of volume directories to decrypt/validate")
 )
 
 func init() {
@@ -36,3 +81,16 @@ func init() {
 		log.Fatal(flagsErr)
 	}
 }
+
+// List splits the comma-separated list flag value.
+func List(s string) []string {
+	var res []string
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,201 @@
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+)
+
+const batchFileExt = ".data"
+
+// batchFile describes an encrypted batch file.
+type batchFile struct {
+	path   string
+	number int
+	size   int64
+}
+
+// parseBatchNumber returns the number of the batch file with the given name.
+func parseBatchNumber(name string) (int, error) {
+	if !strings.HasSuffix(name, batchFileExt) {
+		return 0, fmt.Errorf("%s is not a batch file", name)
+	}
+
+	n, nErr := strconv.Atoi(strings.TrimSuffix(name, batchFileExt))
+	if nErr != nil || n < 1 {
+		return 0, fmt.Errorf("invalid batch file name %s", name)
+	}
+
+	return n, nil
+}
+
+// listBatchFiles returns batch files stored in dir ordered by their numbers.
+func listBatchFiles(ctx context.Context, b backend.Backend, dir string) ([]batchFile, error) {
+	sFiles, sFilesErr := b.List(ctx, dir)
+	if sFilesErr != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %v", dir, sFilesErr)
+	}
+
+	var res []batchFile
+
+	for _, sf := range sFiles {
+		// Skip hidden files.
+		if sf.Name[:1] == "." {
+			continue
+		}
+
+		n, nErr := parseBatchNumber(sf.Name)
+		if nErr != nil {
+			return nil, fmt.Errorf("unexpected file in %s: %v", dir, nErr)
+		}
+
+		res = append(res, batchFile{
+			path:   path.Join(dir, sf.Name),
+			number: n,
+			size:   sf.Size,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].number < res[j].number
+	})
+
+	return res, nil
+}
+
+// forEachBatch calls handler for every batch file of the source archive in
+// order. The size of the batch files is set as the progress total if known.
+func (p *Processor) forEachBatch(ctx context.Context, pr *progress, handler func(bf batchFile) error) error {
+	vols, volsErr := p.sourceVolumes()
+	if volsErr != nil {
+		return fmt.Errorf("failed to list volumes: %v", volsErr)
+	}
+
+	// Check for cancellation before every batch.
+	checked := func(bf batchFile) error {
+		ctxErr := checkContext(ctx)
+		if ctxErr != nil {
+			return ctxErr
+		}
+
+		return handler(bf)
+	}
+
+	if len(vols) > 0 {
+		return p.forEachVolumeBatch(ctx, vols, pr, checked)
+	}
+
+	bFiles, bFilesErr := listBatchFiles(ctx, p.source, p.sourceDir)
+	if bFilesErr != nil {
+		return fmt.Errorf("failed to list source files directory: %v", bFilesErr)
+	}
+
+	var total int64
+	for _, bf := range bFiles {
+		total += bf.size
+	}
+
+	pr.setTotals(0, total)
+
+	for _, bf := range bFiles {
+		hErr := checked(bf)
+		if hErr != nil {
+			return hErr
+		}
+	}
+
+	return nil
+}
+
+// batchKey is the data key of the batch files numbered from first on and the
+// IV their IVs are derived from.
+type batchKey struct {
+	first int
+	key   string
+	iv    string
+}
+
+func newBatchKey(first int, key string) (batchKey, error) {
+	iv, ivErr := sha256Hash(key, 10)
+	if ivErr != nil {
+		return batchKey{}, fmt.Errorf("failed to determine IV: %v", ivErr)
+	}
+
+	return batchKey{
+		first: first,
+		key:   key,
+		iv:    formatIV(iv),
+	}, nil
+}
+
+// setKeys sets the keys of the batch files ordered by their first batch
+// numbers, new batch files and volume catalogs are encrypted with the last one.
+func (p *Processor) setKeys(keys []batchKey) {
+	p.keys = keys
+	p.encryptionKey = ""
+	p.iv = ""
+
+	if len(keys) > 0 {
+		p.encryptionKey = keys[len(keys)-1].key
+		p.iv = keys[len(keys)-1].iv
+	}
+
+	p.cachedIVFirst = 0
+	p.cachedIVNumber = 0
+	p.cachedIV = ""
+}
+
+// batchKey returns the key of the batch file with the given number.
+func (p *Processor) batchKey(number int) batchKey {
+	k := p.keys[0]
+
+	for _, bk := range p.keys[1:] {
+		if bk.first <= number {
+			k = bk
+		}
+	}
+
+	return k
+}
+
+// batchCipher is the key and the IV of a batch file.
+type batchCipher struct {
+	key string
+	iv  string
+}
+
+// batchCipher returns the key and the IV of the batch file with the given
+// number.
+func (p *Processor) batchCipher(number int) (batchCipher, error) {
+	if number < 1 {
+		return batchCipher{}, errors.New("invalid batch number provided")
+	}
+
+	k := p.batchKey(number)
+
+	// Start over if the requested batch precedes the cached one or its IV is
+	// derived from another key.
+	if number < p.cachedIVNumber || k.first != p.cachedIVFirst {
+		p.cachedIVFirst = k.first
+		p.cachedIVNumber = k.first - 1
+		p.cachedIV = k.iv
+	}
+
+	for p.cachedIVNumber < number {
+		next, nextErr := nextIV(p.cachedIV)
+		if nextErr != nil {
+			return batchCipher{}, fmt.Errorf("failed to generate next IV: %v", nextErr)
+		}
+
+		p.cachedIV = next
+		p.cachedIVNumber++
+	}
+
+	return batchCipher{key: k.key, iv: p.cachedIV}, nil
+}
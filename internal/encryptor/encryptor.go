@@ -1,31 +1,149 @@
 package encryptor
 
 import (
-	"bufio"
-	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strconv"
-	"strings"
-	"time"
 
-	"github.com/alex-ant/directory-encryptor/internal/aes256/cbc"
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/alex-ant/directory-encryptor/internal/filter"
+	"github.com/alex-ant/directory-encryptor/internal/openssl"
 )
 
 const (
 	sourceFileReadChunkSize int = 100 * 1024 * 1024
+
+	// stdioPath as the source or the output directory stands for a tar
+	// stream read from stdin or written to stdout.
+	stdioPath = "-"
+
+	// DefaultMountCacheSize is the max number of decrypted bytes Mount keeps
+	// in memory unless configured.
+	DefaultMountCacheSize int64 = 64 * 1024 * 1024
 )
 
+// Config contains encryptor processor configuration.
+type Config struct {
+	// MaxBatchSize is the max encrypted batch file size in bytes.
+	MaxBatchSize int64
+
+	SourceDir string
+	OutputDir string
+
+	Password string
+
+	// Keyfile is the path to a file which contents contribute to the
+	// encryption key instead of or in addition to the password.
+	Keyfile string
+
+	// Recipients is the list of X25519 public key files, the archive is
+	// encrypted with a random data key wrapped to each of them.
+	Recipients []string
+
+	// Identity is the X25519 private key file used to decrypt archives
+	// encrypted to recipients.
+	Identity string
+
+	// NewPassword and NewKeyfile unlock the key slot written by Passwd
+	// and AddKey.
+	NewPassword string
+	NewKeyfile  string
+
+	// IgnoredFiles is the list of file base names to ignore during the
+	// validation.
+	IgnoredFiles []string
+
+	// VolumeSize enables grouping batch files into volume directories of at
+	// most VolumeSize bytes each when positive.
+	VolumeSize int64
+
+	// Volumes is the list of volume directories to read batch files from.
+	Volumes []string
+
+	// Include and Exclude are the lists of gitignore-style patterns
+	// selecting files to process.
+	Include []string
+	Exclude []string
+
+	// MinSize and MaxSize exclude files outside of the size range when positive.
+	MinSize int64
+	MaxSize int64
+
+	// ExcludeCaches excludes directories tagged with CACHEDIR.TAG.
+	ExcludeCaches bool
+
+	// ParityShards enables generating the given number of Reed-Solomon parity
+	// files per group of ParityGroupSize batch files when positive.
+	ParityShards    int
+	ParityGroupSize int
+
+	// ExportPath is the archive file written by Export, the whole archive
+	// is exported as a tar stream if empty.
+	ExportPath string
+
+	// AgeRecipients is the list of age1... recipients or files listing
+	// them, Export encrypts to them and to AgePassphrase.
+	AgeRecipients []string
+
+	// AgeIdentity is the age identity file used by Import along with
+	// AgePassphrase.
+	AgeIdentity   string
+	AgePassphrase string
+
+	// ZipPassword is the password of the ZIP file written by ExportZip.
+	ZipPassword string
+
+	// OpenSSLIterations is the PBKDF2 iteration count of OpenSSLEncrypt and
+	// OpenSSLDecrypt, the openssl enc default is used if not positive.
+	OpenSSLIterations int
+
+	// S3 storage of archives given as s3://bucket/prefix source or output
+	// locations, AWS S3 is used if the endpoint is empty.
+	S3Endpoint  string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// SFTPKey is the private key authenticating to the SSH server of
+	// sftp://user@host/path locations, SFTPKnownHosts lists its host key.
+	// Both default to the files in ~/.ssh.
+	SFTPKey        string
+	SFTPKnownHosts string
+
+	// ServeAddr is the loopback address Serve listens on, DefaultServeAddr
+	// is used if empty. ServeToken is the access token, a random one is
+	// generated if empty.
+	ServeAddr  string
+	ServeToken string
+
+	// MountCacheSize is the max number of decrypted bytes Mount keeps in
+	// memory, DefaultMountCacheSize is used if not positive.
+	MountCacheSize int64
+
+	// Stdin and Stdout are the tar streams and the exported archives are
+	// read from and written to, os.Stdin and os.Stdout are used if nil.
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	// SourceFS is the file tree Encrypt reads instead of the source
+	// directory, e.g. an in-memory tree or the contents of a ZIP file.
+	SourceFS fs.FS
+
+	// OnProgress is called with the state of the operation as it's
+	// processed instead of logging the percentage done.
+	OnProgress func(Progress)
+}
+
 // Processor contains encryptor processor data.
 type Processor struct {
 	maxBatchSize int64
@@ -33,67 +151,231 @@ type Processor struct {
 	sourceDir string
 	outputDir string
 
+	// Read by Encrypt instead of the source directory if set.
+	sourceFS fs.FS
+
+	// Storage of the source and the output directories, the directories of
+	// object storage are key prefixes within the bucket and remote paths of
+	// SSH servers.
+	source backend.Backend
+	output backend.Backend
+
 	ignoredFiles []string
 
+	volumeSize int64
+	volumes    []string
+
+	rules *filter.Rules
+
+	parityShards    int
+	parityGroupSize int
+
+	exportPath       string
+	stdin            io.Reader
+	stdout           io.Writer
+	ageRecipientList []string
+	ageIdentity      string
+	agePassphrase    string
+
+	zipPassword string
+
+	opensslIterations int
+
+	serveAddr  string
+	serveToken string
+
+	mountCacheSize int64
+
+	onProgress func(Progress)
+
+	// promptVolume is called to ask for the path of a volume which wasn't
+	// found among the known ones.
+	promptVolume func(volume, total int) (string, error)
+
+	password   string
+	keyfile    string
+	recipients []string
+	identity   string
+
+	newPassword string
+	newKeyfile  string
+
+	// Set by unlock, the encryption key and the IV are the ones of the last
+	// batch key.
+	header        *header
+	slot          int
+	keys          []batchKey
 	encryptionKey string
 	iv            string
+
+	// Last calculated batch IV used to speed up subsequent calculations, the
+	// first batch number of its key identifies the key.
+	cachedIVFirst  int
+	cachedIVNumber int
+	cachedIV       string
 }
 
 // New returns new Processor.
-func New(maxBatchSize int64, sourceDir, outputDir string, password, ignoredFiles string) (*Processor, error) {
-	if password == "" {
-		return nil, errors.New("empty password provided")
+func New(cfg Config) (*Processor, error) {
+	if cfg.ParityShards < 0 || (cfg.ParityShards > 0 && cfg.ParityGroupSize < 1) || cfg.ParityShards+cfg.ParityGroupSize > 256 {
+		return nil, fmt.Errorf("invalid parity configuration, %d parity files per %d batch files", cfg.ParityShards, cfg.ParityGroupSize)
 	}
 
-	if outputDir == "" {
-		return nil, errors.New("empty outputDir provided")
+	if cfg.VolumeSize < 0 {
+		return nil, fmt.Errorf("invalid volume size %d", cfg.VolumeSize)
 	}
 
-	// Generate encryption key.
-	encryptionKey, encryptionKeyErr := sha256Hash(password, 10)
-	if encryptionKeyErr != nil {
-		return nil, fmt.Errorf("failed to generate encryption key from password: %v", encryptionKeyErr)
+	source, sourceDir, sourceErr := cfg.openStorage(cfg.SourceDir)
+	if sourceErr != nil {
+		return nil, sourceErr
 	}
 
-	encryptionKey = encryptionKey[:32]
+	output, outputDir, outputErr := cfg.openStorage(cfg.OutputDir)
+	if outputErr != nil {
+		closeStorage(source)
+		return nil, outputErr
+	}
+
+	// Storage connections are closed unless the processor is returned.
+	var initialized bool
+	defer func() {
+		if !initialized {
+			closeStorage(source)
+			closeStorage(output)
+		}
+	}()
+
+	if !isLocal(output) && (cfg.VolumeSize > 0 || cfg.ParityShards > 0) {
+		return nil, errors.New("volumes and parity files can't be written to remote storage")
+	}
 
 	// Trim output path.
-	if outputDir[len(outputDir)-1] == '/' {
+	if len(outputDir) > 1 && outputDir[len(outputDir)-1] == '/' {
 		outputDir = outputDir[:len(outputDir)-1]
 	}
 
-	// Create output directory if one doesn't exist.
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		mkdirErr := os.Mkdir(outputDir, 0755)
-		if mkdirErr != nil {
-			return nil, fmt.Errorf("failed to create output directory: %v", mkdirErr)
+	// Create output directory if one doesn't exist, it's not used for verification
+	// or when writing to stdout.
+	if outputDir != "" && outputDir != stdioPath && isLocal(output) {
+		if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+			mkdirErr := os.Mkdir(outputDir, 0755)
+			if mkdirErr != nil {
+				return nil, fmt.Errorf("failed to create output directory: %v", mkdirErr)
+			}
 		}
 	}
 
-	// Check if source directory exists.
-	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
-		return nil, fmt.Errorf("source directory %s doesn't exist", sourceDir)
+	if !isLocal(source) && len(cfg.Volumes) > 0 {
+		return nil, errors.New("volumes can't be read along with remote sources")
+	}
+
+	// Check if source directory exists, it may be omitted if volumes are listed explicitly.
+	if (cfg.SourceDir != "" || len(cfg.Volumes) == 0) && cfg.SourceDir != stdioPath && cfg.SourceFS == nil && isLocal(source) {
+		if _, err := os.Stat(cfg.SourceDir); os.IsNotExist(err) {
+			return nil, fmt.Errorf("source directory %s doesn't exist", cfg.SourceDir)
+		}
+	}
+
+	// Parse filter rules.
+	rules, rulesErr := filter.New(cfg.Include, cfg.Exclude, cfg.MinSize, cfg.MaxSize, cfg.ExcludeCaches)
+	if rulesErr != nil {
+		return nil, fmt.Errorf("failed to parse filter rules: %v", rulesErr)
+	}
+
+	opensslIterations := cfg.OpenSSLIterations
+	if opensslIterations <= 0 {
+		opensslIterations = openssl.DefaultIterations
+	}
+
+	serveAddr := cfg.ServeAddr
+	if serveAddr == "" {
+		serveAddr = DefaultServeAddr
 	}
 
-	// Deternime IV.
-	iv, ivErr := sha256Hash(encryptionKey, 10)
-	if ivErr != nil {
-		return nil, fmt.Errorf("failed to determine IV: %v", ivErr)
+	mountCacheSize := cfg.MountCacheSize
+	if mountCacheSize <= 0 {
+		mountCacheSize = DefaultMountCacheSize
 	}
 
-	iv = formatIV(iv)
+	var stdin io.Reader = os.Stdin
+	if cfg.Stdin != nil {
+		stdin = cfg.Stdin
+	}
+
+	var stdout io.Writer = os.Stdout
+	if cfg.Stdout != nil {
+		stdout = cfg.Stdout
+	}
 
-	return &Processor{
-		maxBatchSize: maxBatchSize,
+	p := &Processor{
+		maxBatchSize: cfg.MaxBatchSize,
 
 		sourceDir: sourceDir,
 		outputDir: outputDir,
+		sourceFS:  cfg.SourceFS,
+
+		source: source,
+		output: output,
+
+		ignoredFiles: cfg.IgnoredFiles,
+
+		volumeSize: cfg.VolumeSize,
+		volumes:    cfg.Volumes,
+
+		rules: rules,
+
+		parityShards:    cfg.ParityShards,
+		parityGroupSize: cfg.ParityGroupSize,
+
+		exportPath:       cfg.ExportPath,
+		stdin:            stdin,
+		stdout:           stdout,
+		ageRecipientList: cfg.AgeRecipients,
+		ageIdentity:      cfg.AgeIdentity,
+		agePassphrase:    cfg.AgePassphrase,
+
+		zipPassword: cfg.ZipPassword,
+
+		opensslIterations: opensslIterations,
+
+		serveAddr:  serveAddr,
+		serveToken: cfg.ServeToken,
+
+		mountCacheSize: mountCacheSize,
+
+		onProgress: cfg.OnProgress,
+
+		promptVolume: promptVolumeStdin,
+
+		password:   cfg.Password,
+		keyfile:    cfg.Keyfile,
+		recipients: cfg.Recipients,
+		identity:   cfg.Identity,
+
+		newPassword: cfg.NewPassword,
+		newKeyfile:  cfg.NewKeyfile,
+	}
 
-		ignoredFiles: strings.Split(ignoredFiles, ","),
+	initialized = true
 
-		encryptionKey: encryptionKey,
-		iv:            iv,
-	}, nil
+	return p, nil
+}
+
+// Close closes the connections to the remote storage of the source and the
+// output directories.
+func (p *Processor) Close() error {
+	sErr := closeStorage(p.source)
+	if sErr != nil {
+		closeStorage(p.output)
+		return fmt.Errorf("failed to close source storage: %v", sErr)
+	}
+
+	oErr := closeStorage(p.output)
+	if oErr != nil {
+		return fmt.Errorf("failed to close output storage: %v", oErr)
+	}
+
+	return nil
 }
 
 type filetype int
@@ -101,12 +383,48 @@ type filetype int
 const (
 	FILE filetype = iota
 	DIRECTORY
+	CHECKSUM
 )
 
 type fileInfo struct {
 	RelativePath string   `json:"p"`
 	Filetype     filetype `json:"t"`
-	size         int64
+	Offset       int64    `json:"o,omitempty"`
+	Size         int64    `json:"s,omitempty"`
+	Cache        bool     `json:"c,omitempty"`
+
+	// SHA-256 checksum of the file part, stored in a checksum record
+	// following the file data.
+	Checksum string `json:"h,omitempty"`
+
+	// Metadata preserved from tar sources.
+	Mode    int64  `json:"m,omitempty"`
+	ModTime int64  `json:"mt,omitempty"`
+	UID     int    `json:"u,omitempty"`
+	GID     int    `json:"g,omitempty"`
+	Uname   string `json:"un,omitempty"`
+	Gname   string `json:"gn,omitempty"`
+
+	// Size of the file part stored in the batch.
+	size int64
+}
+
+// part returns a copy of the file metadata describing size bytes of the file
+// starting at offset.
+func (fi *fileInfo) part(offset, size int64) *fileInfo {
+	return &fileInfo{
+		RelativePath: fi.RelativePath,
+		Filetype:     fi.Filetype,
+		Offset:       offset,
+		Size:         fi.Size,
+		Mode:         fi.Mode,
+		ModTime:      fi.ModTime,
+		UID:          fi.UID,
+		GID:          fi.GID,
+		Uname:        fi.Uname,
+		Gname:        fi.Gname,
+		size:         size,
+	}
 }
 
 func (p *Processor) ignoreFile(path string) bool {
@@ -118,270 +436,224 @@ func (p *Processor) ignoreFile(path string) bool {
 	return false
 }
 
-func (p *Processor) Encrypt() error {
-	files := []*fileInfo{}
-
-	// Define size stat counters.
-	var totalBytes, writtenMD, writtenFiledata int64
-
-	// List files to encrypt.
-	walkErr := filepath.Walk(
-		p.sourceDir,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// Trim path.
-			if path[len(path)-1] == '/' {
-				path = path[:len(path)-1]
-			}
-
-			path = path[len(p.sourceDir):]
-
-			if len(path) == 0 {
-				return nil
-			}
-
-			if path[0] == '/' {
-				path = path[1:]
-			}
-
-			// Populate file metadata.
-			ft := FILE
-			var size int64
-
-			if info.IsDir() {
-				ft = DIRECTORY
-			} else {
-				// Track only file sizes.
-				size = info.Size()
-			}
-
-			// Validate filesize.
-			if ft == FILE && size == 0 {
-				log.Printf("empty file detected, ignoring: %s", path)
-				return nil
-			}
-
-			files = append(files, &fileInfo{
-				RelativePath: path,
-				Filetype:     ft,
-				size:         size,
-			})
-
-			totalBytes += size
+// errEmptyOutputDir is returned by operations requiring the output directory.
+var errEmptyOutputDir = errors.New("empty outputDir provided")
 
-			return nil
-		})
-	if walkErr != nil {
-		return fmt.Errorf("failed to get contents of %s: %v", p.sourceDir, walkErr)
+// prepareEncrypt unlocks the output archive for writing.
+func (p *Processor) prepareEncrypt(ctx context.Context) error {
+	if p.outputDir == "" {
+		return errEmptyOutputDir
 	}
 
-	log.Printf("processing %d files, %d bytes", len(files), totalBytes)
+	if p.outputDir == stdioPath {
+		return errors.New("archives can't be written to stdout")
+	}
 
-	// Generate metadata batches.
-	batches := [][]*fileInfo{}
+	unlockErr := p.unlock(ctx, p.outputDir, true)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
 
-	var currentBatchSize int64
+	if p.maxBatchSize <= 0 {
+		return fmt.Errorf("invalid max batch size %d", p.maxBatchSize)
+	}
 
-	currBatch := []*fileInfo{}
-	for _, f := range files {
-		if f.size > p.maxBatchSize {
-			// Store large files in a single batch.
-			if len(currBatch) > 0 {
-				batches = append(batches, currBatch)
-				currBatch = []*fileInfo{}
-				currentBatchSize = 0
-			}
+	return nil
+}
 
-			batches = append(batches, []*fileInfo{f})
+func (p *Processor) Encrypt(ctx context.Context) error {
+	prepErr := p.prepareEncrypt(ctx)
+	if prepErr != nil {
+		return prepErr
+	}
 
-			continue
+	fsys := p.sourceFS
+	if fsys == nil {
+		if p.sourceDir == stdioPath {
+			return p.encryptTar(ctx, p.stdin)
 		}
 
-		if currentBatchSize+f.size > p.maxBatchSize {
-			batches = append(batches, currBatch)
-			currBatch = []*fileInfo{}
-			currentBatchSize = 0
+		localErr := requireLocal(p.source, "source directory")
+		if localErr != nil {
+			return localErr
 		}
 
-		currBatch = append(currBatch, f)
-		currentBatchSize += f.size
+		fsys = os.DirFS(p.sourceDir)
 	}
 
-	if len(currBatch) > 0 {
-		batches = append(batches, currBatch)
-	}
+	files := []*fileInfo{}
 
-	// Write result file.
-	var bytesProcessed int64
-	var progressPerc int
-	batchStart := time.Now()
+	var totalFiles, totalBytes int64
 
-	var initShift int
-	var initErr error
-	p.iv, initShift, initErr = p.encryptionInits()
-	if initErr != nil {
-		return fmt.Errorf("failed to calculate inits: %v", initErr)
+	ff, ffErr := p.newFileFilter(fsys)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
 	}
 
-	for batchI, batch := range batches {
-		// Update IV.
-		var pIVErr error
-		p.iv, pIVErr = nextIV(p.iv)
-		if pIVErr != nil {
-			return fmt.Errorf("failed to generate next IV: %v", pIVErr)
+	// List files to encrypt.
+	walkErr := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
 
-		// Open batch result file.
-		fnStr, fnStrErr := fileNumber(batchI+1+initShift, 32)
-		if fnStrErr != nil {
-			return fmt.Errorf("failed to generate file number string: %v", fnStrErr)
+		ctxErr := checkContext(ctx)
+		if ctxErr != nil {
+			return ctxErr
 		}
 
-		resF, resFErr := os.OpenFile(fmt.Sprintf("%s/%s.data", p.outputDir, fnStr), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
-		if resFErr != nil {
-			return fmt.Errorf("failed to open result file: %v", resFErr)
+		if name == "." {
+			return nil
 		}
 
-		// Greate GZip writer.
-		gzipResFW := gzip.NewWriter(resF)
-		gzipResFWBuf := bufio.NewWriter(gzipResFW)
-
-		for _, f := range batch {
-			// Marshall and encrypt metadata.
-			fb, fbErr := json.Marshal(*f)
-			if fbErr != nil {
-				return fmt.Errorf("failed to marshall metadata: %v", fbErr)
-			}
-
-			encFb, encFbErr := cbc.Encrypt(fb, p.encryptionKey, p.iv)
-			if encFbErr != nil {
-				return fmt.Errorf("failed to encrypt metadata: %v", encFbErr)
-			}
+		// Populate file metadata.
+		ft := FILE
+		var size int64
 
-			// Write metadata.
-			_, mdWErr := gzipResFWBuf.Write(encFb)
-			if mdWErr != nil {
-				return fmt.Errorf("failed to write metadata: %v", mdWErr)
+		if d.IsDir() {
+			ft = DIRECTORY
+		} else {
+			info, infoErr := d.Info()
+			if infoErr != nil {
+				return infoErr
 			}
 
-			writtenMD += int64(len(encFb))
-
-			// Write data delimiters.
-			switch f.Filetype {
-			case DIRECTORY:
-				_, wErr := gzipResFWBuf.Write([]byte("$"))
-				if wErr != nil {
-					return fmt.Errorf("failed to write metadata delimiter: %v", wErr)
-				}
-
-				writtenMD += 1
+			// Track only file sizes.
+			size = info.Size()
+		}
 
-				// No file data to write, move to next file.
-				continue
+		// Validate filesize.
+		if ft == FILE && size == 0 {
+			log.Printf("empty file detected, ignoring: %s", name)
+			return nil
+		}
 
-			case FILE:
-				_, wErr := gzipResFWBuf.Write([]byte("?"))
-				if wErr != nil {
-					return fmt.Errorf("failed to write file data delimiter: %v", wErr)
-				}
+		fi := &fileInfo{
+			RelativePath: name,
+			Filetype:     ft,
+			Size:         size,
+			Cache:        ft == DIRECTORY && isCacheDir(fsys, name),
+			size:         size,
+		}
 
-				writtenMD += 1
+		// Apply filter rules.
+		excluded, exErr := ff.excluded(fi)
+		if exErr != nil {
+			return fmt.Errorf("failed to apply filter rules: %v", exErr)
+		}
 
-			default:
-				return fmt.Errorf("invalid filetype in metadata: %v", f.Filetype)
+		if excluded {
+			if ft == DIRECTORY {
+				return fs.SkipDir
 			}
 
-			// Read file contents.
-			var chunkI int
-			readErr := readFileInChunks(path.Join(p.sourceDir, f.RelativePath), func(data []byte) error {
-				if chunkI > 0 {
-					_, wErr := gzipResFWBuf.Write([]byte("?"))
-					if wErr != nil {
-						return fmt.Errorf("failed to write metadata delimiter: %v", wErr)
-					}
-
-					writtenMD += 1
-				}
+			return nil
+		}
 
-				// Encrypt and write file contents.
-				encData, encDataErr := cbc.Encrypt(data, p.encryptionKey, p.iv)
-				if encDataErr != nil {
-					return fmt.Errorf("failed to encrypt file data: %v", encDataErr)
-				}
+		files = append(files, fi)
 
-				_, wErr := gzipResFWBuf.Write(encData)
-				if wErr != nil {
-					return fmt.Errorf("failed to write file data: %v", wErr)
-				}
+		if ft == FILE {
+			totalFiles++
+			totalBytes += size
+		}
 
-				writtenFiledata += int64(len(encData))
-				bytesProcessed += int64(len(data))
+		return nil
+	})
+	if walkErr != nil {
+		return fmt.Errorf("failed to list source files: %w", walkErr)
+	}
 
-				// Print progress.
-				currentPerc := int(bytesProcessed * 100 / totalBytes)
-				if currentPerc != progressPerc {
-					progressPerc = currentPerc
-					elapsedMs := time.Now().UnixMilli() - batchStart.UnixMilli()
-					eta := time.Duration(time.Millisecond * time.Duration(int64(elapsedMs)*100/int64(currentPerc)-elapsedMs))
+	log.Printf("processing %d files, %d bytes", len(files), totalBytes)
 
-					log.Printf("%d%%, ETA %s", currentPerc, eta.String())
-				}
+	bw, bwErr := p.newBatchWriter(ctx, totalFiles, totalBytes)
+	if bwErr != nil {
+		return bwErr
+	}
 
-				chunkI++
+	for _, f := range files {
+		var wErr error
 
-				return nil
-			})
-			if readErr != nil {
-				return fmt.Errorf("failed to read file contents: %v", readErr)
-			}
+		switch f.Filetype {
+		case DIRECTORY:
+			wErr = bw.writeDirectory(f)
 
-			_, wErr := gzipResFWBuf.Write([]byte("$"))
-			if wErr != nil {
-				return fmt.Errorf("failed to write metadata delimiter: %v", wErr)
-			}
+		case FILE:
+			wErr = encryptFile(bw, fsys, f)
+		}
 
-			writtenMD += 1
+		if wErr != nil {
+			return bw.fail(wErr)
 		}
+	}
+
+	return bw.finish()
+}
 
-		// Close result file.
-		gzipResFWBuf.Flush()
-		gzipResFW.Close()
-		resF.Close()
+// encryptFile writes the contents of the file of the source tree.
+func encryptFile(bw *batchWriter, fsys fs.FS, fi *fileInfo) error {
+	f, fErr := fsys.Open(fi.RelativePath)
+	if fErr != nil {
+		return fmt.Errorf("failed to open file %s: %v", fi.RelativePath, fErr)
 	}
 
-	log.Printf("encrypted %d bytes of metadata and %d bytes of filedata", writtenMD, writtenFiledata)
+	defer f.Close()
 
-	return nil
+	return bw.writeFile(fi, f)
 }
 
-func (p *Processor) encryptionInits() (string, int, error) {
+func (p *Processor) encryptionInits(ctx context.Context) (string, int, error) {
 	// List encrypted files.
-	sFiles, sFilesErr := ioutil.ReadDir(p.outputDir)
-	if sFilesErr != nil || len(sFiles) == 0 {
-		return p.iv, 0, nil
+	sFiles, sFilesErr := p.output.List(ctx, p.outputDir)
+	if sFilesErr != nil {
+		if isNotExist(sFilesErr) {
+			return p.iv, 0, nil
+		}
+
+		return "", 0, fmt.Errorf("failed to list output directory: %v", sFilesErr)
 	}
 
 	var count int
 
 	for _, sf := range sFiles {
-		if sf.IsDir() {
-			continue
-		}
-
 		// Skip hidden files.
-		if sf.Name()[:1] == "." {
+		if sf.Name[:1] == "." {
 			continue
 		}
 
 		count++
 	}
 
+	// Count batch files stored in volumes.
+	var vols []string
+	if isLocal(p.output) {
+		var volsErr error
+		vols, volsErr = listVolumes(p.outputDir)
+		if volsErr != nil {
+			return "", 0, fmt.Errorf("failed to list volumes: %v", volsErr)
+		}
+	}
+
+	for _, vol := range vols {
+		vFiles, vFilesErr := listBatchFiles(ctx, backend.Local{}, vol)
+		if vFilesErr != nil {
+			return "", 0, fmt.Errorf("failed to list volume %s: %v", vol, vFilesErr)
+		}
+
+		count += len(vFiles)
+	}
+
+	// Batch files appended to recipients archives get a new data key.
+	if len(p.keys) == 0 {
+		akErr := p.addAppendKey(ctx, count+1)
+		if akErr != nil {
+			return "", 0, akErr
+		}
+	}
+
 	// Determine shifted IV.
-	newIV := p.iv
-	for i := 0; i < count; i++ {
+	last := p.keys[len(p.keys)-1]
+
+	newIV := last.iv
+	for i := last.first - 1; i < count; i++ {
 		var pIVErr error
 		newIV, pIVErr = nextIV(newIV)
 		if pIVErr != nil {
@@ -391,505 +663,273 @@ func (p *Processor) encryptionInits() (string, int, error) {
 	return newIV, count, nil
 }
 
-func (p *Processor) Decrypt() error {
-	// List encrypted files.
-	var sFilenames []string
-
-	sFiles, sFilesErr := ioutil.ReadDir(p.sourceDir)
-	if sFilesErr != nil {
-		return fmt.Errorf("failed to list source files directory: %v", sFilesErr)
+func (p *Processor) Decrypt(ctx context.Context) error {
+	if p.outputDir == stdioPath {
+		return p.decryptTar(ctx)
 	}
 
-	for _, sf := range sFiles {
-		if sf.IsDir() {
-			continue
-		}
-
-		// Skip hidden files.
-		if sf.Name()[:1] == "." {
-			continue
-		}
+	return p.restore(ctx, nil)
+}
 
-		sFilenames = append(sFilenames, sf.Name())
+// restore decrypts the files into the output directory. If the report is
+// provided, damaged records are skipped and reported instead of aborting.
+func (p *Processor) restore(ctx context.Context, report *SalvageReport) error {
+	if p.outputDir == "" {
+		return errEmptyOutputDir
 	}
 
-	sort.Strings(sFilenames)
-
-	var progressPerc int
-	batchStart := time.Now()
+	if p.outputDir == stdioPath {
+		return errors.New("files can't be restored to stdout")
+	}
 
-	// Loop over encrypted files.
-	for sfnI, sfn := range sFilenames {
-		// Update IV.
-		var pIVErr error
-		p.iv, pIVErr = nextIV(p.iv)
-		if pIVErr != nil {
-			return fmt.Errorf("failed to generate next IV: %v", pIVErr)
-		}
+	localErr := requireLocal(p.output, "output directory")
+	if localErr != nil {
+		return localErr
+	}
 
-		// Read file.
-		fPath := path.Join(p.sourceDir, sfn)
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
 
-		encGzipF, encGzipFErr := os.Open(fPath)
-		if encGzipFErr != nil {
-			return fmt.Errorf("failed to open file %s: %v", fPath, encGzipFErr)
-		}
+	salvage := newSalvageState(report)
 
-		encF, encFErr := gzip.NewReader(encGzipF)
-		if encFErr != nil {
-			return fmt.Errorf("failed to init gzip reader on file %s: %v", fPath, encFErr)
-		}
+	pr := p.newProgress()
 
-		br := bufio.NewReader(encF)
+	// Only the configured rules apply, ignore files left in the output
+	// directory don't select the files restored.
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
 
-		var currSectorData []byte
-		var currFile *os.File
-		var currFilename string
-		var mdRead bool
+	// Define checksum stat counters.
+	var restoredParts, verifiedParts int
+	var mismatches []string
 
-		resetState := func() {
-			currSectorData = []byte{}
-			mdRead = false
+	// The file which parts aren't all restored yet, removed on cancellation.
+	var incomplete string
 
-			if currFile != nil {
-				currFile.Close()
-				currFile = nil
-			}
+	// The file being restored and the number of its bytes restored so far,
+	// missing parts leave it shorter than its size.
+	var restoredPath string
+	var restoredSize, restoredBytes int64
+	var incompleteFiles []string
 
-			currFilename = ""
+	checkRestored := func() {
+		if report == nil && restoredPath != "" && restoredSize > 0 && restoredBytes != restoredSize {
+			log.Printf("file %s is incomplete, %d of %d bytes restored", restoredPath, restoredBytes, restoredSize)
+			incompleteFiles = append(incompleteFiles, restoredPath)
 		}
 
-		decryptMD := func() (*fileInfo, error) {
-			// Decrypt metadata.
-			decMD, decMDErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-			if decMDErr != nil {
-				return nil, fmt.Errorf("failed to decrypt metadata (%v): %v", currSectorData, decMDErr)
-			}
-
-			// Unmarshal metadata.
-			var fi fileInfo
+		restoredPath = ""
+	}
 
-			fiErr := json.Unmarshal(decMD, &fi)
-			if fiErr != nil {
-				return nil, fmt.Errorf("failed to unmarshall metadata (%s): %v", string(decMD), fiErr)
-			}
+	// Loop over encrypted files.
+	iterErr := p.forEachBatch(ctx, pr, func(bf batchFile) error {
+		salvage.batch(bf)
 
-			return &fi, nil
+		// Determine batch key and IV.
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return fmt.Errorf("failed to determine batch key: %v", bcErr)
 		}
 
-		for {
-			b, bErr := br.ReadByte()
-			if bErr != nil {
-				if bErr != io.EOF {
-					return fmt.Errorf("failed to read file %s byte: %v", fPath, bErr)
+		var currFile *os.File
+		var currFilename string
+		var currHash hash.Hash
+		var currWritten int64
+		var lastChecksum string
+
+		h := recordHandler{
+			directory: func(fi *fileInfo) error {
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil {
+					return fmt.Errorf("failed to apply filter rules: %v", exErr)
 				}
 
-				break
-			}
-
-			switch string(b) {
-			case "$":
-				if !mdRead {
-					// Decrypt directory metadata.
-					fi, fiErr := decryptMD()
-					if fiErr != nil {
-						return fmt.Errorf("failed to decrypt directory metadata: %v", fiErr)
-					}
-
-					if fi.Filetype != DIRECTORY {
-						return fmt.Errorf("expected directory (%d) metadata but received (%d)", DIRECTORY, fi.Filetype)
-					}
-
-					// Create directory.
-					dirPath := path.Join(p.outputDir, fi.RelativePath)
-
-					mkdirErr := os.MkdirAll(dirPath, 0755)
-					if mkdirErr != nil {
-						return fmt.Errorf("failed to create directory %s", dirPath)
-					}
-
-					// Reset state.
-					resetState()
-
-					// Proceed reading next bytes.
-					continue
-
-				} else {
-					// Decrypt file part contents.
-					decFC, decFCErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-					if decFCErr != nil {
-						return fmt.Errorf("failed to decrypt file %s part contents (%v): %v", currFilename, currSectorData, decFCErr)
-					}
-
-					// Append to file.
-					_, decFCWErr := currFile.Write(decFC)
-					if decFCWErr != nil {
-						return fmt.Errorf("failed to write file part contents: %v", decFCWErr)
-					}
-
-					// Reset state.
-					resetState()
-
-					// Proceed reading next bytes.
-					continue
+				if excluded {
+					return nil
 				}
 
-			case "?":
-				// Process file metadata
-				if !mdRead {
-					// Decrypt file metadata.
-					fi, fiErr := decryptMD()
-					if fiErr != nil {
-						return fmt.Errorf("failed to decrypt file metadata: %v", fiErr)
-					}
+				// Create directory.
+				dirPath := path.Join(p.outputDir, fi.RelativePath)
 
-					if fi.Filetype != FILE {
-						return fmt.Errorf("expected file (%d) metadata but received (%d)", FILE, fi.Filetype)
-					}
-
-					fName := fmt.Sprintf("%s/%s", p.outputDir, fi.RelativePath)
-
-					// Create file directory if doesn't exist.
-					os.MkdirAll(filepath.Dir(fName), 0755)
-
-					// Create file.
-					decF, decFErr := os.OpenFile(fName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
-					if decFErr != nil {
-						return fmt.Errorf("failed to open decrypted file: %v", decFErr)
-					}
+				mkdirErr := os.MkdirAll(dirPath, 0755)
+				if mkdirErr != nil {
+					return fmt.Errorf("failed to create directory %s", dirPath)
+				}
 
-					// Store file pointer.
-					currFile = decF
-					currFilename = fName
+				return nil
+			},
 
-					mdRead = true
+			fileStart: func(fi *fileInfo) error {
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil {
+					return fmt.Errorf("failed to apply filter rules: %v", exErr)
+				}
 
-					currSectorData = []byte{}
+				if excluded {
+					return errSkipFile
+				}
 
-					// Continue with file contents in the following bytes.
-					continue
-				} else {
-					// Decrypt file part contents.
-					decFC, decFCErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-					if decFCErr != nil {
-						return fmt.Errorf("failed to decrypt file %s part contents (%v): %v", currFilename, currSectorData, decFCErr)
-					}
+				// Parts must follow each other, a missing part would leave a hole.
+				if report == nil && fi.Offset > 0 && (fi.RelativePath != restoredPath || fi.Offset != restoredBytes) {
+					return fmt.Errorf("file %s part at offset %d doesn't follow the preceding part", fi.RelativePath, fi.Offset)
+				}
 
-					// Append to file.
-					_, decFCWErr := currFile.Write(decFC)
-					if decFCWErr != nil {
-						return fmt.Errorf("failed to write file part contents: %v", decFCWErr)
-					}
+				fName := fmt.Sprintf("%s/%s", p.outputDir, fi.RelativePath)
 
-					currSectorData = []byte{}
+				// Create file directory if doesn't exist.
+				os.MkdirAll(filepath.Dir(fName), 0755)
 
-					// Continue with file contents in the following bytes.
-					continue
+				// Create file, truncating it unless a following part is being restored.
+				flags := os.O_WRONLY | os.O_CREATE
+				if fi.Offset == 0 {
+					flags |= os.O_TRUNC
+				}
 
+				decF, decFErr := os.OpenFile(fName, flags, 0755)
+				if decFErr != nil {
+					return fmt.Errorf("failed to open decrypted file: %v", decFErr)
 				}
-			}
 
-			currSectorData = append(currSectorData, b)
-		}
+				// Move to the part offset.
+				_, seekErr := decF.Seek(fi.Offset, io.SeekStart)
+				if seekErr != nil {
+					decF.Close()
+					return fmt.Errorf("failed to seek decrypted file %s to offset %d: %v", fName, fi.Offset, seekErr)
+				}
 
-		encF.Close()
-		encGzipF.Close()
+				// Check the preceding file once a new one starts.
+				if fi.Offset == 0 || fi.RelativePath != restoredPath {
+					checkRestored()
 
-		// Print progress.
-		currentPerc := sfnI * 100 / len(sFilenames)
-		if currentPerc != progressPerc {
-			progressPerc = currentPerc
-			elapsedMs := time.Now().UnixMilli() - batchStart.UnixMilli()
-			eta := time.Duration(time.Millisecond * time.Duration(int64(elapsedMs)*100/int64(currentPerc)-elapsedMs))
+					restoredPath = fi.RelativePath
+					restoredSize = fi.Size
+					restoredBytes = 0
+				}
 
-			log.Printf("%d%%, ETA %s", currentPerc, eta.String())
-		}
-	}
+				// Store file pointer.
+				currFile = decF
+				currFilename = fName
+				currHash = sha256.New()
+				currWritten = 0
+				incomplete = fName
 
-	if progressPerc != 100 {
-		log.Print("100%")
-	}
+				salvage.fileStart(fi)
 
-	return nil
-}
+				return nil
+			},
 
-func (p *Processor) Validate() error {
-	// List encrypted files.
-	var sFilenames []string
+			fileData: func(fi *fileInfo, data []byte) error {
+				// Append to file.
+				_, decFCWErr := currFile.Write(data)
+				if decFCWErr != nil {
+					return fmt.Errorf("failed to write file %s part contents: %v", currFilename, decFCWErr)
+				}
 
-	sFiles, sFilesErr := ioutil.ReadDir(p.sourceDir)
-	if sFilesErr != nil {
-		return fmt.Errorf("failed to list source files directory: %v", sFilesErr)
-	}
+				currHash.Write(data)
+				currWritten += int64(len(data))
+				restoredBytes += int64(len(data))
 
-	for _, sf := range sFiles {
-		if sf.IsDir() {
-			continue
-		}
+				salvage.fileData(fi, data)
 
-		// Skip hidden files.
-		if sf.Name()[:1] == "." {
-			continue
-		}
+				return nil
+			},
 
-		sFilenames = append(sFilenames, sf.Name())
-	}
+			fileEnd: func(fi *fileInfo) error {
+				closeErr := currFile.Close()
+				currFile = nil
+				if closeErr != nil {
+					return fmt.Errorf("failed to close decrypted file %s: %v", currFilename, closeErr)
+				}
 
-	sort.Strings(sFilenames)
+				lastChecksum = hex.EncodeToString(currHash.Sum(nil))
+				restoredParts++
 
-	var progressPerc int
-	batchStart := time.Now()
+				if fi.Offset+currWritten >= fi.Size {
+					incomplete = ""
+				}
 
-	// Loop over encrypted files.
-	for sfnI, sfn := range sFilenames {
-		// Update IV.
-		var pIVErr error
-		p.iv, pIVErr = nextIV(p.iv)
-		if pIVErr != nil {
-			return fmt.Errorf("failed to generate next IV: %v", pIVErr)
-		}
+				return nil
+			},
+
+			checksum: func(fi *fileInfo) error {
+				if fi.Checksum != lastChecksum {
+					log.Printf("checksum mismatch for file %s at offset %d", fi.RelativePath, fi.Offset)
+					mismatches = append(mismatches, fi.RelativePath)
+					salvage.damaged(bf.path, fi, fmt.Errorf("checksum mismatch for part at offset %d", fi.Offset))
+					return nil
+				}
 
-		// Read file.
-		fPath := path.Join(p.sourceDir, sfn)
+				verifiedParts++
 
-		encGzipF, encGzipFErr := os.Open(fPath)
-		if encGzipFErr != nil {
-			return fmt.Errorf("failed to open file %s: %v", fPath, encGzipFErr)
-		}
+				return nil
+			},
 
-		encF, encFErr := gzip.NewReader(encGzipF)
-		if encFErr != nil {
-			return fmt.Errorf("failed to init gzip reader on file %s: %v", fPath, encFErr)
+			progress: pr,
 		}
 
-		br := bufio.NewReader(encF)
-
-		var currSectorData []byte
-		var currFile *os.File
-		var currFileReader *bufio.Reader
-		var ignoreCurrentFile bool
-		var currFilename string
-		var mdRead bool
-
-		resetState := func() {
-			currSectorData = []byte{}
-			mdRead = false
-			ignoreCurrentFile = false
+		if report != nil {
+			h.salvage = func(fi *fileInfo, err error) {
+				// Keep the part restored so far.
+				if currFile != nil {
+					currFile.Close()
+					currFile = nil
+				}
 
-			if currFile != nil {
-				currFile.Close()
-				currFile = nil
+				salvage.damaged(bf.path, fi, err)
 			}
-
-			currFileReader = nil
-
-			currFilename = ""
 		}
 
-		decryptMD := func() (*fileInfo, error) {
-			// Decrypt metadata.
-			decMD, decMDErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-			if decMDErr != nil {
-				return nil, fmt.Errorf("failed to decrypt metadata (%v): %v", currSectorData, decMDErr)
-			}
+		readErr := p.readBatch(ctx, bf.path, bc, h)
 
-			// Unmarshal metadata.
-			var fi fileInfo
-
-			fiErr := json.Unmarshal(decMD, &fi)
-			if fiErr != nil {
-				return nil, fmt.Errorf("failed to unmarshall metadata (%s): %v", string(decMD), fiErr)
-			}
-
-			return &fi, nil
+		if currFile != nil {
+			currFile.Close()
 		}
 
-		for {
-			b, bErr := br.ReadByte()
-			if bErr != nil {
-				if bErr != io.EOF {
-					return fmt.Errorf("failed to read file %s byte: %v", fPath, bErr)
-				}
-
-				break
+		if readErr != nil {
+			if report == nil || errors.Is(readErr, ErrCanceled) {
+				return readErr
 			}
 
-			switch string(b) {
-			case "$":
-				if !mdRead {
-					// Decrypt directory metadata.
-					fi, fiErr := decryptMD()
-					if fiErr != nil {
-						return fmt.Errorf("failed to decrypt directory metadata: %v", fiErr)
-					}
-
-					if fi.Filetype != DIRECTORY {
-						return fmt.Errorf("expected directory (%d) metadata but received (%d)", DIRECTORY, fi.Filetype)
-					}
-
-					// Do nothing for directories.
-
-					// Reset state.
-					resetState()
-
-					// Proceed reading next bytes.
-					continue
-
-				} else {
-					if !ignoreCurrentFile {
-						// Decrypt file part contents.
-						decFC, decFCErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-						if decFCErr != nil {
-							return fmt.Errorf("failed to decrypt file %s part contents (%v): %v", currFilename, currSectorData, decFCErr)
-						}
-
-						// Compare to decrypted file.
-						for i := 0; i < len(decFC); i++ {
-							decB, decErr := currFileReader.ReadByte()
-							if decErr != nil {
-								return fmt.Errorf("failed to read raw file: %v", decErr)
-							}
-
-							if decB != decFC[i] {
-								return fmt.Errorf("filedata doesn't match for file: %s", currFilename)
-							}
-						}
-					}
-
-					// Reset state.
-					resetState()
-
-					// Proceed reading next bytes.
-					continue
-				}
-
-			case "?":
-				// Process file metadata
-				if !mdRead {
-					// Decrypt file metadata.
-					fi, fiErr := decryptMD()
-					if fiErr != nil {
-						return fmt.Errorf("failed to decrypt file metadata: %v", fiErr)
-					}
-
-					if fi.Filetype != FILE {
-						return fmt.Errorf("expected file (%d) metadata but received (%d)", FILE, fi.Filetype)
-					}
-
-					fName := fmt.Sprintf("%s/%s", p.outputDir, fi.RelativePath)
-
-					// Open decrypted file.
-					var decF *os.File
-					var decFReader *bufio.Reader
-					if !p.ignoreFile(fName) {
-						var decFErr error
-						decF, decFErr = os.Open(fName)
-						if decFErr != nil {
-							return fmt.Errorf("failed to open decrypted file: %v", decFErr)
-						}
-
-						decFReader = bufio.NewReader(decF)
-					} else {
-						ignoreCurrentFile = true
-					}
-
-					// Store file pointer.
-					currFile = decF
-					currFileReader = decFReader
-					currFilename = fName
-
-					mdRead = true
-
-					currSectorData = []byte{}
-
-					// Continue with file contents in the following bytes.
-					continue
-				} else {
-					// Decrypt file part contents.
-					if !ignoreCurrentFile {
-						decFC, decFCErr := cbc.Decrypt(currSectorData, p.encryptionKey, p.iv)
-						if decFCErr != nil {
-							return fmt.Errorf("failed to decrypt file %s part contents (%v): %v", currFilename, currSectorData, decFCErr)
-						}
-
-						// Compare to decrypted file.
-						for i := 0; i < len(decFC); i++ {
-							decB, decErr := currFileReader.ReadByte()
-							if decErr != nil {
-								return fmt.Errorf("failed to read raw file: %v", decErr)
-							}
-
-							if decB != decFC[i] {
-								return fmt.Errorf("filedata doesn't match for file: %s", currFilename)
-							}
-						}
-					}
-
-					currSectorData = []byte{}
-
-					// Continue with file contents in the following bytes.
-					continue
+			salvage.damaged(bf.path, nil, readErr)
+		}
 
-				}
+		return nil
+	})
+	if iterErr != nil {
+		if incomplete != "" && errors.Is(iterErr, ErrCanceled) {
+			rmErr := os.Remove(incomplete)
+			if rmErr != nil {
+				log.Printf("failed to remove incomplete file %s: %v", incomplete, rmErr)
 			}
-
-			currSectorData = append(currSectorData, b)
 		}
 
-		encF.Close()
-		encGzipF.Close()
-
-		// Print progress.
-		currentPerc := sfnI * 100 / len(sFilenames)
-		if currentPerc != progressPerc {
-			progressPerc = currentPerc
-
-			elapsedMs := time.Now().UnixMilli() - batchStart.UnixMilli()
-			eta := time.Duration(time.Millisecond * time.Duration(int64(elapsedMs)*100/int64(currentPerc)-elapsedMs))
-
-			log.Printf("%d%%, ETA %s", currentPerc, eta.String())
-		}
+		return iterErr
 	}
 
-	if progressPerc != 100 {
-		log.Print("100%")
-	}
+	checkRestored()
 
-	return nil
-}
+	pr.finish()
 
-// base64( enc( json(d1-metadata) ) ) $ base64( enc( json(f1-metadata) ) ) ? base64( enc( f1-contents-p1 ) ) ? base64( enc( f1-contents-p2 ) ) $
+	log.Printf("verified checksums of %d file parts, %d file parts have no checksum", verifiedParts, restoredParts-verifiedParts-len(mismatches))
 
-func readFileInChunks(file string, handler func(data []byte) error) error {
-	f, fErr := os.Open(file)
-	if fErr != nil {
-		return fmt.Errorf("failed to open file %s: %v", file, fErr)
+	if report != nil {
+		salvage.finish(p.archiveDir(), p.header.Batches)
+		return nil
 	}
 
-	defer f.Close()
-
-	reader := bufio.NewReader(f)
-	buf := make([]byte, sourceFileReadChunkSize)
-
-	for {
-		n, rErr := reader.Read(buf)
-		if rErr != nil {
-			if rErr != io.EOF {
-				return fmt.Errorf("failed to read file %s: %v", file, rErr)
-			}
-
-			break
-		}
-
-		hErr := handler(buf[0:n])
-		if hErr != nil {
-			return fmt.Errorf("handler error: %v", hErr)
-		}
+	if len(mismatches) > 0 || len(incompleteFiles) > 0 {
+		return &ChecksumError{Paths: mismatches, Incomplete: incompleteFiles}
 	}
 
 	return nil
 }
 
+// base64( enc( json(d1-metadata) ) ) $ base64( enc( json(f1-metadata) ) ) ? base64( enc( f1-contents-p1 ) ) ? base64( enc( f1-contents-p2 ) ) $
+
 func sha256Hash(data string, interN int) (string, error) {
 	if interN < 1 {
 		return "", errors.New("invalid interN provided")
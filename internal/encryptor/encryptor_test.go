@@ -0,0 +1,258 @@
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPassword = "password"
+
+// writeTree writes the files into dir, nil contents stand for directories.
+func writeTree(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		fPath := filepath.Join(dir, filepath.FromSlash(name))
+
+		if data == nil {
+			require.NoError(t, os.MkdirAll(fPath, 0755))
+			continue
+		}
+
+		require.NoError(t, os.MkdirAll(filepath.Dir(fPath), 0755))
+		require.NoError(t, ioutil.WriteFile(fPath, data, 0644))
+	}
+}
+
+// readTree returns the files stored in dir, directories map to nil.
+func readTree(t *testing.T, dir string) map[string][]byte {
+	res := make(map[string][]byte)
+
+	require.NoError(t, filepath.Walk(dir, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil || fPath == dir {
+			return err
+		}
+
+		rel, relErr := filepath.Rel(dir, fPath)
+		if relErr != nil {
+			return relErr
+		}
+
+		if info.IsDir() {
+			res[filepath.ToSlash(rel)] = nil
+			return nil
+		}
+
+		data, dataErr := ioutil.ReadFile(fPath)
+		if dataErr != nil {
+			return dataErr
+		}
+
+		res[filepath.ToSlash(rel)] = data
+
+		return nil
+	}))
+
+	return res
+}
+
+// testData returns n bytes of non-repeating data.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+
+	return data
+}
+
+// newTestProcessor returns the processor unlocked by the test password
+// unless other secrets are configured.
+func newTestProcessor(t *testing.T, cfg Config) *Processor {
+	if cfg.Password == "" && cfg.Keyfile == "" && cfg.Identity == "" && len(cfg.Recipients) == 0 {
+		cfg.Password = testPassword
+	}
+
+	p, pErr := New(cfg)
+	require.NoError(t, pErr)
+
+	return p
+}
+
+func encryptTree(t *testing.T, cfg Config) {
+	require.NoError(t, newTestProcessor(t, cfg).Encrypt(context.Background()))
+}
+
+func decryptTree(t *testing.T, cfg Config) map[string][]byte {
+	require.NoError(t, newTestProcessor(t, cfg).Decrypt(context.Background()))
+
+	return readTree(t, cfg.OutputDir)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string][]byte{
+		"a.txt":      []byte("first file"),
+		"docs":       nil,
+		"docs/b.bin": testData(5000),
+		"docs/empty": nil,
+	}
+
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: 4096,
+	})
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+	enc := filepath.Join(dir, "enc")
+
+	writeTree(t, raw, map[string][]byte{
+		"a.txt":                 []byte("first file"),
+		"debug.log":             []byte("ignored file"),
+		"docs":                  nil,
+		"docs/.encryptorignore": []byte("*.tmp\n"),
+		"docs/b.txt":            []byte("second file"),
+		"docs/c.tmp":            []byte("ignored file"),
+		".encryptorignore":      []byte("*.log\n"),
+	})
+
+	encryptTree(t, Config{SourceDir: raw, OutputDir: enc, MaxBatchSize: testBatchSize})
+
+	archived := map[string][]byte{
+		".encryptorignore":      []byte("*.log\n"),
+		"a.txt":                 []byte("first file"),
+		"docs":                  nil,
+		"docs/.encryptorignore": []byte("*.tmp\n"),
+		"docs/b.txt":            []byte("second file"),
+	}
+
+	// Ignore files left in the output directory don't apply on restore.
+	restored := filepath.Join(dir, "restored")
+	writeTree(t, restored, map[string][]byte{".encryptorignore": []byte("*.txt\n")})
+
+	require.NoError(t, newTestProcessor(t, Config{SourceDir: enc, OutputDir: restored}).Decrypt(context.Background()))
+	require.Equal(t, archived, readTree(t, restored))
+
+	// Files ignored in the raw file directory aren't reported as extra.
+	report, vErr := newTestProcessor(t, Config{SourceDir: enc, OutputDir: raw}).ValidateReport(context.Background())
+	require.NoError(t, vErr)
+	require.Empty(t, report.Differences)
+}
+
+func TestDecryptMissingBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{"big.bin": testData(5 * testBatchSize)})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+	})
+
+	batches := archiveBatches(t, filepath.Join(dir, "enc"))
+	require.Greater(t, len(batches), 3)
+
+	cfg := Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	}
+
+	// The file is restored shorter than its size.
+	require.NoError(t, os.Remove(batches[len(batches)-1]))
+
+	dErr := newTestProcessor(t, cfg).Decrypt(context.Background())
+
+	var checksumErr *ChecksumError
+	require.True(t, errors.As(dErr, &checksumErr), dErr)
+	require.Equal(t, []string{"big.bin"}, checksumErr.Incomplete)
+
+	// The part following the missing one is rejected.
+	require.NoError(t, os.Remove(batches[2]))
+
+	dErr = newTestProcessor(t, cfg).Decrypt(context.Background())
+	require.Error(t, dErr)
+	require.Contains(t, dErr.Error(), "big.bin part at offset")
+}
+
+func TestDecryptChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{
+		"a.bin": testData(100),
+		"b.bin": testData(101)[1:],
+	})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+	})
+
+	batches := archiveBatches(t, filepath.Join(dir, "enc"))
+	require.Len(t, batches, 1)
+
+	// Swap the data records of the files, the records decrypt but don't
+	// match the checksums.
+	var first, second []byte
+
+	damageRecord(t, batches[0], 4, func(record []byte) []byte {
+		second = append([]byte(nil), record...)
+		return record
+	})
+
+	damageRecord(t, batches[0], 1, func(record []byte) []byte {
+		first = append([]byte(nil), record...)
+		return second
+	})
+
+	damageRecord(t, batches[0], 4, func(record []byte) []byte {
+		return first
+	})
+
+	dErr := newTestProcessor(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	}).Decrypt(context.Background())
+
+	var checksumErr *ChecksumError
+	require.True(t, errors.As(dErr, &checksumErr), dErr)
+	require.Equal(t, []string{"a.bin", "b.bin"}, checksumErr.Paths)
+	require.Empty(t, checksumErr.Incomplete)
+}
+
+func TestDecryptDamagedBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{"big.bin": testData(3 * testBatchSize)})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+	})
+
+	batches := archiveBatches(t, filepath.Join(dir, "enc"))
+	corruptFile(t, batches[1])
+
+	require.Error(t, newTestProcessor(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	}).Decrypt(context.Background()))
+}
@@ -0,0 +1,119 @@
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrWrongKey is returned if the credentials don't unlock the archive. Wrong
+// passwords of archives without key slots or recipients aren't detected until
+// their contents fail to decrypt.
+var ErrWrongKey = errors.New("wrong key")
+
+// keyError is a descriptive ErrWrongKey.
+type keyError struct {
+	msg string
+}
+
+func (e *keyError) Error() string {
+	return e.msg
+}
+
+func (e *keyError) Is(target error) bool {
+	return target == ErrWrongKey
+}
+
+func newKeyError(format string, a ...interface{}) error {
+	return &keyError{msg: fmt.Sprintf(format, a...)}
+}
+
+// ErrCanceled is returned if the context of an operation is canceled or its
+// deadline is exceeded. The returned errors match the context error too.
+var ErrCanceled = errors.New("operation canceled")
+
+// canceledError is ErrCanceled caused by the context error.
+type canceledError struct {
+	cause error
+}
+
+func (e *canceledError) Error() string {
+	return fmt.Sprintf("operation canceled: %v", e.cause)
+}
+
+func (e *canceledError) Is(target error) bool {
+	return target == ErrCanceled
+}
+
+func (e *canceledError) Unwrap() error {
+	return e.cause
+}
+
+// checkContext returns ErrCanceled if the context is done.
+func checkContext(ctx context.Context) error {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return &canceledError{cause: ctxErr}
+	}
+
+	return nil
+}
+
+// contextError returns ErrCanceled instead of the error if the context is
+// done, requests of remote backends fail with the context error.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	ctxErr := checkContext(ctx)
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// ChecksumError is returned by Decrypt if restored file parts don't match
+// their checksums or parts of the restored files are missing.
+type ChecksumError struct {
+	Paths []string
+
+	// Files restored shorter than their size.
+	Incomplete []string
+}
+
+func (e *ChecksumError) Error() string {
+	var msgs []string
+
+	if len(e.Paths) > 0 {
+		msgs = append(msgs, fmt.Sprintf("checksum mismatch for %d file parts: %s", len(e.Paths), strings.Join(e.Paths, ", ")))
+	}
+
+	if len(e.Incomplete) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d files are incomplete: %s", len(e.Incomplete), strings.Join(e.Incomplete, ", ")))
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+// DifferenceError is returned by Validate if the archive differs from the raw
+// file directory, the report lists the differences.
+type DifferenceError struct {
+	Differences int
+}
+
+func (e *DifferenceError) Error() string {
+	return fmt.Sprintf("found %d differences", e.Differences)
+}
+
+// DamageError is returned by Verify and Salvage if damaged records are found,
+// the report lists the problems.
+type DamageError struct {
+	Problems int
+}
+
+func (e *DamageError) Error() string {
+	return fmt.Sprintf("found %d problems", e.Problems)
+}
@@ -0,0 +1,340 @@
+package encryptor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/age"
+)
+
+// ageExtension is trimmed from the names of imported files.
+const ageExtension = ".age"
+
+var (
+	// errNoAgeRecipients is returned by Export if neither recipients nor a
+	// passphrase is provided.
+	errNoAgeRecipients = errors.New("no age recipients or passphrase provided")
+
+	// errNoAgeIdentities is returned by Import if neither an identity file
+	// nor a passphrase is provided.
+	errNoAgeIdentities = errors.New("no age identity or passphrase provided")
+
+	// errExportDone stops reading the archive once the exported file is complete.
+	errExportDone = errors.New("export done")
+)
+
+// parseAgeRecipients parses age1... recipients listed directly or in
+// recipient files, one per line.
+func parseAgeRecipients(list []string) ([]age.Recipient, error) {
+	var res []age.Recipient
+
+	for _, item := range list {
+		lines := []string{item}
+
+		if !strings.HasPrefix(item, "age1") {
+			data, dataErr := ioutil.ReadFile(item)
+			if dataErr != nil {
+				return nil, fmt.Errorf("failed to read recipients file: %v", dataErr)
+			}
+
+			lines = strings.Split(string(data), "\n")
+		}
+
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			r, rErr := age.ParseX25519Recipient(line)
+			if rErr != nil {
+				return nil, rErr
+			}
+
+			res = append(res, r)
+		}
+	}
+
+	return res, nil
+}
+
+// ageRecipients returns the recipients of the exported file.
+func (p *Processor) ageRecipients() ([]age.Recipient, error) {
+	res, rErr := parseAgeRecipients(p.ageRecipientList)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	if p.agePassphrase != "" {
+		r, sErr := age.NewScryptRecipient(p.agePassphrase)
+		if sErr != nil {
+			return nil, sErr
+		}
+
+		res = append(res, r)
+	}
+
+	if len(res) == 0 {
+		return nil, errNoAgeRecipients
+	}
+
+	return res, nil
+}
+
+// ageIdentities returns the identities decrypting the imported file.
+func (p *Processor) ageIdentities() ([]age.Identity, error) {
+	var res []age.Identity
+
+	if p.ageIdentity != "" {
+		f, fErr := os.Open(p.ageIdentity)
+		if fErr != nil {
+			return nil, fmt.Errorf("failed to open identity file: %v", fErr)
+		}
+
+		defer f.Close()
+
+		ids, idsErr := age.ParseIdentities(f)
+		if idsErr != nil {
+			return nil, idsErr
+		}
+
+		res = append(res, ids...)
+	}
+
+	if p.agePassphrase != "" {
+		id, sErr := age.NewScryptIdentity(p.agePassphrase)
+		if sErr != nil {
+			return nil, sErr
+		}
+
+		res = append(res, id)
+	}
+
+	if len(res) == 0 {
+		return nil, errNoAgeIdentities
+	}
+
+	return res, nil
+}
+
+// Export writes the archive file at the export path, or a tar stream of the
+// whole archive if the path is empty, to the export output in the age format.
+func (p *Processor) Export(ctx context.Context) error {
+	recipients, rErr := p.ageRecipients()
+	if rErr != nil {
+		return fmt.Errorf("failed to parse age recipients: %v", rErr)
+	}
+
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	aw, awErr := age.Encrypt(p.stdout, recipients...)
+	if awErr != nil {
+		return fmt.Errorf("failed to start age file: %v", awErr)
+	}
+
+	var exportErr error
+
+	if p.exportPath != "" {
+		exportErr = p.exportFile(ctx, p.exportPath, aw)
+	} else {
+		exportErr = p.writeTar(ctx, aw, nil)
+	}
+
+	// The age file is left without the final chunk on failure so it fails
+	// to decrypt as truncated.
+	if exportErr != nil {
+		return exportErr
+	}
+
+	closeErr := aw.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to finish age file: %v", closeErr)
+	}
+
+	return nil
+}
+
+// exportFile writes the contents of the archive file to w.
+func (p *Processor) exportFile(ctx context.Context, name string, w io.Writer) error {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+
+	var checker partChecker
+	var found, dir bool
+	var written int64
+
+	h := recordHandler{
+		directory: func(fi *fileInfo) error {
+			if fi.RelativePath == name {
+				dir = true
+			}
+
+			return nil
+		},
+
+		fileStart: func(fi *fileInfo) error {
+			if fi.RelativePath != name {
+				return errSkipFile
+			}
+
+			if fi.Offset != written {
+				return fmt.Errorf("file %s part at offset %d doesn't follow the preceding part", fi.RelativePath, fi.Offset)
+			}
+
+			found = true
+			checker.start()
+
+			return nil
+		},
+
+		fileData: func(fi *fileInfo, data []byte) error {
+			checker.write(data)
+
+			_, wErr := w.Write(data)
+			if wErr != nil {
+				return fmt.Errorf("failed to write file contents: %v", wErr)
+			}
+
+			written += int64(len(data))
+
+			return nil
+		},
+
+		fileEnd: func(fi *fileInfo) error {
+			checker.end()
+			return nil
+		},
+
+		checksum: func(fi *fileInfo) error {
+			cErr := checker.check(fi)
+			if cErr != nil {
+				return cErr
+			}
+
+			// Stop once the last part is verified.
+			if fi.Size > 0 && written == fi.Size {
+				return errExportDone
+			}
+
+			return nil
+		},
+	}
+
+	readErr := p.forEachRecord(ctx, h)
+	if readErr != nil && readErr != errExportDone {
+		return readErr
+	}
+
+	if dir {
+		return fmt.Errorf("%s is a directory", name)
+	}
+
+	if !found {
+		return fmt.Errorf("file %s not found in the archive", name)
+	}
+
+	log.Printf("exported %d bytes of %s", written, name)
+
+	return nil
+}
+
+// Import decrypts the age file at the source path and encrypts its contents
+// to the output archive as they're read. Tar streams are encrypted entry by
+// entry, other contents are stored as a single file named after the age
+// file.
+func (p *Processor) Import(ctx context.Context) error {
+	identities, idErr := p.ageIdentities()
+	if idErr != nil {
+		return fmt.Errorf("failed to parse age identities: %v", idErr)
+	}
+
+	localErr := requireLocal(p.source, "age file")
+	if localErr != nil {
+		return localErr
+	}
+
+	src, srcErr := os.Open(p.sourceDir)
+	if srcErr != nil {
+		return fmt.Errorf("failed to open age file: %v", srcErr)
+	}
+
+	defer src.Close()
+
+	info, infoErr := src.Stat()
+	if infoErr != nil {
+		return fmt.Errorf("failed to read age file info: %v", infoErr)
+	}
+
+	// The size of a single file is computed from the size of the age file
+	// as it's needed before the contents are read.
+	ar, size, arErr := age.DecryptFile(src, info.Size(), identities...)
+	if arErr != nil {
+		return fmt.Errorf("failed to decrypt age file: %v", arErr)
+	}
+
+	br := bufio.NewReader(ar)
+
+	prepErr := p.prepareEncrypt(ctx)
+	if prepErr != nil {
+		return prepErr
+	}
+
+	if isTar(br) {
+		return p.encryptTar(ctx, br)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(p.sourceDir), ageExtension)
+	if name == "" || name == "." {
+		name = "data"
+	}
+
+	if size == 0 {
+		log.Printf("empty file detected, ignoring: %s", name)
+		return nil
+	}
+
+	fi := &fileInfo{
+		RelativePath: name,
+		Filetype:     FILE,
+		Size:         size,
+		size:         size,
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	excluded, exErr := ff.excluded(fi)
+	if exErr != nil {
+		return fmt.Errorf("failed to apply filter rules: %v", exErr)
+	}
+
+	if excluded {
+		log.Printf("file excluded by filter rules, ignoring: %s", name)
+		return nil
+	}
+
+	bw, bwErr := p.newBatchWriter(ctx, 1, size)
+	if bwErr != nil {
+		return bwErr
+	}
+
+	wErr := bw.writeFile(fi, br)
+	if wErr != nil {
+		return bw.fail(wErr)
+	}
+
+	return bw.finish()
+}
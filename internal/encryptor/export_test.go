@@ -0,0 +1,94 @@
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/age"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAgeFile encrypts the data to the identity's recipient into the file.
+func writeAgeFile(t *testing.T, name string, id *age.X25519Identity, data []byte) {
+	var buf bytes.Buffer
+
+	w, wErr := age.Encrypt(&buf, id.Recipient())
+	require.NoError(t, wErr)
+
+	_, wErr = w.Write(data)
+	require.NoError(t, wErr)
+	require.NoError(t, w.Close())
+
+	require.NoError(t, ioutil.WriteFile(name, buf.Bytes(), 0644))
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+
+	id, idErr := age.GenerateX25519Identity()
+	require.NoError(t, idErr)
+
+	idFile := filepath.Join(dir, "id.txt")
+	require.NoError(t, ioutil.WriteFile(idFile, []byte(id.String()+"\n"), 0600))
+
+	// A single file spanning several batches.
+	data := testData(3*testBatchSize + 100)
+	writeAgeFile(t, filepath.Join(dir, "data.bin.age"), id, data)
+
+	require.NoError(t, newTestProcessor(t, Config{
+		SourceDir:    filepath.Join(dir, "data.bin.age"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+		AgeIdentity:  idFile,
+	}).Import(context.Background()))
+
+	require.Equal(t, map[string][]byte{"data.bin": data}, decryptTree(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+
+	// Truncated files fail leaving no batches behind.
+	encrypted, readErr := ioutil.ReadFile(filepath.Join(dir, "data.bin.age"))
+	require.NoError(t, readErr)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "truncated.age"), encrypted[:len(encrypted)-10], 0644))
+
+	iErr := newTestProcessor(t, Config{
+		SourceDir:    filepath.Join(dir, "truncated.age"),
+		OutputDir:    filepath.Join(dir, "truncated"),
+		MaxBatchSize: testBatchSize,
+		AgeIdentity:  idFile,
+	}).Import(context.Background())
+	require.Error(t, iErr)
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "truncated"))
+	for _, e := range entries {
+		require.NotEqual(t, batchFileExt, filepath.Ext(e.Name()))
+	}
+
+	// Tar streams written by Export are imported entry by entry.
+	var exported bytes.Buffer
+
+	require.NoError(t, newTestProcessor(t, Config{
+		SourceDir:     filepath.Join(dir, "enc"),
+		AgeRecipients: []string{id.Recipient().String()},
+		Stdout:        &exported,
+	}).Export(context.Background()))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "archive.age"), exported.Bytes(), 0644))
+
+	require.NoError(t, newTestProcessor(t, Config{
+		SourceDir:    filepath.Join(dir, "archive.age"),
+		OutputDir:    filepath.Join(dir, "reimported"),
+		MaxBatchSize: testBatchSize,
+		AgeIdentity:  idFile,
+	}).Import(context.Background()))
+
+	require.Equal(t, map[string][]byte{"data.bin": data}, decryptTree(t, Config{
+		SourceDir: filepath.Join(dir, "reimported"),
+		OutputDir: filepath.Join(dir, "restored-tar"),
+	}))
+}
@@ -0,0 +1,104 @@
+package encryptor
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/filter"
+)
+
+// fileFilter applies include/exclude rules during a single operation.
+type fileFilter struct {
+	rules *filter.Rules
+
+	// File tree to load ignore files from.
+	fsys   fs.FS
+	loaded map[string]bool
+
+	cacheDirs map[string]bool
+}
+
+// newFileFilter returns the filter loading ignore files from the file tree,
+// which may be nil.
+func (p *Processor) newFileFilter(fsys fs.FS) (*fileFilter, error) {
+	ff := &fileFilter{
+		rules: p.rules.Clone(),
+
+		fsys:   fsys,
+		loaded: make(map[string]bool),
+
+		cacheDirs: make(map[string]bool),
+	}
+
+	// Load the root directory ignore file.
+	loadErr := ff.loadIgnoreFile("")
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	return ff, nil
+}
+
+// loadIgnoreFile loads the ignore file of the directory relative to the root.
+func (ff *fileFilter) loadIgnoreFile(dir string) error {
+	if ff.loaded[dir] {
+		return nil
+	}
+
+	ff.loaded[dir] = true
+
+	// Ignore files aren't loaded without the file tree.
+	if ff.fsys == nil {
+		return nil
+	}
+
+	data, dataErr := fs.ReadFile(ff.fsys, path.Join(dir, filter.IgnoreFilename))
+	if dataErr != nil {
+		// The directory might be missing or be a file in a raw file tree.
+		if isNotExist(dataErr) || errors.Is(dataErr, fs.ErrInvalid) {
+			return nil
+		}
+
+		return dataErr
+	}
+
+	return ff.rules.AddIgnoreFile(dir, data)
+}
+
+// excluded reports whether the file described by the metadata is excluded.
+func (ff *fileFilter) excluded(fi *fileInfo) (bool, error) {
+	// Check parent directories.
+	parts := strings.Split(fi.RelativePath, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+
+		if ff.cacheDirs[dir] {
+			return true, nil
+		}
+
+		loadErr := ff.loadIgnoreFile(dir)
+		if loadErr != nil {
+			return false, loadErr
+		}
+	}
+
+	if fi.Filetype == DIRECTORY && fi.Cache && ff.rules.ExcludeCaches {
+		ff.cacheDirs[fi.RelativePath] = true
+		return true, nil
+	}
+
+	return ff.rules.Excluded(fi.RelativePath, fi.Filetype == DIRECTORY, fi.Size), nil
+}
+
+// isCacheDir reports whether the directory of the file tree is tagged with
+// CACHEDIR.TAG.
+func isCacheDir(fsys fs.FS, dir string) bool {
+	data, dataErr := fs.ReadFile(fsys, path.Join(dir, filter.CacheDirTagFilename))
+	if dataErr != nil {
+		return false
+	}
+
+	return filter.IsCacheDirTag(data)
+}
@@ -0,0 +1,99 @@
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// archiveFS is the fs.FS of the archive tree.
+type archiveFS struct {
+	ctx  context.Context
+	p    *Processor
+	tree *serveTree
+}
+
+func (afs *archiveFS) lookup(op, name string) (*serveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	e := afs.tree.entry(name, false)
+	if e == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return e, nil
+}
+
+func (afs *archiveFS) Open(name string) (fs.File, error) {
+	e, lErr := afs.lookup("open", name)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	return &serveFile{
+		ctx: afs.ctx,
+		p:   afs.p,
+		e:   e,
+	}, nil
+}
+
+func (afs *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, lErr := afs.lookup("readdir", name)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	children := e.sortedChildren()
+
+	res := make([]fs.DirEntry, len(children))
+	for i, c := range children {
+		res[i] = fs.FileInfoToDirEntry(c)
+	}
+
+	return res, nil
+}
+
+func (afs *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	e, lErr := afs.lookup("stat", name)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	return e, nil
+}
+
+// FS unlocks the archive and returns the files selected by the filter rules
+// as an fs.FS, which also implements fs.ReadDirFS and fs.StatFS. Files are
+// decrypted on demand as they're read until the context is done, they
+// implement io.Seeker. Seeking skips the data records preceding the offset
+// without decrypting them, the checksums of the file parts are only verified
+// if they're read from their start.
+func (p *Processor) FS(ctx context.Context) (fs.FS, error) {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return nil, fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return nil, fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	tree, treeErr := p.indexArchive(ctx, ff)
+	if treeErr != nil {
+		return nil, fmt.Errorf("failed to index archive: %w", treeErr)
+	}
+
+	return &archiveFS{
+		ctx:  ctx,
+		p:    p,
+		tree: tree,
+	}, nil
+}
@@ -0,0 +1,698 @@
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/alex-ant/directory-encryptor/internal/x25519"
+)
+
+const (
+	headerFilename = ".header"
+	headerVersion  = 1
+
+	// appendKeysVersion is the version of the headers recording append keys,
+	// earlier releases can't decrypt the batch files appended.
+	appendKeysVersion = 2
+
+	kdfSHA256           = "sha256"
+	kdfSHA256Iterations = 10
+
+	// The random data key is wrapped to X25519 recipients.
+	kdfX25519 = "x25519"
+
+	// The random data key is wrapped by keys derived from the secrets in
+	// key slots.
+	kdfSlots = "slots"
+
+	dataKeySize = 32
+)
+
+// Key factors.
+const (
+	factorPassword = "password"
+	factorKeyfile  = "keyfile"
+)
+
+var (
+	// errEmptyPassword is returned by operations requiring the password.
+	errEmptyPassword = errors.New("empty password provided")
+
+	// errEmptyKeyfile is returned by operations requiring the keyfile.
+	errEmptyKeyfile = errors.New("empty keyfile provided")
+
+	// errEmptyIdentity is returned by operations requiring the private key.
+	errEmptyIdentity = errors.New("empty identity provided")
+)
+
+// keyDerivation describes how the encryption key is derived from the secrets.
+type keyDerivation struct {
+	KDF        string   `json:"kdf"`
+	Iterations int      `json:"iterations,omitempty"`
+	Factors    []string `json:"factors,omitempty"`
+
+	Recipients []recipient `json:"recipients,omitempty"`
+	Slots      []keySlot   `json:"slots,omitempty"`
+
+	// Data keys of the batch files appended to recipients archives.
+	Appends []appendKey `json:"appends,omitempty"`
+}
+
+// appendKey contains the data key of the batch files appended to a recipients
+// archive from the first batch number on, wrapped to the archive recipients
+// so that appending doesn't require the identity.
+type appendKey struct {
+	FirstBatch int         `json:"first_batch"`
+	Recipients []recipient `json:"recipients"`
+}
+
+// recipient contains the data key wrapped to an X25519 public key.
+type recipient struct {
+	PublicKey    []byte `json:"public_key"`
+	EphemeralKey []byte `json:"ephemeral_key"`
+	WrappedKey   []byte `json:"wrapped_key"`
+}
+
+// header describes the archive, it's stored unencrypted in the archive root
+// and in every volume.
+type header struct {
+	Version int           `json:"version"`
+	Key     keyDerivation `json:"key"`
+
+	// Number of batch files written, 0 for archives written before it was
+	// recorded.
+	Batches int `json:"batches,omitempty"`
+}
+
+// legacyHeader describes archives created before headers were introduced.
+func legacyHeader() *header {
+	return &header{
+		Version: headerVersion,
+		Key: keyDerivation{
+			KDF:        kdfSHA256,
+			Iterations: kdfSHA256Iterations,
+			Factors:    []string{factorPassword},
+		},
+	}
+}
+
+func encodeHeader(h *header) ([]byte, error) {
+	hb, hbErr := json.MarshalIndent(h, "", "  ")
+	if hbErr != nil {
+		return nil, fmt.Errorf("failed to marshal header: %v", hbErr)
+	}
+
+	return hb, nil
+}
+
+func writeHeader(ctx context.Context, b backend.Backend, dir string, h *header) error {
+	hb, hbErr := encodeHeader(h)
+	if hbErr != nil {
+		return hbErr
+	}
+
+	// The header is replaced once written, the archive can't be unlocked without it.
+	f, fErr := b.Create(ctx, path.Join(dir, headerFilename))
+	if fErr != nil {
+		return fmt.Errorf("failed to create header: %v", fErr)
+	}
+
+	_, wErr := f.Write(hb)
+	if wErr != nil {
+		f.Close()
+		return fmt.Errorf("failed to write header: %v", wErr)
+	}
+
+	closeErr := f.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to replace header: %v", closeErr)
+	}
+
+	return nil
+}
+
+// readHeader reads the archive header from dir returning nil if it doesn't exist.
+func readHeader(ctx context.Context, b backend.Backend, dir string) (*header, error) {
+	f, fErr := b.Open(ctx, path.Join(dir, headerFilename))
+	if fErr != nil {
+		if isNotExist(fErr) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read header: %v", fErr)
+	}
+
+	defer f.Close()
+
+	hb, hbErr := ioutil.ReadAll(f)
+	if hbErr != nil {
+		return nil, fmt.Errorf("failed to read header: %v", hbErr)
+	}
+
+	var h header
+
+	hErr := json.Unmarshal(hb, &h)
+	if hErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal header: %v", hErr)
+	}
+
+	if h.Version > appendKeysVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", h.Version)
+	}
+
+	return &h, nil
+}
+
+// keyfileHash returns the hex-encoded SHA-256 hash of the keyfile contents.
+func keyfileHash(keyfile string) (string, error) {
+	f, fErr := os.Open(keyfile)
+	if fErr != nil {
+		return "", fmt.Errorf("failed to open keyfile: %v", fErr)
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	_, cErr := io.Copy(h, f)
+	if cErr != nil {
+		return "", fmt.Errorf("failed to read keyfile: %v", cErr)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Keygen generates a new X25519 key pair writing the private key to the
+// identity file and the public key to the identity file with the .pub suffix.
+func Keygen(identity string) error {
+	if identity == "" {
+		return errEmptyIdentity
+	}
+
+	privateKey, publicKey, gErr := x25519.GenerateKey()
+	if gErr != nil {
+		return gErr
+	}
+
+	for _, kf := range []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{identity, x25519.EncodePrivateKey(privateKey), 0600},
+		{identity + ".pub", x25519.EncodePublicKey(publicKey), 0644},
+	} {
+		f, fErr := os.OpenFile(kf.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, kf.perm)
+		if fErr != nil {
+			return fmt.Errorf("failed to create key file: %v", fErr)
+		}
+
+		_, wErr := f.Write(kf.data)
+		if wErr != nil {
+			f.Close()
+			return fmt.Errorf("failed to write key file %s: %v", kf.path, wErr)
+		}
+
+		cErr := f.Close()
+		if cErr != nil {
+			return fmt.Errorf("failed to close key file %s: %v", kf.path, cErr)
+		}
+	}
+
+	return nil
+}
+
+// credentials are the secrets unlocking password-based archives.
+type credentials struct {
+	password string
+	keyfile  string
+}
+
+// factors returns the key factors provided.
+func (c credentials) factors() []string {
+	var res []string
+
+	if c.password != "" {
+		res = append(res, factorPassword)
+	}
+
+	if c.keyfile != "" {
+		res = append(res, factorKeyfile)
+	}
+
+	return res
+}
+
+// secret combines the secrets of the given factors, the provided factors
+// must match them.
+func (c credentials) secret(factors []string) (string, error) {
+	var secret string
+
+	for _, f := range factors {
+		switch f {
+		case factorPassword:
+			if c.password == "" {
+				return "", errEmptyPassword
+			}
+
+			secret += c.password
+
+		case factorKeyfile:
+			if c.keyfile == "" {
+				return "", errEmptyKeyfile
+			}
+
+			kh, khErr := keyfileHash(c.keyfile)
+			if khErr != nil {
+				return "", khErr
+			}
+
+			secret += kh
+
+		default:
+			return "", fmt.Errorf("unsupported key factor %s", f)
+		}
+	}
+
+	if len(c.factors()) != len(factors) {
+		return "", newKeyError("archive is unlocked with %s only, got %s", strings.Join(factors, "+"), strings.Join(c.factors(), "+"))
+	}
+
+	return secret, nil
+}
+
+func (p *Processor) credentials() credentials {
+	return credentials{
+		password: p.password,
+		keyfile:  p.keyfile,
+	}
+}
+
+// archiveDir returns the directory containing the header of the archive being read.
+func (p *Processor) archiveDir() string {
+	if p.sourceDir == "" && len(p.volumes) > 0 {
+		return p.volumes[0]
+	}
+
+	return p.sourceDir
+}
+
+// newDataKey returns a new random data key.
+func newDataKey() (string, error) {
+	dataKey := make([]byte, dataKeySize)
+
+	_, rErr := io.ReadFull(rand.Reader, dataKey)
+	if rErr != nil {
+		return "", fmt.Errorf("failed to generate data key: %v", rErr)
+	}
+
+	return string(dataKey), nil
+}
+
+// newHeader returns the header of a new archive and its random data key.
+func (p *Processor) newHeader() (*header, string, error) {
+	dataKey, dkErr := newDataKey()
+	if dkErr != nil {
+		return nil, "", dkErr
+	}
+
+	if len(p.recipients) == 0 {
+		if len(p.credentials().factors()) == 0 {
+			return nil, "", errEmptyPassword
+		}
+
+		slot, slotErr := newKeySlot(p.credentials(), dataKey)
+		if slotErr != nil {
+			return nil, "", slotErr
+		}
+
+		return &header{
+			Version: headerVersion,
+			Key: keyDerivation{
+				KDF:   kdfSlots,
+				Slots: []keySlot{*slot},
+			},
+		}, dataKey, nil
+	}
+
+	if len(p.credentials().factors()) > 0 {
+		return nil, "", errors.New("password and keyfile can't be combined with recipients")
+	}
+
+	h := &header{
+		Version: headerVersion,
+		Key: keyDerivation{
+			KDF: kdfX25519,
+		},
+	}
+
+	var publicKeys [][]byte
+
+	for _, r := range p.recipients {
+		rb, rbErr := ioutil.ReadFile(r)
+		if rbErr != nil {
+			return nil, "", fmt.Errorf("failed to read recipient public key: %v", rbErr)
+		}
+
+		publicKey, pErr := x25519.ParsePublicKey(rb)
+		if pErr != nil {
+			return nil, "", fmt.Errorf("failed to parse recipient public key %s: %v", r, pErr)
+		}
+
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	var wErr error
+	h.Key.Recipients, wErr = wrapKey(dataKey, publicKeys)
+	if wErr != nil {
+		return nil, "", wErr
+	}
+
+	return h, dataKey, nil
+}
+
+// legacySlotsHeader returns the key slots header of an archive created
+// before headers were introduced, the data key remains derived from the
+// password so the existing batch files can still be decrypted.
+func (p *Processor) legacySlotsHeader() (*header, string, error) {
+	if len(p.recipients) > 0 {
+		return nil, "", errors.New("recipients of an existing archive can't be changed")
+	}
+
+	key, kErr := p.passwordKey(legacyHeader())
+	if kErr != nil {
+		return nil, "", kErr
+	}
+
+	slot, slotErr := newKeySlot(p.credentials(), key)
+	if slotErr != nil {
+		return nil, "", slotErr
+	}
+
+	log.Printf("converting archive to key slots, the data key remains derived from the password")
+
+	return &header{
+		Version: headerVersion,
+		Key: keyDerivation{
+			KDF:   kdfSlots,
+			Slots: []keySlot{*slot},
+		},
+	}, key, nil
+}
+
+// hasBatchFiles reports whether dir or its volumes hold batch files.
+func hasBatchFiles(ctx context.Context, b backend.Backend, dir string) (bool, error) {
+	files, filesErr := b.List(ctx, dir)
+	if filesErr != nil {
+		if isNotExist(filesErr) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to list directory %s: %v", dir, filesErr)
+	}
+
+	for _, f := range files {
+		if f.Name[:1] != "." && strings.HasSuffix(f.Name, batchFileExt) {
+			return true, nil
+		}
+	}
+
+	if !isLocal(b) {
+		return false, nil
+	}
+
+	vols, volsErr := listVolumes(dir)
+	if volsErr != nil {
+		return false, volsErr
+	}
+
+	return len(vols) > 0, nil
+}
+
+// passwordKey derives the encryption key from the password and the keyfile.
+func (p *Processor) passwordKey(h *header) (string, error) {
+	if h.Key.Iterations < 1 {
+		return "", fmt.Errorf("invalid number of iterations %d", h.Key.Iterations)
+	}
+
+	secret, secretErr := p.credentials().secret(h.Key.Factors)
+	if secretErr != nil {
+		return "", secretErr
+	}
+
+	// Generate encryption key.
+	encryptionKey, encryptionKeyErr := sha256Hash(secret, h.Key.Iterations)
+	if encryptionKeyErr != nil {
+		return "", fmt.Errorf("failed to generate encryption key: %v", encryptionKeyErr)
+	}
+
+	return encryptionKey[:32], nil
+}
+
+// recipientKeys unwraps the data key and the append keys with the identity.
+func (p *Processor) recipientKeys(h *header) (string, []batchKey, error) {
+	if len(p.credentials().factors()) > 0 {
+		return "", nil, newKeyError("archive is encrypted to recipients, an identity is required instead of password and keyfile")
+	}
+
+	if p.identity == "" {
+		return "", nil, errEmptyIdentity
+	}
+
+	ib, ibErr := ioutil.ReadFile(p.identity)
+	if ibErr != nil {
+		return "", nil, fmt.Errorf("failed to read identity: %v", ibErr)
+	}
+
+	privateKey, pErr := x25519.ParsePrivateKey(ib)
+	if pErr != nil {
+		return "", nil, fmt.Errorf("failed to parse identity: %v", pErr)
+	}
+
+	publicKey, pErr := x25519.PublicKey(privateKey)
+	if pErr != nil {
+		return "", nil, pErr
+	}
+
+	dataKey, dkErr := unwrapKey(privateKey, publicKey, h.Key.Recipients)
+	if dkErr != nil {
+		return "", nil, dkErr
+	}
+
+	var appendKeys []batchKey
+
+	for _, a := range h.Key.Appends {
+		ak, akErr := unwrapKey(privateKey, publicKey, a.Recipients)
+		if akErr != nil {
+			return "", nil, fmt.Errorf("failed to unwrap key of batch files from %d on: %w", a.FirstBatch, akErr)
+		}
+
+		bk, bkErr := newBatchKey(a.FirstBatch, ak)
+		if bkErr != nil {
+			return "", nil, bkErr
+		}
+
+		appendKeys = append(appendKeys, bk)
+	}
+
+	return dataKey, appendKeys, nil
+}
+
+// unwrapKey unwraps the data key wrapped to the public key.
+func unwrapKey(privateKey, publicKey []byte, recipients []recipient) (string, error) {
+	for _, r := range recipients {
+		if !bytes.Equal(r.PublicKey, publicKey) {
+			continue
+		}
+
+		dataKey, dkErr := x25519.Unwrap(privateKey, r.EphemeralKey, r.WrappedKey)
+		if dkErr != nil {
+			return "", dkErr
+		}
+
+		if len(dataKey) != dataKeySize {
+			return "", fmt.Errorf("invalid data key size %d", len(dataKey))
+		}
+
+		return string(dataKey), nil
+	}
+
+	return "", newKeyError("identity isn't among the archive recipients")
+}
+
+// wrapKey wraps the data key to the public keys.
+func wrapKey(dataKey string, publicKeys [][]byte) ([]recipient, error) {
+	var res []recipient
+
+	for _, publicKey := range publicKeys {
+		ephemeral, wrapped, wErr := x25519.Wrap(publicKey, []byte(dataKey))
+		if wErr != nil {
+			return nil, fmt.Errorf("failed to wrap data key: %v", wErr)
+		}
+
+		res = append(res, recipient{
+			PublicKey:    publicKey,
+			EphemeralKey: ephemeral,
+			WrappedKey:   wrapped,
+		})
+	}
+
+	return res, nil
+}
+
+// addAppendKey encrypts the batch files appended to the recipients archive
+// from the first number on with a new data key wrapped to the recipients.
+func (p *Processor) addAppendKey(ctx context.Context, first int) error {
+	dataKey, dkErr := newDataKey()
+	if dkErr != nil {
+		return dkErr
+	}
+
+	var publicKeys [][]byte
+	for _, r := range p.header.Key.Recipients {
+		publicKeys = append(publicKeys, r.PublicKey)
+	}
+
+	recipients, wErr := wrapKey(dataKey, publicKeys)
+	if wErr != nil {
+		return wErr
+	}
+
+	// Keys of the runs which didn't store batch files are replaced.
+	var appends []appendKey
+	for _, a := range p.header.Key.Appends {
+		if a.FirstBatch < first {
+			appends = append(appends, a)
+		}
+	}
+
+	p.header.Version = appendKeysVersion
+	p.header.Key.Appends = append(appends, appendKey{
+		FirstBatch: first,
+		Recipients: recipients,
+	})
+
+	// The key is recorded before the batch files are written, files of
+	// interrupted runs remain readable.
+	hErr := writeHeader(ctx, p.output, p.outputDir, p.header)
+	if hErr != nil {
+		return fmt.Errorf("failed to record append key: %v", hErr)
+	}
+
+	bk, bkErr := newBatchKey(first, dataKey)
+	if bkErr != nil {
+		return bkErr
+	}
+
+	p.setKeys([]batchKey{bk})
+
+	return nil
+}
+
+// unlock derives the encryption key according to the header of the archive
+// stored in dir. If create is set, the header is written for a new archive
+// in the output directory, otherwise it's read from the source one.
+func (p *Processor) unlock(ctx context.Context, dir string, create bool) error {
+	storage := p.source
+	if create {
+		storage = p.output
+	}
+
+	h, hErr := readHeader(ctx, storage, dir)
+	if hErr != nil {
+		return hErr
+	}
+
+	var key string
+
+	switch {
+	case h == nil && create:
+		legacy, legacyErr := hasBatchFiles(ctx, storage, dir)
+		if legacyErr != nil {
+			return legacyErr
+		}
+
+		var nErr error
+		if legacy {
+			h, key, nErr = p.legacySlotsHeader()
+		} else {
+			h, key, nErr = p.newHeader()
+		}
+
+		if nErr != nil {
+			return nErr
+		}
+
+		wErr := writeHeader(ctx, storage, dir, h)
+		if wErr != nil {
+			return wErr
+		}
+
+	case h == nil:
+		h = legacyHeader()
+
+	case create && len(p.recipients) > 0:
+		return errors.New("recipients of an existing archive can't be changed")
+	}
+
+	// Batch files are appended to recipients archives without the identity,
+	// the key is added once the first batch number is known.
+	if key == "" && create && h.Key.KDF == kdfX25519 {
+		if len(p.credentials().factors()) > 0 {
+			return newKeyError("archive is encrypted to recipients, password and keyfile can't be used")
+		}
+
+		p.header = h
+		p.setKeys(nil)
+
+		return nil
+	}
+
+	var appendKeys []batchKey
+
+	if key == "" {
+		var kErr error
+
+		switch h.Key.KDF {
+		case kdfSHA256:
+			key, kErr = p.passwordKey(h)
+
+		case kdfX25519:
+			key, appendKeys, kErr = p.recipientKeys(h)
+
+		case kdfSlots:
+			key, p.slot, kErr = p.credentials().slotsKey(h)
+
+		default:
+			kErr = fmt.Errorf("unsupported key derivation %s", h.Key.KDF)
+		}
+
+		if kErr != nil {
+			return kErr
+		}
+	}
+
+	bk, bkErr := newBatchKey(1, key)
+	if bkErr != nil {
+		return bkErr
+	}
+
+	p.setKeys(append([]batchKey{bk}, appendKeys...))
+
+	p.header = h
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package encryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendToLegacyArchive(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	writeTree(t, filepath.Join(dir, "raw1"), map[string][]byte{"a.txt": []byte("legacy file")})
+	writeTree(t, filepath.Join(dir, "raw2"), map[string][]byte{"b.txt": []byte("appended file")})
+
+	// Archives created before headers were introduced have their key derived
+	// from the password.
+	require.NoError(t, os.Mkdir(enc, 0755))
+	require.NoError(t, writeHeader(context.Background(), backend.Local{}, enc, legacyHeader()))
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw1"),
+		OutputDir:    enc,
+		MaxBatchSize: 4096,
+	})
+
+	require.NoError(t, os.Remove(filepath.Join(enc, headerFilename)))
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw2"),
+		OutputDir:    enc,
+		MaxBatchSize: 4096,
+	})
+
+	h, hErr := readHeader(context.Background(), backend.Local{}, enc)
+	require.NoError(t, hErr)
+	require.Equal(t, kdfSlots, h.Key.KDF)
+
+	require.Equal(t, map[string][]byte{
+		"a.txt": []byte("legacy file"),
+		"b.txt": []byte("appended file"),
+	}, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
+
+func TestRecipients(t *testing.T) {
+	for _, volumeSize := range []int64{0, testVolumeSize} {
+		dir := t.TempDir()
+		enc := filepath.Join(dir, "enc")
+
+		team := filepath.Join(dir, "team.key")
+		backup := filepath.Join(dir, "backup.key")
+		other := filepath.Join(dir, "other.key")
+
+		for _, identity := range []string{team, backup, other} {
+			require.NoError(t, Keygen(identity))
+		}
+
+		files1 := map[string][]byte{"a.txt": []byte("first run"), "big.bin": testData(2 * testBatchSize)}
+		files2 := map[string][]byte{"b.txt": []byte("second run"), "big2.bin": testData(3 * testBatchSize)}
+		files3 := map[string][]byte{"c.txt": []byte("third run")}
+
+		writeTree(t, filepath.Join(dir, "raw1"), files1)
+		writeTree(t, filepath.Join(dir, "raw2"), files2)
+		writeTree(t, filepath.Join(dir, "raw3"), files3)
+
+		encryptTree(t, Config{
+			SourceDir:    filepath.Join(dir, "raw1"),
+			OutputDir:    enc,
+			MaxBatchSize: testBatchSize,
+			VolumeSize:   volumeSize,
+			Recipients:   []string{team + ".pub", backup + ".pub"},
+		})
+
+		// Files are appended without the identity.
+		for _, raw := range []string{"raw2", "raw3"} {
+			p, pErr := New(Config{
+				SourceDir:    filepath.Join(dir, raw),
+				OutputDir:    enc,
+				MaxBatchSize: testBatchSize,
+				VolumeSize:   volumeSize,
+			})
+			require.NoError(t, pErr)
+			require.NoError(t, p.Encrypt(context.Background()))
+		}
+
+		// Passwords don't apply.
+		eErr := newTestProcessor(t, Config{
+			SourceDir:    filepath.Join(dir, "raw3"),
+			OutputDir:    enc,
+			MaxBatchSize: testBatchSize,
+		}).Encrypt(context.Background())
+		require.True(t, errors.Is(eErr, ErrWrongKey), eErr)
+
+		h, hErr := readHeader(context.Background(), backend.Local{}, enc)
+		require.NoError(t, hErr)
+		require.Equal(t, kdfX25519, h.Key.KDF)
+		require.Equal(t, appendKeysVersion, h.Version)
+		require.Len(t, h.Key.Appends, 2)
+
+		expected := make(map[string][]byte)
+		for _, files := range []map[string][]byte{files1, files2, files3} {
+			for name, data := range files {
+				expected[name] = data
+			}
+		}
+
+		// Every recipient decrypts all runs.
+		for i, identity := range []string{team, backup} {
+			require.Equal(t, expected, decryptTree(t, Config{
+				SourceDir: enc,
+				OutputDir: filepath.Join(dir, fmt.Sprintf("restored-%d", i)),
+				Identity:  identity,
+			}))
+		}
+
+		// Catalogs rewritten by the appending runs are read.
+		if volumeSize > 0 {
+			vols, volsErr := listVolumes(enc)
+			require.NoError(t, volsErr)
+			require.Greater(t, len(vols), 1)
+
+			require.Equal(t, expected, decryptTree(t, Config{
+				Volumes:   vols,
+				OutputDir: filepath.Join(dir, "restored-volumes"),
+				Identity:  team,
+			}))
+		}
+
+		dErr := newTestProcessor(t, Config{
+			SourceDir: enc,
+			OutputDir: filepath.Join(dir, "other"),
+			Identity:  other,
+		}).Decrypt(context.Background())
+		require.True(t, errors.Is(dErr, ErrWrongKey), dErr)
+
+		report := verifyArchive(t, Config{SourceDir: enc, Identity: team})
+		require.Empty(t, report.Problems)
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	dir := t.TempDir()
+
+	keyfile := filepath.Join(dir, "key.bin")
+	wrongKeyfile := filepath.Join(dir, "wrong.bin")
+	missingKeyfile := filepath.Join(dir, "missing.bin")
+
+	require.NoError(t, ioutil.WriteFile(keyfile, testData(1000), 0600))
+	require.NoError(t, ioutil.WriteFile(wrongKeyfile, testData(999), 0600))
+
+	files := map[string][]byte{"a.txt": []byte("first file"), "big.bin": testData(2 * testBatchSize)}
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	// unlockArchive unlocks the archive with the credentials.
+	unlockArchive := func(enc, password, keyfile string) error {
+		p, pErr := New(Config{SourceDir: enc, Password: password, Keyfile: keyfile})
+		require.NoError(t, pErr)
+
+		return p.unlock(context.Background(), p.archiveDir(), false)
+	}
+
+	cases := []struct {
+		name     string
+		password string
+		wrong    [][2]string
+	}{
+		{
+			name:     "password and keyfile",
+			password: testPassword,
+			wrong: [][2]string{
+				{testPassword, ""},
+				{"", keyfile},
+				{testPassword, wrongKeyfile},
+				{"wrong", keyfile},
+			},
+		},
+		{
+			name: "keyfile",
+			wrong: [][2]string{
+				{testPassword, ""},
+				{testPassword, keyfile},
+				{"", wrongKeyfile},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		enc := filepath.Join(dir, c.name)
+
+		encryptTree(t, Config{
+			SourceDir:    filepath.Join(dir, "raw"),
+			OutputDir:    enc,
+			MaxBatchSize: testBatchSize,
+			Password:     c.password,
+			Keyfile:      keyfile,
+		})
+
+		h, hErr := readHeader(context.Background(), backend.Local{}, enc)
+		require.NoError(t, hErr)
+		require.Len(t, h.Key.Slots, 1)
+
+		expectedFactors := []string{factorKeyfile}
+		if c.password != "" {
+			expectedFactors = []string{factorPassword, factorKeyfile}
+		}
+
+		require.Equal(t, expectedFactors, h.Key.Slots[0].Factors, c.name)
+
+		require.NoError(t, unlockArchive(enc, c.password, keyfile), c.name)
+
+		require.Equal(t, files, decryptTree(t, Config{
+			SourceDir: enc,
+			OutputDir: filepath.Join(dir, c.name+" restored"),
+			Password:  c.password,
+			Keyfile:   keyfile,
+		}), c.name)
+
+		for _, w := range c.wrong {
+			uErr := unlockArchive(enc, w[0], w[1])
+			require.True(t, errors.Is(uErr, ErrWrongKey), "%s: password %q, keyfile %q: %v", c.name, w[0], w[1], uErr)
+		}
+
+		// Missing keyfiles aren't read.
+		uErr := unlockArchive(enc, c.password, missingKeyfile)
+		require.Error(t, uErr, c.name)
+		require.Contains(t, uErr.Error(), "failed to open keyfile", c.name)
+	}
+}
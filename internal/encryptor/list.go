@@ -0,0 +1,113 @@
+package encryptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Entry describes a file or a directory stored in the archive.
+type Entry struct {
+	Path    string      `json:"path"`
+	IsDir   bool        `json:"is_dir"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// Listing contains the archive entries selected by the filter rules.
+type Listing struct {
+	Entries []Entry `json:"entries"`
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+}
+
+// Write writes the listing in the given format.
+func (l *Listing) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(l)
+
+	case ReportFormatTable, "":
+		if len(l.Entries) > 0 {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader([]string{"Mode", "Size", "Modified", "Path"})
+
+			for _, e := range l.Entries {
+				size := strconv.FormatInt(e.Size, 10)
+				if e.IsDir {
+					size = ""
+				}
+
+				table.Append([]string{e.Mode.String(), size, e.ModTime.Format(time.RFC3339), e.Path})
+			}
+
+			table.Render()
+		}
+
+		_, wErr := fmt.Fprintf(w, "%d entries, %d files, %d bytes\n", len(l.Entries), l.Files, l.Bytes)
+
+		return wErr
+
+	default:
+		return fmt.Errorf("unsupported report format %s", format)
+	}
+}
+
+// List returns the entries of the archive selected by the filter rules
+// ordered by path. Directories created by Encrypt don't record their metadata
+// and are listed with the time of the listing.
+func (p *Processor) List(ctx context.Context) (*Listing, error) {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return nil, fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return nil, fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	tree, treeErr := p.indexArchive(ctx, ff)
+	if treeErr != nil {
+		return nil, fmt.Errorf("failed to index archive: %w", treeErr)
+	}
+
+	l := &Listing{
+		Entries: []Entry{},
+	}
+
+	var walk func(e *serveEntry)
+	walk = func(e *serveEntry) {
+		for _, c := range e.sortedChildren() {
+			l.Entries = append(l.Entries, Entry{
+				Path:    c.relPath,
+				IsDir:   c.dir,
+				Size:    c.size,
+				Mode:    c.mode,
+				ModTime: c.modTime,
+			})
+
+			if c.dir {
+				walk(c)
+				continue
+			}
+
+			l.Files++
+			l.Bytes += c.size
+		}
+	}
+
+	walk(tree.root)
+
+	return l, nil
+}
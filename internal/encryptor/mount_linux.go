@@ -0,0 +1,317 @@
+package encryptor
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountBlockSize is the size of the decrypted file blocks cached in memory.
+const mountBlockSize = 1024 * 1024
+
+type blockKey struct {
+	e     *serveEntry
+	index int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache keeps the least recently used decrypted blocks up to the
+// configured number of bytes.
+type blockCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	blocks  map[blockKey]*list.Element
+}
+
+func newBlockCache(maxSize int64) *blockCache {
+	return &blockCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		blocks:  make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+
+	return el.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.blocks[key]; ok || int64(len(data)) > c.maxSize {
+		return
+	}
+
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.size += int64(len(data))
+
+	// Evict the least recently used blocks.
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		b := el.Value.(*cachedBlock)
+
+		c.lru.Remove(el)
+		delete(c.blocks, b.key)
+		c.size -= int64(len(b.data))
+	}
+}
+
+// setAttr fills in the attributes of the served entry.
+func setAttr(e *serveEntry, out *fuse.Attr) {
+	out.Mode = uint32(e.mode.Perm())
+	out.Nlink = 1
+
+	if e.dir {
+		out.Mode |= syscall.S_IFDIR
+		out.Nlink = 2
+	} else {
+		out.Mode |= syscall.S_IFREG
+		out.Size = uint64(e.size)
+		out.Blocks = (out.Size + 511) / 512
+	}
+
+	out.SetTimes(nil, &e.modTime, &e.modTime)
+}
+
+// mountDir is a directory of the mounted tree.
+type mountDir struct {
+	fs.Inode
+
+	ctx   context.Context
+	p     *Processor
+	e     *serveEntry
+	cache *blockCache
+}
+
+var _ = (fs.NodeOnAdder)((*mountDir)(nil))
+var _ = (fs.NodeGetattrer)((*mountDir)(nil))
+
+// OnAdd adds the whole tree once the root is mounted.
+func (d *mountDir) OnAdd(ctx context.Context) {
+	for _, c := range d.e.sortedChildren() {
+		var node fs.InodeEmbedder
+		var mode uint32
+
+		if c.dir {
+			node = &mountDir{ctx: d.ctx, p: d.p, e: c, cache: d.cache}
+			mode = syscall.S_IFDIR
+		} else {
+			node = &mountFile{ctx: d.ctx, p: d.p, e: c, cache: d.cache}
+			mode = syscall.S_IFREG
+		}
+
+		d.AddChild(c.name, d.NewPersistentInode(ctx, node, fs.StableAttr{Mode: mode}), false)
+	}
+}
+
+func (d *mountDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setAttr(d.e, &out.Attr)
+	return 0
+}
+
+// mountFile is a file of the mounted tree decrypted on demand.
+type mountFile struct {
+	fs.Inode
+
+	ctx   context.Context
+	p     *Processor
+	e     *serveEntry
+	cache *blockCache
+}
+
+var _ = (fs.NodeGetattrer)((*mountFile)(nil))
+var _ = (fs.NodeOpener)((*mountFile)(nil))
+
+func (f *mountFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setAttr(f.e, &out.Attr)
+	return 0
+}
+
+func (f *mountFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+
+	return &mountHandle{
+		f: f,
+		stream: &serveFile{
+			ctx: f.ctx,
+			p:   f.p,
+			e:   f.e,
+		},
+	}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// mountHandle reads the blocks missing in the cache from a stream kept open
+// between reads, so sequential reads decrypt each batch once.
+type mountHandle struct {
+	f *mountFile
+
+	mu     sync.Mutex
+	stream *serveFile
+}
+
+var _ = (fs.FileReader)((*mountHandle)(nil))
+var _ = (fs.FileReleaser)((*mountHandle)(nil))
+
+// block returns the decrypted block of the file.
+func (h *mountHandle) block(index int64) ([]byte, error) {
+	key := blockKey{e: h.f.e, index: index}
+
+	if data, ok := h.f.cache.get(key); ok {
+		return data, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	start := index * mountBlockSize
+
+	size := h.f.e.size - start
+	if size > mountBlockSize {
+		size = mountBlockSize
+	}
+
+	// The stream is restarted unless it's positioned at the block already.
+	_, seekErr := h.stream.Seek(start, io.SeekStart)
+	if seekErr != nil {
+		return nil, seekErr
+	}
+
+	data := make([]byte, size)
+
+	_, rErr := io.ReadFull(h.stream, data)
+	if rErr != nil {
+		h.stream.closeStream()
+		h.stream.pos = 0
+
+		return nil, rErr
+	}
+
+	h.f.cache.put(key, data)
+
+	return data, nil
+}
+
+func (h *mountHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	var n int
+
+	for n < len(dest) && off+int64(n) < h.f.e.size {
+		pos := off + int64(n)
+
+		data, bErr := h.block(pos / mountBlockSize)
+		if bErr != nil {
+			log.Printf("failed to read file %s: %v", h.f.e.relPath, bErr)
+			return nil, syscall.EIO
+		}
+
+		n += copy(dest[n:], data[pos%mountBlockSize:])
+	}
+
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *mountHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stream.Close()
+
+	return 0
+}
+
+// Mount unlocks the archive and mounts the files selected by the filter rules
+// read-only at the output directory until it's unmounted or the context is
+// done. File contents are decrypted on demand keeping up to the configured
+// number of bytes in memory.
+func (p *Processor) Mount(ctx context.Context) error {
+	if p.outputDir == "" {
+		return errors.New("mount point isn't set")
+	}
+
+	lErr := requireLocal(p.output, "mount point")
+	if lErr != nil {
+		return lErr
+	}
+
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	tree, treeErr := p.indexArchive(ctx, ff)
+	if treeErr != nil {
+		return fmt.Errorf("failed to index archive: %w", treeErr)
+	}
+
+	root := &mountDir{
+		ctx:   ctx,
+		p:     p,
+		e:     tree.root,
+		cache: newBlockCache(p.mountCacheSize),
+	}
+
+	srv, mountErr := fs.Mount(p.outputDir, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      p.sourceDir,
+			Name:        "directory-encryptor",
+			DirectMount: true,
+			Options:     []string{"ro"},
+		},
+	})
+	if mountErr != nil {
+		return fmt.Errorf("failed to mount %s: %v", p.outputDir, mountErr)
+	}
+
+	log.Printf("mounted archive at %s, unmount it or interrupt to exit", p.outputDir)
+
+	// Unmount once the context is done.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			umountErr := srv.Unmount()
+			if umountErr != nil {
+				log.Printf("failed to unmount %s: %v", p.outputDir, umountErr)
+			}
+
+		case <-done:
+		}
+	}()
+
+	srv.Wait()
+
+	return checkContext(ctx)
+}
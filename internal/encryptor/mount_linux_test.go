@@ -0,0 +1,173 @@
+package encryptor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache(t *testing.T) {
+	e := &serveEntry{}
+	c := newBlockCache(10)
+
+	c.put(blockKey{e: e, index: 0}, []byte("aaaa"))
+	c.put(blockKey{e: e, index: 1}, []byte("bbbb"))
+
+	// The first block becomes the most recently used one.
+	data, ok := c.get(blockKey{e: e, index: 0})
+	require.True(t, ok)
+	require.Equal(t, "aaaa", string(data))
+
+	// The least recently used block is evicted.
+	c.put(blockKey{e: e, index: 2}, []byte("cccc"))
+
+	_, ok = c.get(blockKey{e: e, index: 1})
+	require.False(t, ok)
+
+	for _, index := range []int64{0, 2} {
+		_, ok = c.get(blockKey{e: e, index: index})
+		require.True(t, ok, index)
+	}
+
+	require.Equal(t, int64(8), c.size)
+
+	// Cached blocks aren't replaced.
+	c.put(blockKey{e: e, index: 0}, []byte("dddd"))
+
+	data, _ = c.get(blockKey{e: e, index: 0})
+	require.Equal(t, "aaaa", string(data))
+
+	// Blocks larger than the cache aren't cached and don't evict others.
+	c.put(blockKey{e: e, index: 3}, []byte("eeeeeeeeeee"))
+
+	_, ok = c.get(blockKey{e: e, index: 3})
+	require.False(t, ok)
+	require.Equal(t, int64(8), c.size)
+	require.Equal(t, 2, c.lru.Len())
+}
+
+// mountTestFile encrypts the data and returns the mounted file serving it
+// along with the batch files of the archive.
+func mountTestFile(t *testing.T, data []byte) (*mountFile, []string) {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{"big.bin": data})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: mountBlockSize,
+	})
+
+	ctx := context.Background()
+
+	p := newTestProcessor(t, Config{SourceDir: filepath.Join(dir, "enc")})
+	require.NoError(t, p.unlock(ctx, p.archiveDir(), false))
+
+	ff, ffErr := p.newFileFilter(nil)
+	require.NoError(t, ffErr)
+
+	tree, treeErr := p.indexArchive(ctx, ff)
+	require.NoError(t, treeErr)
+
+	e := tree.entry("big.bin", false)
+	require.NotNil(t, e)
+	require.Greater(t, len(e.parts), 2)
+
+	return &mountFile{
+		ctx:   ctx,
+		p:     p,
+		e:     e,
+		cache: newBlockCache(4 * mountBlockSize),
+	}, archiveBatches(t, filepath.Join(dir, "enc"))
+}
+
+func openMountFile(t *testing.T, f *mountFile) *mountHandle {
+	fh, _, errno := f.Open(context.Background(), syscall.O_RDONLY)
+	require.Equal(t, syscall.Errno(0), errno)
+
+	return fh.(*mountHandle)
+}
+
+func TestMountRead(t *testing.T) {
+	data := testData(2*mountBlockSize + 1000)
+
+	f, _ := mountTestFile(t, data)
+
+	// Writable opens are rejected.
+	_, _, errno := f.Open(context.Background(), syscall.O_RDWR)
+	require.Equal(t, syscall.EROFS, errno)
+
+	h := openMountFile(t, f)
+	defer h.Release(context.Background())
+
+	// Blocks are read out of order seeking the stream.
+	for _, index := range []int64{2, 0, 1} {
+		block, bErr := h.block(index)
+		require.NoError(t, bErr)
+
+		start := index * mountBlockSize
+		end := start + mountBlockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		require.Equal(t, data[start:end], block, "block %d", index)
+
+		_, ok := f.cache.get(blockKey{e: f.e, index: index})
+		require.True(t, ok, "block %d", index)
+	}
+
+	// Reads span the blocks and stop at the end of the file.
+	for _, off := range []int64{0, mountBlockSize - 10, 2*mountBlockSize + 900} {
+		dest := make([]byte, 200)
+
+		res, errno := h.Read(context.Background(), dest, off)
+		require.Equal(t, syscall.Errno(0), errno)
+
+		end := off + 200
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		got, _ := res.Bytes(nil)
+		require.Equal(t, data[off:end], got, "offset %d", off)
+	}
+}
+
+func TestMountReadFailure(t *testing.T) {
+	data := testData(2*mountBlockSize + 1000)
+
+	f, batches := mountTestFile(t, data)
+
+	h := openMountFile(t, f)
+	defer h.Release(context.Background())
+
+	// Read the first block keeping the stream open.
+	_, bErr := h.block(0)
+	require.NoError(t, bErr)
+
+	// The stream is reset once a read fails.
+	last := batches[len(batches)-1]
+	require.NoError(t, os.Rename(last, last+".moved"))
+
+	_, bErr = h.block(2)
+	require.Error(t, bErr)
+	require.Nil(t, h.stream.stream)
+	require.Equal(t, int64(0), h.stream.pos)
+
+	dest := make([]byte, 100)
+	_, errno := h.Read(context.Background(), dest, 2*mountBlockSize)
+	require.Equal(t, syscall.EIO, errno)
+
+	// The following reads start a new stream.
+	require.NoError(t, os.Rename(last+".moved", last))
+
+	block, bErr := h.block(2)
+	require.NoError(t, bErr)
+	require.Equal(t, data[2*mountBlockSize:], block)
+}
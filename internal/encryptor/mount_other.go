@@ -0,0 +1,13 @@
+//go:build !linux
+
+package encryptor
+
+import (
+	"context"
+	"errors"
+)
+
+// Mount is only supported on Linux.
+func (p *Processor) Mount(ctx context.Context) error {
+	return errors.New("mounting archives is only supported on Linux")
+}
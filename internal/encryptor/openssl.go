@@ -0,0 +1,116 @@
+package encryptor
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/openssl"
+)
+
+// opensslExtension is appended to the names of files encrypted by
+// OpenSSLEncrypt and trimmed by OpenSSLDecrypt.
+const opensslExtension = ".enc"
+
+// opensslFile streams the source file through the transformation into the
+// output directory under the given name, existing files aren't overwritten.
+// The output is removed if the transformation fails.
+func (p *Processor) opensslFile(name string, transform func(dst io.Writer, src io.Reader) error) error {
+	if p.outputDir == "" {
+		return errEmptyOutputDir
+	}
+
+	localErr := requireLocal(p.source, "source file")
+	if localErr != nil {
+		return localErr
+	}
+
+	localErr = requireLocal(p.output, "output directory")
+	if localErr != nil {
+		return localErr
+	}
+
+	if p.password == "" {
+		return errEmptyPassword
+	}
+
+	src, srcErr := os.Open(p.sourceDir)
+	if srcErr != nil {
+		return fmt.Errorf("failed to open source file: %v", srcErr)
+	}
+
+	defer src.Close()
+
+	outPath := filepath.Join(p.outputDir, name)
+
+	f, fErr := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if fErr != nil {
+		return fmt.Errorf("failed to create output file: %v", fErr)
+	}
+
+	tErr := transform(f, src)
+	if tErr != nil {
+		f.Close()
+		os.Remove(outPath)
+		return tErr
+	}
+
+	closeErr := f.Close()
+	if closeErr != nil {
+		os.Remove(outPath)
+		return fmt.Errorf("failed to close output file: %v", closeErr)
+	}
+
+	log.Printf("written %s", outPath)
+
+	return nil
+}
+
+// OpenSSLEncrypt encrypts the source file into the output directory in the
+// `openssl enc -aes-256-cbc -pbkdf2` format.
+func (p *Processor) OpenSSLEncrypt() error {
+	return p.opensslFile(filepath.Base(p.sourceDir)+opensslExtension, func(dst io.Writer, src io.Reader) error {
+		w, wErr := openssl.NewWriter(dst, p.password, p.opensslIterations)
+		if wErr != nil {
+			return fmt.Errorf("failed to initialize encryption: %v", wErr)
+		}
+
+		_, cErr := io.Copy(w, src)
+		if cErr != nil {
+			return fmt.Errorf("failed to encrypt source file: %v", cErr)
+		}
+
+		closeErr := w.Close()
+		if closeErr != nil {
+			return fmt.Errorf("failed to encrypt source file: %v", closeErr)
+		}
+
+		return nil
+	})
+}
+
+// OpenSSLDecrypt decrypts the source file encrypted by OpenSSLEncrypt or
+// `openssl enc -aes-256-cbc -pbkdf2` into the output directory.
+func (p *Processor) OpenSSLDecrypt() error {
+	name := filepath.Base(p.sourceDir)
+	if trimmed := strings.TrimSuffix(name, opensslExtension); trimmed != "" {
+		name = trimmed
+	}
+
+	return p.opensslFile(name, func(dst io.Writer, src io.Reader) error {
+		r, rErr := openssl.NewReader(src, p.password, p.opensslIterations)
+		if rErr != nil {
+			return fmt.Errorf("failed to read source file: %v", rErr)
+		}
+
+		_, cErr := io.Copy(dst, r)
+		if cErr != nil {
+			return fmt.Errorf("failed to decrypt source file: %v", cErr)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,376 @@
+package encryptor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	parityDirName     = "parity"
+	parityManifestExt = ".manifest"
+)
+
+// parityShard describes a file protected by or holding parity data.
+type parityShard struct {
+	// Path relative to the archive root.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// parityManifest describes a group of batch files protected by parity files.
+type parityManifest struct {
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	ShardSize    int64 `json:"shard_size"`
+
+	Batches []parityShard `json:"batches"`
+	Parity  []parityShard `json:"parity"`
+}
+
+// zeroReader returns an endless stream of zero bytes used to pad shards.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+// fileSHA256 returns the size and the hex-encoded SHA-256 hash of the file.
+func fileSHA256(file string) (int64, string, error) {
+	f, fErr := os.Open(file)
+	if fErr != nil {
+		return 0, "", fErr
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	n, cErr := io.Copy(h, f)
+	if cErr != nil {
+		return 0, "", cErr
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeParity generates parity files over groups of the given batch files,
+// which paths are relative to the output directory.
+func (p *Processor) writeParity(batches []string) error {
+	parityDir := path.Join(p.outputDir, parityDirName)
+
+	mkdirErr := os.MkdirAll(parityDir, 0755)
+	if mkdirErr != nil {
+		return fmt.Errorf("failed to create parity directory: %v", mkdirErr)
+	}
+
+	for start := 0; start < len(batches); start += p.parityGroupSize {
+		end := start + p.parityGroupSize
+		if end > len(batches) {
+			end = len(batches)
+		}
+
+		gErr := p.writeParityGroup(parityDir, batches[start:end])
+		if gErr != nil {
+			return fmt.Errorf("failed to write parity of %s: %v", batches[start], gErr)
+		}
+	}
+
+	return nil
+}
+
+func (p *Processor) writeParityGroup(parityDir string, batches []string) error {
+	m := &parityManifest{
+		DataShards:   len(batches),
+		ParityShards: p.parityShards,
+	}
+
+	// Describe batch files.
+	for _, b := range batches {
+		size, sum, sumErr := fileSHA256(path.Join(p.outputDir, b))
+		if sumErr != nil {
+			return fmt.Errorf("failed to hash batch file: %v", sumErr)
+		}
+
+		if size > m.ShardSize {
+			m.ShardSize = size
+		}
+
+		m.Batches = append(m.Batches, parityShard{
+			Path:   b,
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+
+	enc, encErr := reedsolomon.NewStream(m.DataShards, m.ParityShards)
+	if encErr != nil {
+		return fmt.Errorf("failed to create parity encoder: %v", encErr)
+	}
+
+	// Open padded batch files.
+	inputs := make([]io.Reader, m.DataShards)
+	for i, b := range m.Batches {
+		f, fErr := os.Open(path.Join(p.outputDir, b.Path))
+		if fErr != nil {
+			return fmt.Errorf("failed to open batch file: %v", fErr)
+		}
+
+		defer f.Close()
+
+		inputs[i] = io.MultiReader(f, io.LimitReader(zeroReader{}, m.ShardSize-b.Size))
+	}
+
+	// Create parity files.
+	groupName := strings.TrimSuffix(path.Base(batches[0]), batchFileExt)
+
+	outputs := make([]io.Writer, m.ParityShards)
+	parityFiles := make([]*os.File, m.ParityShards)
+	for i := range outputs {
+		f, fErr := os.Create(path.Join(parityDir, fmt.Sprintf("%s.parity.%d", groupName, i)))
+		if fErr != nil {
+			return fmt.Errorf("failed to create parity file: %v", fErr)
+		}
+
+		defer f.Close()
+
+		outputs[i] = f
+		parityFiles[i] = f
+	}
+
+	eErr := enc.Encode(inputs, outputs)
+	if eErr != nil {
+		return fmt.Errorf("failed to encode parity: %v", eErr)
+	}
+
+	// Describe parity files.
+	for _, f := range parityFiles {
+		cErr := f.Close()
+		if cErr != nil {
+			return fmt.Errorf("failed to close parity file: %v", cErr)
+		}
+
+		rel := path.Join(parityDirName, path.Base(f.Name()))
+
+		size, sum, sumErr := fileSHA256(f.Name())
+		if sumErr != nil {
+			return fmt.Errorf("failed to hash parity file: %v", sumErr)
+		}
+
+		m.Parity = append(m.Parity, parityShard{
+			Path:   rel,
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+
+	mb, mbErr := json.MarshalIndent(m, "", "  ")
+	if mbErr != nil {
+		return fmt.Errorf("failed to marshal parity manifest: %v", mbErr)
+	}
+
+	wErr := ioutil.WriteFile(path.Join(parityDir, groupName+parityManifestExt), mb, 0644)
+	if wErr != nil {
+		return fmt.Errorf("failed to write parity manifest: %v", wErr)
+	}
+
+	return nil
+}
+
+// Repair checks batch files against parity manifests and reconstructs damaged
+// or missing ones from parity files.
+func (p *Processor) Repair() error {
+	localErr := requireLocal(p.source, "source directory")
+	if localErr != nil {
+		return localErr
+	}
+
+	parityDir := path.Join(p.sourceDir, parityDirName)
+
+	pFiles, pFilesErr := ioutil.ReadDir(parityDir)
+	if pFilesErr != nil {
+		return fmt.Errorf("failed to list parity directory: %v", pFilesErr)
+	}
+
+	var manifests []string
+	for _, pf := range pFiles {
+		if strings.HasSuffix(pf.Name(), parityManifestExt) {
+			manifests = append(manifests, path.Join(parityDir, pf.Name()))
+		}
+	}
+
+	sort.Strings(manifests)
+
+	var repaired, unrepairable int
+
+	for _, mPath := range manifests {
+		n, rErr := p.repairGroup(mPath)
+		if rErr != nil {
+			log.Printf("failed to repair group %s: %v", path.Base(mPath), rErr)
+			unrepairable++
+			continue
+		}
+
+		repaired += n
+	}
+
+	log.Printf("checked %d parity groups, repaired %d files", len(manifests), repaired)
+
+	if unrepairable > 0 {
+		return fmt.Errorf("%d parity groups can't be repaired", unrepairable)
+	}
+
+	return nil
+}
+
+// repairGroup repairs files of the parity group returning the number of
+// repaired files.
+func (p *Processor) repairGroup(mPath string) (int, error) {
+	mb, mbErr := ioutil.ReadFile(mPath)
+	if mbErr != nil {
+		return 0, fmt.Errorf("failed to read parity manifest: %v", mbErr)
+	}
+
+	var m parityManifest
+
+	mErr := json.Unmarshal(mb, &m)
+	if mErr != nil {
+		return 0, fmt.Errorf("failed to unmarshal parity manifest: %v", mErr)
+	}
+
+	shards := append(append([]parityShard{}, m.Batches...), m.Parity...)
+
+	if len(m.Batches) != m.DataShards || len(m.Parity) != m.ParityShards {
+		return 0, fmt.Errorf("invalid parity manifest")
+	}
+
+	// Find damaged files.
+	var damaged []int
+	for i, s := range shards {
+		if !validRelativePath(s.Path) {
+			return 0, fmt.Errorf("invalid path in parity manifest: %q", s.Path)
+		}
+
+		size, sum, sumErr := fileSHA256(path.Join(p.sourceDir, s.Path))
+		if sumErr != nil || size != s.Size || sum != s.SHA256 {
+			log.Printf("damaged file detected: %s", s.Path)
+			damaged = append(damaged, i)
+		}
+	}
+
+	if len(damaged) == 0 {
+		return 0, nil
+	}
+
+	if len(damaged) > m.ParityShards {
+		return 0, fmt.Errorf("%d files are damaged, at most %d can be repaired", len(damaged), m.ParityShards)
+	}
+
+	enc, encErr := reedsolomon.NewStream(m.DataShards, m.ParityShards)
+	if encErr != nil {
+		return 0, fmt.Errorf("failed to create parity decoder: %v", encErr)
+	}
+
+	valid := make([]io.Reader, len(shards))
+	fill := make([]io.Writer, len(shards))
+	tmpFiles := make(map[int]*os.File)
+
+	defer func() {
+		for _, f := range tmpFiles {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	isDamaged := make(map[int]bool)
+	for _, i := range damaged {
+		isDamaged[i] = true
+	}
+
+	for i, s := range shards {
+		fPath := path.Join(p.sourceDir, s.Path)
+
+		if isDamaged[i] {
+			// Reconstruct into a temporary file next to the damaged one.
+			mkdirErr := os.MkdirAll(filepath.Dir(fPath), 0755)
+			if mkdirErr != nil {
+				return 0, fmt.Errorf("failed to create directory: %v", mkdirErr)
+			}
+
+			f, fErr := ioutil.TempFile(filepath.Dir(fPath), ".repair-")
+			if fErr != nil {
+				return 0, fmt.Errorf("failed to create temporary file: %v", fErr)
+			}
+
+			tmpFiles[i] = f
+			fill[i] = f
+
+			continue
+		}
+
+		f, fErr := os.Open(fPath)
+		if fErr != nil {
+			return 0, fmt.Errorf("failed to open file: %v", fErr)
+		}
+
+		defer f.Close()
+
+		valid[i] = io.MultiReader(f, io.LimitReader(zeroReader{}, m.ShardSize-s.Size))
+	}
+
+	rErr := enc.Reconstruct(valid, fill)
+	if rErr != nil {
+		return 0, fmt.Errorf("failed to reconstruct files: %v", rErr)
+	}
+
+	// Replace damaged files with the reconstructed ones.
+	for i, f := range tmpFiles {
+		s := shards[i]
+
+		tErr := f.Truncate(s.Size)
+		if tErr != nil {
+			return 0, fmt.Errorf("failed to truncate reconstructed file: %v", tErr)
+		}
+
+		cErr := f.Close()
+		if cErr != nil {
+			return 0, fmt.Errorf("failed to close reconstructed file: %v", cErr)
+		}
+
+		_, sum, sumErr := fileSHA256(f.Name())
+		if sumErr != nil {
+			return 0, fmt.Errorf("failed to hash reconstructed file: %v", sumErr)
+		}
+
+		if sum != s.SHA256 {
+			return 0, fmt.Errorf("reconstructed file %s doesn't match its checksum", s.Path)
+		}
+
+		mvErr := os.Rename(f.Name(), path.Join(p.sourceDir, s.Path))
+		if mvErr != nil {
+			return 0, fmt.Errorf("failed to replace damaged file: %v", mvErr)
+		}
+
+		delete(tmpFiles, i)
+
+		log.Printf("repaired %s", s.Path)
+	}
+
+	return len(damaged), nil
+}
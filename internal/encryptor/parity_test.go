@@ -0,0 +1,165 @@
+package encryptor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+// testFiles returns n files of the given size with distinct contents.
+func testFiles(n, size int) map[string][]byte {
+	files := make(map[string][]byte)
+
+	for i := 0; i < n; i++ {
+		data := testData(size)
+		copy(data, fmt.Sprintf("file %d", i))
+
+		files[fmt.Sprintf("f%d.bin", i)] = data
+	}
+
+	return files
+}
+
+// corruptFile flips bytes in the middle of the file.
+func corruptFile(t *testing.T, fPath string) {
+	data, dErr := os.ReadFile(fPath)
+	require.NoError(t, dErr)
+
+	for i := len(data) / 2; i < len(data)/2+16 && i < len(data); i++ {
+		data[i] ^= 0xff
+	}
+
+	require.NoError(t, os.WriteFile(fPath, data, 0644))
+}
+
+func verifyArchive(t *testing.T, cfg Config) *VerificationReport {
+	report, vErr := newTestProcessor(t, cfg).VerifyReport(context.Background())
+	require.NoError(t, vErr)
+
+	return report
+}
+
+// archiveBatches returns the paths of the batch files stored in the archive
+// directory and its volumes.
+func archiveBatches(t *testing.T, enc string) []string {
+	dirs := []string{enc}
+
+	vols, volsErr := listVolumes(enc)
+	require.NoError(t, volsErr)
+
+	var res []string
+
+	for _, dir := range append(dirs, vols...) {
+		bFiles, bErr := listBatchFiles(context.Background(), backend.Local{}, dir)
+		require.NoError(t, bErr)
+
+		for _, bf := range bFiles {
+			res = append(res, bf.path)
+		}
+	}
+
+	return res
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	files := testFiles(6, 2000)
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:       filepath.Join(dir, "raw"),
+		OutputDir:       enc,
+		MaxBatchSize:    testBatchSize,
+		ParityShards:    1,
+		ParityGroupSize: 3,
+	})
+
+	batches := archiveBatches(t, enc)
+	require.Len(t, batches, 6)
+
+	// Damage a batch file of every parity group.
+	corruptFile(t, batches[1])
+	require.NoError(t, os.Remove(batches[4]))
+
+	require.NotEmpty(t, verifyArchive(t, Config{SourceDir: enc}).Problems)
+
+	require.NoError(t, newTestProcessor(t, Config{SourceDir: enc}).Repair())
+
+	report := verifyArchive(t, Config{SourceDir: enc})
+	require.Empty(t, report.Problems)
+	require.Equal(t, 6, report.Batches)
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
+
+func TestRepairVolumes(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	files := testFiles(6, 2000)
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:       filepath.Join(dir, "raw"),
+		OutputDir:       enc,
+		MaxBatchSize:    testBatchSize,
+		VolumeSize:      2 * testBatchSize,
+		ParityShards:    1,
+		ParityGroupSize: 3,
+	})
+
+	vols, volsErr := listVolumes(enc)
+	require.NoError(t, volsErr)
+	require.Greater(t, len(vols), 1)
+
+	// Damage a batch file stored in the second volume.
+	bFiles, bErr := listBatchFiles(context.Background(), backend.Local{}, vols[1])
+	require.NoError(t, bErr)
+	require.NotEmpty(t, bFiles)
+
+	corruptFile(t, bFiles[0].path)
+
+	require.NotEmpty(t, verifyArchive(t, Config{SourceDir: enc}).Problems)
+
+	require.NoError(t, newTestProcessor(t, Config{SourceDir: enc}).Repair())
+	require.Empty(t, verifyArchive(t, Config{SourceDir: enc}).Problems)
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
+
+func TestRepairTooManyDamaged(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	writeTree(t, filepath.Join(dir, "raw"), testFiles(3, 2000))
+
+	encryptTree(t, Config{
+		SourceDir:       filepath.Join(dir, "raw"),
+		OutputDir:       enc,
+		MaxBatchSize:    testBatchSize,
+		ParityShards:    1,
+		ParityGroupSize: 3,
+	})
+
+	batches := archiveBatches(t, enc)
+	require.Len(t, batches, 3)
+
+	corruptFile(t, batches[0])
+	corruptFile(t, batches[2])
+
+	require.Error(t, newTestProcessor(t, Config{SourceDir: enc}).Repair())
+	require.NotEmpty(t, verifyArchive(t, Config{SourceDir: enc}).Problems)
+}
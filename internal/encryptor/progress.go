@@ -0,0 +1,129 @@
+package encryptor
+
+import (
+	"log"
+	"time"
+)
+
+// progressInterval is the min interval between progress callbacks.
+const progressInterval = 200 * time.Millisecond
+
+// Progress is the state of the running operation. Bytes are raw file bytes
+// written by Encrypt and batch file bytes read by the other operations, the
+// totals are 0 if unknown.
+type Progress struct {
+	Files      int64
+	TotalFiles int64
+	Bytes      int64
+	TotalBytes int64
+
+	// Path of the file being processed.
+	Path string
+
+	// Elapsed time and the average number of bytes processed per second.
+	Elapsed    time.Duration
+	Throughput float64
+}
+
+// progress passes the state of the operation to the configured callback at
+// most every progressInterval, without a callback the percentage of the work
+// done is logged along with the ETA.
+type progress struct {
+	start    time.Time
+	last     time.Time
+	perc     int
+	callback func(Progress)
+	state    Progress
+}
+
+func (p *Processor) newProgress() *progress {
+	return &progress{
+		start:    time.Now(),
+		callback: p.onProgress,
+	}
+}
+
+// setTotals sets the number of files and bytes to process.
+func (pr *progress) setTotals(files, bytes int64) {
+	if pr == nil {
+		return
+	}
+
+	pr.state.TotalFiles = files
+	pr.state.TotalBytes = bytes
+}
+
+// file sets the path of the file being processed.
+func (pr *progress) file(path string) {
+	if pr == nil {
+		return
+	}
+
+	pr.state.Path = path
+}
+
+// fileDone counts the file being processed as done.
+func (pr *progress) fileDone() {
+	if pr == nil {
+		return
+	}
+
+	pr.state.Files++
+	pr.report(false)
+}
+
+// add counts n more bytes as processed.
+func (pr *progress) add(n int64) {
+	if pr == nil {
+		return
+	}
+
+	pr.state.Bytes += n
+	pr.report(false)
+}
+
+func (pr *progress) report(force bool) {
+	now := time.Now()
+
+	pr.state.Elapsed = now.Sub(pr.start)
+	if secs := pr.state.Elapsed.Seconds(); secs > 0 {
+		pr.state.Throughput = float64(pr.state.Bytes) / secs
+	}
+
+	if pr.callback != nil {
+		if force || now.Sub(pr.last) >= progressInterval {
+			pr.last = now
+			pr.callback(pr.state)
+		}
+
+		return
+	}
+
+	if pr.state.TotalBytes <= 0 {
+		return
+	}
+
+	currentPerc := int(pr.state.Bytes * 100 / pr.state.TotalBytes)
+	if currentPerc != pr.perc && currentPerc > 0 {
+		pr.perc = currentPerc
+		elapsed := pr.state.Elapsed.Truncate(time.Millisecond)
+		eta := elapsed*100/time.Duration(currentPerc) - elapsed
+
+		log.Printf("%d%%, ETA %s", currentPerc, eta.String())
+	}
+}
+
+// finish reports the final state, the completion is logged unless it was
+// logged already.
+func (pr *progress) finish() {
+	if pr == nil {
+		return
+	}
+
+	pr.state.Path = ""
+	pr.report(true)
+
+	if pr.callback == nil && pr.state.TotalBytes > 0 && pr.perc != 100 {
+		log.Print("100%")
+	}
+}
@@ -0,0 +1,457 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/aes256/cbc"
+)
+
+// errSkipFile is returned by recordHandler.fileStart to skip the contents of
+// the current file.
+var errSkipFile = errors.New("skip this file")
+
+// recordHandler receives records read from a batch file.
+type recordHandler struct {
+	directory func(fi *fileInfo) error
+	fileStart func(fi *fileInfo) error
+	fileEnd   func(fi *fileInfo) error
+
+	// fileData is passed the decrypted file contents as they're read, data
+	// is only valid until it returns.
+	fileData func(fi *fileInfo, data []byte) error
+
+	// checksum is called with the checksum record following the file data,
+	// it is optional and isn't called for skipped files.
+	checksum func(fi *fileInfo) error
+
+	// salvage is optional, when set damaged records don't abort reading.
+	// It's called with the error and the file being read (nil if unknown),
+	// reading resumes at the next readable record. The contents of the file
+	// being read are skipped up to its next part.
+	salvage func(fi *fileInfo, err error)
+
+	// seek is optional, it's called once the file part starts and returns
+	// the number of leading bytes of the part not passed to fileData. Data
+	// preceding the offset is mostly skipped without decrypting it.
+	seek func(fi *fileInfo) int64
+
+	// progress is optional, it's passed the batch file bytes read and the
+	// files read.
+	progress *progress
+}
+
+// progressReader passes the number of bytes read to the progress.
+type progressReader struct {
+	r  io.Reader
+	pr *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pr.add(int64(n))
+
+	return n, err
+}
+
+// maxMetadataRecordSize is the max size of encrypted metadata records, longer
+// records are damaged.
+const maxMetadataRecordSize = 64 * 1024
+
+// dataBufferSize is the size of the buffer file contents are passed to
+// recordHandler.fileData in.
+const dataBufferSize = 64 * 1024
+
+// recordReader reads the record up to its delimiter, which is consumed but
+// not returned.
+type recordReader struct {
+	r *bufio.Reader
+
+	// The delimiter ending the record, 0 until it's read.
+	delimiter byte
+
+	// Error reading the batch, its end isn't an error.
+	err error
+}
+
+func (rr *recordReader) Read(b []byte) (int, error) {
+	if rr.delimiter != 0 {
+		return 0, io.EOF
+	}
+
+	if rr.err != nil {
+		return 0, rr.err
+	}
+
+	_, pErr := rr.r.Peek(1)
+	if pErr != nil {
+		if pErr != io.EOF {
+			rr.err = pErr
+		}
+
+		return 0, pErr
+	}
+
+	data, _ := rr.r.Peek(rr.r.Buffered())
+
+	end := bytes.IndexAny(data, "?$")
+	if end >= 0 {
+		data = data[:end]
+	}
+
+	n := copy(b, data)
+	rr.r.Discard(n)
+
+	if n == end {
+		rr.delimiter, _ = rr.r.ReadByte()
+
+		if n == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// validRelativePath reports whether the metadata path stays inside the archive root.
+func validRelativePath(p string) bool {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p {
+		return false
+	}
+
+	return p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// readBatch reads the batch file records passing them to the handler.
+func (p *Processor) readBatch(ctx context.Context, fPath string, bc batchCipher, h recordHandler) error {
+	encGzipF, encGzipFErr := p.source.Open(ctx, fPath)
+	if encGzipFErr != nil {
+		return contextError(ctx, fmt.Errorf("failed to open file %s: %v", fPath, encGzipFErr))
+	}
+
+	defer encGzipF.Close()
+
+	var batchR io.Reader = encGzipF
+	if h.progress != nil {
+		batchR = &progressReader{r: encGzipF, pr: h.progress}
+	}
+
+	encF, encFErr := gzip.NewReader(batchR)
+	if encFErr != nil {
+		return contextError(ctx, fmt.Errorf("failed to init gzip reader on file %s: %v", fPath, encFErr))
+	}
+
+	defer encF.Close()
+
+	br := bufio.NewReader(encF)
+
+	var currSectorData []byte
+	var currFile *fileInfo
+	var currPartBytes int64
+	var seekLeft int64
+	var skipCurrentFile bool
+
+	// The last file ended and whether it was skipped.
+	var lastFile *fileInfo
+	var lastFileSkipped bool
+
+	// Set while looking for the next readable record in salvage mode.
+	var resync bool
+
+	decryptMD := func() (*fileInfo, error) {
+		if len(currSectorData) >= maxMetadataRecordSize {
+			return nil, fmt.Errorf("metadata record exceeds %d bytes", maxMetadataRecordSize)
+		}
+
+		// Decrypt metadata.
+		decMD, decMDErr := cbc.Decrypt(currSectorData, bc.key, bc.iv)
+		if decMDErr != nil {
+			return nil, fmt.Errorf("failed to decrypt metadata (%d bytes): %v", len(currSectorData), decMDErr)
+		}
+
+		// Unmarshal metadata.
+		var fi fileInfo
+
+		fiErr := json.Unmarshal(decMD, &fi)
+		if fiErr != nil {
+			return nil, fmt.Errorf("failed to unmarshall metadata (%d bytes): %v", len(decMD), fiErr)
+		}
+
+		if !validRelativePath(fi.RelativePath) {
+			return nil, fmt.Errorf("invalid path in metadata: %q", fi.RelativePath)
+		}
+
+		return &fi, nil
+	}
+
+	buf := make([]byte, dataBufferSize)
+
+	// readData streams the file data record to the handler, the rest of the
+	// record is discarded if the file is skipped or the record is damaged.
+	// Errors reading the batch are left in the record reader.
+	readData := func(rr *recordReader) error {
+		if skipCurrentFile {
+			// Read errors are kept by the record reader.
+			io.Copy(ioutil.Discard, rr)
+			return nil
+		}
+
+		cr, crErr := cbc.NewReader(rr, []byte(bc.key), []byte(bc.iv))
+		if crErr != nil {
+			return fmt.Errorf("failed to decrypt file %s part contents: %v", currFile.RelativePath, crErr)
+		}
+
+		var rErr error
+
+		if seekLeft > 0 {
+			var skipped int64
+			skipped, rErr = cr.Skip(seekLeft)
+
+			seekLeft -= skipped
+			currPartBytes += skipped
+		}
+
+		for rErr == nil {
+			var n int
+			n, rErr = cr.Read(buf)
+
+			if n > 0 {
+				currPartBytes += int64(n)
+
+				dErr := h.fileData(currFile, buf[:n])
+				if dErr != nil {
+					return dErr
+				}
+			}
+		}
+
+		io.Copy(ioutil.Discard, rr)
+
+		// The record ending with the batch is reported once it's read.
+		if rErr == io.EOF || rr.err != nil || rr.delimiter == 0 {
+			return nil
+		}
+
+		err := fmt.Errorf("failed to decrypt file %s part contents: %v", currFile.RelativePath, rErr)
+		if h.salvage == nil {
+			return err
+		}
+
+		h.salvage(currFile, err)
+		skipCurrentFile = true
+
+		return nil
+	}
+
+	for {
+		var b byte
+		var bErr error
+
+		if currFile != nil {
+			// Stream the file data record.
+			rr := &recordReader{r: br}
+
+			dErr := readData(rr)
+			if dErr != nil {
+				return dErr
+			}
+
+			b, bErr = rr.delimiter, rr.err
+			if b == 0 && bErr == nil {
+				bErr = io.EOF
+			}
+		} else {
+			b, bErr = br.ReadByte()
+		}
+
+		if bErr != nil {
+			if bErr != io.EOF {
+				// Reading remote batch files fails once the context is done.
+				ctxErr := checkContext(ctx)
+				if ctxErr != nil {
+					return ctxErr
+				}
+
+				err := fmt.Errorf("failed to read file %s: %v", fPath, bErr)
+				if h.salvage == nil {
+					return err
+				}
+
+				h.salvage(currFile, err)
+
+				return nil
+			}
+
+			break
+		}
+
+		// Check for cancellation at the end of every record.
+		if b == '$' || b == '?' {
+			ctxErr := checkContext(ctx)
+			if ctxErr != nil {
+				return ctxErr
+			}
+		}
+
+		if (b == '$' || b == '?') && currFile == nil && resync {
+			// Skip records until a readable metadata record is found.
+			fi, fiErr := decryptMD()
+			if fiErr != nil || (b == '$') == (fi.Filetype == FILE) {
+				currSectorData = []byte{}
+				continue
+			}
+
+			resync = false
+		}
+
+		switch string(b) {
+		case "$":
+			if currFile == nil {
+				// Decrypt directory or file checksum metadata.
+				fi, fiErr := decryptMD()
+				if fiErr == nil && fi.Filetype != DIRECTORY && fi.Filetype != CHECKSUM {
+					fiErr = fmt.Errorf("expected directory (%d) or checksum (%d) metadata but received (%d)", DIRECTORY, CHECKSUM, fi.Filetype)
+				}
+
+				if fiErr != nil {
+					err := fmt.Errorf("failed to decrypt directory metadata: %v", fiErr)
+					if h.salvage == nil {
+						return err
+					}
+
+					h.salvage(nil, err)
+
+					lastFile = nil
+					resync = true
+					currSectorData = []byte{}
+
+					continue
+				}
+
+				switch fi.Filetype {
+				case DIRECTORY:
+					dErr := h.directory(fi)
+					if dErr != nil {
+						return dErr
+					}
+
+				case CHECKSUM:
+					if lastFile == nil || lastFile.RelativePath != fi.RelativePath || lastFile.Offset != fi.Offset {
+						if h.salvage != nil {
+							// The file was lost along with a damaged record.
+							break
+						}
+
+						return fmt.Errorf("unexpected checksum record for file %s at offset %d", fi.RelativePath, fi.Offset)
+					}
+
+					if h.checksum != nil && !lastFileSkipped {
+						cErr := h.checksum(fi)
+						if cErr != nil {
+							return cErr
+						}
+					}
+
+				}
+
+				lastFile = nil
+			} else {
+				if !skipCurrentFile {
+					eErr := h.fileEnd(currFile)
+					if eErr != nil {
+						return eErr
+					}
+
+					if currFile.Offset+currPartBytes >= currFile.Size {
+						h.progress.fileDone()
+					}
+				}
+
+				lastFile = currFile
+				lastFileSkipped = skipCurrentFile
+
+				currFile = nil
+				skipCurrentFile = false
+			}
+
+			currSectorData = []byte{}
+
+			// Proceed reading next bytes.
+			continue
+
+		case "?":
+			if currFile == nil {
+				// Decrypt file metadata.
+				fi, fiErr := decryptMD()
+				if fiErr == nil && fi.Filetype != FILE {
+					fiErr = fmt.Errorf("expected file (%d) metadata but received (%d)", FILE, fi.Filetype)
+				}
+
+				if fiErr != nil {
+					err := fmt.Errorf("failed to decrypt file metadata: %v", fiErr)
+					if h.salvage == nil {
+						return err
+					}
+
+					h.salvage(nil, err)
+
+					lastFile = nil
+					resync = true
+					currSectorData = []byte{}
+
+					continue
+				}
+
+				lastFile = nil
+
+				sErr := h.fileStart(fi)
+				if sErr != nil && sErr != errSkipFile {
+					return sErr
+				}
+
+				currFile = fi
+				currPartBytes = 0
+				seekLeft = 0
+				skipCurrentFile = sErr == errSkipFile
+
+				if !skipCurrentFile {
+					h.progress.file(fi.RelativePath)
+
+					if h.seek != nil {
+						seekLeft = h.seek(fi)
+					}
+				}
+			}
+
+			currSectorData = []byte{}
+
+			// Continue with file contents in the following bytes.
+			continue
+		}
+
+		// Metadata records are limited, the following bytes are dropped.
+		if len(currSectorData) < maxMetadataRecordSize {
+			currSectorData = append(currSectorData, b)
+		}
+	}
+
+	if currFile != nil || (len(currSectorData) > 0 && !resync) {
+		err := fmt.Errorf("unexpected end of file %s", fPath)
+		if h.salvage == nil {
+			return err
+		}
+
+		h.salvage(currFile, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package encryptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Salvaged file statuses.
+const (
+	SalvageStatusPartial = "partial"
+	SalvageStatusLost    = "lost"
+)
+
+// SalvageProblem describes a damaged record skipped by Salvage.
+type SalvageProblem struct {
+	Batch string `json:"batch,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// SalvagedFile describes a file which couldn't be fully restored.
+type SalvagedFile struct {
+	Path           string `json:"path"`
+	Status         string `json:"status"`
+	Size           int64  `json:"size"`
+	RecoveredBytes int64  `json:"recovered_bytes"`
+}
+
+// SalvageReport contains the result of a salvage run.
+type SalvageReport struct {
+	Batches       int `json:"batches"`
+	RestoredFiles int `json:"restored_files"`
+
+	DamagedBatches []string         `json:"damaged_batches"`
+	Files          []SalvagedFile   `json:"files"`
+	Problems       []SalvageProblem `json:"problems"`
+}
+
+// Write writes the report in the given format.
+func (r *SalvageReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(r)
+
+	case ReportFormatTable, "":
+		if len(r.Problems) > 0 {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader([]string{"Batch", "Path", "Error"})
+
+			for _, p := range r.Problems {
+				table.Append([]string{p.Batch, p.Path, p.Error})
+			}
+
+			table.Render()
+		}
+
+		if len(r.Files) > 0 {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader([]string{"Path", "Status", "Size", "Recovered"})
+
+			for _, f := range r.Files {
+				table.Append([]string{f.Path, f.Status, strconv.FormatInt(f.Size, 10), strconv.FormatInt(f.RecoveredBytes, 10)})
+			}
+
+			table.Render()
+		}
+
+		_, wErr := fmt.Fprintf(w, "salvaged %d batches: %d files restored, %d files lost or partially recovered, %d damaged batches, %d problems\n",
+			r.Batches, r.RestoredFiles, len(r.Files), len(r.DamagedBatches), len(r.Problems))
+
+		return wErr
+
+	default:
+		return fmt.Errorf("unsupported report format %s", format)
+	}
+}
+
+// Err returns the DamageError if problems were found.
+func (r *SalvageReport) Err() error {
+	if len(r.Problems) > 0 {
+		return &DamageError{Problems: len(r.Problems)}
+	}
+
+	return nil
+}
+
+// SalvageReport decrypts the files into the output directory resynchronizing
+// at the next readable record or batch file on errors and returns the report
+// of lost and partially recovered files.
+func (p *Processor) SalvageReport(ctx context.Context) (*SalvageReport, error) {
+	report := &SalvageReport{
+		DamagedBatches: []string{},
+		Files:          []SalvagedFile{},
+		Problems:       []SalvageProblem{},
+	}
+
+	rErr := p.restore(ctx, report)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	return report, nil
+}
+
+// salvageEntry contains the recovery state of a single archived file.
+type salvageEntry struct {
+	size      int64
+	recovered int64
+	damaged   bool
+}
+
+// salvageState collects the salvage report while restoring files, all its
+// methods are no-op on a nil state.
+type salvageState struct {
+	report *SalvageReport
+
+	prevNumber     int
+	prevDir        string
+	entries        map[string]*salvageEntry
+	damagedBatches map[string]bool
+}
+
+func newSalvageState(report *SalvageReport) *salvageState {
+	if report == nil {
+		return nil
+	}
+
+	return &salvageState{
+		report:         report,
+		entries:        make(map[string]*salvageEntry),
+		damagedBatches: make(map[string]bool),
+	}
+}
+
+func (s *salvageState) batch(bf batchFile) {
+	if s == nil {
+		return
+	}
+
+	s.report.Batches++
+
+	// Report missing batch files.
+	s.missing(path.Dir(bf.path), bf.number-1)
+
+	s.prevNumber = bf.number
+	s.prevDir = path.Dir(bf.path)
+}
+
+// missing reports the batch files following the previous one up to the given
+// number as missing from dir.
+func (s *salvageState) missing(dir string, number int) {
+	for n := s.prevNumber + 1; n <= number; n++ {
+		fnStr, _ := fileNumber(n, 32)
+		s.damaged(path.Join(dir, fnStr+batchFileExt), nil, fmt.Errorf("batch file is missing"))
+	}
+}
+
+func (s *salvageState) fileStart(fi *fileInfo) {
+	if s == nil {
+		return
+	}
+
+	e, ok := s.entries[fi.RelativePath]
+	if !ok || fi.Offset == 0 {
+		// The file might have been archived again by a following run.
+		e = &salvageEntry{}
+		s.entries[fi.RelativePath] = e
+	}
+
+	e.size = fi.Size
+}
+
+func (s *salvageState) fileData(fi *fileInfo, data []byte) {
+	if s == nil {
+		return
+	}
+
+	s.entries[fi.RelativePath].recovered += int64(len(data))
+}
+
+func (s *salvageState) damaged(batch string, fi *fileInfo, err error) {
+	if s == nil {
+		return
+	}
+
+	log.Printf("skipping damaged record: %v", err)
+
+	problem := SalvageProblem{
+		Batch: batch,
+		Error: err.Error(),
+	}
+
+	if fi != nil {
+		problem.Path = fi.RelativePath
+
+		if e, ok := s.entries[fi.RelativePath]; ok {
+			e.damaged = true
+		}
+	}
+
+	s.report.Problems = append(s.report.Problems, problem)
+	s.damagedBatches[batch] = true
+}
+
+// finish reports the missing trailing batch files of the archive stored in
+// dir and the number of batch files recorded, then the lost and partially
+// recovered files.
+func (s *salvageState) finish(dir string, batches int) {
+	if s.prevDir != "" {
+		dir = s.prevDir
+	}
+
+	s.missing(dir, batches)
+
+	paths := make([]string, 0, len(s.entries))
+	for p := range s.entries {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	for _, ePath := range paths {
+		e := s.entries[ePath]
+
+		var status string
+		switch {
+		case e.recovered == 0 && (e.size > 0 || e.damaged):
+			status = SalvageStatusLost
+
+		case e.damaged || e.recovered != e.size:
+			status = SalvageStatusPartial
+
+		default:
+			s.report.RestoredFiles++
+			continue
+		}
+
+		s.report.Files = append(s.report.Files, SalvagedFile{
+			Path:           ePath,
+			Status:         status,
+			Size:           e.size,
+			RecoveredBytes: e.recovered,
+		})
+	}
+
+	for b := range s.damagedBatches {
+		s.report.DamagedBatches = append(s.report.DamagedBatches, b)
+	}
+
+	sort.Strings(s.report.DamagedBatches)
+}
@@ -0,0 +1,232 @@
+package encryptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// damageRecord replaces the record with the given index of the batch file,
+// the delimiter is kept.
+func damageRecord(t *testing.T, fPath string, index int, damage func(record []byte) []byte) {
+	gzData, gzErr := ioutil.ReadFile(fPath)
+	require.NoError(t, gzErr)
+
+	gr, grErr := gzip.NewReader(bytes.NewReader(gzData))
+	require.NoError(t, grErr)
+
+	data, dErr := ioutil.ReadAll(gr)
+	require.NoError(t, dErr)
+
+	var start, n int
+	for i, b := range data {
+		if b != '?' && b != '$' {
+			continue
+		}
+
+		if n == index {
+			data = append(data[:start:start], append(damage(data[start:i]), data[i:]...)...)
+			break
+		}
+
+		start = i + 1
+		n++
+	}
+
+	require.Equal(t, index, n, "batch %s has no record %d", fPath, index)
+
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	_, wErr := gw.Write(data)
+	require.NoError(t, wErr)
+	require.NoError(t, gw.Close())
+
+	require.NoError(t, ioutil.WriteFile(fPath, buf.Bytes(), 0644))
+}
+
+// dropChar removes the last character making the record length invalid.
+func dropChar(record []byte) []byte {
+	return record[:len(record)-1]
+}
+
+func salvageArchive(t *testing.T, cfg Config) *SalvageReport {
+	report, sErr := newTestProcessor(t, cfg).SalvageReport(context.Background())
+	require.NoError(t, sErr)
+
+	return report
+}
+
+// salvageFixture encrypts a small file followed by a file split across
+// several batches and another small file.
+func salvageFixture(t *testing.T, dir string) (map[string][]byte, []string) {
+	files := map[string][]byte{
+		"a.txt":   []byte("first file"),
+		"big.bin": testData(3 * testBatchSize),
+		"c.txt":   []byte("last file"),
+	}
+
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+	})
+
+	batches := archiveBatches(t, filepath.Join(dir, "enc"))
+	require.Greater(t, len(batches), 3)
+
+	return files, batches
+}
+
+// partOffset returns the offset of the file part in the batch parts.
+func partOffset(t *testing.T, parts []string, name string) int64 {
+	for _, part := range parts {
+		if strings.HasPrefix(part, name+"@") {
+			offset, oErr := strconv.ParseInt(strings.TrimPrefix(part, name+"@"), 10, 64)
+			require.NoError(t, oErr)
+
+			return offset
+		}
+	}
+
+	require.Fail(t, "file part not found", "%s in %v", name, parts)
+
+	return 0
+}
+
+func TestSalvageDamagedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	files, batches := salvageFixture(t, dir)
+
+	// The second batch starts with the metadata of the big.bin second part.
+	damageRecord(t, batches[1], 0, dropChar)
+
+	report := salvageArchive(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	})
+
+	require.Equal(t, []string{batches[1]}, report.DamagedBatches)
+	require.Len(t, report.Problems, 1)
+	require.Empty(t, report.Problems[0].Path)
+	require.Equal(t, 2, report.RestoredFiles)
+
+	require.Len(t, report.Files, 1)
+	require.Equal(t, "big.bin", report.Files[0].Path)
+	require.Equal(t, SalvageStatusPartial, report.Files[0].Status)
+	require.Less(t, report.Files[0].RecoveredBytes, int64(len(files["big.bin"])))
+
+	restored := readTree(t, filepath.Join(dir, "restored"))
+	require.Equal(t, files["a.txt"], restored["a.txt"])
+	require.Equal(t, files["c.txt"], restored["c.txt"])
+}
+
+func TestSalvageDamagedData(t *testing.T) {
+	dir := t.TempDir()
+	files, batches := salvageFixture(t, dir)
+
+	parts := batchParts(t, filepath.Join(dir, "enc"))
+	second, third := partOffset(t, parts[1], "big.bin"), partOffset(t, parts[2], "big.bin")
+
+	// Damage the data of the big.bin second part.
+	damageRecord(t, batches[1], 1, dropChar)
+
+	report := salvageArchive(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	})
+
+	require.Equal(t, []string{batches[1]}, report.DamagedBatches)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, "big.bin", report.Problems[0].Path)
+	require.Equal(t, 2, report.RestoredFiles)
+
+	require.Len(t, report.Files, 1)
+	require.Equal(t, "big.bin", report.Files[0].Path)
+	require.Equal(t, SalvageStatusPartial, report.Files[0].Status)
+
+	// The parts around the damaged one are restored.
+	size := int64(len(files["big.bin"]))
+	require.GreaterOrEqual(t, report.Files[0].RecoveredBytes, size-(third-second))
+	require.Less(t, report.Files[0].RecoveredBytes, size)
+
+	restored := readTree(t, filepath.Join(dir, "restored"))
+	require.Equal(t, files["a.txt"], restored["a.txt"])
+	require.Equal(t, files["c.txt"], restored["c.txt"])
+	require.Equal(t, files["big.bin"][:second], restored["big.bin"][:second])
+	require.Equal(t, files["big.bin"][third:], restored["big.bin"][third:])
+}
+
+func TestSalvageTruncatedBatch(t *testing.T) {
+	dir := t.TempDir()
+	files, batches := salvageFixture(t, dir)
+
+	// Truncate the gzip stream of the last batch holding the c.txt file,
+	// which metadata is lost along with it.
+	last := batches[len(batches)-1]
+
+	data, dErr := ioutil.ReadFile(last)
+	require.NoError(t, dErr)
+	require.NoError(t, os.WriteFile(last, data[:len(data)/2], 0644))
+
+	report := salvageArchive(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	})
+
+	require.Equal(t, []string{last}, report.DamagedBatches)
+	require.NotEmpty(t, report.Problems)
+	require.Equal(t, 1, report.RestoredFiles)
+
+	statuses := make(map[string]string)
+	for _, f := range report.Files {
+		statuses[f.Path] = f.Status
+	}
+
+	require.Equal(t, map[string]string{"big.bin": SalvageStatusPartial}, statuses)
+
+	restored := readTree(t, filepath.Join(dir, "restored"))
+	require.Equal(t, files["a.txt"], restored["a.txt"])
+	require.NotContains(t, restored, "c.txt")
+}
+
+func TestSalvageMissingBatches(t *testing.T) {
+	dir := t.TempDir()
+	files, batches := salvageFixture(t, dir)
+
+	// Remove a batch file of big.bin and the trailing one holding c.txt.
+	last := batches[len(batches)-1]
+
+	require.NoError(t, os.Remove(batches[1]))
+	require.NoError(t, os.Remove(last))
+
+	report := salvageArchive(t, Config{
+		SourceDir: filepath.Join(dir, "enc"),
+		OutputDir: filepath.Join(dir, "restored"),
+	})
+
+	require.Equal(t, []string{batches[1], last}, report.DamagedBatches)
+	require.Equal(t, []SalvageProblem{
+		{Batch: batches[1], Error: "batch file is missing"},
+		{Batch: last, Error: "batch file is missing"},
+	}, report.Problems)
+	require.Equal(t, 1, report.RestoredFiles)
+
+	require.Len(t, report.Files, 1)
+	require.Equal(t, "big.bin", report.Files[0].Path)
+	require.Equal(t, SalvageStatusPartial, report.Files[0].Status)
+
+	restored := readTree(t, filepath.Join(dir, "restored"))
+	require.Equal(t, files["a.txt"], restored["a.txt"])
+	require.NotContains(t, restored, "c.txt")
+}
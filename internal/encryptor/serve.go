@@ -0,0 +1,771 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultServeAddr is the address Serve listens on unless configured.
+	DefaultServeAddr = "127.0.0.1:8080"
+
+	tokenCookie = "token"
+)
+
+// errStreamDone stops reading the batch once the file part is streamed.
+var errStreamDone = errors.New("stream done")
+
+// servePart is a file part stored in a batch file.
+type servePart struct {
+	batch  string
+	cipher batchCipher
+	offset int64
+	size   int64
+}
+
+// serveEntry is a file or a directory of the served tree.
+type serveEntry struct {
+	name    string
+	relPath string
+	dir     bool
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+
+	parts    []servePart
+	children map[string]*serveEntry
+}
+
+func (e *serveEntry) Name() string       { return e.name }
+func (e *serveEntry) Size() int64        { return e.size }
+func (e *serveEntry) Mode() fs.FileMode  { return e.mode }
+func (e *serveEntry) ModTime() time.Time { return e.modTime }
+func (e *serveEntry) IsDir() bool        { return e.dir }
+func (e *serveEntry) Sys() interface{}   { return nil }
+
+// sortedChildren returns the directory entries ordered by name.
+func (e *serveEntry) sortedChildren() []*serveEntry {
+	res := make([]*serveEntry, 0, len(e.children))
+	for _, c := range e.children {
+		res = append(res, c)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
+
+// serveTree is the index of the archive files and directories.
+type serveTree struct {
+	root    *serveEntry
+	modTime time.Time
+}
+
+// entry returns the entry at the slash-separated path, creating missing
+// directories if create is set.
+func (t *serveTree) entry(relPath string, create bool) *serveEntry {
+	e := t.root
+
+	if relPath == "" || relPath == "." {
+		return e
+	}
+
+	for i, name := range strings.Split(relPath, "/") {
+		child, ok := e.children[name]
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			child = &serveEntry{
+				name:     name,
+				relPath:  strings.Join(strings.Split(relPath, "/")[:i+1], "/"),
+				dir:      true,
+				mode:     fs.ModeDir | 0755,
+				modTime:  t.modTime,
+				children: make(map[string]*serveEntry),
+			}
+
+			e.children[name] = child
+		}
+
+		if !child.dir && create {
+			return nil
+		}
+
+		e = child
+	}
+
+	return e
+}
+
+// indexArchive reads the metadata of the unlocked archive. File contents are
+// only decrypted to determine the file sizes of archives not recording them.
+func (p *Processor) indexArchive(ctx context.Context, ff *fileFilter) (*serveTree, error) {
+	t := &serveTree{
+		modTime: time.Now(),
+	}
+
+	t.root = &serveEntry{
+		name:     ".",
+		dir:      true,
+		mode:     fs.ModeDir | 0755,
+		modTime:  t.modTime,
+		children: make(map[string]*serveEntry),
+	}
+
+	// The file which part is being read.
+	var curr *serveEntry
+
+	setMetadata := func(e *serveEntry, fi *fileInfo) {
+		if fi.Mode != 0 {
+			e.mode = e.mode&fs.ModeType | fs.FileMode(fi.Mode)&fs.ModePerm
+		}
+
+		if fi.ModTime != 0 {
+			e.modTime = time.Unix(0, fi.ModTime)
+		}
+	}
+
+	var files int
+
+	pr := p.newProgress()
+
+	idxErr := p.forEachBatch(ctx, pr, func(bf batchFile) error {
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return fmt.Errorf("failed to determine batch key: %v", bcErr)
+		}
+
+		return p.readBatch(ctx, bf.path, bc, recordHandler{
+			directory: func(fi *fileInfo) error {
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil || excluded {
+					return exErr
+				}
+
+				e := t.entry(fi.RelativePath, true)
+				if e == nil {
+					return fmt.Errorf("directory %s conflicts with a file", fi.RelativePath)
+				}
+
+				setMetadata(e, fi)
+
+				return nil
+			},
+
+			fileStart: func(fi *fileInfo) error {
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil {
+					return exErr
+				}
+
+				if excluded {
+					return errSkipFile
+				}
+
+				dir := t.entry(path.Dir(fi.RelativePath), true)
+				if dir == nil {
+					return fmt.Errorf("directory of %s conflicts with a file", fi.RelativePath)
+				}
+
+				name := path.Base(fi.RelativePath)
+
+				e := dir.children[name]
+				if e != nil && e.dir {
+					return fmt.Errorf("file %s conflicts with a directory", fi.RelativePath)
+				}
+
+				// Files encrypted again replace the preceding copies.
+				if e == nil || fi.Offset == 0 {
+					e = &serveEntry{
+						name:    name,
+						relPath: fi.RelativePath,
+						mode:    0644,
+						modTime: t.modTime,
+					}
+
+					dir.children[name] = e
+					files++
+				}
+
+				setMetadata(e, fi)
+
+				e.parts = append(e.parts, servePart{
+					batch:  bf.path,
+					cipher: bc,
+					offset: fi.Offset,
+				})
+
+				curr = e
+
+				// The file size is unknown until the file is read.
+				if fi.Size == 0 {
+					return nil
+				}
+
+				e.size = fi.Size
+
+				// Files which contents are skipped are counted once.
+				if fi.Offset == 0 {
+					pr.file(fi.RelativePath)
+					pr.fileDone()
+				}
+
+				return errSkipFile
+			},
+
+			fileData: func(fi *fileInfo, data []byte) error {
+				curr.parts[len(curr.parts)-1].size += int64(len(data))
+				curr.size += int64(len(data))
+				return nil
+			},
+
+			fileEnd: func(fi *fileInfo) error {
+				return nil
+			},
+
+			progress: pr,
+		})
+	})
+	if idxErr != nil {
+		return nil, idxErr
+	}
+
+	pr.finish()
+
+	// Determine the part sizes of files with known sizes.
+	var walk func(e *serveEntry)
+	walk = func(e *serveEntry) {
+		for _, c := range e.children {
+			if c.dir {
+				walk(c)
+				continue
+			}
+
+			for i := range c.parts {
+				end := c.size
+				if i+1 < len(c.parts) {
+					end = c.parts[i+1].offset
+				}
+
+				c.parts[i].size = end - c.parts[i].offset
+			}
+		}
+	}
+
+	walk(t.root)
+
+	log.Printf("indexed %d files", files)
+
+	return t, nil
+}
+
+// streamFile writes the file contents starting at offset to w. Parts read
+// from their start are verified against their checksums, the data records
+// preceding the offset aren't decrypted so the part it falls into isn't
+// verified.
+func (p *Processor) streamFile(ctx context.Context, e *serveEntry, offset int64, w io.Writer) error {
+	for _, part := range e.parts {
+		if part.offset+part.size <= offset {
+			continue
+		}
+
+		skip := offset - part.offset
+		if skip < 0 {
+			return fmt.Errorf("file %s part at offset %d doesn't follow the preceding part", e.relPath, part.offset)
+		}
+
+		verify := skip == 0
+
+		var checker partChecker
+		var found, ended bool
+
+		stopAfterPart := func(fi *fileInfo) error {
+			if ended {
+				return errStreamDone
+			}
+
+			return nil
+		}
+
+		readErr := p.readBatch(ctx, part.batch, part.cipher, recordHandler{
+			directory: stopAfterPart,
+
+			fileStart: func(fi *fileInfo) error {
+				if ended {
+					return errStreamDone
+				}
+
+				if fi.RelativePath != e.relPath || fi.Offset != part.offset {
+					return errSkipFile
+				}
+
+				found = true
+				checker.start()
+
+				return nil
+			},
+
+			seek: func(fi *fileInfo) int64 {
+				return skip
+			},
+
+			fileData: func(fi *fileInfo, data []byte) error {
+				checker.write(data)
+
+				_, wErr := w.Write(data)
+
+				return wErr
+			},
+
+			fileEnd: func(fi *fileInfo) error {
+				checker.end()
+				ended = true
+				return nil
+			},
+
+			checksum: func(fi *fileInfo) error {
+				if verify {
+					cErr := checker.check(fi)
+					if cErr != nil {
+						return cErr
+					}
+				}
+
+				return errStreamDone
+			},
+		})
+		if readErr != nil && readErr != errStreamDone {
+			return readErr
+		}
+
+		if !found {
+			return fmt.Errorf("file %s part at offset %d not found in %s", e.relPath, part.offset, part.batch)
+		}
+
+		offset = part.offset + part.size
+	}
+
+	return nil
+}
+
+// serveFile is the http.File and the fs.File of a served file or directory.
+// File contents are streamed from the current position until the file is
+// seeked.
+type serveFile struct {
+	ctx context.Context
+	p   *Processor
+	e   *serveEntry
+
+	pos    int64
+	stream *io.PipeReader
+
+	// Position of the directory listing.
+	dirPos int
+}
+
+func (f *serveFile) Read(b []byte) (int, error) {
+	if f.e.dir {
+		return 0, errors.New("is a directory")
+	}
+
+	if f.pos >= f.e.size {
+		return 0, io.EOF
+	}
+
+	if f.stream == nil {
+		pr, pw := io.Pipe()
+
+		go func(offset int64) {
+			pw.CloseWithError(f.p.streamFile(f.ctx, f.e, offset, pw))
+		}(f.pos)
+
+		f.stream = pr
+	}
+
+	n, rErr := f.stream.Read(b)
+	f.pos += int64(n)
+
+	if rErr == io.EOF && f.pos < f.e.size {
+		rErr = io.ErrUnexpectedEOF
+	}
+
+	return n, rErr
+}
+
+func (f *serveFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.e.size
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if pos != f.pos {
+		f.closeStream()
+		f.pos = pos
+	}
+
+	return pos, nil
+}
+
+func (f *serveFile) closeStream() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+}
+
+func (f *serveFile) Close() error {
+	f.closeStream()
+	return nil
+}
+
+func (f *serveFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.e.dir {
+		return nil, errors.New("not a directory")
+	}
+
+	children := f.e.sortedChildren()[f.dirPos:]
+
+	if count > 0 {
+		if len(children) == 0 {
+			return nil, io.EOF
+		}
+
+		if len(children) > count {
+			children = children[:count]
+		}
+	}
+
+	f.dirPos += len(children)
+
+	res := make([]fs.FileInfo, len(children))
+	for i, c := range children {
+		res[i] = c
+	}
+
+	return res, nil
+}
+
+func (f *serveFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	infos, rErr := f.Readdir(count)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	res := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		res[i] = fs.FileInfoToDirEntry(fi)
+	}
+
+	return res, nil
+}
+
+func (f *serveFile) Stat() (fs.FileInfo, error) {
+	return f.e, nil
+}
+
+// serveFS is the http.FileSystem of the archive tree.
+type serveFS struct {
+	ctx  context.Context
+	p    *Processor
+	tree *serveTree
+}
+
+func (sfs *serveFS) lookup(name string) *serveEntry {
+	return sfs.tree.entry(strings.Trim(path.Clean("/"+name), "/"), false)
+}
+
+func (sfs *serveFS) Open(name string) (http.File, error) {
+	e := sfs.lookup(name)
+	if e == nil {
+		return nil, os.ErrNotExist
+	}
+
+	return &serveFile{
+		ctx: sfs.ctx,
+		p:   sfs.p,
+		e:   e,
+	}, nil
+}
+
+// WebDAV PROPFIND response (RFC 4918) allowing to mount the tree read-only.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string     `xml:"D:displayname"`
+	ResourceType  davResType `xml:"D:resourcetype"`
+	ContentLength *int64     `xml:"D:getcontentlength,omitempty"`
+	LastModified  string     `xml:"D:getlastmodified"`
+}
+
+type davResType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func davEntry(e *serveEntry) davResponse {
+	href := "/" + e.relPath
+
+	prop := davProp{
+		DisplayName:  e.name,
+		LastModified: e.modTime.UTC().Format(http.TimeFormat),
+	}
+
+	if e.dir {
+		prop.ResourceType.Collection = &struct{}{}
+		if e.relPath != "" {
+			href += "/"
+		}
+	} else {
+		size := e.size
+		prop.ContentLength = &size
+	}
+
+	return davResponse{
+		Href: (&url.URL{Path: href}).EscapedPath(),
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func (sfs *serveFS) propfind(w http.ResponseWriter, r *http.Request) {
+	e := sfs.lookup(r.URL.Path)
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		http.Error(w, "only depth 0 and 1 are supported", http.StatusForbidden)
+		return
+	}
+
+	ms := davMultistatus{
+		Namespace: "DAV:",
+		Responses: []davResponse{davEntry(e)},
+	}
+
+	if e.dir && depth == "1" {
+		for _, c := range e.sortedChildren() {
+			ms.Responses = append(ms.Responses, davEntry(c))
+		}
+	}
+
+	body, bodyErr := xml.Marshal(ms)
+	if bodyErr != nil {
+		http.Error(w, bodyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// serveHandler authorizes requests with the access token passed as the
+// token query parameter, the cookie set for it, a bearer token or the basic
+// auth password, and serves the tree read-only.
+type serveHandler struct {
+	fs    *serveFS
+	files http.Handler
+	token string
+}
+
+func (h *serveHandler) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *serveHandler) authorized(r *http.Request) bool {
+	if c, cErr := r.Cookie(tokenCookie); cErr == nil && h.validToken(c.Value) {
+		return true
+	}
+
+	if _, password, ok := r.BasicAuth(); ok && h.validToken(password) {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+
+	return strings.HasPrefix(auth, "Bearer ") && h.validToken(strings.TrimPrefix(auth, "Bearer "))
+}
+
+func (h *serveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Exchange the token in the link for a cookie keeping it out of the
+	// addresses of the following requests.
+	if token := r.URL.Query().Get(tokenCookie); token != "" && h.validToken(token) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		http.Redirect(w, r, r.URL.EscapedPath(), http.StatusSeeOther)
+
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="directory-encryptor"`)
+		http.Error(w, "access token required", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.files.ServeHTTP(w, r)
+
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+
+	case "PROPFIND":
+		h.fs.propfind(w, r)
+
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		http.Error(w, "the archive is read-only", http.StatusMethodNotAllowed)
+	}
+}
+
+// newServeHandler unlocks and indexes the archive returning the handler
+// serving it to the requests authorized by the token.
+func (p *Processor) newServeHandler(ctx context.Context, token string) (*serveHandler, error) {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return nil, fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return nil, fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	tree, treeErr := p.indexArchive(ctx, ff)
+	if treeErr != nil {
+		return nil, fmt.Errorf("failed to index archive: %w", treeErr)
+	}
+
+	sfs := &serveFS{
+		ctx:  ctx,
+		p:    p,
+		tree: tree,
+	}
+
+	return &serveHandler{
+		fs:    sfs,
+		files: http.FileServer(sfs),
+		token: token,
+	}, nil
+}
+
+// Serve unlocks the archive and serves the files selected by the filter
+// rules over HTTP until it fails or the context is done. Files are decrypted
+// on demand, the tree can be browsed or mounted with WebDAV clients.
+func (p *Processor) Serve(ctx context.Context) error {
+	host, _, splitErr := net.SplitHostPort(p.serveAddr)
+	if splitErr != nil {
+		return fmt.Errorf("invalid serve address %s: %v", p.serveAddr, splitErr)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("serve address %s isn't a loopback address", p.serveAddr)
+	}
+
+	token := p.serveToken
+	if token == "" {
+		tb := make([]byte, 16)
+
+		_, rErr := io.ReadFull(rand.Reader, tb)
+		if rErr != nil {
+			return fmt.Errorf("failed to generate access token: %v", rErr)
+		}
+
+		token = hex.EncodeToString(tb)
+	}
+
+	h, hErr := p.newServeHandler(ctx, token)
+	if hErr != nil {
+		return hErr
+	}
+
+	l, lErr := net.Listen("tcp", p.serveAddr)
+	if lErr != nil {
+		return fmt.Errorf("failed to listen on %s: %v", p.serveAddr, lErr)
+	}
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("serving archive on http://%s/?%s=%s", l.Addr(), tokenCookie, token)
+
+	// Shut down once the context is done.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			srv.Shutdown(shutdownCtx)
+
+		case <-done:
+		}
+	}()
+
+	serveErr := srv.Serve(l)
+	if serveErr == http.ErrServerClosed {
+		return checkContext(ctx)
+	}
+
+	return serveErr
+}
@@ -0,0 +1,217 @@
+package encryptor
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testServeToken = "secret"
+
+// serveArchive encrypts the files and serves the archive returning the test
+// server.
+func serveArchive(t *testing.T, files map[string][]byte) *httptest.Server {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+	})
+
+	p := newTestProcessor(t, Config{SourceDir: filepath.Join(dir, "enc")})
+
+	h, hErr := p.newServeHandler(context.Background(), testServeToken)
+	require.NoError(t, hErr)
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// serveRequest sends the request without following redirects.
+func serveRequest(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, rErr := client.Do(req)
+	require.NoError(t, rErr)
+
+	defer resp.Body.Close()
+
+	body, bErr := ioutil.ReadAll(resp.Body)
+	require.NoError(t, bErr)
+
+	return resp, body
+}
+
+func newServeRequest(t *testing.T, method, url string) *http.Request {
+	req, rErr := http.NewRequest(method, url, nil)
+	require.NoError(t, rErr)
+
+	return req
+}
+
+func TestServeAuth(t *testing.T) {
+	srv := serveArchive(t, map[string][]byte{"a.txt": []byte("first file")})
+
+	// Missing and wrong tokens.
+	resp, _ := serveRequest(t, newServeRequest(t, http.MethodGet, srv.URL+"/a.txt"))
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+
+	resp, _ = serveRequest(t, newServeRequest(t, http.MethodGet, srv.URL+"/a.txt?token=wrong"))
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req := newServeRequest(t, http.MethodGet, srv.URL+"/a.txt")
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, _ = serveRequest(t, req)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req = newServeRequest(t, http.MethodGet, srv.URL+"/a.txt")
+	req.AddCookie(&http.Cookie{Name: tokenCookie, Value: "wrong"})
+	resp, _ = serveRequest(t, req)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Bearer token and basic auth password.
+	req = newServeRequest(t, http.MethodGet, srv.URL+"/a.txt")
+	req.Header.Set("Authorization", "Bearer "+testServeToken)
+	resp, body := serveRequest(t, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "first file", string(body))
+
+	req = newServeRequest(t, http.MethodGet, srv.URL+"/a.txt")
+	req.SetBasicAuth("", testServeToken)
+	resp, body = serveRequest(t, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "first file", string(body))
+
+	// The token in the link is exchanged for a cookie.
+	resp, _ = serveRequest(t, newServeRequest(t, http.MethodGet, srv.URL+"/a.txt?token="+testServeToken))
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/a.txt", resp.Header.Get("Location"))
+	require.Len(t, resp.Cookies(), 1)
+
+	req = newServeRequest(t, http.MethodGet, srv.URL+"/a.txt")
+	req.AddCookie(resp.Cookies()[0])
+	resp, body = serveRequest(t, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "first file", string(body))
+
+	// The archive is read-only.
+	req = newServeRequest(t, http.MethodPut, srv.URL+"/a.txt")
+	req.Header.Set("Authorization", "Bearer "+testServeToken)
+	resp, _ = serveRequest(t, req)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestServeLoopback(t *testing.T) {
+	p := newTestProcessor(t, Config{SourceDir: t.TempDir(), ServeAddr: "0.0.0.0:0"})
+
+	sErr := p.Serve(context.Background())
+	require.Error(t, sErr)
+	require.Contains(t, sErr.Error(), "isn't a loopback address")
+}
+
+func TestServeDownload(t *testing.T) {
+	big := testData(3 * testBatchSize)
+
+	srv := serveArchive(t, map[string][]byte{
+		"a.txt":       []byte("first file"),
+		"docs/b.bin":  big,
+		"docs/c.txt":  []byte("last file"),
+		"docs/nested": nil,
+	})
+
+	req := newServeRequest(t, http.MethodGet, srv.URL+"/docs/b.bin")
+	req.Header.Set("Authorization", "Bearer "+testServeToken)
+	resp, body := serveRequest(t, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, big, body)
+
+	// Ranges starting in the following parts.
+	for _, start := range []int{1, testBatchSize, 2*testBatchSize + 17} {
+		req = newServeRequest(t, http.MethodGet, srv.URL+"/docs/b.bin")
+		req.Header.Set("Authorization", "Bearer "+testServeToken)
+		req.Header.Set("Range", "bytes="+strconv.Itoa(start)+"-"+strconv.Itoa(start+999))
+		resp, body = serveRequest(t, req)
+		require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		require.Equal(t, big[start:start+1000], body, "range starting at %d", start)
+	}
+
+	req = newServeRequest(t, http.MethodGet, srv.URL+"/missing.txt")
+	req.Header.Set("Authorization", "Bearer "+testServeToken)
+	resp, _ = serveRequest(t, req)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServePropfind(t *testing.T) {
+	srv := serveArchive(t, map[string][]byte{
+		"a.txt":       []byte("first file"),
+		"docs/b.bin":  testData(3 * testBatchSize),
+		"docs/nested": nil,
+	})
+
+	type propfindResponse struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Length     string    `xml:"propstat>prop>getcontentlength"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+
+	propfind := func(urlPath, depth string) (*http.Response, *propfindResponse) {
+		req := newServeRequest(t, "PROPFIND", srv.URL+urlPath)
+		req.Header.Set("Authorization", "Bearer "+testServeToken)
+		req.Header.Set("Depth", depth)
+
+		resp, body := serveRequest(t, req)
+		if resp.StatusCode != http.StatusMultiStatus {
+			return resp, nil
+		}
+
+		var res propfindResponse
+		require.NoError(t, xml.Unmarshal(body, &res))
+
+		return resp, &res
+	}
+
+	_, res := propfind("/docs", "1")
+	require.NotNil(t, res)
+	require.Len(t, res.Responses, 3)
+
+	require.Equal(t, "/docs/", res.Responses[0].Href)
+	require.NotNil(t, res.Responses[0].Collection)
+
+	require.Equal(t, "/docs/b.bin", res.Responses[1].Href)
+	require.Equal(t, strconv.Itoa(3*testBatchSize), res.Responses[1].Length)
+	require.Nil(t, res.Responses[1].Collection)
+
+	require.Equal(t, "/docs/nested/", res.Responses[2].Href)
+	require.NotNil(t, res.Responses[2].Collection)
+
+	// Depth 0 only describes the entry.
+	_, res = propfind("/", "0")
+	require.NotNil(t, res)
+	require.Len(t, res.Responses, 1)
+	require.Equal(t, "/", res.Responses[0].Href)
+
+	resp, _ := propfind("/", "infinity")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = propfind("/missing", "0")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,290 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/aes256/gcm"
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	slotKDFScrypt = "scrypt"
+
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptMaxN    = 1 << 22
+	scryptSaltLen = 16
+)
+
+// errEmptyNewPassword is returned when neither new password nor new keyfile is provided.
+var errEmptyNewPassword = errors.New("empty new password provided")
+
+// keySlot contains the data key wrapped by a key derived from the secrets.
+type keySlot struct {
+	Factors []string `json:"factors"`
+
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// newKeySlot returns a new key slot wrapping the data key by a key derived
+// from the credentials.
+func newKeySlot(c credentials, dataKey string) (*keySlot, error) {
+	s := &keySlot{
+		Factors: c.factors(),
+		KDF:     slotKDFScrypt,
+		Salt:    make([]byte, scryptSaltLen),
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+	}
+
+	_, rErr := io.ReadFull(rand.Reader, s.Salt)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", rErr)
+	}
+
+	kek, kekErr := s.kek(c)
+	if kekErr != nil {
+		return nil, kekErr
+	}
+
+	wrapped, wErr := gcm.Seal([]byte(dataKey), kek)
+	if wErr != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", wErr)
+	}
+
+	s.WrappedKey = wrapped
+
+	return s, nil
+}
+
+// kek derives the key encryption key of the slot from the credentials.
+func (s *keySlot) kek(c credentials) ([]byte, error) {
+	if s.KDF != slotKDFScrypt {
+		return nil, fmt.Errorf("unsupported key slot derivation %s", s.KDF)
+	}
+
+	if s.N > scryptMaxN {
+		return nil, fmt.Errorf("scrypt cost %d is too high", s.N)
+	}
+
+	secret, secretErr := c.secret(s.Factors)
+	if secretErr != nil {
+		return nil, secretErr
+	}
+
+	kek, kekErr := scrypt.Key([]byte(secret), s.Salt, s.N, s.R, s.P, 32)
+	if kekErr != nil {
+		return nil, fmt.Errorf("failed to derive key encryption key: %v", kekErr)
+	}
+
+	return kek, nil
+}
+
+// slotsKey unwraps the data key from the first key slot unlocked by the
+// credentials returning the key and the slot index.
+func (c credentials) slotsKey(h *header) (string, int, error) {
+	factors := strings.Join(c.factors(), "+")
+	if factors == "" {
+		return "", 0, errEmptyPassword
+	}
+
+	var matched bool
+
+	for i := range h.Key.Slots {
+		s := &h.Key.Slots[i]
+
+		if strings.Join(s.Factors, "+") != factors {
+			continue
+		}
+
+		matched = true
+
+		kek, kekErr := s.kek(c)
+		if kekErr != nil {
+			return "", 0, fmt.Errorf("failed to unlock key slot %d: %v", i, kekErr)
+		}
+
+		dataKey, dkErr := gcm.Open(s.WrappedKey, kek)
+		if dkErr != nil {
+			// Try the following slots.
+			continue
+		}
+
+		if len(dataKey) != dataKeySize {
+			return "", 0, fmt.Errorf("invalid data key size %d in key slot %d", len(dataKey), i)
+		}
+
+		return string(dataKey), i, nil
+	}
+
+	if !matched {
+		return "", 0, newKeyError("no key slot is unlocked with %s", factors)
+	}
+
+	return "", 0, newKeyError("wrong %s", factors)
+}
+
+func (p *Processor) newCredentials() credentials {
+	return credentials{
+		password: p.newPassword,
+		keyfile:  p.newKeyfile,
+	}
+}
+
+// Passwd replaces the key slot unlocked by the password and keyfile with a
+// slot unlocked by the new password and keyfile.
+func (p *Processor) Passwd(ctx context.Context) error {
+	return p.editSlots(ctx, func(slots []keySlot, slot int) ([]keySlot, error) {
+		ns, nsErr := p.newKeySlot()
+		if nsErr != nil {
+			return nil, nsErr
+		}
+
+		if slot < 0 {
+			return []keySlot{*ns}, nil
+		}
+
+		slots[slot] = *ns
+
+		return slots, nil
+	})
+}
+
+// AddKey adds a key slot unlocked by the new password and keyfile.
+func (p *Processor) AddKey(ctx context.Context) error {
+	return p.editSlots(ctx, func(slots []keySlot, slot int) ([]keySlot, error) {
+		ns, nsErr := p.newKeySlot()
+		if nsErr != nil {
+			return nil, nsErr
+		}
+
+		// Keep the current secrets of converted archives.
+		if slot < 0 {
+			cs, csErr := newKeySlot(p.credentials(), p.encryptionKey)
+			if csErr != nil {
+				return nil, csErr
+			}
+
+			slots = append(slots, *cs)
+		}
+
+		return append(slots, *ns), nil
+	})
+}
+
+// RemoveKey removes the key slot unlocked by the password and keyfile.
+func (p *Processor) RemoveKey(ctx context.Context) error {
+	return p.editSlots(ctx, func(slots []keySlot, slot int) ([]keySlot, error) {
+		if slot < 0 || len(slots) < 2 {
+			return nil, errors.New("the last key slot can't be removed")
+		}
+
+		return append(slots[:slot], slots[slot+1:]...), nil
+	})
+}
+
+func (p *Processor) newKeySlot() (*keySlot, error) {
+	if len(p.newCredentials().factors()) == 0 {
+		return nil, errEmptyNewPassword
+	}
+
+	return newKeySlot(p.newCredentials(), p.encryptionKey)
+}
+
+// editSlots unlocks the archive and updates its headers with the key slots
+// returned by edit, which receives the index of the unlocked slot or -1 if
+// the archive is converted to key slots.
+func (p *Processor) editSlots(ctx context.Context, edit func(slots []keySlot, slot int) ([]keySlot, error)) error {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	h := p.header
+	slot := p.slot
+
+	switch h.Key.KDF {
+	case kdfSlots:
+
+	case kdfSHA256:
+		// The data key remains derived from the current secrets.
+		log.Printf("converting archive to key slots, the current %s can still be used to derive the data key", strings.Join(h.Key.Factors, "+"))
+
+		h = &header{
+			Version: headerVersion,
+			Key: keyDerivation{
+				KDF: kdfSlots,
+			},
+		}
+		slot = -1
+
+	default:
+		return fmt.Errorf("key slots aren't supported by %s archives", h.Key.KDF)
+	}
+
+	slots, editErr := edit(append([]keySlot{}, h.Key.Slots...), slot)
+	if editErr != nil {
+		return editErr
+	}
+
+	h.Key.Slots = slots
+
+	// Update headers of the archive and all its volumes.
+	dirs := append([]string{}, p.volumes...)
+
+	if p.sourceDir != "" && isLocal(p.source) {
+		dirs = append(dirs, p.sourceDir)
+
+		vols, volsErr := listVolumes(p.sourceDir)
+		if volsErr != nil {
+			return volsErr
+		}
+
+		dirs = append(dirs, vols...)
+	}
+
+	written := make(map[string]bool)
+
+	// Remote archives have no volumes.
+	if !isLocal(p.source) {
+		wErr := writeHeader(ctx, p.source, p.sourceDir, h)
+		if wErr != nil {
+			return fmt.Errorf("failed to update header in %s: %v", p.sourceDir, wErr)
+		}
+
+		written[p.sourceDir] = true
+	}
+
+	for _, dir := range dirs {
+		if written[path.Clean(dir)] {
+			continue
+		}
+
+		wErr := writeHeader(ctx, backend.Local{}, dir, h)
+		if wErr != nil {
+			return fmt.Errorf("failed to update header in %s: %v", dir, wErr)
+		}
+
+		written[path.Clean(dir)] = true
+	}
+
+	log.Printf("updated headers in %d directories, archive has %d key slots", len(written), len(h.Key.Slots))
+
+	return nil
+}
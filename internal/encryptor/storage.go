@@ -0,0 +1,109 @@
+package encryptor
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+)
+
+const (
+	// s3Scheme prefixes the archive locations stored in an S3 bucket,
+	// s3://bucket/prefix.
+	s3Scheme = "s3://"
+
+	// sftpScheme prefixes the archive locations stored on an SSH server,
+	// sftp://user@host:port/path, paths starting with /~/ are relative to
+	// the home directory.
+	sftpScheme = "sftp://"
+)
+
+// openStorage returns the backend storing the archive at the location and
+// the directory of the archive within the backend.
+func (cfg Config) openStorage(location string) (backend.Backend, string, error) {
+	switch {
+	case strings.HasPrefix(location, s3Scheme):
+		return cfg.openS3(location)
+
+	case strings.HasPrefix(location, sftpScheme):
+		return cfg.openSFTP(location)
+	}
+
+	return backend.Local{}, location, nil
+}
+
+func (cfg Config) openS3(location string) (backend.Backend, string, error) {
+	bucketPrefix := strings.SplitN(strings.TrimPrefix(location, s3Scheme), "/", 2)
+
+	dir := "."
+	if len(bucketPrefix) > 1 && strings.Trim(bucketPrefix[1], "/") != "" {
+		dir = strings.Trim(bucketPrefix[1], "/")
+	}
+
+	s3, s3Err := backend.NewS3(backend.S3Config{
+		Endpoint:  cfg.S3Endpoint,
+		Region:    cfg.S3Region,
+		Bucket:    bucketPrefix[0],
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+	})
+	if s3Err != nil {
+		return nil, "", fmt.Errorf("failed to initialize S3 storage of %s: %v", location, s3Err)
+	}
+
+	return s3, dir, nil
+}
+
+func (cfg Config) openSFTP(location string) (backend.Backend, string, error) {
+	u, uErr := url.Parse(location)
+	if uErr != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid SFTP location %s", location)
+	}
+
+	dir := u.Path
+	if dir == "" || dir == "/~" {
+		dir = "."
+	} else if strings.HasPrefix(dir, "/~/") {
+		dir = strings.TrimPrefix(dir, "/~/")
+	}
+
+	s, sErr := backend.NewSFTP(backend.SFTPConfig{
+		Addr:           u.Host,
+		User:           u.User.Username(),
+		KeyFile:        cfg.SFTPKey,
+		KnownHostsFile: cfg.SFTPKnownHosts,
+	})
+	if sErr != nil {
+		return nil, "", fmt.Errorf("failed to initialize SFTP storage of %s: %v", location, sErr)
+	}
+
+	return s, dir, nil
+}
+
+// closeStorage closes the connection of the backend if it keeps one.
+func closeStorage(b backend.Backend) error {
+	c, ok := b.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return c.Close()
+}
+
+// isLocal reports whether the backend stores files in the local filesystem.
+func isLocal(b backend.Backend) bool {
+	_, ok := b.(backend.Local)
+	return ok
+}
+
+// requireLocal returns an error if the directory isn't stored in the local
+// filesystem.
+func requireLocal(b backend.Backend, what string) error {
+	if !isLocal(b) {
+		return fmt.Errorf("%s must be a local directory", what)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelingBackend cancels the context once the batch file is read halfway
+// and fails the following reads like remote backends do.
+type cancelingBackend struct {
+	backend.Local
+	cancel context.CancelFunc
+}
+
+func (b cancelingBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, rErr := b.Local.Open(ctx, name)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	return &cancelingReader{ReadCloser: r, ctx: ctx, cancel: b.cancel, left: testBatchSize / 4}, nil
+}
+
+type cancelingReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	left   int
+}
+
+func (r *cancelingReader) Read(b []byte) (int, error) {
+	if r.left <= 0 {
+		r.cancel()
+		return 0, r.ctx.Err()
+	}
+
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+
+	n, err := r.ReadCloser.Read(b)
+	r.left -= n
+
+	return n, err
+}
+
+func TestCancelRemoteRead(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	// Random data isn't compressed, batch files are read in several reads.
+	data := make([]byte, 3*testBatchSize)
+	_, rErr := rand.Read(data)
+	require.NoError(t, rErr)
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{"big.bin": data})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+	})
+
+	restored := filepath.Join(dir, "restored")
+
+	for name, op := range map[string]func(p *Processor, ctx context.Context) error{
+		"decrypt": func(p *Processor, ctx context.Context) error {
+			return p.Decrypt(ctx)
+		},
+		"salvage": func(p *Processor, ctx context.Context) error {
+			_, err := p.SalvageReport(ctx)
+			return err
+		},
+		"verify": func(p *Processor, ctx context.Context) error {
+			_, err := p.VerifyReport(ctx)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		p := newTestProcessor(t, Config{SourceDir: enc, OutputDir: restored})
+		p.source = cancelingBackend{cancel: cancel}
+
+		// Failed reads aren't reported as damaged batches.
+		err := op(p, ctx)
+		require.True(t, errors.Is(err, ErrCanceled), "%s: %v", name, err)
+		require.True(t, errors.Is(err, context.Canceled), "%s: %v", name, err)
+	}
+}
+
+// closingBackend counts the times its connection is closed.
+type closingBackend struct {
+	backend.Local
+	closed *int
+}
+
+func (b closingBackend) Close() error {
+	*b.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	var closed int
+
+	p := newTestProcessor(t, Config{SourceDir: t.TempDir()})
+	p.source = closingBackend{closed: &closed}
+
+	require.NoError(t, p.Close())
+	require.Equal(t, 1, closed)
+
+	// Local storage has no connection.
+	require.NoError(t, closeStorage(backend.Local{}))
+}
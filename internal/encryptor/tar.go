@@ -0,0 +1,439 @@
+package encryptor
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// forEachRecord reads the records of all batch files of the unlocked archive
+// in order reporting the progress.
+func (p *Processor) forEachRecord(ctx context.Context, h recordHandler) error {
+	h.progress = p.newProgress()
+
+	iterErr := p.forEachBatch(ctx, h.progress, func(bf batchFile) error {
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return fmt.Errorf("failed to determine batch key: %v", bcErr)
+		}
+
+		return p.readBatch(ctx, bf.path, bc, h)
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+
+	h.progress.finish()
+
+	return nil
+}
+
+// partChecker verifies file parts against the checksum records following them.
+type partChecker struct {
+	hash         hash.Hash
+	lastChecksum string
+}
+
+func (c *partChecker) start() {
+	c.hash = sha256.New()
+}
+
+func (c *partChecker) write(data []byte) {
+	c.hash.Write(data)
+}
+
+func (c *partChecker) end() {
+	c.lastChecksum = hex.EncodeToString(c.hash.Sum(nil))
+}
+
+func (c *partChecker) check(fi *fileInfo) error {
+	if fi.Checksum != c.lastChecksum {
+		return fmt.Errorf("checksum mismatch for file %s at offset %d", fi.RelativePath, fi.Offset)
+	}
+
+	return nil
+}
+
+// modificationTime returns the modification time preserved from tar sources
+// or now for files of other sources, which don't record it.
+func (fi *fileInfo) modificationTime(now time.Time) time.Time {
+	if fi.ModTime != 0 {
+		return time.Unix(0, fi.ModTime)
+	}
+
+	return now
+}
+
+// tarHeader returns the tar header of the file or the directory using the
+// metadata preserved from tar sources and the defaults otherwise.
+func (fi *fileInfo) tarHeader(size int64, now time.Time) *tar.Header {
+	th := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fi.RelativePath,
+		Size:     size,
+		Mode:     fi.Mode,
+		ModTime:  fi.modificationTime(now),
+		Uid:      fi.UID,
+		Gid:      fi.GID,
+		Uname:    fi.Uname,
+		Gname:    fi.Gname,
+	}
+
+	if fi.Filetype == DIRECTORY {
+		th.Typeflag = tar.TypeDir
+		th.Name += "/"
+	}
+
+	if th.Mode == 0 {
+		th.Mode = 0644
+		if fi.Filetype == DIRECTORY {
+			th.Mode = 0755
+		}
+	}
+
+	return th
+}
+
+// writeTar writes the contents of the unlocked archive to w as a tar stream,
+// the file filter is optional. Files are streamed part by part, only files
+// of archives which don't record file sizes are spooled to a temporary file
+// first.
+func (p *Processor) writeTar(ctx context.Context, w io.Writer, ff *fileFilter) error {
+	tw := tar.NewWriter(w)
+
+	now := time.Now()
+
+	var checker partChecker
+	var spool *os.File
+
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	// The file which contents are being written to the tar stream.
+	var currPath string
+	var currOffset int64
+
+	excluded := func(fi *fileInfo) (bool, error) {
+		if ff == nil {
+			return false, nil
+		}
+
+		excluded, exErr := ff.excluded(fi)
+		if exErr != nil {
+			return false, fmt.Errorf("failed to apply filter rules: %v", exErr)
+		}
+
+		return excluded, nil
+	}
+
+	var spooled *fileInfo
+
+	h := recordHandler{
+		directory: func(fi *fileInfo) error {
+			skip, exErr := excluded(fi)
+			if exErr != nil || skip {
+				return exErr
+			}
+
+			return tw.WriteHeader(fi.tarHeader(0, now))
+		},
+
+		fileStart: func(fi *fileInfo) error {
+			skip, exErr := excluded(fi)
+			if exErr != nil {
+				return exErr
+			}
+
+			if skip {
+				return errSkipFile
+			}
+
+			checker.start()
+
+			// Continue the file started in a preceding batch.
+			if fi.Offset > 0 {
+				if fi.RelativePath != currPath || fi.Offset != currOffset {
+					return fmt.Errorf("file %s part at offset %d doesn't follow the preceding part", fi.RelativePath, fi.Offset)
+				}
+
+				return nil
+			}
+
+			currPath = fi.RelativePath
+			currOffset = 0
+
+			// The size is unknown until the file is read.
+			if fi.Size == 0 {
+				var spoolErr error
+				spool, spoolErr = ioutil.TempFile("", "directory-encryptor-")
+				if spoolErr != nil {
+					return fmt.Errorf("failed to create temporary file: %v", spoolErr)
+				}
+
+				spooled = fi
+
+				return nil
+			}
+
+			return tw.WriteHeader(fi.tarHeader(fi.Size, now))
+		},
+
+		fileData: func(fi *fileInfo, data []byte) error {
+			checker.write(data)
+			currOffset += int64(len(data))
+
+			if spool != nil {
+				_, wErr := spool.Write(data)
+				return wErr
+			}
+
+			_, wErr := tw.Write(data)
+			if wErr != nil {
+				return fmt.Errorf("failed to write file %s contents: %v", fi.RelativePath, wErr)
+			}
+
+			return nil
+		},
+
+		fileEnd: func(fi *fileInfo) error {
+			checker.end()
+
+			if spool == nil {
+				return nil
+			}
+
+			defer func() {
+				spool.Close()
+				os.Remove(spool.Name())
+				spool = nil
+			}()
+
+			hErr := tw.WriteHeader(spooled.tarHeader(currOffset, now))
+			if hErr != nil {
+				return hErr
+			}
+
+			_, seekErr := spool.Seek(0, io.SeekStart)
+			if seekErr != nil {
+				return fmt.Errorf("failed to rewind temporary file: %v", seekErr)
+			}
+
+			_, cErr := io.Copy(tw, spool)
+			if cErr != nil {
+				return fmt.Errorf("failed to write file %s contents: %v", fi.RelativePath, cErr)
+			}
+
+			return nil
+		},
+
+		checksum: checker.check,
+	}
+
+	readErr := p.forEachRecord(ctx, h)
+	if readErr != nil {
+		return readErr
+	}
+
+	// Close fails if the last file is incomplete.
+	closeErr := tw.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to finish tar stream: %v", closeErr)
+	}
+
+	return nil
+}
+
+// isTar reports whether the stream starts with a tar header.
+func isTar(br *bufio.Reader) bool {
+	block, _ := br.Peek(512)
+	if len(block) < 512 {
+		return false
+	}
+
+	_, hErr := tar.NewReader(bytes.NewReader(block)).Next()
+
+	return hErr == nil
+}
+
+// encryptTar encrypts the directories and regular files of the tar stream
+// preserving their metadata, other entries are skipped. Ignore files aren't
+// applied as the stream can't be read ahead.
+func (p *Processor) encryptTar(ctx context.Context, r io.Reader) error {
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	bw, bwErr := p.newBatchWriter(ctx, 0, 0)
+	if bwErr != nil {
+		return bwErr
+	}
+
+	wErr := p.writeTarEntries(bw, ff, r)
+	if wErr != nil {
+		return bw.fail(wErr)
+	}
+
+	return bw.finish()
+}
+
+// writeTarEntries writes the tar stream entries selected by the filter rules.
+func (p *Processor) writeTarEntries(bw *batchWriter, ff *fileFilter, r io.Reader) error {
+	// Excluded directories which contents are skipped.
+	var excludedDirs []string
+
+	tr := tar.NewReader(r)
+
+	var files int
+
+	for {
+		th, thErr := tr.Next()
+		if thErr == io.EOF {
+			break
+		}
+
+		if thErr != nil {
+			return fmt.Errorf("failed to read tar entry: %v", thErr)
+		}
+
+		name := strings.TrimPrefix(path.Clean(strings.TrimPrefix(th.Name, "./")), "/")
+		if name == "." {
+			continue
+		}
+
+		if !validRelativePath(name) {
+			return fmt.Errorf("invalid path in tar entry: %q", th.Name)
+		}
+
+		fi := &fileInfo{
+			RelativePath: name,
+			Mode:         th.Mode,
+			UID:          th.Uid,
+			GID:          th.Gid,
+			Uname:        th.Uname,
+			Gname:        th.Gname,
+		}
+
+		if !th.ModTime.IsZero() {
+			fi.ModTime = th.ModTime.UnixNano()
+		}
+
+		switch th.Typeflag {
+		case tar.TypeDir:
+			fi.Filetype = DIRECTORY
+
+		case tar.TypeReg:
+			fi.Filetype = FILE
+			fi.Size = th.Size
+			fi.size = th.Size
+
+			if fi.size == 0 {
+				log.Printf("empty file detected, ignoring: %s", name)
+				continue
+			}
+
+		default:
+			log.Printf("unsupported tar entry type, ignoring: %s", th.Name)
+			continue
+		}
+
+		var skip bool
+		for _, dir := range excludedDirs {
+			if strings.HasPrefix(name, dir+"/") {
+				skip = true
+				break
+			}
+		}
+
+		if !skip {
+			var exErr error
+			skip, exErr = ff.excluded(fi)
+			if exErr != nil {
+				return fmt.Errorf("failed to apply filter rules: %v", exErr)
+			}
+
+			if skip && fi.Filetype == DIRECTORY {
+				excludedDirs = append(excludedDirs, name)
+			}
+		}
+
+		if skip {
+			continue
+		}
+
+		var wErr error
+		if fi.Filetype == DIRECTORY {
+			wErr = bw.writeDirectory(fi)
+		} else {
+			wErr = bw.writeFile(fi, tr)
+			files++
+		}
+
+		if wErr != nil {
+			return wErr
+		}
+	}
+
+	log.Printf("processed %d files", files)
+
+	return nil
+}
+
+// decryptTar writes the files selected by the filter rules to stdout as a
+// tar stream.
+func (p *Processor) decryptTar(ctx context.Context) error {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	return p.writeTar(ctx, p.stdout, ff)
+}
+
+// writeFile writes the contents of r to the file creating its directory.
+func writeFile(name string, r io.Reader) error {
+	mkdirErr := os.MkdirAll(filepath.Dir(name), 0755)
+	if mkdirErr != nil {
+		return fmt.Errorf("failed to create directory of %s: %v", name, mkdirErr)
+	}
+
+	f, fErr := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if fErr != nil {
+		return fmt.Errorf("failed to create file %s: %v", name, fErr)
+	}
+
+	_, cErr := io.Copy(f, r)
+	if cErr != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file %s: %v", name, cErr)
+	}
+
+	closeErr := f.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to close file %s: %v", name, closeErr)
+	}
+
+	return nil
+}
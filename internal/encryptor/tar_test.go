@@ -0,0 +1,129 @@
+package encryptor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tarEntry is a tar stream entry, directories have nil contents.
+type tarEntry struct {
+	name    string
+	mode    int64
+	modTime time.Time
+	data    []byte
+}
+
+func writeTarStream(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, e := range entries {
+		th := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Mode:     e.mode,
+			ModTime:  e.modTime,
+			Size:     int64(len(e.data)),
+		}
+
+		if e.data == nil {
+			th.Typeflag = tar.TypeDir
+		}
+
+		require.NoError(t, tw.WriteHeader(th))
+
+		_, wErr := tw.Write(e.data)
+		require.NoError(t, wErr)
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func readTarStream(t *testing.T, data []byte) []tarEntry {
+	var res []tarEntry
+
+	tr := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		th, thErr := tr.Next()
+		if thErr == io.EOF {
+			break
+		}
+
+		require.NoError(t, thErr)
+
+		e := tarEntry{
+			name:    th.Name,
+			mode:    th.Mode,
+			modTime: th.ModTime,
+		}
+
+		if th.Typeflag == tar.TypeReg {
+			var dErr error
+			e.data, dErr = ioutil.ReadAll(tr)
+			require.NoError(t, dErr)
+		}
+
+		res = append(res, e)
+	}
+
+	return res
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	modTime := time.Unix(1600000000, 0)
+
+	entries := []tarEntry{
+		{name: "docs/", mode: 0700, modTime: modTime},
+		{name: "docs/a.txt", mode: 0600, modTime: modTime, data: []byte("first file")},
+		{name: "docs/empty.txt", mode: 0644, modTime: modTime, data: []byte{}},
+		{name: "big.bin", mode: 0640, modTime: modTime, data: testData(3 * testBatchSize)},
+	}
+
+	encryptTree(t, Config{
+		SourceDir:    stdioPath,
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+		Stdin:        bytes.NewReader(writeTarStream(t, entries)),
+	})
+
+	// The big file is split across batches.
+	requireBatchSizes(t, enc)
+	require.Greater(t, len(archiveBatches(t, enc)), 3)
+
+	var out bytes.Buffer
+
+	p := newTestProcessor(t, Config{
+		SourceDir: enc,
+		OutputDir: stdioPath,
+		Stdout:    &out,
+	})
+	require.NoError(t, p.Decrypt(context.Background()))
+
+	// Empty files are ignored like in source directories.
+	require.Equal(t, []tarEntry{entries[0], entries[1], entries[3]}, readTarStream(t, out.Bytes()))
+
+	// The archive restores into a directory as well.
+	require.Equal(t, map[string][]byte{
+		"docs":       nil,
+		"docs/a.txt": entries[1].data,
+		"big.bin":    entries[3].data,
+	}, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
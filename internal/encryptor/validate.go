@@ -0,0 +1,483 @@
+package encryptor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Supported validation report formats.
+const (
+	ReportFormatTable = "table"
+	ReportFormatJSON  = "json"
+)
+
+// DifferenceKind describes the kind of difference between an archive and a raw
+// file directory.
+type DifferenceKind string
+
+// Validation difference kinds.
+const (
+	DifferenceMissing DifferenceKind = "missing"
+	DifferenceExtra   DifferenceKind = "extra"
+
+	// DifferenceContent is reported if the bytes the archived and the disk
+	// files have in common differ.
+	DifferenceContent DifferenceKind = "content-differs"
+
+	// DifferenceSize is reported if the file sizes differ, its details tell
+	// whether the disk file is truncated or appended to when the common bytes
+	// are the same.
+	DifferenceSize DifferenceKind = "size-differs"
+
+	// DifferenceMetadata is only reported for entries archived as a directory
+	// and stored as a file on disk or vice versa. File modes and modification
+	// times aren't compared since they're only recorded for tar sources and
+	// aren't restored.
+	DifferenceMetadata DifferenceKind = "metadata-differs"
+)
+
+// Difference describes a single difference found by Validate.
+type Difference struct {
+	Kind DifferenceKind `json:"kind"`
+	Path string         `json:"path"`
+
+	// Offset of the first differing byte for content differences.
+	Offset *int64 `json:"offset,omitempty"`
+
+	ArchiveSize *int64 `json:"archive_size,omitempty"`
+	DiskSize    *int64 `json:"disk_size,omitempty"`
+
+	Details string `json:"details,omitempty"`
+}
+
+// ValidationReport contains the result of a validation.
+type ValidationReport struct {
+	Checked     int                    `json:"checked"`
+	Differences []Difference           `json:"differences"`
+	Summary     map[DifferenceKind]int `json:"summary"`
+}
+
+func (r *ValidationReport) add(d Difference) {
+	r.Differences = append(r.Differences, d)
+	r.Summary[d.Kind]++
+}
+
+// Write writes the report in the given format.
+func (r *ValidationReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(r)
+
+	case ReportFormatTable, "":
+		if len(r.Differences) > 0 {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader([]string{"Kind", "Path", "Details"})
+
+			for _, d := range r.Differences {
+				table.Append([]string{string(d.Kind), d.Path, d.Details})
+			}
+
+			table.Render()
+		}
+
+		_, wErr := fmt.Fprintf(w, "checked %d entries, %d differences: %d missing, %d extra, %d content-differs, %d size-differs, %d metadata-differs\n",
+			r.Checked, len(r.Differences),
+			r.Summary[DifferenceMissing], r.Summary[DifferenceExtra], r.Summary[DifferenceContent],
+			r.Summary[DifferenceSize], r.Summary[DifferenceMetadata])
+
+		return wErr
+
+	default:
+		return fmt.Errorf("unsupported report format %s", format)
+	}
+}
+
+// Err returns the DifferenceError if differences were found.
+func (r *ValidationReport) Err() error {
+	if len(r.Differences) > 0 {
+		return &DifferenceError{Differences: len(r.Differences)}
+	}
+
+	return nil
+}
+
+// validationEntry contains the comparison state of a single archived entry.
+type validationEntry struct {
+	filetype filetype
+
+	// Archived file size.
+	size int64
+
+	diskSize   int64
+	diffOffset int64
+
+	missing     bool
+	typeDiffers bool
+}
+
+// isNotExist reports whether the error indicates that the file doesn't exist
+// or one of its parents isn't a directory.
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// ValidateReport compares encrypted files against the raw file directory and
+// returns the report of all differences found.
+func (p *Processor) ValidateReport(ctx context.Context) (*ValidationReport, error) {
+	if p.outputDir == "" {
+		return nil, errEmptyOutputDir
+	}
+
+	localErr := requireLocal(p.output, "raw file directory")
+	if localErr != nil {
+		return nil, localErr
+	}
+
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return nil, fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	pr := p.newProgress()
+
+	// The raw file directory is the tree the archive was encrypted from, its
+	// ignore files exclude the files which weren't archived.
+	outFS := os.DirFS(p.outputDir)
+
+	ff, ffErr := p.newFileFilter(outFS)
+	if ffErr != nil {
+		return nil, fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	entries := make(map[string]*validationEntry)
+
+	getEntry := func(fi *fileInfo) *validationEntry {
+		e, ok := entries[fi.RelativePath]
+		if !ok {
+			e = &validationEntry{
+				filetype:   fi.Filetype,
+				diffOffset: -1,
+			}
+
+			entries[fi.RelativePath] = e
+		}
+
+		return e
+	}
+
+	// Loop over encrypted files.
+	iterErr := p.forEachBatch(ctx, pr, func(bf batchFile) error {
+		// Determine batch key and IV.
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return fmt.Errorf("failed to determine batch key: %v", bcErr)
+		}
+
+		var currEntry *validationEntry
+		var currFile *os.File
+		var currFileReader *bufio.Reader
+		var currPos int64
+		var comparing bool
+
+		readErr := p.readBatch(ctx, bf.path, bc, recordHandler{
+			directory: func(fi *fileInfo) error {
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil {
+					return fmt.Errorf("failed to apply filter rules: %v", exErr)
+				}
+
+				if excluded {
+					return nil
+				}
+
+				e := getEntry(fi)
+
+				st, stErr := os.Stat(filepath.Join(p.outputDir, fi.RelativePath))
+				switch {
+				case isNotExist(stErr):
+					e.missing = true
+
+				case stErr != nil:
+					return fmt.Errorf("failed to stat raw directory: %v", stErr)
+
+				case !st.IsDir():
+					e.typeDiffers = true
+				}
+
+				return nil
+			},
+
+			fileStart: func(fi *fileInfo) error {
+				fName := fmt.Sprintf("%s/%s", p.outputDir, fi.RelativePath)
+
+				if p.ignoreFile(fName) {
+					return errSkipFile
+				}
+
+				excluded, exErr := ff.excluded(fi)
+				if exErr != nil {
+					return fmt.Errorf("failed to apply filter rules: %v", exErr)
+				}
+
+				if excluded {
+					return errSkipFile
+				}
+
+				currEntry = getEntry(fi)
+				if fi.Size > currEntry.size {
+					currEntry.size = fi.Size
+				}
+
+				if currEntry.missing || currEntry.typeDiffers {
+					return errSkipFile
+				}
+
+				st, stErr := os.Stat(fName)
+				switch {
+				case isNotExist(stErr):
+					currEntry.missing = true
+					return errSkipFile
+
+				case stErr != nil:
+					return fmt.Errorf("failed to stat raw file: %v", stErr)
+
+				case st.IsDir():
+					currEntry.typeDiffers = true
+					return errSkipFile
+				}
+
+				currEntry.diskSize = st.Size()
+
+				// Open raw file.
+				decF, decFErr := os.Open(fName)
+				if decFErr != nil {
+					return fmt.Errorf("failed to open raw file: %v", decFErr)
+				}
+
+				// Move to the part offset.
+				_, seekErr := decF.Seek(fi.Offset, io.SeekStart)
+				if seekErr != nil {
+					decF.Close()
+					return fmt.Errorf("failed to seek raw file %s to offset %d: %v", fName, fi.Offset, seekErr)
+				}
+
+				// Store file pointer.
+				currFile = decF
+				currFileReader = bufio.NewReader(decF)
+				currPos = fi.Offset
+				comparing = currEntry.diffOffset < 0
+
+				return nil
+			},
+
+			fileData: func(fi *fileInfo, data []byte) error {
+				// Compare to raw file until the first difference.
+				for i := 0; comparing && i < len(data); i++ {
+					decB, decErr := currFileReader.ReadByte()
+					if decErr != nil {
+						if decErr != io.EOF {
+							return fmt.Errorf("failed to read raw file: %v", decErr)
+						}
+
+						// The raw file is shorter, reported as a size difference.
+						comparing = false
+						break
+					}
+
+					if decB != data[i] {
+						currEntry.diffOffset = currPos + int64(i)
+						comparing = false
+					}
+				}
+
+				currPos += int64(len(data))
+				if currPos > currEntry.size {
+					currEntry.size = currPos
+				}
+
+				return nil
+			},
+
+			fileEnd: func(fi *fileInfo) error {
+				currFile.Close()
+				currFile = nil
+
+				return nil
+			},
+
+			progress: pr,
+		})
+
+		if currFile != nil {
+			currFile.Close()
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+
+		return nil
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+
+	pr.finish()
+
+	report := &ValidationReport{
+		Checked:     len(entries),
+		Differences: []Difference{},
+		Summary:     make(map[DifferenceKind]int),
+	}
+
+	// Report differences of archived entries.
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	for _, ePath := range paths {
+		e := entries[ePath]
+
+		switch {
+		case e.missing:
+			report.add(Difference{
+				Kind:    DifferenceMissing,
+				Path:    ePath,
+				Details: "not found on disk",
+			})
+
+		case e.typeDiffers && e.filetype == DIRECTORY:
+			report.add(Difference{
+				Kind:    DifferenceMetadata,
+				Path:    ePath,
+				Details: "archived as a directory, a file on disk",
+			})
+
+		case e.typeDiffers:
+			report.add(Difference{
+				Kind:    DifferenceMetadata,
+				Path:    ePath,
+				Details: "archived as a file, a directory on disk",
+			})
+
+		case e.filetype == FILE:
+			if e.diskSize != e.size {
+				archiveSize, diskSize := e.size, e.diskSize
+
+				details := fmt.Sprintf("%d bytes archived, %d bytes on disk", archiveSize, diskSize)
+
+				// The common bytes are the same.
+				if e.diffOffset < 0 {
+					if diskSize < archiveSize {
+						details += ", truncated on disk"
+					} else {
+						details += ", appended to on disk"
+					}
+				}
+
+				report.add(Difference{
+					Kind:        DifferenceSize,
+					Path:        ePath,
+					ArchiveSize: &archiveSize,
+					DiskSize:    &diskSize,
+					Details:     details,
+				})
+			}
+
+			if e.diffOffset >= 0 {
+				offset := e.diffOffset
+				report.add(Difference{
+					Kind:    DifferenceContent,
+					Path:    ePath,
+					Offset:  &offset,
+					Details: "first difference at offset " + strconv.FormatInt(offset, 10),
+				})
+			}
+		}
+	}
+
+	// Report files existing on disk only.
+	walkErr := filepath.Walk(p.outputDir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, relErr := filepath.Rel(p.outputDir, fullPath)
+		if relErr != nil {
+			return relErr
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		fi := &fileInfo{
+			RelativePath: rel,
+			Filetype:     FILE,
+			Size:         info.Size(),
+		}
+
+		if info.IsDir() {
+			fi.Filetype = DIRECTORY
+			fi.Size = 0
+			fi.Cache = isCacheDir(outFS, rel)
+		} else if info.Size() == 0 {
+			// Empty files are never archived.
+			return nil
+		}
+
+		excluded, exErr := ff.excluded(fi)
+		if exErr != nil {
+			return fmt.Errorf("failed to apply filter rules: %v", exErr)
+		}
+
+		if excluded || (!info.IsDir() && p.ignoreFile(fullPath)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if _, ok := entries[rel]; ok {
+			return nil
+		}
+
+		report.add(Difference{
+			Kind:    DifferenceExtra,
+			Path:    rel,
+			Details: "not found in the archive",
+		})
+
+		// Don't report the contents of extra directories.
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if walkErr != nil {
+		return nil, fmt.Errorf("failed to list raw file directory: %v", walkErr)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,102 @@
+package encryptor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateReport(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+	enc := filepath.Join(dir, "enc")
+
+	big := testData(3 * testBatchSize)
+
+	writeTree(t, raw, map[string][]byte{
+		"same.txt":      []byte("same file"),
+		"missing.txt":   []byte("missing file"),
+		"changed.txt":   []byte("changed file"),
+		"truncated.txt": []byte("truncated file"),
+		"appended.txt":  []byte("appended file"),
+		"resized.txt":   []byte("resized file"),
+		"big.bin":       big,
+		"dir":           nil,
+		"file":          []byte("archived as a file"),
+	})
+
+	encryptTree(t, Config{
+		SourceDir:    raw,
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+	})
+
+	// Change the raw directory.
+	changedBig := append([]byte{}, big...)
+	changedBig[2*testBatchSize] ^= 0xff
+
+	require.NoError(t, os.Remove(filepath.Join(raw, "missing.txt")))
+	require.NoError(t, os.Remove(filepath.Join(raw, "dir")))
+	require.NoError(t, os.Remove(filepath.Join(raw, "file")))
+
+	writeTree(t, raw, map[string][]byte{
+		"changed.txt":   []byte("chanGed file"),
+		"truncated.txt": []byte("truncated"),
+		"appended.txt":  []byte("appended file, more data"),
+		"resized.txt":   []byte("Resized"),
+		"big.bin":       changedBig,
+		"dir":           []byte("stored as a file"),
+		"file":          nil,
+		"extra.txt":     []byte("extra file"),
+	})
+
+	report, vErr := newTestProcessor(t, Config{SourceDir: enc, OutputDir: raw}).ValidateReport(context.Background())
+	require.NoError(t, vErr)
+
+	require.Equal(t, 9, report.Checked)
+	require.Error(t, report.Err())
+
+	type diff struct {
+		kind    DifferenceKind
+		path    string
+		details string
+	}
+
+	var diffs []diff
+	for _, d := range report.Differences {
+		diffs = append(diffs, diff{d.Kind, d.Path, d.Details})
+	}
+
+	require.Equal(t, []diff{
+		{DifferenceSize, "appended.txt", "13 bytes archived, 24 bytes on disk, appended to on disk"},
+		{DifferenceContent, "big.bin", "first difference at offset 8192"},
+		{DifferenceContent, "changed.txt", "first difference at offset 4"},
+		{DifferenceMetadata, "dir", "archived as a directory, a file on disk"},
+		{DifferenceMetadata, "file", "archived as a file, a directory on disk"},
+		{DifferenceMissing, "missing.txt", "not found on disk"},
+		{DifferenceSize, "resized.txt", "12 bytes archived, 7 bytes on disk"},
+		{DifferenceContent, "resized.txt", "first difference at offset 0"},
+		{DifferenceSize, "truncated.txt", "14 bytes archived, 9 bytes on disk, truncated on disk"},
+		{DifferenceExtra, "extra.txt", "not found in the archive"},
+	}, diffs)
+
+	require.Equal(t, map[DifferenceKind]int{
+		DifferenceMissing:  1,
+		DifferenceExtra:    1,
+		DifferenceContent:  3,
+		DifferenceSize:     3,
+		DifferenceMetadata: 2,
+	}, report.Summary)
+
+	// Validating the unchanged files reports no differences.
+	restored := filepath.Join(dir, "restored")
+	decryptTree(t, Config{SourceDir: enc, OutputDir: restored})
+
+	report, vErr = newTestProcessor(t, Config{SourceDir: enc, OutputDir: restored}).ValidateReport(context.Background())
+	require.NoError(t, vErr)
+	require.Empty(t, report.Differences)
+	require.NoError(t, report.Err())
+}
@@ -0,0 +1,269 @@
+package encryptor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// VerificationProblem describes a single problem found by Verify.
+type VerificationProblem struct {
+	Batch string `json:"batch,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// VerificationReport contains the result of an archive verification.
+type VerificationReport struct {
+	Batches int   `json:"batches"`
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+
+	// Number of file part checksums compared.
+	VerifiedChecksums int `json:"verified_checksums"`
+
+	DamagedBatches []string              `json:"damaged_batches"`
+	AffectedFiles  []string              `json:"affected_files"`
+	Problems       []VerificationProblem `json:"problems"`
+}
+
+// Write writes the report in the given format.
+func (r *VerificationReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(r)
+
+	case ReportFormatTable, "":
+		if len(r.Problems) > 0 {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader([]string{"Batch", "Path", "Error"})
+
+			for _, p := range r.Problems {
+				table.Append([]string{p.Batch, p.Path, p.Error})
+			}
+
+			table.Render()
+		}
+
+		_, wErr := fmt.Fprintf(w, "verified %d batches, %d files, %d bytes, %d checksums: %d problems, %d damaged batches, %d affected files\n",
+			r.Batches, r.Files, r.Bytes, r.VerifiedChecksums, len(r.Problems), len(r.DamagedBatches), len(r.AffectedFiles))
+
+		return wErr
+
+	default:
+		return fmt.Errorf("unsupported report format %s", format)
+	}
+}
+
+// Err returns the DamageError if problems were found.
+func (r *VerificationReport) Err() error {
+	if len(r.Problems) > 0 {
+		return &DamageError{Problems: len(r.Problems)}
+	}
+
+	return nil
+}
+
+// verificationEntry contains the verification state of a single archived file.
+type verificationEntry struct {
+	size       int64
+	nextOffset int64
+
+	// Set when a part of the file was unreadable, skips the next continuity check.
+	damaged bool
+}
+
+// VerifyReport decrypts every record of the encrypted files checking their
+// structure and returns the report of all problems found.
+func (p *Processor) VerifyReport(ctx context.Context) (*VerificationReport, error) {
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return nil, fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	pr := p.newProgress()
+
+	report := &VerificationReport{
+		DamagedBatches: []string{},
+		AffectedFiles:  []string{},
+		Problems:       []VerificationProblem{},
+	}
+
+	entries := make(map[string]*verificationEntry)
+	damagedBatches := make(map[string]bool)
+	affectedFiles := make(map[string]bool)
+
+	addProblem := func(batch, path string, err error) {
+		report.Problems = append(report.Problems, VerificationProblem{
+			Batch: batch,
+			Path:  path,
+			Error: err.Error(),
+		})
+
+		if batch != "" {
+			damagedBatches[batch] = true
+		}
+
+		if path != "" {
+			affectedFiles[path] = true
+		}
+	}
+
+	var prevNumber int
+	var prevDir string
+
+	// addMissing reports the batch files following the previous one up to
+	// the given number as missing from dir.
+	addMissing := func(dir string, number int) {
+		for n := prevNumber + 1; n <= number; n++ {
+			fnStr, _ := fileNumber(n, 32)
+			addProblem(path.Join(dir, fnStr+batchFileExt), "", fmt.Errorf("batch file is missing"))
+		}
+	}
+
+	// Loop over encrypted files.
+	iterErr := p.forEachBatch(ctx, pr, func(bf batchFile) error {
+		report.Batches++
+
+		// Check for missing batch files.
+		addMissing(path.Dir(bf.path), bf.number-1)
+
+		prevNumber = bf.number
+		prevDir = path.Dir(bf.path)
+
+		// Determine batch key and IV.
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return fmt.Errorf("failed to determine batch key: %v", bcErr)
+		}
+
+		var currEntry *verificationEntry
+		var currPath string
+		var currHash hash.Hash
+		var lastChecksum string
+
+		readErr := p.readBatch(ctx, bf.path, bc, recordHandler{
+			directory: func(fi *fileInfo) error {
+				return nil
+			},
+
+			fileStart: func(fi *fileInfo) error {
+				currPath = fi.RelativePath
+
+				e, ok := entries[fi.RelativePath]
+				if !ok || fi.Offset == 0 {
+					// The file might have been archived again by a following run.
+					e = &verificationEntry{}
+					entries[fi.RelativePath] = e
+				}
+
+				if fi.Offset != e.nextOffset && !e.damaged {
+					addProblem(bf.path, fi.RelativePath, fmt.Errorf("expected part at offset %d, found offset %d", e.nextOffset, fi.Offset))
+				}
+
+				e.size = fi.Size
+				e.nextOffset = fi.Offset
+				e.damaged = false
+				currEntry = e
+				currHash = sha256.New()
+
+				return nil
+			},
+
+			fileData: func(fi *fileInfo, data []byte) error {
+				currEntry.nextOffset += int64(len(data))
+				report.Bytes += int64(len(data))
+				currHash.Write(data)
+
+				return nil
+			},
+
+			fileEnd: func(fi *fileInfo) error {
+				currPath = ""
+				lastChecksum = hex.EncodeToString(currHash.Sum(nil))
+
+				return nil
+			},
+
+			checksum: func(fi *fileInfo) error {
+				if fi.Checksum != lastChecksum {
+					addProblem(bf.path, fi.RelativePath, fmt.Errorf("checksum mismatch for part at offset %d", fi.Offset))
+				}
+
+				report.VerifiedChecksums++
+
+				return nil
+			},
+
+			progress: pr,
+		})
+		if errors.Is(readErr, ErrCanceled) {
+			return readErr
+		}
+
+		if readErr != nil {
+			addProblem(bf.path, currPath, fmt.Errorf("%v, following records are unreadable", readErr))
+
+			if currPath != "" {
+				currEntry.damaged = true
+			}
+		}
+
+		return nil
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+
+	pr.finish()
+
+	// Check for missing trailing batch files.
+	if prevDir == "" {
+		prevDir = p.archiveDir()
+	}
+
+	addMissing(prevDir, p.header.Batches)
+
+	// Check for incomplete files.
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	for _, ePath := range paths {
+		e := entries[ePath]
+
+		if e.size > 0 && e.nextOffset != e.size {
+			addProblem("", ePath, fmt.Errorf("incomplete file, %d of %d bytes found", e.nextOffset, e.size))
+		}
+	}
+
+	report.Files = len(entries)
+
+	for b := range damagedBatches {
+		report.DamagedBatches = append(report.DamagedBatches, b)
+	}
+
+	for f := range affectedFiles {
+		report.AffectedFiles = append(report.AffectedFiles, f)
+	}
+
+	sort.Strings(report.DamagedBatches)
+	sort.Strings(report.AffectedFiles)
+
+	return report, nil
+}
@@ -0,0 +1,64 @@
+package encryptor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMissingBatches(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		volumeSize int64
+	}{
+		{name: "batches"},
+		{name: "volumes", volumeSize: testVolumeSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			enc := filepath.Join(dir, "enc")
+
+			writeTree(t, filepath.Join(dir, "raw"), testFiles(6, 2000))
+
+			encryptTree(t, Config{
+				SourceDir:    filepath.Join(dir, "raw"),
+				OutputDir:    enc,
+				MaxBatchSize: testBatchSize,
+				VolumeSize:   tc.volumeSize,
+			})
+
+			h, hErr := readHeader(context.Background(), backend.Local{}, enc)
+			require.NoError(t, hErr)
+			require.Equal(t, 6, h.Batches)
+
+			report := verifyArchive(t, Config{SourceDir: enc})
+			require.Empty(t, report.Problems)
+
+			// Remove a batch file in the middle and the trailing one.
+			batches := archiveBatches(t, enc)
+			require.Len(t, batches, 6)
+
+			require.NoError(t, os.Remove(batches[2]))
+			require.NoError(t, os.Remove(batches[5]))
+
+			report = verifyArchive(t, Config{SourceDir: enc})
+			require.Len(t, report.Problems, 2)
+
+			for i, b := range []string{batches[2], batches[5]} {
+				require.Equal(t, b, report.Problems[i].Batch)
+				require.Empty(t, report.Problems[i].Path)
+
+				// Batch files listed by volume catalogs fail to be read instead.
+				if tc.volumeSize == 0 {
+					require.Equal(t, "batch file is missing", report.Problems[i].Error)
+				}
+			}
+
+			require.Equal(t, []string{batches[2], batches[5]}, report.DamagedBatches)
+		})
+	}
+}
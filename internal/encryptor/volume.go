@@ -0,0 +1,474 @@
+package encryptor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/aes256/cbc"
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+)
+
+const (
+	volumeDirPrefix = "volume-"
+	catalogFilename = ".catalog"
+)
+
+// catalog describes the contents of a volume.
+type catalog struct {
+	Volume       int      `json:"v"`
+	TotalVolumes int      `json:"n"`
+	TotalBatches int      `json:"c"`
+	Batches      []string `json:"b"`
+}
+
+// catalogIV returns the IV used to encrypt volume catalogs with the key of
+// the given IV.
+func catalogIV(iv string) (string, error) {
+	h, hErr := sha256Hash("catalog"+iv, 1)
+	if hErr != nil {
+		return "", fmt.Errorf("failed to generate catalog IV hash: %v", hErr)
+	}
+
+	return formatIV(h), nil
+}
+
+func (p *Processor) encodeCatalog(c *catalog) ([]byte, error) {
+	cb, cbErr := json.Marshal(c)
+	if cbErr != nil {
+		return nil, fmt.Errorf("failed to marshal catalog: %v", cbErr)
+	}
+
+	iv, ivErr := catalogIV(p.iv)
+	if ivErr != nil {
+		return nil, ivErr
+	}
+
+	encC, encCErr := cbc.Encrypt(cb, p.encryptionKey, iv)
+	if encCErr != nil {
+		return nil, fmt.Errorf("failed to encrypt catalog: %v", encCErr)
+	}
+
+	return encC, nil
+}
+
+func (p *Processor) writeCatalog(dir string, c *catalog) error {
+	encC, encCErr := p.encodeCatalog(c)
+	if encCErr != nil {
+		return encCErr
+	}
+
+	wErr := ioutil.WriteFile(path.Join(dir, catalogFilename), encC, 0644)
+	if wErr != nil {
+		return fmt.Errorf("failed to write catalog: %v", wErr)
+	}
+
+	return nil
+}
+
+func (p *Processor) readCatalog(dir string) (*catalog, error) {
+	encC, encCErr := ioutil.ReadFile(path.Join(dir, catalogFilename))
+	if encCErr != nil {
+		return nil, fmt.Errorf("failed to read catalog: %v", encCErr)
+	}
+
+	// Catalogs are encrypted with the last key of the run which wrote them,
+	// the keys are tried from the newest one.
+	var c catalog
+	var cErr error
+
+	for i := len(p.keys) - 1; i >= 0; i-- {
+		iv, ivErr := catalogIV(p.keys[i].iv)
+		if ivErr != nil {
+			return nil, ivErr
+		}
+
+		cb, cbErr := cbc.Decrypt(encC, p.keys[i].key, iv)
+		if cbErr != nil {
+			cErr = fmt.Errorf("failed to decrypt catalog: %v", cbErr)
+			continue
+		}
+
+		cErr = json.Unmarshal(cb, &c)
+		if cErr != nil {
+			cErr = fmt.Errorf("failed to unmarshal catalog: %v", cErr)
+			continue
+		}
+
+		return &c, nil
+	}
+
+	return nil, cErr
+}
+
+// catalogSize returns the max size of an encrypted catalog listing the given
+// batch files.
+func (p *Processor) catalogSize(batches []string) (int64, error) {
+	encC, encCErr := p.encodeCatalog(&catalog{
+		Volume:       math.MaxInt32,
+		TotalVolumes: math.MaxInt32,
+		TotalBatches: math.MaxInt32,
+		Batches:      batches,
+	})
+	if encCErr != nil {
+		return 0, encCErr
+	}
+
+	return int64(len(encC)), nil
+}
+
+// headerSize returns the max size of the header written into every volume,
+// the batch count grows as batch files are added.
+func (p *Processor) headerSize() (int64, error) {
+	h := *p.header
+	h.Batches = math.MaxInt32
+
+	hb, hbErr := encodeHeader(&h)
+	if hbErr != nil {
+		return 0, hbErr
+	}
+
+	return int64(len(hb)), nil
+}
+
+// parseVolumeNumber returns the number of the volume directory with the given name.
+func parseVolumeNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, volumeDirPrefix) {
+		return 0, false
+	}
+
+	n, nErr := strconv.Atoi(strings.TrimPrefix(name, volumeDirPrefix))
+	if nErr != nil || n < 1 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// listVolumes returns volume directories stored in dir ordered by their numbers.
+func listVolumes(dir string) ([]string, error) {
+	sFiles, sFilesErr := ioutil.ReadDir(dir)
+	if sFilesErr != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %v", dir, sFilesErr)
+	}
+
+	numbers := make(map[string]int)
+
+	var res []string
+
+	for _, sf := range sFiles {
+		if !sf.IsDir() {
+			continue
+		}
+
+		n, ok := parseVolumeNumber(sf.Name())
+		if !ok {
+			continue
+		}
+
+		vPath := path.Join(dir, sf.Name())
+		numbers[vPath] = n
+		res = append(res, vPath)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return numbers[res[i]] < numbers[res[j]]
+	})
+
+	return res, nil
+}
+
+// volumeWriter distributes batch files written by Encrypt among volumes.
+type volumeWriter struct {
+	p *Processor
+
+	number  int
+	dir     string
+	used    int64
+	batches []string
+
+	// Volume directories created.
+	created []string
+}
+
+func (p *Processor) newVolumeWriter() (*volumeWriter, error) {
+	vols, volsErr := listVolumes(p.outputDir)
+	if volsErr != nil {
+		return nil, volsErr
+	}
+
+	// Continue numbering after existing volumes, always starting a new one.
+	var number int
+	if len(vols) > 0 {
+		number, _ = parseVolumeNumber(path.Base(vols[len(vols)-1]))
+	}
+
+	return &volumeWriter{
+		p:      p,
+		number: number,
+	}, nil
+}
+
+// add moves the batch file from tmpPath into the current volume under the
+// given name, starting a new volume if it doesn't fit, and returns its new path.
+func (w *volumeWriter) add(tmpPath, name string) (string, error) {
+	st, stErr := os.Stat(tmpPath)
+	if stErr != nil {
+		return "", fmt.Errorf("failed to stat batch file: %v", stErr)
+	}
+
+	// The catalog and the header are written along with the batch files.
+	hSize, hSizeErr := w.p.headerSize()
+	if hSizeErr != nil {
+		return "", hSizeErr
+	}
+
+	size := st.Size()
+
+	var fits bool
+	if w.dir != "" {
+		cSize, cSizeErr := w.p.catalogSize(append(w.batches, name))
+		if cSizeErr != nil {
+			return "", cSizeErr
+		}
+
+		fits = w.used+size+cSize+hSize <= w.p.volumeSize
+	}
+
+	if !fits {
+		// Check if the batch file fits into an empty volume.
+		cSize, cSizeErr := w.p.catalogSize([]string{name})
+		if cSizeErr != nil {
+			return "", cSizeErr
+		}
+
+		if size+cSize+hSize > w.p.volumeSize {
+			return "", fmt.Errorf("batch file %s of %d bytes doesn't fit into a volume of %d bytes, decrease max batch size", name, size, w.p.volumeSize)
+		}
+
+		// Start new volume.
+		w.number++
+
+		vnStr, vnStrErr := fileNumber(w.number, 4)
+		if vnStrErr != nil {
+			return "", fmt.Errorf("failed to generate volume number string: %v", vnStrErr)
+		}
+
+		w.dir = path.Join(w.p.outputDir, volumeDirPrefix+vnStr)
+		w.used = 0
+		w.batches = nil
+
+		mkdirErr := os.Mkdir(w.dir, 0755)
+		if mkdirErr != nil {
+			return "", fmt.Errorf("failed to create volume directory: %v", mkdirErr)
+		}
+
+		w.created = append(w.created, w.dir)
+
+		log.Printf("writing volume %d", w.number)
+	}
+
+	newPath := path.Join(w.dir, name)
+
+	mvErr := os.Rename(tmpPath, newPath)
+	if mvErr != nil {
+		return "", fmt.Errorf("failed to move batch file into volume: %v", mvErr)
+	}
+
+	w.used += size
+	w.batches = append(w.batches, name)
+
+	return newPath, nil
+}
+
+// abort removes the volume directories created along with their batch files.
+func (w *volumeWriter) abort() error {
+	for _, dir := range w.created {
+		rmErr := os.RemoveAll(dir)
+		if rmErr != nil {
+			return fmt.Errorf("failed to remove volume directory %s: %v", dir, rmErr)
+		}
+	}
+
+	return nil
+}
+
+// finish (re)writes catalogs of all volumes stored in the output directory.
+func (w *volumeWriter) finish(ctx context.Context) error {
+	vols, volsErr := listVolumes(w.p.outputDir)
+	if volsErr != nil {
+		return volsErr
+	}
+
+	catalogs := make([]*catalog, len(vols))
+
+	var totalVolumes, totalBatches int
+
+	for i, vol := range vols {
+		bFiles, bFilesErr := listBatchFiles(ctx, backend.Local{}, vol)
+		if bFilesErr != nil {
+			return fmt.Errorf("failed to list volume %s: %v", vol, bFilesErr)
+		}
+
+		c := &catalog{}
+		c.Volume, _ = parseVolumeNumber(path.Base(vol))
+
+		for _, bf := range bFiles {
+			c.Batches = append(c.Batches, path.Base(bf.path))
+
+			// Batch numbers are consecutive across volumes.
+			if bf.number > totalBatches {
+				totalBatches = bf.number
+			}
+		}
+
+		if c.Volume > totalVolumes {
+			totalVolumes = c.Volume
+		}
+
+		catalogs[i] = c
+	}
+
+	for i, c := range catalogs {
+		c.TotalVolumes = totalVolumes
+		c.TotalBatches = totalBatches
+
+		wErr := w.p.writeCatalog(vols[i], c)
+		if wErr != nil {
+			return fmt.Errorf("failed to write catalog of volume %d: %v", c.Volume, wErr)
+		}
+
+		// Every volume carries the header to be read on its own.
+		hErr := writeHeader(ctx, backend.Local{}, vols[i], w.p.header)
+		if hErr != nil {
+			return fmt.Errorf("failed to write header of volume %d: %v", c.Volume, hErr)
+		}
+	}
+
+	return nil
+}
+
+// sourceVolumes returns volume directories to read batch files from.
+func (p *Processor) sourceVolumes() ([]string, error) {
+	if len(p.volumes) > 0 {
+		return p.volumes, nil
+	}
+
+	// Remote archives aren't split into volumes.
+	if !isLocal(p.source) {
+		return nil, nil
+	}
+
+	return listVolumes(p.sourceDir)
+}
+
+// forEachVolumeBatch calls handler for every batch file stored in volumes in
+// order, prompting for the volumes which weren't provided. The size of the
+// batch files is set as the progress total if all volumes are provided.
+func (p *Processor) forEachVolumeBatch(ctx context.Context, vols []string, pr *progress, handler func(bf batchFile) error) error {
+	known := make(map[int]string)
+
+	var totalVolumes int
+
+	for _, vol := range vols {
+		c, cErr := p.readCatalog(vol)
+		if cErr != nil {
+			return fmt.Errorf("failed to read volume %s: %v", vol, cErr)
+		}
+
+		known[c.Volume] = vol
+
+		if c.TotalVolumes > totalVolumes {
+			totalVolumes = c.TotalVolumes
+		}
+	}
+
+	if len(known) == totalVolumes {
+		var total int64
+
+		for _, vol := range known {
+			bFiles, bFilesErr := listBatchFiles(ctx, backend.Local{}, vol)
+			if bFilesErr != nil {
+				return fmt.Errorf("failed to list volume %s: %v", vol, bFilesErr)
+			}
+
+			for _, bf := range bFiles {
+				total += bf.size
+			}
+		}
+
+		pr.setTotals(0, total)
+	}
+
+	for v := 1; v <= totalVolumes; v++ {
+		// Re-read the catalog since removable media might have been swapped.
+		vol, ok := known[v]
+
+		var c *catalog
+		if ok {
+			c, _ = p.readCatalog(vol)
+		}
+
+		for c == nil || c.Volume != v {
+			if p.promptVolume == nil {
+				return fmt.Errorf("volume %d of %d is missing", v, totalVolumes)
+			}
+
+			var vErr error
+			vol, vErr = p.promptVolume(v, totalVolumes)
+			if vErr != nil {
+				return fmt.Errorf("failed to get path of volume %d: %v", v, vErr)
+			}
+
+			var cErr error
+			c, cErr = p.readCatalog(vol)
+			if cErr != nil {
+				log.Printf("failed to read volume %s: %v", vol, cErr)
+				continue
+			}
+
+			if c.Volume != v {
+				log.Printf("%s contains volume %d, expected volume %d", vol, c.Volume, v)
+			}
+		}
+
+		for _, name := range c.Batches {
+			n, nErr := parseBatchNumber(name)
+			if nErr != nil {
+				return fmt.Errorf("invalid catalog of volume %d: %v", v, nErr)
+			}
+
+			hErr := handler(batchFile{
+				path:   path.Join(vol, name),
+				number: n,
+			})
+			if hErr != nil {
+				return hErr
+			}
+		}
+	}
+
+	return nil
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func promptVolumeStdin(volume, total int) (string, error) {
+	fmt.Fprintf(os.Stderr, "volume %d of %d is required, enter its path: ", volume, total)
+
+	line, lErr := stdinReader.ReadString('\n')
+	if lErr != nil && line == "" {
+		return "", fmt.Errorf("failed to read volume path: %v", lErr)
+	}
+
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,250 @@
+package encryptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+const testVolumeSize = 3 * testBatchSize
+
+// encryptVolumes encrypts the files into volumes returning their paths.
+func encryptVolumes(t *testing.T, dir string, files map[string][]byte) []string {
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: testBatchSize,
+		VolumeSize:   testVolumeSize,
+	})
+
+	vols, volsErr := listVolumes(filepath.Join(dir, "enc"))
+	require.NoError(t, volsErr)
+
+	return vols
+}
+
+func TestVolumeRollover(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	files := testFiles(8, 2000)
+	vols := encryptVolumes(t, dir, files)
+	require.Greater(t, len(vols), 1)
+
+	// Batch files are only stored in volumes.
+	bFiles, bErr := listBatchFiles(context.Background(), backend.Local{}, enc)
+	require.NoError(t, bErr)
+	require.Empty(t, bFiles)
+
+	var batches int
+
+	for i, vol := range vols {
+		require.Equal(t, fmt.Sprintf("volume-%04d", i+1), path.Base(vol))
+
+		entries, eErr := ioutil.ReadDir(vol)
+		require.NoError(t, eErr)
+
+		var size int64
+		for _, e := range entries {
+			size += e.Size()
+		}
+
+		require.LessOrEqual(t, size, int64(testVolumeSize))
+
+		vBatches, vErr := listBatchFiles(context.Background(), backend.Local{}, vol)
+		require.NoError(t, vErr)
+		require.NotEmpty(t, vBatches)
+
+		batches += len(vBatches)
+
+		// Every volume carries the header.
+		_, hErr := os.Stat(filepath.Join(vol, headerFilename))
+		require.NoError(t, hErr)
+	}
+
+	require.Equal(t, 8, batches)
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+
+	// Following runs continue with a new volume.
+	writeTree(t, filepath.Join(dir, "raw2"), map[string][]byte{"new.txt": []byte("new file")})
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw2"),
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+		VolumeSize:   testVolumeSize,
+	})
+
+	newVols, volsErr := listVolumes(enc)
+	require.NoError(t, volsErr)
+	require.Len(t, newVols, len(vols)+1)
+
+	files["new.txt"] = []byte("new file")
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored2"),
+	}))
+}
+
+func TestVolumeSizes(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+
+	writeTree(t, raw, testFiles(8, 2000))
+
+	// Volumes including their catalogs and headers never exceed the size.
+	for size := int64(testBatchSize); size <= testVolumeSize; size += 1024 {
+		enc := filepath.Join(dir, fmt.Sprintf("enc-%d", size))
+
+		encryptTree(t, Config{
+			SourceDir:    raw,
+			OutputDir:    enc,
+			MaxBatchSize: testBatchSize,
+			VolumeSize:   size,
+		})
+
+		vols, volsErr := listVolumes(enc)
+		require.NoError(t, volsErr)
+		require.NotEmpty(t, vols)
+
+		for _, vol := range vols {
+			entries, eErr := ioutil.ReadDir(vol)
+			require.NoError(t, eErr)
+
+			var used int64
+			for _, e := range entries {
+				used += e.Size()
+			}
+
+			require.LessOrEqual(t, used, size, vol)
+		}
+	}
+}
+
+func TestVolumeCatalog(t *testing.T) {
+	dir := t.TempDir()
+
+	vols := encryptVolumes(t, dir, testFiles(8, 2000))
+	require.Greater(t, len(vols), 1)
+
+	p := newTestProcessor(t, Config{SourceDir: filepath.Join(dir, "enc")})
+	require.NoError(t, p.unlock(context.Background(), p.archiveDir(), false))
+
+	var totalBatches int
+
+	for i, vol := range vols {
+		raw, rErr := ioutil.ReadFile(filepath.Join(vol, catalogFilename))
+		require.NoError(t, rErr)
+
+		// Catalogs don't reveal the batch file names.
+		require.Error(t, json.Unmarshal(raw, &catalog{}))
+		require.NotContains(t, string(raw), batchFileExt)
+
+		c, cErr := p.readCatalog(vol)
+		require.NoError(t, cErr)
+		require.Equal(t, i+1, c.Volume)
+		require.Equal(t, len(vols), c.TotalVolumes)
+		require.Equal(t, 8, c.TotalBatches)
+
+		vBatches, vErr := listBatchFiles(context.Background(), backend.Local{}, vol)
+		require.NoError(t, vErr)
+		require.Len(t, c.Batches, len(vBatches))
+
+		for j, bf := range vBatches {
+			require.Equal(t, path.Base(bf.path), c.Batches[j])
+		}
+
+		totalBatches += len(c.Batches)
+	}
+
+	require.Equal(t, 8, totalBatches)
+
+	// Catalogs can't be read with another key.
+	wrongKey, wkErr := newBatchKey(1, strings.Repeat("k", len(p.encryptionKey)))
+	require.NoError(t, wkErr)
+
+	p.setKeys([]batchKey{wrongKey})
+
+	_, cErr := p.readCatalog(vols[0])
+	require.Error(t, cErr)
+}
+
+func TestDecryptVolumesList(t *testing.T) {
+	dir := t.TempDir()
+
+	files := testFiles(8, 2000)
+	vols := encryptVolumes(t, dir, files)
+	require.Greater(t, len(vols), 1)
+
+	// Move the volumes apart as if they were stored on removable media.
+	var moved []string
+
+	for i, vol := range vols {
+		mPath := filepath.Join(dir, fmt.Sprintf("media%d", i), path.Base(vol))
+		require.NoError(t, os.MkdirAll(filepath.Dir(mPath), 0755))
+		require.NoError(t, os.Rename(vol, mPath))
+
+		moved = append(moved, mPath)
+	}
+
+	// Volumes are read in their order regardless of the list order.
+	reversed := make([]string, len(moved))
+	for i, vol := range moved {
+		reversed[len(moved)-1-i] = vol
+	}
+
+	require.Equal(t, files, decryptTree(t, Config{
+		Volumes:   reversed,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+
+	// Volumes which weren't listed are prompted for.
+	p := newTestProcessor(t, Config{
+		Volumes:   moved[:1],
+		OutputDir: filepath.Join(dir, "prompted"),
+	})
+
+	var prompted []int
+
+	p.promptVolume = func(volume, total int) (string, error) {
+		require.Equal(t, len(moved), total)
+		prompted = append(prompted, volume)
+
+		return moved[volume-1], nil
+	}
+
+	require.NoError(t, p.Decrypt(context.Background()))
+	require.Equal(t, files, readTree(t, filepath.Join(dir, "prompted")))
+
+	var expected []int
+	for v := 2; v <= len(moved); v++ {
+		expected = append(expected, v)
+	}
+
+	require.Equal(t, expected, prompted)
+
+	// Missing volumes fail the decryption without a prompt.
+	p = newTestProcessor(t, Config{
+		Volumes:   moved[:len(moved)-1],
+		OutputDir: filepath.Join(dir, "missing"),
+	})
+	p.promptVolume = nil
+
+	require.Error(t, p.Decrypt(context.Background()))
+}
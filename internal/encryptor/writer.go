@@ -0,0 +1,531 @@
+package encryptor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/alex-ant/directory-encryptor/internal/aes256/cbc"
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+)
+
+// batchWriter writes records to consecutive batch files, a new batch is
+// started once the current one can't fit the next file. Files larger than
+// the max batch size are split into parts spread across consecutive batches.
+type batchWriter struct {
+	ctx context.Context
+	p   *Processor
+
+	iv        string
+	initShift int
+	vw        *volumeWriter
+
+	// Number of batches started.
+	batches int
+
+	// The current batch, nil if not started.
+	resF      backend.Writer
+	resFName  string
+	fnStr     string
+	gzipW     *gzip.Writer
+	bufW      *bufio.Writer
+	batchSize int64
+
+	// Batch files written, relative to the output directory.
+	written []string
+
+	writtenMD       int64
+	writtenFiledata int64
+	progress        *progress
+}
+
+// newBatchWriter returns a writer of the given number of files and bytes, 0 if
+// unknown.
+func (p *Processor) newBatchWriter(ctx context.Context, totalFiles, totalBytes int64) (*batchWriter, error) {
+	iv, initShift, initErr := p.encryptionInits(ctx)
+	if initErr != nil {
+		return nil, fmt.Errorf("failed to calculate inits: %v", initErr)
+	}
+
+	// Prepare volume writer.
+	var vw *volumeWriter
+	if p.volumeSize > 0 {
+		var vwErr error
+		vw, vwErr = p.newVolumeWriter()
+		if vwErr != nil {
+			return nil, fmt.Errorf("failed to initialize volume writer: %v", vwErr)
+		}
+	}
+
+	pr := p.newProgress()
+	pr.setTotals(totalFiles, totalBytes)
+
+	return &batchWriter{
+		ctx: ctx,
+		p:   p,
+
+		iv:        iv,
+		initShift: initShift,
+		vw:        vw,
+
+		progress: pr,
+	}, nil
+}
+
+// startBatch opens the next batch file.
+func (w *batchWriter) startBatch() error {
+	// Update IV.
+	var pIVErr error
+	w.iv, pIVErr = nextIV(w.iv)
+	if pIVErr != nil {
+		return fmt.Errorf("failed to generate next IV: %v", pIVErr)
+	}
+
+	w.batches++
+
+	// Open batch result file.
+	fnStr, fnStrErr := fileNumber(w.batches+w.initShift, 32)
+	if fnStrErr != nil {
+		return fmt.Errorf("failed to generate file number string: %v", fnStrErr)
+	}
+
+	resFName := path.Join(w.p.outputDir, fnStr+".data")
+	if w.vw != nil {
+		// Batch files are moved into volumes once written.
+		resFName = path.Join(w.p.outputDir, "."+fnStr+".data.tmp")
+	}
+
+	resF, resFErr := w.p.output.Create(w.ctx, resFName)
+	if resFErr != nil {
+		return fmt.Errorf("failed to open result file: %v", resFErr)
+	}
+
+	// Greate GZip writer.
+	w.gzipW = gzip.NewWriter(resF)
+	w.bufW = bufio.NewWriter(w.gzipW)
+
+	w.resF = resF
+	w.resFName = resFName
+	w.fnStr = fnStr
+	w.batchSize = 0
+
+	return nil
+}
+
+// closeBatch closes the current batch file if started.
+func (w *batchWriter) closeBatch() error {
+	if w.resF == nil {
+		return nil
+	}
+
+	// Close result file, it's stored once closed.
+	flushErr := w.bufW.Flush()
+	if flushErr != nil {
+		return fmt.Errorf("failed to write result file: %v", flushErr)
+	}
+
+	gzipErr := w.gzipW.Close()
+	if gzipErr != nil {
+		return fmt.Errorf("failed to write result file: %v", gzipErr)
+	}
+
+	closeErr := w.resF.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to close result file: %v", closeErr)
+	}
+
+	w.resF = nil
+
+	resFName := w.resFName
+
+	// Move result file into a volume.
+	if w.vw != nil {
+		var addErr error
+		resFName, addErr = w.vw.add(resFName, w.fnStr+".data")
+		if addErr != nil {
+			return fmt.Errorf("failed to add batch file to volume: %v", addErr)
+		}
+	}
+
+	w.written = append(w.written, strings.TrimPrefix(resFName, path.Clean(w.p.outputDir)+"/"))
+
+	return nil
+}
+
+// batchGzipOverhead is reserved in every batch for the gzip header, trailer
+// and block headers, base64-encoded records are otherwise only shrunk by
+// compression.
+const batchGzipOverhead = 64
+
+// metadataRecordSize returns the number of bytes the metadata record takes in
+// the batch along with its delimiter.
+func metadataRecordSize(fi *fileInfo) (int64, error) {
+	fb, fbErr := json.Marshal(*fi)
+	if fbErr != nil {
+		return 0, fmt.Errorf("failed to marshall metadata: %v", fbErr)
+	}
+
+	return cbc.EncodedLen(int64(len(fb))) + 1, nil
+}
+
+// partRecordsSize returns the number of bytes the records of the file part
+// take in the batch: the metadata, the data chunks and the checksum.
+func partRecordsSize(part *fileInfo) (int64, error) {
+	mdSize, mdErr := metadataRecordSize(part)
+	if mdErr != nil {
+		return 0, mdErr
+	}
+
+	checksumSize, csErr := metadataRecordSize(&fileInfo{
+		RelativePath: part.RelativePath,
+		Filetype:     CHECKSUM,
+		Offset:       part.Offset,
+		Checksum:     strings.Repeat("0", sha256.Size*2),
+	})
+	if csErr != nil {
+		return 0, csErr
+	}
+
+	chunks := part.size / int64(sourceFileReadChunkSize)
+	dataSize := chunks * (cbc.EncodedLen(int64(sourceFileReadChunkSize)) + 1)
+
+	if rest := part.size % int64(sourceFileReadChunkSize); rest > 0 {
+		dataSize += cbc.EncodedLen(rest) + 1
+	}
+
+	// Only the delimiter is written for empty files.
+	if part.size == 0 {
+		dataSize = 1
+	}
+
+	return mdSize + dataSize + checksumSize, nil
+}
+
+// batchSpace returns the number of bytes left in the current batch, the whole
+// batch if not started.
+func (w *batchWriter) batchSpace() int64 {
+	space := w.p.maxBatchSize - batchGzipOverhead
+	if w.resF != nil {
+		space -= w.batchSize
+	}
+
+	return space
+}
+
+// fitPart returns the largest part of the file starting at offset which
+// records fit the space, 0 if none does.
+func fitPart(fi *fileInfo, offset, space int64) (int64, error) {
+	lo, hi := int64(0), fi.size-offset
+
+	for lo < hi {
+		mid := hi - (hi-lo)/2
+
+		size, sErr := partRecordsSize(fi.part(offset, mid))
+		if sErr != nil {
+			return 0, sErr
+		}
+
+		if size <= space {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return lo, nil
+}
+
+// writeMetadata encrypts and writes the metadata record followed by the
+// delimiter.
+func (w *batchWriter) writeMetadata(fi *fileInfo, delimiter byte) error {
+	// Marshall and encrypt metadata.
+	fb, fbErr := json.Marshal(*fi)
+	if fbErr != nil {
+		return fmt.Errorf("failed to marshall metadata: %v", fbErr)
+	}
+
+	encFb, encFbErr := cbc.Encrypt(fb, w.p.encryptionKey, w.iv)
+	if encFbErr != nil {
+		return fmt.Errorf("failed to encrypt metadata: %v", encFbErr)
+	}
+
+	// Write metadata.
+	_, mdWErr := w.bufW.Write(append(encFb, delimiter))
+	if mdWErr != nil {
+		return fmt.Errorf("failed to write metadata: %v", mdWErr)
+	}
+
+	w.writtenMD += int64(len(encFb)) + 1
+	w.batchSize += int64(len(encFb)) + 1
+
+	return nil
+}
+
+// writeDirectory writes the directory record to the current batch, a new
+// batch is started if it doesn't fit.
+func (w *batchWriter) writeDirectory(fi *fileInfo) error {
+	size, sErr := metadataRecordSize(fi)
+	if sErr != nil {
+		return sErr
+	}
+
+	if w.resF != nil && size > w.batchSpace() {
+		cErr := w.closeBatch()
+		if cErr != nil {
+			return cErr
+		}
+	}
+
+	if w.resF == nil {
+		if size > w.batchSpace() {
+			return fmt.Errorf("max batch size %d can't fit directory %s metadata", w.p.maxBatchSize, fi.RelativePath)
+		}
+
+		sErr := w.startBatch()
+		if sErr != nil {
+			return sErr
+		}
+	}
+
+	return w.writeMetadata(fi, '$')
+}
+
+// writeFile writes fi.size bytes of the file contents read from r. A new
+// batch is started unless the whole file fits the current one, files which
+// don't fit a batch are split into parts spread across consecutive batches
+// so that every batch file stays within the max batch size. The last part may
+// share its batch with the following files.
+func (w *batchWriter) writeFile(fi *fileInfo, r io.Reader) error {
+	size, sErr := partRecordsSize(fi)
+	if sErr != nil {
+		return sErr
+	}
+
+	if w.resF != nil && size > w.batchSpace() {
+		cErr := w.closeBatch()
+		if cErr != nil {
+			return cErr
+		}
+	}
+
+	for offset := int64(0); ; {
+		if w.resF == nil {
+			sErr := w.startBatch()
+			if sErr != nil {
+				return sErr
+			}
+		}
+
+		part := fi
+		if offset > 0 || size > w.batchSpace() {
+			n, fitErr := fitPart(fi, offset, w.batchSpace())
+			if fitErr != nil {
+				return fitErr
+			}
+
+			if n == 0 {
+				return fmt.Errorf("max batch size %d can't fit file %s metadata", w.p.maxBatchSize, fi.RelativePath)
+			}
+
+			part = fi.part(offset, n)
+		}
+
+		wErr := w.writePart(part, r)
+		if wErr != nil {
+			return wErr
+		}
+
+		offset += part.size
+		if offset >= fi.size {
+			return nil
+		}
+
+		cErr := w.closeBatch()
+		if cErr != nil {
+			return cErr
+		}
+	}
+}
+
+// writePart writes the file part record, its contents read from r and the
+// checksum record.
+func (w *batchWriter) writePart(f *fileInfo, r io.Reader) error {
+	ctxErr := checkContext(w.ctx)
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	w.progress.file(f.RelativePath)
+
+	mdErr := w.writeMetadata(f, '?')
+	if mdErr != nil {
+		return mdErr
+	}
+
+	hash := sha256.New()
+	src := io.TeeReader(r, hash)
+
+	for left := f.size; left > 0; {
+		// Check for cancellation before every chunk.
+		ctxErr = checkContext(w.ctx)
+		if ctxErr != nil {
+			return ctxErr
+		}
+
+		chunkSize := int64(sourceFileReadChunkSize)
+		if left < chunkSize {
+			chunkSize = left
+		}
+
+		if left < f.size {
+			_, wErr := w.bufW.Write([]byte("?"))
+			if wErr != nil {
+				return fmt.Errorf("failed to write metadata delimiter: %v", wErr)
+			}
+
+			w.writtenMD += 1
+			w.batchSize += 1
+		}
+
+		// Encrypt and write file contents as they're read.
+		encW, encWErr := cbc.NewWriter(w.bufW, []byte(w.p.encryptionKey), []byte(w.iv))
+		if encWErr != nil {
+			return fmt.Errorf("failed to encrypt file data: %v", encWErr)
+		}
+
+		_, cpErr := io.CopyN(encW, &progressReader{r: src, pr: w.progress}, chunkSize)
+		if cpErr != nil {
+			return fmt.Errorf("failed to encrypt file %s contents: %v", f.RelativePath, cpErr)
+		}
+
+		closeErr := encW.Close()
+		if closeErr != nil {
+			return fmt.Errorf("failed to write file data: %v", closeErr)
+		}
+
+		w.writtenFiledata += cbc.EncodedLen(chunkSize)
+		w.batchSize += cbc.EncodedLen(chunkSize)
+		left -= chunkSize
+	}
+
+	_, wErr := w.bufW.Write([]byte("$"))
+	if wErr != nil {
+		return fmt.Errorf("failed to write metadata delimiter: %v", wErr)
+	}
+
+	w.writtenMD += 1
+	w.batchSize += 1
+
+	// Write file part checksum.
+	cErr := w.writeMetadata(&fileInfo{
+		RelativePath: f.RelativePath,
+		Filetype:     CHECKSUM,
+		Offset:       f.Offset,
+		Checksum:     hex.EncodeToString(hash.Sum(nil)),
+	}, '$')
+	if cErr != nil {
+		return cErr
+	}
+
+	if f.Offset+f.size >= f.Size {
+		w.progress.fileDone()
+	}
+
+	return nil
+}
+
+// abort discards the current batch and removes the batch files written, so
+// the archive is left as it was before.
+func (w *batchWriter) abort() error {
+	if w.resF != nil {
+		abortErr := w.resF.Abort()
+		if abortErr != nil {
+			return fmt.Errorf("failed to discard result file: %v", abortErr)
+		}
+
+		w.resF = nil
+	}
+
+	// Batch files are removed even if the context is done.
+	for _, name := range w.written {
+		rmErr := w.p.output.Remove(context.Background(), path.Join(w.p.outputDir, name))
+		if rmErr != nil {
+			return fmt.Errorf("failed to remove batch file %s: %v", name, rmErr)
+		}
+	}
+
+	w.written = nil
+
+	if w.vw != nil {
+		return w.vw.abort()
+	}
+
+	return nil
+}
+
+// fail aborts writing and returns err, ErrCanceled if the context is done.
+func (w *batchWriter) fail(err error) error {
+	abortErr := w.abort()
+	if abortErr != nil {
+		log.Printf("failed to clean up batch files: %v", abortErr)
+	}
+
+	return contextError(w.ctx, err)
+}
+
+// finish closes the last batch and writes volume catalogs and parity files.
+// The batch files are removed if the last batch isn't stored.
+func (w *batchWriter) finish() error {
+	ctxErr := checkContext(w.ctx)
+	if ctxErr != nil {
+		return w.fail(ctxErr)
+	}
+
+	cErr := w.closeBatch()
+	if cErr != nil {
+		return w.fail(cErr)
+	}
+
+	// Record the number of batch files, volume headers are written along
+	// with the catalogs.
+	if w.batches > 0 {
+		w.p.header.Batches = w.batches + w.initShift
+
+		hErr := writeHeader(w.ctx, w.p.output, w.p.outputDir, w.p.header)
+		if hErr != nil {
+			return fmt.Errorf("failed to update header: %v", hErr)
+		}
+	}
+
+	// Write volume catalogs.
+	if w.vw != nil {
+		catErr := w.vw.finish(w.ctx)
+		if catErr != nil {
+			return fmt.Errorf("failed to write volume catalogs: %v", catErr)
+		}
+	}
+
+	// Write parity files.
+	if w.p.parityShards > 0 && len(w.written) > 0 {
+		log.Printf("generating parity files")
+
+		parityErr := w.p.writeParity(w.written)
+		if parityErr != nil {
+			return fmt.Errorf("failed to write parity files: %v", parityErr)
+		}
+	}
+
+	w.progress.finish()
+
+	log.Printf("encrypted %d bytes of metadata and %d bytes of filedata", w.writtenMD, w.writtenFiledata)
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package encryptor
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-ant/directory-encryptor/internal/backend"
+	"github.com/stretchr/testify/require"
+)
+
+const testBatchSize = 4096
+
+// batchParts returns the file parts stored in every batch of the archive as
+// path@offset.
+func batchParts(t *testing.T, enc string) [][]string {
+	p := newTestProcessor(t, Config{SourceDir: enc})
+	require.NoError(t, p.unlock(context.Background(), p.archiveDir(), false))
+
+	var res [][]string
+
+	require.NoError(t, p.forEachBatch(context.Background(), nil, func(bf batchFile) error {
+		bc, bcErr := p.batchCipher(bf.number)
+		if bcErr != nil {
+			return bcErr
+		}
+
+		var parts []string
+
+		h := recordHandler{
+			directory: func(fi *fileInfo) error { return nil },
+			fileStart: func(fi *fileInfo) error {
+				parts = append(parts, fmt.Sprintf("%s@%d", fi.RelativePath, fi.Offset))
+				return nil
+			},
+			fileData: func(fi *fileInfo, data []byte) error { return nil },
+			fileEnd:  func(fi *fileInfo) error { return nil },
+		}
+
+		rErr := p.readBatch(context.Background(), bf.path, bc, h)
+		res = append(res, parts)
+
+		return rErr
+	}))
+
+	return res
+}
+
+// requireBatchSizes checks the batch files don't exceed the max batch size.
+func requireBatchSizes(t *testing.T, enc string) {
+	bFiles, bErr := listBatchFiles(context.Background(), backend.Local{}, enc)
+	require.NoError(t, bErr)
+	require.NotEmpty(t, bFiles)
+
+	for _, bf := range bFiles {
+		st, stErr := os.Stat(bf.path)
+		require.NoError(t, stErr)
+		require.LessOrEqual(t, st.Size(), int64(testBatchSize), bf.path)
+
+		// The records are sized before compression.
+		f, fErr := os.Open(bf.path)
+		require.NoError(t, fErr)
+
+		gzR, gzErr := gzip.NewReader(f)
+		require.NoError(t, gzErr)
+
+		n, nErr := io.Copy(ioutil.Discard, gzR)
+		require.NoError(t, nErr)
+		require.LessOrEqual(t, n, int64(testBatchSize-batchGzipOverhead), bf.path)
+
+		f.Close()
+	}
+}
+
+// largestPart returns the size of the largest new file fitting a batch.
+func largestPart(t *testing.T, name string) int64 {
+	fi := &fileInfo{RelativePath: name, Filetype: FILE, Size: testBatchSize * 2, size: testBatchSize * 2}
+
+	n, nErr := fitPart(fi, 0, testBatchSize-batchGzipOverhead)
+	require.NoError(t, nErr)
+	require.Greater(t, n, int64(0))
+
+	fi.Size = n
+	fi.size = n
+
+	size, sErr := partRecordsSize(fi)
+	require.NoError(t, sErr)
+	require.LessOrEqual(t, size, int64(testBatchSize-batchGzipOverhead))
+
+	return n
+}
+
+func TestWriteFileSplit(t *testing.T) {
+	largest := largestPart(t, "f.bin")
+
+	for _, tc := range []struct {
+		name  string
+		size  int64
+		parts [][]string
+	}{
+		{
+			name:  "largest part",
+			size:  largest,
+			parts: [][]string{{"f.bin@0"}},
+		},
+		{
+			name:  "largest part+1",
+			size:  largest + 1,
+			parts: [][]string{{"f.bin@0"}, {fmt.Sprintf("f.bin@%d", largest)}},
+		},
+		{
+			name:  "max",
+			size:  testBatchSize,
+			parts: [][]string{{"f.bin@0"}, {fmt.Sprintf("f.bin@%d", largest)}},
+		},
+		{
+			name:  "max+1",
+			size:  testBatchSize + 1,
+			parts: [][]string{{"f.bin@0"}, {fmt.Sprintf("f.bin@%d", largest)}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			enc := filepath.Join(dir, "enc")
+
+			files := map[string][]byte{"f.bin": testData(int(tc.size))}
+			writeTree(t, filepath.Join(dir, "raw"), files)
+
+			encryptTree(t, Config{
+				SourceDir:    filepath.Join(dir, "raw"),
+				OutputDir:    enc,
+				MaxBatchSize: testBatchSize,
+			})
+
+			requireBatchSizes(t, enc)
+			require.Equal(t, tc.parts, batchParts(t, enc))
+
+			require.Equal(t, files, decryptTree(t, Config{
+				SourceDir: enc,
+				OutputDir: filepath.Join(dir, "restored"),
+			}))
+		})
+	}
+}
+
+func TestWriteFileSharedBatch(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	files := map[string][]byte{
+		"a.txt":   []byte("first file"),
+		"big.bin": testData(3 * testBatchSize),
+		"c.txt":   []byte("last file"),
+	}
+
+	writeTree(t, filepath.Join(dir, "raw"), files)
+
+	encryptTree(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+	})
+
+	requireBatchSizes(t, enc)
+
+	// The large file starts a new batch, its last part shares the batch
+	// with the following file.
+	parts := batchParts(t, enc)
+	require.Equal(t, []string{"a.txt@0"}, parts[0])
+	require.Equal(t, "big.bin@0", parts[1][0])
+
+	last := parts[len(parts)-1]
+	require.Len(t, last, 2)
+	require.Regexp(t, `^big\.bin@[1-9][0-9]*$`, last[0])
+	require.Equal(t, "c.txt@0", last[1])
+
+	for _, bParts := range parts[1 : len(parts)-1] {
+		require.Len(t, bParts, 1)
+	}
+
+	require.Equal(t, files, decryptTree(t, Config{
+		SourceDir: enc,
+		OutputDir: filepath.Join(dir, "restored"),
+	}))
+}
+
+func TestWriteFileTooSmallBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTree(t, filepath.Join(dir, "raw"), map[string][]byte{"a.txt": []byte("first file")})
+
+	p := newTestProcessor(t, Config{
+		SourceDir:    filepath.Join(dir, "raw"),
+		OutputDir:    filepath.Join(dir, "enc"),
+		MaxBatchSize: 128,
+	})
+	require.Error(t, p.Encrypt(context.Background()))
+
+	bFiles, bErr := listBatchFiles(context.Background(), backend.Local{}, filepath.Join(dir, "enc"))
+	require.NoError(t, bErr)
+	require.Empty(t, bFiles)
+}
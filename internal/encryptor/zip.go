@@ -0,0 +1,175 @@
+package encryptor
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/alex-ant/directory-encryptor/internal/zipaes"
+)
+
+// errEmptyZipPassword is returned by ExportZip if the ZIP password is empty.
+var errEmptyZipPassword = errors.New("empty ZIP password provided")
+
+// ExportZip writes the archive entries selected by the include/exclude rules
+// to the export output as a ZIP file encrypted with WinZip AES-256 under the
+// ZIP password.
+func (p *Processor) ExportZip(ctx context.Context) error {
+	if p.zipPassword == "" {
+		return errEmptyZipPassword
+	}
+
+	unlockErr := p.unlock(ctx, p.archiveDir(), false)
+	if unlockErr != nil {
+		return fmt.Errorf("failed to unlock archive: %w", unlockErr)
+	}
+
+	// Ignore files are read from the archive only when restoring it.
+	ff, ffErr := p.newFileFilter(nil)
+	if ffErr != nil {
+		return fmt.Errorf("failed to initialize file filter: %v", ffErr)
+	}
+
+	zw := zip.NewWriter(p.stdout)
+
+	now := time.Now()
+
+	var checker partChecker
+	var entries int
+
+	// The entry being written, parts of a file follow each other.
+	var curr io.WriteCloser
+	var currPath string
+	var currOffset int64
+
+	closeEntry := func() error {
+		if curr == nil {
+			return nil
+		}
+
+		cErr := curr.Close()
+		curr = nil
+		if cErr != nil {
+			return fmt.Errorf("failed to finish ZIP entry %s: %v", currPath, cErr)
+		}
+
+		return nil
+	}
+
+	h := recordHandler{
+		directory: func(fi *fileInfo) error {
+			excluded, exErr := ff.excluded(fi)
+			if exErr != nil {
+				return fmt.Errorf("failed to apply filter rules: %v", exErr)
+			}
+
+			if excluded {
+				return nil
+			}
+
+			ceErr := closeEntry()
+			if ceErr != nil {
+				return ceErr
+			}
+
+			_, dErr := zw.CreateHeader(&zip.FileHeader{
+				Name:     fi.RelativePath + "/",
+				Modified: fi.modificationTime(now),
+			})
+			if dErr != nil {
+				return fmt.Errorf("failed to add ZIP directory %s: %v", fi.RelativePath, dErr)
+			}
+
+			entries++
+
+			return nil
+		},
+
+		fileStart: func(fi *fileInfo) error {
+			excluded, exErr := ff.excluded(fi)
+			if exErr != nil {
+				return fmt.Errorf("failed to apply filter rules: %v", exErr)
+			}
+
+			if excluded {
+				return errSkipFile
+			}
+
+			checker.start()
+
+			// Continue the entry started in a preceding batch.
+			if fi.Offset > 0 {
+				if curr == nil || fi.RelativePath != currPath || fi.Offset != currOffset {
+					return fmt.Errorf("file %s part at offset %d doesn't follow the preceding part", fi.RelativePath, fi.Offset)
+				}
+
+				return nil
+			}
+
+			ceErr := closeEntry()
+			if ceErr != nil {
+				return ceErr
+			}
+
+			fh := &zip.FileHeader{
+				Name:     fi.RelativePath,
+				Modified: fi.modificationTime(now),
+			}
+			fh.SetMode(0644)
+
+			w, cErr := zipaes.Create(zw, fh, p.zipPassword)
+			if cErr != nil {
+				return fmt.Errorf("failed to add ZIP entry %s: %v", fi.RelativePath, cErr)
+			}
+
+			curr = w
+			currPath = fi.RelativePath
+			currOffset = 0
+			entries++
+
+			return nil
+		},
+
+		fileData: func(fi *fileInfo, data []byte) error {
+			checker.write(data)
+			currOffset += int64(len(data))
+
+			_, wErr := curr.Write(data)
+			if wErr != nil {
+				return fmt.Errorf("failed to write ZIP entry %s: %v", fi.RelativePath, wErr)
+			}
+
+			return nil
+		},
+
+		fileEnd: func(fi *fileInfo) error {
+			checker.end()
+			return nil
+		},
+
+		checksum: checker.check,
+	}
+
+	readErr := p.forEachRecord(ctx, h)
+	if readErr != nil {
+		return readErr
+	}
+
+	ceErr := closeEntry()
+	if ceErr != nil {
+		return ceErr
+	}
+
+	closeErr := zw.Close()
+	if closeErr != nil {
+		return fmt.Errorf("failed to finish ZIP file: %v", closeErr)
+	}
+
+	log.Printf("exported %d ZIP entries", entries)
+
+	return nil
+}
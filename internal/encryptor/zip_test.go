@@ -0,0 +1,71 @@
+package encryptor
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-ant/directory-encryptor/internal/zipaes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportZip(t *testing.T) {
+	dir := t.TempDir()
+	enc := filepath.Join(dir, "enc")
+
+	dirTime := time.Unix(1500000000, 0)
+	fileTime := time.Unix(1600000000, 0)
+
+	entries := []tarEntry{
+		{name: "docs/", mode: 0700, modTime: dirTime},
+		{name: "docs/a.txt", mode: 0600, modTime: fileTime, data: []byte("first file")},
+		{name: "big.bin", mode: 0640, modTime: fileTime, data: testData(3 * testBatchSize)},
+	}
+
+	encryptTree(t, Config{
+		SourceDir:    stdioPath,
+		OutputDir:    enc,
+		MaxBatchSize: testBatchSize,
+		Stdin:        bytes.NewReader(writeTarStream(t, entries)),
+	})
+
+	var out bytes.Buffer
+
+	require.NoError(t, newTestProcessor(t, Config{
+		SourceDir:   enc,
+		ZipPassword: "zip-secret",
+		Stdout:      &out,
+	}).ExportZip(context.Background()))
+
+	zr, zrErr := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	require.NoError(t, zrErr)
+	require.Len(t, zr.File, len(entries))
+
+	for i, f := range zr.File {
+		e := entries[i]
+
+		require.Equal(t, e.name, f.Name)
+
+		// Modification times preserved from the tar stream.
+		require.True(t, e.modTime.Equal(f.Modified), "%s: %v", f.Name, f.Modified)
+
+		if e.data == nil {
+			continue
+		}
+
+		raw, rawErr := f.OpenRaw()
+		require.NoError(t, rawErr)
+
+		dec, decErr := zipaes.NewReader(raw, int64(f.CompressedSize64), "zip-secret")
+		require.NoError(t, decErr)
+
+		data, dErr := ioutil.ReadAll(flate.NewReader(dec))
+		require.NoError(t, dErr)
+		require.Equal(t, e.data, data, f.Name)
+	}
+}
@@ -0,0 +1,251 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// IgnoreFilename is the name of the files inside the source tree listing
+	// gitignore-style exclude patterns relative to their directory.
+	IgnoreFilename = ".encryptorignore"
+
+	// CacheDirTagFilename is the name of the file marking cache directories.
+	CacheDirTagFilename = "CACHEDIR.TAG"
+
+	cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+type pattern struct {
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+func parsePattern(base, line string) (*pattern, error) {
+	p := &pattern{
+		base: base,
+	}
+
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	// Patterns without slashes match names at any level, others are
+	// anchored to the base directory.
+	if !strings.Contains(line, "/") {
+		p.segments = []string{"**", line}
+	} else {
+		p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	}
+
+	// Validate segment syntax.
+	for _, s := range p.segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", line, err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *pattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if p.base != "" {
+		if !strings.HasPrefix(relPath, p.base+"/") {
+			return false
+		}
+
+		relPath = relPath[len(p.base)+1:]
+	}
+
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(pat, name []string) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+
+	if pat[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pat[1:], name[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pat[0], name[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pat[1:], name[1:])
+}
+
+// Rules decides which files and directories are excluded.
+type Rules struct {
+	excludes []*pattern
+	includes []*pattern
+
+	minSize int64
+	maxSize int64
+
+	// ExcludeCaches excludes directories tagged with CACHEDIR.TAG.
+	ExcludeCaches bool
+}
+
+// New returns new Rules. Files not matching any of the include patterns are
+// excluded when those are provided, files smaller than minSize or larger than
+// maxSize are excluded when the limits are positive.
+func New(include, exclude []string, minSize, maxSize int64, excludeCaches bool) (*Rules, error) {
+	r := &Rules{
+		minSize: minSize,
+		maxSize: maxSize,
+
+		ExcludeCaches: excludeCaches,
+	}
+
+	for _, line := range include {
+		p, pErr := parsePattern("", line)
+		if pErr != nil {
+			return nil, fmt.Errorf("invalid include pattern: %v", pErr)
+		}
+
+		r.includes = append(r.includes, p)
+	}
+
+	addErr := r.AddPatterns("", exclude)
+	if addErr != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %v", addErr)
+	}
+
+	return r, nil
+}
+
+// Clone returns a copy of the rules which can be extended independently.
+func (r *Rules) Clone() *Rules {
+	c := *r
+	c.excludes = append([]*pattern{}, r.excludes...)
+	c.includes = append([]*pattern{}, r.includes...)
+
+	return &c
+}
+
+// AddPatterns adds exclude patterns relative to the base directory.
+func (r *Rules) AddPatterns(base string, lines []string) error {
+	for _, line := range lines {
+		p, pErr := parsePattern(base, line)
+		if pErr != nil {
+			return pErr
+		}
+
+		r.excludes = append(r.excludes, p)
+	}
+
+	return nil
+}
+
+// AddIgnoreFile adds patterns from the ignore file contents located in the
+// base directory.
+func (r *Rules) AddIgnoreFile(base string, data []byte) error {
+	var lines []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		// Skip blank lines and comments.
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return r.AddPatterns(base, lines)
+}
+
+// Excluded reports whether the path relative to the root directory should be
+// excluded. A size of 0 is treated as unknown.
+func (r *Rules) Excluded(relPath string, isDir bool, size int64) bool {
+	// Exclude everything inside excluded directories.
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.patternExcluded(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	if r.patternExcluded(relPath, isDir) {
+		return true
+	}
+
+	if isDir {
+		return false
+	}
+
+	if len(r.includes) > 0 {
+		var included bool
+		for _, p := range r.includes {
+			if p.match(relPath, false) {
+				included = true
+				break
+			}
+		}
+
+		if !included {
+			return true
+		}
+	}
+
+	if size > 0 {
+		if r.minSize > 0 && size < r.minSize {
+			return true
+		}
+
+		if r.maxSize > 0 && size > r.maxSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rules) patternExcluded(relPath string, isDir bool) bool {
+	var excluded bool
+
+	// The last matching pattern wins.
+	for _, p := range r.excludes {
+		if p.match(relPath, isDir) {
+			excluded = !p.negate
+		}
+	}
+
+	return excluded
+}
+
+// IsCacheDirTag reports whether data is a valid CACHEDIR.TAG file contents.
+func IsCacheDirTag(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(cacheDirTagSignature))
+}
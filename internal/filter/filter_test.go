@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules(t *testing.T) {
+	r, rErr := New(nil, []string{"*.log", "/build/", "docs/**/*.tmp", "!keep.log"}, 0, 0, false)
+	require.NoError(t, rErr)
+
+	require.NoError(t, r.AddIgnoreFile("src", []byte("# comment\n\nvendor/\n/generated.go\n")))
+
+	cases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"a.log", false, true},
+		{"x/y/a.log", false, true},
+		{"x/keep.log", false, false},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"x/build", true, false},
+		{"build", false, false},
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"other/a.tmp", false, false},
+		{"src/vendor/lib.go", false, true},
+		{"vendor/lib.go", false, false},
+		{"src/generated.go", false, true},
+		{"src/x/generated.go", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.excluded, r.Excluded(c.path, c.isDir, 0), c.path)
+	}
+}
+
+func TestRulesIncludeAndSize(t *testing.T) {
+	r, rErr := New([]string{"*.jpg", "raw/**"}, nil, 10, 100, false)
+	require.NoError(t, rErr)
+
+	require.False(t, r.Excluded("photos", true, 0))
+	require.False(t, r.Excluded("photos/a.jpg", false, 50))
+	require.False(t, r.Excluded("raw/a/b.cr2", false, 50))
+	require.True(t, r.Excluded("photos/a.png", false, 50))
+	require.True(t, r.Excluded("photos/a.jpg", false, 5))
+	require.True(t, r.Excluded("photos/a.jpg", false, 500))
+	require.False(t, r.Excluded("photos/a.jpg", false, 0))
+}
+
+func TestIsCacheDirTag(t *testing.T) {
+	require.True(t, IsCacheDirTag([]byte("Signature: 8a477f597d28d172789f06886806bc55\n# created by app\n")))
+	require.False(t, IsCacheDirTag([]byte("Signature: something else")))
+}
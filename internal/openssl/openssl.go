@@ -0,0 +1,175 @@
+// Package openssl implements the file format of
+// `openssl enc -aes-256-cbc -pbkdf2`, the key and the IV are derived from the
+// password and a random salt stored after the Salted__ magic.
+package openssl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/alex-ant/directory-encryptor/internal/aes256/cbc"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultIterations is the PBKDF2 iteration count used by openssl enc
+	// unless -iter is given.
+	DefaultIterations = 10000
+
+	saltSize = 8
+	keySize  = 32
+	ivSize   = 16
+)
+
+var magic = []byte("Salted__")
+
+// deriveKey derives the key and the IV from the password and the salt.
+func deriveKey(password string, salt []byte, iterations int) ([]byte, []byte) {
+	keyIV := pbkdf2.Key([]byte(password), salt, iterations, keySize+ivSize, sha256.New)
+	return keyIV[:keySize], keyIV[keySize:]
+}
+
+// checkParams validates the password and the iteration count.
+func checkParams(password string, iterations int) error {
+	if password == "" {
+		return errors.New("empty password provided")
+	}
+
+	if iterations < 1 {
+		return fmt.Errorf("invalid iteration count %d", iterations)
+	}
+
+	return nil
+}
+
+// NewWriter writes the header to w and returns a writer encrypting the data
+// written to it with the password. Close must be called to write the padded
+// last block, w isn't closed.
+func NewWriter(w io.Writer, password string, iterations int) (io.WriteCloser, error) {
+	paramsErr := checkParams(password, iterations)
+	if paramsErr != nil {
+		return nil, paramsErr
+	}
+
+	salt := make([]byte, saltSize)
+
+	_, rErr := io.ReadFull(rand.Reader, salt)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", rErr)
+	}
+
+	_, wErr := w.Write(append(append([]byte{}, magic...), salt...))
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	key, iv := deriveKey(password, salt, iterations)
+
+	return cbc.NewBytesWriter(w, key, iv)
+}
+
+// NewReader reads the header from r and returns a reader decrypting the
+// data following it with the password.
+func NewReader(r io.Reader, password string, iterations int) (io.Reader, error) {
+	paramsErr := checkParams(password, iterations)
+	if paramsErr != nil {
+		return nil, paramsErr
+	}
+
+	header := make([]byte, len(magic)+saltSize)
+
+	_, rErr := io.ReadFull(r, header)
+	if rErr == io.EOF || rErr == io.ErrUnexpectedEOF || rErr == nil && !IsEncrypted(header) {
+		return nil, errors.New("missing Salted__ header")
+	}
+
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to read header: %v", rErr)
+	}
+
+	key, iv := deriveKey(password, header[len(magic):], iterations)
+
+	src := &sourceReader{r: r}
+
+	cr, crErr := cbc.NewBytesReader(src, key, iv)
+	if crErr != nil {
+		return nil, crErr
+	}
+
+	return &decryptReader{r: cr, src: src}, nil
+}
+
+// sourceReader records the error of the underlying reader.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(data []byte) (int, error) {
+	n, rErr := s.r.Read(data)
+	if rErr != nil && rErr != io.EOF {
+		s.err = rErr
+	}
+
+	return n, rErr
+}
+
+// decryptReader explains the decryption errors which aren't caused by the
+// underlying reader.
+type decryptReader struct {
+	r   io.Reader
+	src *sourceReader
+}
+
+func (d *decryptReader) Read(data []byte) (int, error) {
+	n, rErr := d.r.Read(data)
+	if rErr != nil && rErr != io.EOF && d.src.err == nil {
+		rErr = fmt.Errorf("failed to decrypt data, the password or the iteration count is wrong: %v", rErr)
+	}
+
+	return n, rErr
+}
+
+// Encrypt encrypts data with the password, the result is decrypted by
+// `openssl enc -d -aes-256-cbc -pbkdf2 -iter <iterations>`.
+func Encrypt(data []byte, password string, iterations int) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, wErr := NewWriter(&buf, password, iterations)
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	_, wErr = w.Write(data)
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	closeErr := w.Close()
+	if closeErr != nil {
+		return nil, closeErr
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts data encrypted by
+// `openssl enc -aes-256-cbc -pbkdf2 -iter <iterations>` with the password.
+func Decrypt(data []byte, password string, iterations int) ([]byte, error) {
+	r, rErr := NewReader(bytes.NewReader(data), password, iterations)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// IsEncrypted reports whether the data starts with the Salted__ header.
+func IsEncrypted(data []byte) bool {
+	return len(data) >= len(magic)+saltSize && bytes.HasPrefix(data, magic)
+}
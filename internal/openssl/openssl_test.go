@@ -0,0 +1,114 @@
+package openssl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptOpenSSL(t *testing.T) {
+	// Generated with
+	// printf '<data>' | openssl enc -aes-256-cbc -pbkdf2 [-iter <iterations>] -S <salt> -pass pass:<password>
+	// which omits the header when the salt is explicit.
+	vectors := []struct {
+		data       string
+		password   string
+		iterations int
+		salt       string
+		encrypted  string
+	}{
+		{"The quick brown fox jumps over the lazy dog", "secret", DefaultIterations, "0102030405060708", "qYUDWTspYXZ7DwACE3SVQG4xA49M71oXpsL7ji+S5TdHv3IU1wQ5aRmwWHgnhCcj"},
+		{"", "secret", DefaultIterations, "0102030405060708", "K3D9/AZ6+Fp3HcaXGI/MOQ=="},
+		{"abc", "pw", 1000, "a1b2c3d4e5f60718", "rSJK/MaSuzKugt007HRUTg=="},
+	}
+
+	for _, v := range vectors {
+		salt, sErr := hex.DecodeString(v.salt)
+		require.NoError(t, sErr)
+
+		encrypted, eErr := base64.StdEncoding.DecodeString(v.encrypted)
+		require.NoError(t, eErr)
+
+		data := append(append([]byte("Salted__"), salt...), encrypted...)
+
+		decrypted, dErr := Decrypt(data, v.password, v.iterations)
+		require.NoError(t, dErr)
+		require.Equal(t, v.data, string(decrypted))
+
+		// Wrong password.
+		_, dErr = Decrypt(data, v.password+"x", v.iterations)
+		require.Error(t, dErr)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	data := []byte("0123456789abcdef")
+
+	encrypted, eErr := Encrypt(data, "secret", DefaultIterations)
+	require.NoError(t, eErr)
+	require.True(t, IsEncrypted(encrypted))
+	require.Len(t, encrypted, 16+32)
+
+	decrypted, dErr := Decrypt(encrypted, "secret", DefaultIterations)
+	require.NoError(t, dErr)
+	require.Equal(t, data, decrypted)
+
+	// Truncated data.
+	_, dErr = Decrypt(encrypted[:20], "secret", DefaultIterations)
+	require.Error(t, dErr)
+}
+
+func TestStream(t *testing.T) {
+	data := make([]byte, 100*1024+5)
+	_, rErr := rand.Read(data)
+	require.NoError(t, rErr)
+
+	var buf bytes.Buffer
+
+	w, wErr := NewWriter(&buf, "secret", DefaultIterations)
+	require.NoError(t, wErr)
+
+	_, wErr = io.Copy(w, iotest.HalfReader(bytes.NewReader(data)))
+	require.NoError(t, wErr)
+	require.NoError(t, w.Close())
+	require.True(t, IsEncrypted(buf.Bytes()))
+
+	// The stream is the same as the whole data decrypted at once.
+	decrypted, dErr := Decrypt(buf.Bytes(), "secret", DefaultIterations)
+	require.NoError(t, dErr)
+	require.Equal(t, data, decrypted)
+
+	r, rErr := NewReader(iotest.OneByteReader(bytes.NewReader(buf.Bytes())), "secret", DefaultIterations)
+	require.NoError(t, rErr)
+
+	decrypted, dErr = ioutil.ReadAll(r)
+	require.NoError(t, dErr)
+	require.Equal(t, data, decrypted)
+
+	// Wrong password.
+	r, rErr = NewReader(bytes.NewReader(buf.Bytes()), "wrong", DefaultIterations)
+	require.NoError(t, rErr)
+
+	_, dErr = ioutil.ReadAll(r)
+	require.Error(t, dErr)
+	require.Contains(t, dErr.Error(), "the password or the iteration count is wrong")
+
+	// Source errors aren't blamed on the password.
+	r, rErr = NewReader(io.MultiReader(bytes.NewReader(buf.Bytes()[:1000]), iotest.ErrReader(io.ErrClosedPipe)), "secret", DefaultIterations)
+	require.NoError(t, rErr)
+
+	_, dErr = ioutil.ReadAll(r)
+	require.Error(t, dErr)
+	require.NotContains(t, dErr.Error(), "the password or the iteration count is wrong")
+
+	// Missing header.
+	_, rErr = NewReader(bytes.NewReader([]byte("Salted_")), "secret", DefaultIterations)
+	require.Error(t, rErr)
+}
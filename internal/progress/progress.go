@@ -0,0 +1,237 @@
+// Package progress renders the progress of archive operations as a terminal
+// progress bar or as newline-delimited JSON events.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alex-ant/directory-encryptor/archive"
+)
+
+// Progress formats.
+const (
+	FormatLog  = "log"
+	FormatBar  = "bar"
+	FormatJSON = "json"
+)
+
+// barWidth is the number of characters of the progress bar.
+const barWidth = 30
+
+// Renderer renders the progress of the operation.
+type Renderer interface {
+	archive.ProgressReporter
+
+	// Finish renders the completion of the operation and releases the
+	// output.
+	Finish(opErr error)
+}
+
+// New returns the renderer of the progress format writing to the file, stderr
+// is used if it's empty. The log format is rendered by the archive package,
+// nil is returned for it.
+func New(format, file string) (Renderer, error) {
+	if format == FormatLog {
+		return nil, nil
+	}
+
+	if format != FormatBar && format != FormatJSON {
+		return nil, fmt.Errorf("unsupported progress format %s", format)
+	}
+
+	var w io.WriteCloser = os.Stderr
+	if file != "" {
+		f, fErr := os.Create(file)
+		if fErr != nil {
+			return nil, fmt.Errorf("failed to create progress file: %v", fErr)
+		}
+
+		w = f
+	}
+
+	if format == FormatJSON {
+		return &jsonRenderer{
+			w:   w,
+			enc: json.NewEncoder(w),
+		}, nil
+	}
+
+	br := &barRenderer{
+		w: w,
+	}
+
+	// Log lines are written above the bar until it's finished.
+	if w == os.Stderr {
+		br.logOutput = log.Writer()
+		log.SetOutput(br)
+	}
+
+	return br, nil
+}
+
+// formatBytes returns the human-readable size.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// barRenderer renders a progress bar updated in place on a terminal.
+type barRenderer struct {
+	mu   sync.Mutex
+	w    io.WriteCloser
+	line string
+
+	// The log output replaced by the renderer.
+	logOutput io.Writer
+}
+
+func (r *barRenderer) Report(p archive.Progress) {
+	var b strings.Builder
+
+	if p.TotalBytes > 0 {
+		perc := p.Bytes * 100 / p.TotalBytes
+		filled := int(perc * barWidth / 100)
+
+		fmt.Fprintf(&b, "[%s%s] %3d%% ", strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), perc)
+		fmt.Fprintf(&b, "%s/%s", formatBytes(float64(p.Bytes)), formatBytes(float64(p.TotalBytes)))
+	} else {
+		b.WriteString(formatBytes(float64(p.Bytes)))
+	}
+
+	if p.TotalFiles > 0 {
+		fmt.Fprintf(&b, ", %d/%d files", p.Files, p.TotalFiles)
+	} else {
+		fmt.Fprintf(&b, ", %d files", p.Files)
+	}
+
+	fmt.Fprintf(&b, ", %s/s", formatBytes(p.Throughput))
+
+	if p.TotalBytes > 0 && p.Throughput > 0 {
+		eta := time.Duration(float64(p.TotalBytes-p.Bytes) / p.Throughput * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", eta.Truncate(time.Second))
+	}
+
+	if p.Path != "" {
+		fmt.Fprintf(&b, " %s", p.Path)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.line = b.String()
+	fmt.Fprintf(r.w, "\r%s\x1b[K", r.line)
+}
+
+// Write writes the log line above the bar.
+func (r *barRenderer) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.line == "" {
+		return r.w.Write(b)
+	}
+
+	_, wErr := fmt.Fprintf(r.w, "\r\x1b[K%s%s", b, r.line)
+	if wErr != nil {
+		return 0, wErr
+	}
+
+	return len(b), nil
+}
+
+func (r *barRenderer) Finish(opErr error) {
+	// Restored before locking as log holds its own lock writing to the
+	// renderer.
+	if r.logOutput != nil {
+		log.SetOutput(r.logOutput)
+		r.logOutput = nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.line != "" {
+		fmt.Fprintln(r.w)
+		r.line = ""
+	}
+
+	if r.w != os.Stderr {
+		r.w.Close()
+	}
+}
+
+// event is a newline-delimited JSON progress event, the last event of the
+// operation is "done".
+type event struct {
+	Event      string  `json:"event"`
+	Files      int64   `json:"files"`
+	TotalFiles int64   `json:"total_files"`
+	Bytes      int64   `json:"bytes"`
+	TotalBytes int64   `json:"total_bytes"`
+	Path       string  `json:"path,omitempty"`
+	Elapsed    float64 `json:"elapsed"`
+	Throughput float64 `json:"throughput"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// jsonRenderer writes progress events.
+type jsonRenderer struct {
+	w    io.WriteCloser
+	enc  *json.Encoder
+	last archive.Progress
+}
+
+func newEvent(name string, p archive.Progress) event {
+	return event{
+		Event:      name,
+		Files:      p.Files,
+		TotalFiles: p.TotalFiles,
+		Bytes:      p.Bytes,
+		TotalBytes: p.TotalBytes,
+		Path:       p.Path,
+		Elapsed:    p.Elapsed.Seconds(),
+		Throughput: p.Throughput,
+	}
+}
+
+func (r *jsonRenderer) Report(p archive.Progress) {
+	r.last = p
+
+	eErr := r.enc.Encode(newEvent("progress", p))
+	if eErr != nil {
+		log.Printf("failed to write progress event: %v", eErr)
+	}
+}
+
+func (r *jsonRenderer) Finish(opErr error) {
+	e := newEvent("done", r.last)
+	if opErr != nil {
+		e.Error = opErr.Error()
+	}
+
+	eErr := r.enc.Encode(e)
+	if eErr != nil {
+		log.Printf("failed to write progress event: %v", eErr)
+	}
+
+	if r.w != os.Stderr {
+		r.w.Close()
+	}
+}
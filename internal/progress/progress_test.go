@@ -0,0 +1,103 @@
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-ant/directory-encryptor/archive"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "progress.ndjson")
+
+	r, rErr := New(FormatJSON, file)
+	require.NoError(t, rErr)
+
+	r.Report(archive.Progress{
+		Files:      1,
+		TotalFiles: 2,
+		Bytes:      512,
+		TotalBytes: 1024,
+		Path:       "docs/a.txt",
+		Elapsed:    2 * time.Second,
+		Throughput: 256,
+	})
+	r.Finish(errors.New("failed"))
+
+	f, fErr := os.Open(file)
+	require.NoError(t, fErr)
+
+	defer f.Close()
+
+	var events []event
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e event
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+
+		events = append(events, e)
+	}
+
+	require.Equal(t, []event{
+		{
+			Event:      "progress",
+			Files:      1,
+			TotalFiles: 2,
+			Bytes:      512,
+			TotalBytes: 1024,
+			Path:       "docs/a.txt",
+			Elapsed:    2,
+			Throughput: 256,
+		},
+		{
+			Event:      "done",
+			Files:      1,
+			TotalFiles: 2,
+			Bytes:      512,
+			TotalBytes: 1024,
+			Path:       "docs/a.txt",
+			Elapsed:    2,
+			Throughput: 256,
+			Error:      "failed",
+		},
+	}, events)
+}
+
+func TestFormat(t *testing.T) {
+	r, rErr := New(FormatLog, "")
+	require.NoError(t, rErr)
+	require.Nil(t, r)
+
+	_, rErr = New("xml", "")
+	require.Error(t, rErr)
+
+	require.Equal(t, "512 B", formatBytes(512))
+	require.Equal(t, "1.5 MiB", formatBytes(1.5*1024*1024))
+}
+
+func TestBarLogOutput(t *testing.T) {
+	prev := log.Writer()
+	defer log.SetOutput(prev)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	r, rErr := New(FormatBar, "")
+	require.NoError(t, rErr)
+
+	// Log lines are written above the bar while it's rendered.
+	require.Equal(t, r, log.Writer())
+
+	r.Finish(nil)
+
+	require.Equal(t, &buf, log.Writer())
+}
@@ -0,0 +1,152 @@
+package x25519
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeySize is the size of X25519 private and public keys.
+	KeySize = curve25519.ScalarSize
+
+	privateKeyPEMType = "X25519 PRIVATE KEY"
+	publicKeyPEMType  = "X25519 PUBLIC KEY"
+
+	wrapInfo = "directory-encryptor x25519"
+)
+
+// GenerateKey returns a new random key pair.
+func GenerateKey() (privateKey, publicKey []byte, err error) {
+	privateKey = make([]byte, KeySize)
+
+	_, rErr := io.ReadFull(rand.Reader, privateKey)
+	if rErr != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %v", rErr)
+	}
+
+	publicKey, pErr := PublicKey(privateKey)
+	if pErr != nil {
+		return nil, nil, pErr
+	}
+
+	return privateKey, publicKey, nil
+}
+
+// PublicKey returns the public key of the private key.
+func PublicKey(privateKey []byte) ([]byte, error) {
+	publicKey, pErr := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if pErr != nil {
+		return nil, fmt.Errorf("failed to calculate public key: %v", pErr)
+	}
+
+	return publicKey, nil
+}
+
+// wrapCipher returns the AEAD cipher wrapping keys exchanged between the
+// ephemeral and the recipient keys.
+func wrapCipher(shared, ephemeral, publicKey []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), publicKey...)
+
+	wrapKey := make([]byte, 32)
+
+	_, rErr := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(wrapInfo)), wrapKey)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %v", rErr)
+	}
+
+	c, cErr := aes.NewCipher(wrapKey)
+	if cErr != nil {
+		return nil, fmt.Errorf("failed to create new AES cipher: %v", cErr)
+	}
+
+	return cipher.NewGCM(c)
+}
+
+// Wrap encrypts the key to the recipient public key returning the ephemeral
+// public key and the wrapped key.
+func Wrap(publicKey, key []byte) (ephemeral, wrapped []byte, err error) {
+	ephemeralPrivate, ephemeral, gErr := GenerateKey()
+	if gErr != nil {
+		return nil, nil, gErr
+	}
+
+	shared, sErr := curve25519.X25519(ephemeralPrivate, publicKey)
+	if sErr != nil {
+		return nil, nil, fmt.Errorf("failed to calculate shared secret: %v", sErr)
+	}
+
+	aead, aeadErr := wrapCipher(shared, ephemeral, publicKey)
+	if aeadErr != nil {
+		return nil, nil, aeadErr
+	}
+
+	// The wrapping key is used once, so the nonce is fixed.
+	return ephemeral, aead.Seal(nil, make([]byte, aead.NonceSize()), key, nil), nil
+}
+
+// Unwrap decrypts the key wrapped to the public key of the private key.
+func Unwrap(privateKey, ephemeral, wrapped []byte) ([]byte, error) {
+	publicKey, pErr := PublicKey(privateKey)
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	shared, sErr := curve25519.X25519(privateKey, ephemeral)
+	if sErr != nil {
+		return nil, fmt.Errorf("failed to calculate shared secret: %v", sErr)
+	}
+
+	aead, aeadErr := wrapCipher(shared, ephemeral, publicKey)
+	if aeadErr != nil {
+		return nil, aeadErr
+	}
+
+	key, kErr := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, nil)
+	if kErr != nil {
+		return nil, errors.New("failed to unwrap key, wrong private key")
+	}
+
+	return key, nil
+}
+
+// EncodePrivateKey returns the PEM-encoded private key.
+func EncodePrivateKey(privateKey []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: privateKey})
+}
+
+// EncodePublicKey returns the PEM-encoded public key.
+func EncodePublicKey(publicKey []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: publicKey})
+}
+
+// ParsePrivateKey parses the PEM-encoded private key.
+func ParsePrivateKey(data []byte) ([]byte, error) {
+	return parseKey(data, privateKeyPEMType)
+}
+
+// ParsePublicKey parses the PEM-encoded public key.
+func ParsePublicKey(data []byte) ([]byte, error) {
+	return parseKey(data, publicKeyPEMType)
+}
+
+func parseKey(data []byte, pemType string) ([]byte, error) {
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != pemType {
+		return nil, fmt.Errorf("no %s PEM block found", pemType)
+	}
+
+	if len(b.Bytes) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d", len(b.Bytes))
+	}
+
+	return b.Bytes, nil
+}
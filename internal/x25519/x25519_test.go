@@ -0,0 +1,55 @@
+package x25519
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	privateKey, publicKey, gErr := GenerateKey()
+	require.NoError(t, gErr)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	ephemeral, wrapped, wErr := Wrap(publicKey, key)
+	require.NoError(t, wErr)
+	require.NotContains(t, string(wrapped), string(key))
+
+	unwrapped, uErr := Unwrap(privateKey, ephemeral, wrapped)
+	require.NoError(t, uErr)
+	require.Equal(t, key, unwrapped)
+
+	// Wrong private key.
+	otherPrivateKey, _, gErr := GenerateKey()
+	require.NoError(t, gErr)
+
+	_, uErr = Unwrap(otherPrivateKey, ephemeral, wrapped)
+	require.Error(t, uErr)
+
+	// Damaged wrapped key.
+	wrapped[0] ^= 1
+
+	_, uErr = Unwrap(privateKey, ephemeral, wrapped)
+	require.Error(t, uErr)
+}
+
+func TestEncodeKeys(t *testing.T) {
+	privateKey, publicKey, gErr := GenerateKey()
+	require.NoError(t, gErr)
+
+	parsedPrivate, pErr := ParsePrivateKey(EncodePrivateKey(privateKey))
+	require.NoError(t, pErr)
+	require.Equal(t, privateKey, parsedPrivate)
+
+	parsedPublic, pErr := ParsePublicKey(EncodePublicKey(publicKey))
+	require.NoError(t, pErr)
+	require.Equal(t, publicKey, parsedPublic)
+
+	// Key types aren't interchangeable.
+	_, pErr = ParsePublicKey(EncodePrivateKey(privateKey))
+	require.Error(t, pErr)
+
+	_, pErr = ParsePrivateKey([]byte("not a key"))
+	require.Error(t, pErr)
+}
@@ -0,0 +1,386 @@
+// Package zipaes implements the WinZip AES-256 (AE-2) encryption of ZIP
+// entries (https://www.winzip.com/en/support/aes-encryption/).
+package zipaes
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// Method is the compression method of encrypted entries, the actual
+	// method is stored in the extra field.
+	Method = 99
+
+	// Flags marks the entry as encrypted.
+	Flags = 0x1
+
+	extraID       = 0x9901
+	vendorVersion = 2 // AE-2, the CRC isn't stored.
+	vendorID      = "AE"
+	strength256   = 3
+
+	saltSize     = 16
+	keySize      = 32
+	verifierSize = 2
+	macSize      = 10
+
+	iterations = 1000
+)
+
+// Overhead is the number of bytes added to the entry data.
+const Overhead = saltSize + verifierSize + macSize
+
+// ErrPassword is returned if the password verifier doesn't match.
+var ErrPassword = errors.New("invalid password")
+
+// ErrAuthentication is returned if the entry data was tampered with.
+var ErrAuthentication = errors.New("authentication code mismatch")
+
+// Extra returns the AES extra field of the entry compressed with the actual
+// compression method.
+func Extra(method uint16) []byte {
+	b := make([]byte, 11)
+
+	binary.LittleEndian.PutUint16(b[0:], extraID)
+	binary.LittleEndian.PutUint16(b[2:], 7)
+	binary.LittleEndian.PutUint16(b[4:], vendorVersion)
+	copy(b[6:], vendorID)
+	b[8] = strength256
+	binary.LittleEndian.PutUint16(b[9:], method)
+
+	return b
+}
+
+// ActualMethod returns the actual compression method of the AES extra field
+// found in the entry extra data.
+func ActualMethod(extra []byte) (uint16, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		if id == extraID {
+			if size != 7 || string(extra[6:8]) != vendorID || extra[8] != strength256 {
+				return 0, errors.New("unsupported AES extra field")
+			}
+
+			return binary.LittleEndian.Uint16(extra[9:]), nil
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return 0, errors.New("missing AES extra field")
+}
+
+// deriveKeys derives the encryption key, the MAC key and the password
+// verifier from the password.
+func deriveKeys(password string, salt []byte) ([]byte, []byte, []byte) {
+	k := pbkdf2.Key([]byte(password), salt, iterations, 2*keySize+verifierSize, sha1.New)
+	return k[:keySize], k[keySize : 2*keySize], k[2*keySize:]
+}
+
+// ctr is AES-CTR with the little-endian counter starting at 1.
+type ctr struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	used      int
+}
+
+func newCTR(key []byte) (*ctr, error) {
+	block, bErr := aes.NewCipher(key)
+	if bErr != nil {
+		return nil, fmt.Errorf("failed to create new AES cipher: %v", bErr)
+	}
+
+	return &ctr{
+		block: block,
+		used:  aes.BlockSize,
+	}, nil
+}
+
+func (c *ctr) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			// Increment the little-endian counter.
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+
+			c.block.Encrypt(c.keystream[:], c.counter[:])
+			c.used = 0
+		}
+
+		dst[i] = src[i] ^ c.keystream[c.used]
+		c.used++
+	}
+}
+
+type writer struct {
+	dst    io.Writer
+	stream *ctr
+	mac    hash.Hash
+	buf    []byte
+	closed bool
+}
+
+// NewWriter returns a writer encrypting the entry data to dst, Close writes
+// the authentication code and doesn't close dst.
+func NewWriter(dst io.Writer, password string) (io.WriteCloser, error) {
+	if password == "" {
+		return nil, errors.New("empty password provided")
+	}
+
+	salt := make([]byte, saltSize)
+
+	_, rErr := io.ReadFull(rand.Reader, salt)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", rErr)
+	}
+
+	encKey, macKey, verifier := deriveKeys(password, salt)
+
+	stream, sErr := newCTR(encKey)
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	_, wErr := dst.Write(append(salt, verifier...))
+	if wErr != nil {
+		return nil, wErr
+	}
+
+	return &writer{
+		dst:    dst,
+		stream: stream,
+		mac:    hmac.New(sha1.New, macKey),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed writer")
+	}
+
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+
+	enc := w.buf[:len(p)]
+	w.stream.XORKeyStream(enc, p)
+	w.mac.Write(enc)
+
+	return w.dst.Write(enc)
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	_, wErr := w.dst.Write(w.mac.Sum(nil)[:macSize])
+
+	return wErr
+}
+
+type reader struct {
+	src    io.Reader
+	stream *ctr
+	mac    hash.Hash
+	// Bytes of encrypted data left before the authentication code.
+	left int64
+	done bool
+}
+
+// NewReader returns a reader decrypting the entry data of size bytes
+// (including the overhead) read from src, the authentication code is
+// verified when the reader reaches EOF.
+func NewReader(src io.Reader, size int64, password string) (io.Reader, error) {
+	if size < Overhead {
+		return nil, errors.New("entry data is too short")
+	}
+
+	header := make([]byte, saltSize+verifierSize)
+
+	_, rErr := io.ReadFull(src, header)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to read entry header: %v", rErr)
+	}
+
+	encKey, macKey, verifier := deriveKeys(password, header[:saltSize])
+
+	if subtle.ConstantTimeCompare(verifier, header[saltSize:]) != 1 {
+		return nil, ErrPassword
+	}
+
+	stream, sErr := newCTR(encKey)
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	return &reader{
+		src:    src,
+		stream: stream,
+		mac:    hmac.New(sha1.New, macKey),
+		left:   size - Overhead,
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		if !r.done {
+			r.done = true
+
+			code := make([]byte, macSize)
+
+			_, rErr := io.ReadFull(r.src, code)
+			if rErr != nil {
+				return 0, fmt.Errorf("failed to read authentication code: %v", rErr)
+			}
+
+			if !hmac.Equal(code, r.mac.Sum(nil)[:macSize]) {
+				return 0, ErrAuthentication
+			}
+		}
+
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	n, rErr := r.src.Read(p)
+
+	r.mac.Write(p[:n])
+	r.stream.XORKeyStream(p[:n], p[:n])
+	r.left -= int64(n)
+
+	if rErr == io.EOF && r.left > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	if rErr == io.EOF {
+		rErr = nil
+	}
+
+	return n, rErr
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, wErr := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, wErr
+}
+
+type entryWriter struct {
+	fh    *zip.FileHeader
+	raw   *countWriter
+	enc   io.WriteCloser
+	comp  *flate.Writer
+	plain int64
+}
+
+// Create adds a deflated entry encrypted with the password to zw, the
+// returned writer must be closed before the next entry is added or zw is
+// closed.
+func Create(zw *zip.Writer, fh *zip.FileHeader, password string) (io.WriteCloser, error) {
+	fh.Method = Method
+	fh.Flags |= Flags | 0x8
+	fh.Extra = append(fh.Extra, Extra(zip.Deflate)...)
+	fh.CRC32 = 0
+	fh.ReaderVersion = 51
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | 51
+
+	// CreateRaw doesn't encode the Modified field.
+	if !fh.Modified.IsZero() {
+		fh.SetModTime(fh.Modified)
+	}
+
+	w, cErr := zw.CreateRaw(fh)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	raw := &countWriter{w: w}
+
+	enc, encErr := NewWriter(raw, password)
+	if encErr != nil {
+		return nil, encErr
+	}
+
+	comp, compErr := flate.NewWriter(enc, flate.DefaultCompression)
+	if compErr != nil {
+		return nil, compErr
+	}
+
+	return &entryWriter{
+		fh:   fh,
+		raw:  raw,
+		enc:  enc,
+		comp: comp,
+	}, nil
+}
+
+func (w *entryWriter) Write(p []byte) (int, error) {
+	n, wErr := w.comp.Write(p)
+	w.plain += int64(n)
+	return n, wErr
+}
+
+// Close finishes the entry and records its sizes in the header, zw writes
+// them to the data descriptor along with the next entry.
+func (w *entryWriter) Close() error {
+	cErr := w.comp.Close()
+	if cErr != nil {
+		return cErr
+	}
+
+	eErr := w.enc.Close()
+	if eErr != nil {
+		return eErr
+	}
+
+	w.fh.CompressedSize64 = uint64(w.raw.n)
+	w.fh.UncompressedSize64 = uint64(w.plain)
+
+	if w.fh.CompressedSize64 >= math.MaxUint32 || w.fh.UncompressedSize64 >= math.MaxUint32 {
+		w.fh.CompressedSize = math.MaxUint32
+		w.fh.UncompressedSize = math.MaxUint32
+	} else {
+		w.fh.CompressedSize = uint32(w.fh.CompressedSize64)
+		w.fh.UncompressedSize = uint32(w.fh.UncompressedSize64)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package zipaes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// openEntry decrypts and decompresses the zip entry.
+func openEntry(f *zip.File, password string) ([]byte, error) {
+	raw, rawErr := f.OpenRaw()
+	if rawErr != nil {
+		return nil, rawErr
+	}
+
+	dec, decErr := NewReader(raw, int64(f.CompressedSize64), password)
+	if decErr != nil {
+		return nil, decErr
+	}
+
+	data, rErr := io.ReadAll(flate.NewReader(dec))
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	// Read up to the authentication code.
+	_, rErr = io.Copy(io.Discard, dec)
+
+	return data, rErr
+}
+
+func TestCreate(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.bin": bytes.Repeat([]byte("0123456789"), 100000),
+	}
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	for _, name := range []string{"a.txt", "dir/b.bin"} {
+		w, cErr := Create(zw, &zip.FileHeader{Name: name, Modified: time.Now()}, "secret")
+		require.NoError(t, cErr)
+
+		_, wErr := w.Write(files[name])
+		require.NoError(t, wErr)
+		require.NoError(t, w.Close())
+	}
+
+	require.NoError(t, zw.Close())
+
+	zr, zrErr := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, zrErr)
+	require.Len(t, zr.File, 2)
+
+	for _, f := range zr.File {
+		require.Equal(t, uint16(Method), f.Method)
+		require.Equal(t, uint32(0), f.CRC32)
+		require.Equal(t, uint64(len(files[f.Name])), f.UncompressedSize64)
+
+		method, mErr := ActualMethod(f.Extra)
+		require.NoError(t, mErr)
+		require.Equal(t, zip.Deflate, method)
+
+		data, dErr := openEntry(f, "secret")
+		require.NoError(t, dErr)
+		require.Equal(t, files[f.Name], data)
+
+		_, dErr = openEntry(f, "wrong")
+		require.Error(t, dErr)
+	}
+
+	// Tampered data fails authentication.
+	data := buf.Bytes()
+	off := bytes.Index(data, []byte("a.txt")) + len("a.txt") + 11 + saltSize + verifierSize
+	data[off] ^= 1
+
+	zr, zrErr = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, zrErr)
+
+	_, dErr := openEntry(zr.File[0], "secret")
+	require.Error(t, dErr)
+}
+
+func TestLibarchive(t *testing.T) {
+	zr, zrErr := zip.OpenReader("testdata/libarchive.zip")
+	require.NoError(t, zrErr)
+
+	defer zr.Close()
+
+	var b bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&b, "line %05d of the deflated entry\n", i)
+	}
+
+	files := map[string][]byte{
+		"a.txt":     []byte("hello from libarchive\n"),
+		"c.txt":     []byte("short AE-2 entry\n"),
+		"dir/b.txt": b.Bytes(),
+	}
+
+	require.Len(t, zr.File, len(files))
+
+	for _, f := range zr.File {
+		require.Equal(t, uint16(Method), f.Method, f.Name)
+
+		method, mErr := ActualMethod(f.Extra)
+		require.NoError(t, mErr, f.Name)
+		require.Equal(t, zip.Deflate, method, f.Name)
+
+		data, dErr := openEntry(f, "secret")
+		require.NoError(t, dErr, f.Name)
+		require.Equal(t, files[f.Name], data, f.Name)
+
+		_, dErr = openEntry(f, "wrong")
+		require.Error(t, dErr, f.Name)
+	}
+}